@@ -0,0 +1,96 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"net/http"
+	"net/netip"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/gin-gonic/gin"
+)
+
+// List PDU Sessions of all UEs
+func (amf *Amf) AdminSessions(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	c.JSON(http.StatusOK, amf.smf.SessionsStatus(nil))
+}
+
+// List PDU Sessions of a single UE.
+// The control URI of the UE must be path-escaped (e.g. `/admin/sessions/http:%2F%2F192.0.2.6:8080`).
+func (amf *Amf) AdminUeSessions(c *gin.Context) {
+	ue, err := jsonapi.ParseControlURI(c.Param("ue"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "could not parse UE control URI", Error: err})
+		return
+	}
+	sessions := amf.smf.SessionsStatus(ue)
+	if len(sessions) == 0 {
+		c.JSON(http.StatusNotFound, jsonapi.Message{Message: "no PDU Session for this UE"})
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.JSON(http.StatusOK, sessions)
+}
+
+// List UEs that are not idle, with the state of their procedures
+func (amf *Amf) AdminUes(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	c.JSON(http.StatusOK, amf.ues.Status())
+}
+
+// List UPFs with their association state and allocated TEIDs
+func (amf *Amf) AdminUpfs(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	c.JSON(http.StatusOK, amf.smf.UpfsStatus())
+}
+
+// List PFCP Sessions of an UPF, with the index of their rules
+func (amf *Amf) AdminUpfSessions(c *gin.Context) {
+	nodeID, err := netip.ParseAddr(c.Param("upf"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "could not parse UPF Node ID", Error: err})
+		return
+	}
+	sessions, err := amf.smf.UpfSessionsStatus(nodeID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, jsonapi.MessageWithError{Message: "unknown UPF", Error: err})
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.JSON(http.StatusOK, sessions)
+}
+
+// List RAN areas
+func (amf *Amf) AdminAreas(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	c.JSON(http.StatusOK, amf.smf.AreasStatus())
+}
+
+// List slices with their UE IP Address pool utilisation
+func (amf *Amf) AdminSlices(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	c.JSON(http.StatusOK, amf.smf.SlicesStatus())
+}
+
+// List the most recent CDRs of all UEs
+func (amf *Amf) AdminCdrs(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	c.JSON(http.StatusOK, amf.smf.Cdrs(nil))
+}
+
+// List the most recent CDRs of a single UE.
+// The control URI of the UE must be path-escaped (e.g. `/admin/cdrs/http:%2F%2F192.0.2.6:8080`).
+func (amf *Amf) AdminUeCdrs(c *gin.Context) {
+	ue, err := jsonapi.ParseControlURI(c.Param("ue"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "could not parse UE control URI", Error: err})
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.JSON(http.StatusOK, amf.smf.Cdrs(ue))
+}
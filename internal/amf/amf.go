@@ -13,6 +13,8 @@ import (
 	"time"
 
 	"github.com/nextmn/cp-lite/internal/common"
+	"github.com/nextmn/cp-lite/internal/config"
+	"github.com/nextmn/cp-lite/internal/metrics"
 	"github.com/nextmn/cp-lite/internal/smf"
 
 	"github.com/nextmn/json-api/healthcheck"
@@ -30,21 +32,45 @@ type Amf struct {
 	client    http.Client
 	userAgent string
 	smf       *smf.Smf
+	metrics   *metrics.Metrics
 	srv       *http.Server
 	closed    chan struct{}
+	timers    config.Timers
+	ues       ueContexts
 }
 
-func NewAmf(bindAddr netip.AddrPort, control jsonapi.ControlURI, userAgent string, smf *smf.Smf) *Amf {
+func NewAmf(bindAddr netip.AddrPort, control jsonapi.ControlURI, userAgent string, timers *config.Timers, smf *smf.Smf, metrics *metrics.Metrics) *Amf {
 	amf := Amf{
 		control:   control,
 		client:    http.Client{},
 		userAgent: userAgent,
 		smf:       smf,
+		metrics:   metrics,
 		closed:    make(chan struct{}),
+		timers: config.Timers{
+			Establishment: DefaultEstablishmentTimer,
+			RelocPrep:     DefaultRelocPrepTimer,
+			RelocOverall:  DefaultRelocOverallTimer,
+		},
+		ues: newUeContexts(),
 	}
+	if timers != nil {
+		if timers.Establishment > 0 {
+			amf.timers.Establishment = timers.Establishment
+		}
+		if timers.RelocPrep > 0 {
+			amf.timers.RelocPrep = timers.RelocPrep
+		}
+		if timers.RelocOverall > 0 {
+			amf.timers.RelocOverall = timers.RelocOverall
+		}
+	}
+	smf.OnDownlinkData(amf.HandleDownlinkData)
 	gin.SetMode(gin.ReleaseMode)
 	r := ginlogger.Default()
-	r.GET("/status", Status)
+	r.UseRawPath = true // allow path-escaped control URIs in path parameters
+	r.GET("/status", amf.Status)
+	r.GET("/metrics", amf.Metrics)
 
 	// PDU Sessions
 	r.POST("/ps/establishment-request", amf.EstablishmentRequest)
@@ -52,6 +78,22 @@ func NewAmf(bindAddr netip.AddrPort, control jsonapi.ControlURI, userAgent strin
 	r.POST("/ps/handover-required", amf.HandoverRequired)
 	r.POST("/ps/handover-request-ack", amf.HandoverRequestAck)
 	r.POST("/ps/handover-notify", amf.HandoverNotify)
+	r.POST("/ps/handover-cancel", amf.HandoverCancel)
+	r.POST("/ps/path-switch-request", amf.PathSwitchRequest)
+	r.POST("/ps/release-request", amf.ReleaseRequest)
+	r.POST("/ps/an-release-request", amf.AnReleaseRequest)
+	r.POST("/ps/service-request", amf.ServiceRequest)
+
+	// Management
+	r.GET("/admin/sessions", amf.AdminSessions)
+	r.GET("/admin/sessions/:ue", amf.AdminUeSessions)
+	r.GET("/admin/ues", amf.AdminUes)
+	r.GET("/admin/upfs", amf.AdminUpfs)
+	r.GET("/admin/upfs/:upf/sessions", amf.AdminUpfSessions)
+	r.GET("/admin/areas", amf.AdminAreas)
+	r.GET("/admin/slices", amf.AdminSlices)
+	r.GET("/admin/cdrs", amf.AdminCdrs)
+	r.GET("/admin/cdrs/:ue", amf.AdminUeCdrs)
 
 	logrus.WithFields(logrus.Fields{"http-addr": bindAddr}).Info("HTTP Server created")
 	amf.srv = &http.Server{
@@ -98,10 +140,20 @@ func (amf *Amf) WaitShutdown(ctx context.Context) error {
 }
 
 // get status of the controller
-func Status(c *gin.Context) {
+func (amf *Amf) Status(c *gin.Context) {
 	status := healthcheck.Status{
-		Ready: true,
+		Ready: amf.smf.Ready(),
 	}
 	c.Header("Cache-Control", "no-cache")
 	c.JSON(http.StatusOK, status)
 }
+
+// get metrics in Prometheus text-based format
+func (amf *Amf) Metrics(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	if err := amf.metrics.Write(c.Writer); err != nil {
+		logrus.WithError(err).Error("Could not write metrics")
+	}
+}
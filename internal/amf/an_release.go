@@ -0,0 +1,109 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"net/http"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// AN Release Request, sent by the gNB when the UE is no longer connected (e.g. user inactivity)
+type AnReleaseRequest struct {
+	UeCtrl jsonapi.ControlURI `json:"ue-ctrl"`
+	Cp     jsonapi.ControlURI `json:"cp"`
+	Gnb    jsonapi.ControlURI `json:"gnb"`
+	Cause  Cause              `json:"cause,omitempty"`
+}
+
+// AN Release Command, sent to the gNB so it releases resources of the UE
+type AnReleaseCommand struct {
+	UeCtrl           jsonapi.ControlURI `json:"ue-ctrl"`
+	Cp               jsonapi.ControlURI `json:"cp"`
+	Gnb              jsonapi.ControlURI `json:"gnb"`
+	ReleasedSessions []SessionFailure   `json:"released-sessions,omitempty"` // PDU Sessions that could not be kept
+}
+
+func (amf *Amf) AnReleaseRequest(c *gin.Context) {
+	var m AnReleaseRequest
+	if err := c.BindJSON(&m); err != nil {
+		logrus.WithError(err).Error("could not deserialize")
+		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "could not deserialize", Error: err})
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"ue":    m.UeCtrl.String(),
+		"gnb":   m.Gnb.String(),
+		"cause": m.Cause,
+	}).Info("New AN Release Request")
+	go amf.HandleAnReleaseRequest(m)
+	c.JSON(http.StatusAccepted, jsonapi.Message{Message: "please refer to logs for more information"})
+}
+
+// AN Release Request is send by the gNB to the Control Plane.
+// Upon reception of AN Release Request, the Control Plane:
+// 1. updates the DL FAR of the UPF-A of each PDU Session to buffer packets, and to notify their arrival
+// 2. sends an AN Release Command to the gNB
+// The UE becomes inactive: PDU Sessions are kept until the UE is paged and sends a Service Request.
+// PDU Sessions whose downlink packets cannot be buffered are released.
+func (amf *Amf) HandleAnReleaseRequest(m AnReleaseRequest) {
+	c := amf.ues.acquire(m.UeCtrl)
+	defer amf.ues.release(c)
+	proc := amf.metrics.StartProcedure("an-release")
+	defer proc.End()
+	ctx := amf.Context()
+
+	if c.state != UeStateActive {
+		logrus.WithFields(logrus.Fields{
+			"ue":    m.UeCtrl.String(),
+			"state": c.state,
+		}).Warn("AN Release Request received during another procedure")
+		return
+	}
+
+	released := make([]SessionFailure, 0)
+	for _, s := range amf.smf.SessionsStatus(&m.UeCtrl) {
+		if err := amf.smf.BufferSessionDownlink(m.UeCtrl, s.UeIpAddr, s.Dnn, true); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"ue":      m.UeCtrl.String(),
+				"ue-addr": s.UeIpAddr,
+				"dnn":     s.Dnn,
+			}).Error("AN Release Request: could not buffer downlink packets on UPF-A")
+			if err := amf.smf.ReleaseSessionContext(ctx, m.UeCtrl, s.UeIpAddr, s.Dnn); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"ue":      m.UeCtrl.String(),
+					"ue-addr": s.UeIpAddr,
+					"dnn":     s.Dnn,
+				}).Error("Could not release PDU Session")
+			}
+			released = append(released, SessionFailure{Addr: s.UeIpAddr, Dnn: s.Dnn, Cause: CauseFromError(err)})
+		}
+	}
+	if amf.smf.HasSessions(m.UeCtrl) {
+		amf.ues.setState(c, UeStateInactive)
+	} else {
+		amf.settle(c)
+	}
+
+	resp := AnReleaseCommand{
+		UeCtrl:           m.UeCtrl,
+		Cp:               amf.control,
+		Gnb:              m.Gnb,
+		ReleasedSessions: released,
+	}
+	if err := amf.sendToGnb(ctx, m.Gnb, "ps/an-release-command", resp); err != nil {
+		logrus.WithError(err).Error("Could not send ps/an-release-command")
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"ue":  m.UeCtrl.String(),
+		"gnb": m.Gnb.String(),
+	}).Info("AN Released")
+	proc.Succeed()
+}
@@ -0,0 +1,61 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"errors"
+
+	"github.com/nextmn/cp-lite/internal/smf"
+)
+
+// Cause of a failure, sent to the gNB
+type Cause string
+
+const (
+	CauseUnknownDnn            Cause = "unknown-dnn"
+	CauseUnknownPduSession     Cause = "unknown-pdu-session"
+	CauseUnknownArea           Cause = "unknown-area"
+	CauseUnknownUeMac          Cause = "unknown-ue-mac" // ethernet PDU Sessions require the MAC address of the UE
+	CauseNoPath                Cause = "no-path-for-area"
+	CauseInsufficientResources Cause = "insufficient-resources"
+	CauseUpfFailure            Cause = "upf-failure"
+	CauseInvalidMessage        Cause = "invalid-message"
+	CauseInvalidState          Cause = "invalid-state" // another procedure is in progress for this UE
+	CauseTimeout               Cause = "timeout"
+	CauseHandoverCancelled     Cause = "handover-cancelled"
+	CauseSystemFailure         Cause = "system-failure"
+)
+
+// Returns the cause corresponding to an error of the SMF
+func CauseFromError(err error) Cause {
+	switch {
+	case errors.Is(err, smf.ErrDnnNotFound):
+		return CauseUnknownDnn
+	case errors.Is(err, smf.ErrPDUSessionNotFound):
+		return CauseUnknownPduSession
+	case errors.Is(err, smf.ErrAreaNotFound):
+		return CauseUnknownArea
+	case errors.Is(err, smf.ErrUeMacNotFound):
+		return CauseUnknownUeMac
+	case errors.Is(err, smf.ErrPathNotFound):
+		return CauseNoPath
+	case errors.Is(err, smf.ErrNoIpAvailableInPool):
+		return CauseInsufficientResources
+	case errors.Is(err, smf.ErrUpfNotAssociated),
+		errors.Is(err, smf.ErrUpfNotFound),
+		errors.Is(err, smf.ErrInterfaceNotFound),
+		errors.Is(err, smf.ErrNoPFCPRule),
+		errors.Is(err, smf.ErrPfcpRequestRejected),
+		errors.Is(err, smf.ErrPfcpUnexpectedMessage),
+		errors.Is(err, smf.ErrFteidNotAllocated),
+		errors.Is(err, smf.ErrUeIpAddrNotAllocated),
+		errors.Is(err, smf.ErrUeIpAddrNotInPool),
+		errors.Is(err, smf.ErrUeIpAddrUnavailable):
+		return CauseUpfFailure
+	default:
+		return CauseSystemFailure
+	}
+}
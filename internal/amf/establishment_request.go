@@ -6,9 +6,13 @@
 package amf
 
 import (
-	"bytes"
-	"encoding/json"
+	"errors"
 	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/nextmn/cp-lite/internal/config"
+	"github.com/nextmn/cp-lite/internal/smf"
 
 	"github.com/nextmn/json-api/jsonapi"
 	"github.com/nextmn/json-api/jsonapi/n1n2"
@@ -17,6 +21,47 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// N2 PDU Session Request, with the QoS of the PDU Session
+type N2PduSessionReq struct {
+	n1n2.N2PduSessionReqMsg
+	UeInfo      PduSessionEstabAcceptMsg `json:"ue-info"` // replaces the UE information of the embedded message
+	SessionAmbr *config.BitRate          `json:"session-ambr,omitempty"`
+	QosFlows    []QosFlow                `json:"qos-flows,omitempty"` // the default QoS Flow comes first
+}
+
+// PDU Session Establishment Accept, forwarded to the UE by the gNB.
+// Addr is the IPv4 address, or the first address of the IPv6 prefix for ipv6 PDU Sessions.
+// Ethernet PDU Sessions have no UE IP Address: Addr only identifies the PDU Session
+// (link-local address derived from the MAC address of the UE, with the DNN as zone).
+type PduSessionEstabAcceptMsg struct {
+	n1n2.PduSessionEstabAcceptMsg
+	Type       config.PduSessionType `json:"pdu-session-type"`
+	Ipv6Prefix netip.Prefix          `json:"ipv6-prefix,omitzero"` // for ipv6 and ipv4v6 PDU Sessions
+}
+
+// QoS Flow of a PDU Session, as described to the gNB
+type QosFlow struct {
+	Qfi    uint8           `json:"qfi"`
+	FiveQi uint8           `json:"5qi"`
+	Mbr    *config.BitRate `json:"mbr,omitempty"`
+	Gbr    *config.BitRate `json:"gbr,omitempty"`
+}
+
+// Returns the N2 PDU Session Request, with QoS Flows if QoS is configured for the slice
+func newN2PduSessionReq(msg n1n2.N2PduSessionReqMsg, accept PduSessionEstabAcceptMsg, qos *config.Qos) N2PduSessionReq {
+	r := N2PduSessionReq{N2PduSessionReqMsg: msg, UeInfo: accept}
+	if qos == nil {
+		return r
+	}
+	r.SessionAmbr = qos.SessionAmbr
+	r.QosFlows = make([]QosFlow, 0, len(qos.Flows)+1)
+	r.QosFlows = append(r.QosFlows, QosFlow{Qfi: config.DefaultQfi, FiveQi: qos.Default5qi})
+	for _, flow := range qos.Flows {
+		r.QosFlows = append(r.QosFlows, QosFlow{Qfi: flow.Qfi, FiveQi: flow.FiveQi, Mbr: flow.Mbr, Gbr: flow.Gbr})
+	}
+	return r
+}
+
 func (amf *Amf) EstablishmentRequest(c *gin.Context) {
 	var ps n1n2.PduSessionEstabReqMsg
 	if err := c.BindJSON(&ps); err != nil {
@@ -34,45 +79,78 @@ func (amf *Amf) EstablishmentRequest(c *gin.Context) {
 }
 
 func (amf *Amf) HandleEstablishmentRequest(ps n1n2.PduSessionEstabReqMsg) {
+	c := amf.ues.acquire(ps.Ue)
+	defer amf.ues.release(c)
+	proc := amf.metrics.StartProcedure("establishment-request")
+	defer proc.End()
 	ctx := amf.Context()
-	// TODO: use ctx.WithTimeout()
 
-	ueIpAddr, err := amf.smf.GetNextUeIpAddr(ps.Dnn)
+	switch c.state {
+	case UeStateIdle, UeStateActive, UeStateEstablishing:
+	default:
+		logrus.WithFields(logrus.Fields{
+			"ue":    ps.Ue.String(),
+			"state": c.state,
+		}).Warn("PDU Session Establishment Request received during another procedure")
+		amf.rejectEstablishment(ctx, ps, CauseInvalidState)
+		return
+	}
+
+	ueIpAddr, err := amf.smf.GetNextUeIpAddr(ps.Ue, ps.Dnn)
 	if err != nil {
 		logrus.WithError(err).WithFields(logrus.Fields{
 			"dnn": ps.Dnn,
 			"ue":  ps.Ue.String(),
 			"gnb": ps.Gnb.String(),
 		}).Error("Could not get next IP Address for this DNN")
+		amf.rejectEstablishment(ctx, ps, CauseFromError(err))
 		return
 	}
 	pduSession, err := amf.smf.CreateSessionUplinkContext(ctx, ps.Ue, ueIpAddr, ps.Gnb, ps.Dnn)
 	if err != nil {
 		logrus.WithError(err).Error("Could not create PDU Session Uplink")
+		if !errors.Is(err, smf.ErrRollbackFailed) {
+			// otherwise some UPF may still have rules for this address: it must not be reused
+			amf.smf.ReleaseUeIpAddr(ueIpAddr, ps.Dnn)
+		}
+		amf.rejectEstablishment(ctx, ps, CauseFromError(err))
+		return
 	}
+	// the address may have been allocated by the anchor UPF
+	ueIpAddr = pduSession.UeIpAddr
 
+	qos, err := amf.smf.SessionQos(ps.Dnn)
+	if err != nil {
+		logrus.WithError(err).Error("Could not get QoS of PDU Session")
+		if err := amf.smf.ReleaseSessionContext(ctx, ps.Ue, ueIpAddr, ps.Dnn); err != nil {
+			logrus.WithError(err).Error("Could not release PDU Session")
+		}
+		amf.rejectEstablishment(ctx, ps, CauseFromError(err))
+		return
+	}
 	// send PseAccept to UE
-	n2PsReq := n1n2.N2PduSessionReqMsg{
-		Cp: amf.control,
-		UeInfo: n1n2.PduSessionEstabAcceptMsg{
+	n2PsReq := newN2PduSessionReq(n1n2.N2PduSessionReqMsg{
+		Cp:          amf.control,
+		UplinkFteid: *pduSession.UplinkFteid,
+	}, PduSessionEstabAcceptMsg{
+		PduSessionEstabAcceptMsg: n1n2.PduSessionEstabAcceptMsg{
 			Header: ps,
 			Addr:   pduSession.UeIpAddr,
 		},
-		UplinkFteid: *pduSession.UplinkFteid,
-	}
-	reqBody, err := json.Marshal(n2PsReq)
-	if err != nil {
-		logrus.WithError(err).Error("Could not marshal n1n2.N2PduSessionReqMsg")
-		return
-	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ps.Gnb.JoinPath("ps/n2-establishment-request").String(), bytes.NewBuffer(reqBody))
-	if err != nil {
-		logrus.WithError(err).Error("Could not create request for ps/n2-establishment-request")
-		return
-	}
-	req.Header.Set("User-Agent", amf.userAgent)
-	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	if _, err := amf.client.Do(req); err != nil {
+		Type:       pduSession.Type,
+		Ipv6Prefix: pduSession.UeIpv6Prefix,
+	}, qos)
+	if err := amf.sendToGnb(ctx, ps.Gnb, "ps/n2-establishment-request", n2PsReq); err != nil {
 		logrus.WithError(err).Error("Could not send ps/n2-establishment-request")
+		if err := amf.smf.ReleaseSessionContext(ctx, ps.Ue, ueIpAddr, ps.Dnn); err != nil {
+			logrus.WithError(err).Error("Could not release PDU Session")
+		}
+		return
 	}
+	// the gNB has to answer before the timer expires, otherwise the PDU Session is released
+	e := &establishment{req: ps}
+	e.timer = time.AfterFunc(amf.timers.Establishment, func() { amf.establishmentTimeout(ps.Ue, ueIpAddr, e) })
+	c.establishments[ueIpAddr] = e
+	amf.ues.setState(c, UeStateEstablishing)
+	proc.Succeed()
 }
@@ -0,0 +1,119 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+
+	"github.com/nextmn/json-api/jsonapi"
+	"github.com/nextmn/json-api/jsonapi/n1n2"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PDU Session that could not be established or handed over
+type SessionFailure struct {
+	Addr  netip.Addr `json:"ue-addr"`
+	Dnn   string     `json:"dnn"`
+	Cause Cause      `json:"cause"`
+}
+
+// PDU Session Establishment Reject, forwarded to the UE by the gNB
+type PduSessionEstabRejectMsg struct {
+	Header n1n2.PduSessionEstabReqMsg `json:"header"` // copy of the PDU Session Establishment Request Message
+	Cause  Cause                      `json:"cause"`
+}
+
+// Sent to the gNB when a PDU Session could not be established
+type N2PduSessionRejectMsg struct {
+	Cp     jsonapi.ControlURI       `json:"cp"`
+	UeInfo PduSessionEstabRejectMsg `json:"ue-info"` // information to forward to the UE
+}
+
+// Sent to the source gNB when the handover could not be prepared
+type HandoverPreparationFailure struct {
+	// Header
+	UeCtrl    jsonapi.ControlURI `json:"ue-ctrl"`
+	Cp        jsonapi.ControlURI `json:"cp"`
+	SourceGnb jsonapi.ControlURI `json:"source-gnb"`
+
+	// Handover Preparation Failure
+	TargetGnb      jsonapi.ControlURI `json:"target-gnb"`
+	Cause          Cause              `json:"cause"`
+	FailedSessions []SessionFailure   `json:"failed-sessions,omitempty"`
+}
+
+// Handover Command, with the list of PDU Sessions that could not be handed over
+type HandoverCommand struct {
+	n1n2.HandoverCommand
+	FailedSessions []SessionFailure `json:"failed-sessions,omitempty"`
+}
+
+// Sends a JSON message to the gNB
+func (amf *Amf) sendToGnb(ctx context.Context, gnb jsonapi.ControlURI, path string, msg any) error {
+	reqBody, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, gnb.JoinPath(path).String(), bytes.NewBuffer(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", amf.userAgent)
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	resp, err := amf.client.Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Sends a PDU Session Establishment Reject to the gNB
+func (amf *Amf) rejectEstablishment(ctx context.Context, ps n1n2.PduSessionEstabReqMsg, cause Cause) {
+	msg := N2PduSessionRejectMsg{
+		Cp: amf.control,
+		UeInfo: PduSessionEstabRejectMsg{
+			Header: ps,
+			Cause:  cause,
+		},
+	}
+	if err := amf.sendToGnb(ctx, ps.Gnb, "ps/establishment-reject", msg); err != nil {
+		logrus.WithError(err).Error("Could not send ps/establishment-reject")
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"ue":    ps.Ue.String(),
+		"gnb":   ps.Gnb.String(),
+		"dnn":   ps.Dnn,
+		"cause": cause,
+	}).Info("PDU Session Establishment Rejected")
+}
+
+// Sends a Handover Preparation Failure to the source gNB
+func (amf *Amf) failHandoverPreparation(ctx context.Context, ue jsonapi.ControlURI, sourceGnb jsonapi.ControlURI, targetGnb jsonapi.ControlURI, cause Cause, failed []SessionFailure) {
+	msg := HandoverPreparationFailure{
+		UeCtrl:         ue,
+		Cp:             amf.control,
+		SourceGnb:      sourceGnb,
+		TargetGnb:      targetGnb,
+		Cause:          cause,
+		FailedSessions: failed,
+	}
+	if err := amf.sendToGnb(ctx, sourceGnb, "ps/handover-preparation-failure", msg); err != nil {
+		logrus.WithError(err).Error("Could not send ps/handover-preparation-failure")
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"ue":         ue.String(),
+		"gnb-source": sourceGnb.String(),
+		"gnb-target": targetGnb.String(),
+		"cause":      cause,
+	}).Info("Handover Preparation Failure")
+}
@@ -0,0 +1,84 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Handover in progress, from the reception of Handover Required to the reception of Handover Notify
+type handover struct {
+	sourceGnb jsonapi.ControlURI
+	targetGnb jsonapi.ControlURI
+	sessions  map[sessionKey]*handoverSession // PDU Sessions being handed over
+	failed    []SessionFailure                // PDU Sessions that failed during reception of Handover Required
+	timer     *time.Timer                     // TRELOCprep, then TRELOCoverall
+}
+
+type sessionKey struct {
+	addr netip.Addr
+	dnn  string
+}
+
+// PDU Session being handed over
+type handoverSession struct {
+	newUplink          bool           // a new uplink path has been created toward the target area
+	indirectForwarding bool           // indirect forwarding has been requested by the source gNB
+	nextDownlinkFteid  *jsonapi.Fteid // F-TEID of the target gNB, known once the Handover Request Ack is received
+	buffering          bool           // downlink packets are buffered by the UPF-A once the Handover Request Ack is received
+}
+
+// Removes PFCP rules created for the handover of this PDU Session: the PDU Session stays on the source gNB
+func (amf *Amf) rollbackHandoverSession(ue jsonapi.ControlURI, key sessionKey, hs *handoverSession) {
+	if err := amf.smf.ReleaseSessionForwarding(ue, key.addr, key.dnn); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"ue":      ue.String(),
+			"ue-addr": key.addr,
+			"dnn":     key.dnn,
+		}).Error("Could not release forwarding rules")
+	}
+	if hs.buffering {
+		// buffered packets are flushed toward the source gNB
+		if err := amf.smf.ResumeSessionDownlink(ue, key.addr, key.dnn); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"ue":      ue.String(),
+				"ue-addr": key.addr,
+				"dnn":     key.dnn,
+			}).Error("Could not stop buffering of downlink packets")
+		}
+	}
+	if !hs.newUplink {
+		return
+	}
+	if err := amf.smf.RollbackSessionUplink(ue, key.addr, key.dnn); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"ue":      ue.String(),
+			"ue-addr": key.addr,
+			"dnn":     key.dnn,
+		}).Error("Could not restore previous uplink path")
+	}
+}
+
+// Removes PFCP rules created for the handover, and forgets it.
+// Caller must hold the lock of the context.
+func (amf *Amf) rollbackHandover(c *ueContext) {
+	if c.handover == nil {
+		return
+	}
+	c.handover.timer.Stop()
+	for key, hs := range c.handover.sessions {
+		amf.rollbackHandoverSession(c.ue, key, hs)
+	}
+	c.handover = nil
+	logrus.WithFields(logrus.Fields{
+		"ue": c.ue.String(),
+	}).Info("Handover rolled back")
+}
@@ -0,0 +1,124 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Handover Cancel, sent by the source gNB to abort the handover
+type HandoverCancel struct {
+	UeCtrl    jsonapi.ControlURI `json:"ue-ctrl"`
+	Cp        jsonapi.ControlURI `json:"cp"`
+	SourceGnb jsonapi.ControlURI `json:"source-gnb"`
+	TargetGnb jsonapi.ControlURI `json:"target-gnb"`
+	Cause     Cause              `json:"cause,omitempty"`
+}
+
+// Handover Cancel Acknowledge, sent to the source gNB
+type HandoverCancelAck struct {
+	UeCtrl    jsonapi.ControlURI `json:"ue-ctrl"`
+	Cp        jsonapi.ControlURI `json:"cp"`
+	SourceGnb jsonapi.ControlURI `json:"source-gnb"`
+	TargetGnb jsonapi.ControlURI `json:"target-gnb"`
+}
+
+// UE Context Release Command, sent to the target gNB so it releases resources allocated for the handover
+type UeContextReleaseCommand struct {
+	UeCtrl    jsonapi.ControlURI `json:"ue-ctrl"`
+	Cp        jsonapi.ControlURI `json:"cp"`
+	TargetGnb jsonapi.ControlURI `json:"target-gnb"`
+	Cause     Cause              `json:"cause"`
+}
+
+func (amf *Amf) HandoverCancel(c *gin.Context) {
+	var m HandoverCancel
+	if err := c.BindJSON(&m); err != nil {
+		logrus.WithError(err).Error("could not deserialize")
+		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "could not deserialize", Error: err})
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"ue":         m.UeCtrl.String(),
+		"gnb-source": m.SourceGnb.String(),
+		"gnb-target": m.TargetGnb.String(),
+		"cause":      m.Cause,
+	}).Info("New Handover Cancel")
+	go amf.HandleHandoverCancel(m)
+	c.JSON(http.StatusAccepted, jsonapi.Message{Message: "please refer to logs for more information"})
+}
+
+// Handover Cancel is send by the source gNB to the Control Plane.
+// Upon reception of Handover Cancel, the Control Plane:
+// 1. releases the new uplink path and temporary forwarding rules: PDU Sessions stay on the source gNB
+// 2. sends an UE Context Release Command to the target gNB
+// 3. sends an Handover Cancel Acknowledge to the source gNB
+// The Handover Cancel is acknowledged even if no handover is in progress.
+func (amf *Amf) HandleHandoverCancel(m HandoverCancel) {
+	c := amf.ues.acquire(m.UeCtrl)
+	defer amf.ues.release(c)
+	proc := amf.metrics.StartProcedure("handover-cancel")
+	defer proc.End()
+	ctx := amf.Context()
+
+	ho := c.handover
+	inProgress := (c.state == UeStateHandoverPreparing || c.state == UeStateHandoverExecuting) &&
+		ho.sourceGnb.String() == m.SourceGnb.String() && ho.targetGnb.String() == m.TargetGnb.String()
+	if inProgress {
+		amf.rollbackHandover(c)
+		amf.settle(c)
+		amf.releaseHandoverTarget(ctx, m.UeCtrl, m.TargetGnb, CauseHandoverCancelled)
+	} else {
+		logrus.WithFields(logrus.Fields{
+			"ue":         m.UeCtrl.String(),
+			"gnb-source": m.SourceGnb.String(),
+			"gnb-target": m.TargetGnb.String(),
+			"state":      c.state,
+		}).Warn("Handover Cancel: no handover in progress toward this gNB")
+	}
+
+	ack := HandoverCancelAck{
+		UeCtrl:    m.UeCtrl,
+		Cp:        amf.control,
+		SourceGnb: m.SourceGnb,
+		TargetGnb: m.TargetGnb,
+	}
+	if err := amf.sendToGnb(ctx, m.SourceGnb, "ps/handover-cancel-ack", ack); err != nil {
+		logrus.WithError(err).Error("Could not send ps/handover-cancel-ack")
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"ue":         m.UeCtrl.String(),
+		"gnb-source": m.SourceGnb.String(),
+		"gnb-target": m.TargetGnb.String(),
+	}).Info("Handover Cancelled")
+	proc.Succeed()
+}
+
+// Sends an UE Context Release Command to the target gNB of an handover that has been rolled back
+func (amf *Amf) releaseHandoverTarget(ctx context.Context, ue jsonapi.ControlURI, targetGnb jsonapi.ControlURI, cause Cause) {
+	release := UeContextReleaseCommand{
+		UeCtrl:    ue,
+		Cp:        amf.control,
+		TargetGnb: targetGnb,
+		Cause:     cause,
+	}
+	if err := amf.sendToGnb(ctx, targetGnb, "ps/ue-context-release-command", release); err != nil {
+		logrus.WithError(err).Error("Could not send ps/ue-context-release-command")
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"ue":         ue.String(),
+		"gnb-target": targetGnb.String(),
+		"cause":      cause,
+	}).Info("UE Context Release Command sent to the target gNB")
+}
@@ -33,18 +33,63 @@ func (amf *Amf) HandoverNotify(c *gin.Context) {
 
 // Handover Notify is send by the target gNB to the Control Plane.
 // Upon the reception of Handover Notify, the Control Plane may:
-// 1. update DL rule in the UPF-i if direct forwarding was used
+// 1. update DL rule in the UPF-i if direct forwarding was used, or if sourceArea == targetArea
 // 2. create new DL rules if sourceArea != targetArea
 // 3. release old DL rules if sourceArea != targetArea
 // 4. release rules for the old UL path (from source upf-i to source upf-a) if target area != source area:
-// 5. release forwarding DL rule in UPF-i if sourceArea != targetArea
+// 5. release temporary forwarding DL rules in UPF-i if indirect forwarding was used (once the new DL path is installed)
+// 6. forward DL packets buffered in the UPF-A on the new path if buffering was used
+// PDU Sessions whose downlink path could not be switched to the target gNB are released.
 func (amf *Amf) HandleHandoverNotify(m n1n2.HandoverNotify) {
+	c := amf.ues.acquire(m.UeCtrl)
+	defer amf.ues.release(c)
+	proc := amf.metrics.StartProcedure("handover-notify")
+	defer proc.End()
 	ctx := amf.Context()
+
+	ho := c.handover
+	if c.state != UeStateHandoverExecuting || ho.sourceGnb.String() != m.SourceGnb.String() || ho.targetGnb.String() != m.TargetGnb.String() {
+		logrus.WithFields(logrus.Fields{
+			"ue":         m.UeCtrl.String(),
+			"gnb-source": m.SourceGnb.String(),
+			"gnb-target": m.TargetGnb.String(),
+			"state":      c.state,
+		}).Warn("Unexpected Handover Notify: no handover execution in progress toward this gNB")
+		return
+	}
+	ho.timer.Stop()
+	c.handover = nil
+	defer amf.settle(c)
+
+	failure := false
+	release := func(key sessionKey, cause Cause) {
+		failure = true
+		amf.releaseSession(ctx, PduSessionReleaseReqMsg{Ue: m.UeCtrl, Gnb: m.TargetGnb, Addr: key.addr, Dnn: key.dnn}, cause)
+	}
+	// PDU Sessions acknowledged by the target gNB but missing from the Handover Notify are released
+	defer func() {
+		for key := range ho.sessions {
+			logrus.WithFields(logrus.Fields{
+				"ue":          m.UeCtrl.String(),
+				"pdu-session": key.addr,
+				"dnn":         key.dnn,
+			}).Error("Handover Notify: PDU Session is missing")
+			release(key, CauseInvalidMessage)
+		}
+		if !failure {
+			proc.Succeed()
+		}
+	}()
+
 	sourceArea, ok := amf.smf.Areas.Area(m.SourceGnb)
 	if !ok {
 		logrus.WithFields(logrus.Fields{
 			"source-gnb": m.SourceGnb,
 		}).Error("Unknown Area for source gNB")
+		for key := range ho.sessions {
+			release(key, CauseUnknownArea)
+		}
+		clear(ho.sessions)
 		return
 	}
 	targetArea, ok := amf.smf.Areas.Area(m.TargetGnb)
@@ -52,45 +97,92 @@ func (amf *Amf) HandleHandoverNotify(m n1n2.HandoverNotify) {
 		logrus.WithFields(logrus.Fields{
 			"target-gnb": m.TargetGnb,
 		}).Error("Unknown Area for target gNB")
+		for key := range ho.sessions {
+			release(key, CauseUnknownArea)
+		}
+		clear(ho.sessions)
 		return
 	}
 	for _, s := range m.Sessions {
-		indirectForwardingRequired, err := amf.smf.GetSessionIndirectForwardingRequired(m.UeCtrl, s.Addr, s.Dnn)
-		if err != nil {
-			// TODO: notify of failure
+		key := sessionKey{addr: s.Addr, dnn: s.Dnn}
+		hs, ok := ho.sessions[key]
+		if !ok {
+			logrus.WithFields(logrus.Fields{
+				"ue":          m.UeCtrl.String(),
+				"pdu-session": s.Addr,
+				"dnn":         s.Dnn,
+			}).Error("Handover Notify: PDU Session is not part of the handover")
 			continue
 		}
-		// step 1: update DL rule (only update FAR) in the UPF-i if direct forwarding was used
-		if !indirectForwardingRequired {
-			if err := amf.smf.UpdateSessionDownlinkContext(ctx, m.UeCtrl, s.Addr, s.Dnn, m.SourceGnb); err != nil {
+		delete(ho.sessions, key)
+		if hs.nextDownlinkFteid == nil {
+			logrus.WithFields(logrus.Fields{
+				"ue":          m.UeCtrl.String(),
+				"pdu-session": s.Addr,
+				"dnn":         s.Dnn,
+			}).Error("Handover Notify: no downlink F-TEID for target gNB")
+			release(key, CauseInvalidMessage)
+			continue
+		}
+		// step 1: update DL rule (only update FAR) in the UPF-i if direct forwarding was used,
+		// or if the UPF-i is kept (with indirect forwarding, only the temporary forwarding rules point to the target gNB)
+		if !hs.indirectForwarding || sourceArea == targetArea {
+			if err := amf.smf.UpdateSessionDownlinkContext(ctx, m.UeCtrl, s.Addr, s.Dnn, m.SourceGnb, *hs.nextDownlinkFteid); err != nil {
 				logrus.WithError(err).WithFields(logrus.Fields{
 					"ue":          m.UeCtrl.String(),
 					"pdu-session": s.Addr,
 					"dnn":         s.Dnn,
 					"gnb-source":  m.SourceGnb,
 				}).Error("Handover Notify: could not update session downlink path")
+				release(key, CauseFromError(err))
+				continue
 			}
 		}
 		if sourceArea != targetArea {
 			// step 2. create new DL rules if sourceArea != targetArea
-			nextDlFteid, err := amf.smf.GetNextDownlinkFteid(m.UeCtrl, s.Addr, s.Dnn)
-			if err != nil {
-				// TODO: notify of failure
-			}
-			_, err = amf.smf.CreateSessionDownlinkContext(ctx, m.UeCtrl, s.Addr, s.Dnn, m.TargetGnb, *nextDlFteid)
-			if err != nil {
-				// TODO: notify of failure
+			// step 3. release old DL rules if sourceArea != targetArea
+			// (old DL rules are removed when new DL rules are created, in the same PFCP message if UPFs are common to both paths)
+			if _, err := amf.smf.CreateSessionDownlinkContext(ctx, m.UeCtrl, s.Addr, s.Dnn, m.TargetGnb, *hs.nextDownlinkFteid); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"ue":          m.UeCtrl.String(),
+					"pdu-session": s.Addr,
+					"dnn":         s.Dnn,
+					"gnb-target":  m.TargetGnb,
+				}).Error("Handover Notify: could not create new downlink path")
+				release(key, CauseFromError(err))
 				continue
 			}
 
-			// step 3. TODO: release old DL rules if sourceArea != targetArea
-			// NOTE: until this step is implemented, handover across areas will **NOT** work when sourceUPFA == targetUPFA
-			// step 4. TODO: release rules for the old UL path (from source upf-i to source upf-a) if target area != source area:
-			// step 5. TODO: release forwarding DL rule in UPF-i if sourceArea != targetArea
+			// step 4. release rules for the old UL path (from source upf-i to source upf-a) if target area != source area:
+			if err := amf.smf.ReleaseSessionPreviousUplink(m.UeCtrl, s.Addr, s.Dnn); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"ue":          m.UeCtrl.String(),
+					"pdu-session": s.Addr,
+					"dnn":         s.Dnn,
+				}).Error("Handover Notify: could not release old uplink path")
+			}
+		}
+		if hs.indirectForwarding {
+			// step 5. release temporary forwarding DL rules in UPF-i if indirect forwarding was used
+			if err := amf.smf.ReleaseSessionForwarding(m.UeCtrl, s.Addr, s.Dnn); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"ue":          m.UeCtrl.String(),
+					"pdu-session": s.Addr,
+					"dnn":         s.Dnn,
+				}).Error("Handover Notify: could not release forwarding rules")
+			}
 		}
-		if indirectForwardingRequired {
-			amf.smf.SetSessionIndirectForwardingRequired(m.UeCtrl, s.Addr, s.Dnn, false)
+		if hs.buffering {
+			// step 6. forward buffered DL packets on the new path
+			// (already done if sourceArea != targetArea: the FAR of the UPF-A has been updated with the new path)
+			if err := amf.smf.ResumeSessionDownlink(m.UeCtrl, s.Addr, s.Dnn); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"ue":          m.UeCtrl.String(),
+					"pdu-session": s.Addr,
+					"dnn":         s.Dnn,
+				}).Error("Handover Notify: could not stop buffering of downlink packets")
+				release(key, CauseFromError(err))
+			}
 		}
-
 	}
 }
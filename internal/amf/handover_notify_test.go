@@ -0,0 +1,144 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/nextmn/cp-lite/internal/config"
+	"github.com/nextmn/cp-lite/internal/mockupf"
+
+	"github.com/nextmn/json-api/jsonapi"
+	"github.com/nextmn/json-api/jsonapi/n1n2"
+)
+
+func TestHandoverNotify(t *testing.T) {
+	upfi1 := netip.MustParseAddr("127.0.0.2")
+	upfi2 := netip.MustParseAddr("127.0.0.3")
+	upfa1 := netip.MustParseAddr("127.0.0.4")
+	upfa2 := netip.MustParseAddr("127.0.0.5")
+	sourceFteid := jsonapi.Fteid{Addr: netip.MustParseAddr("127.0.2.1"), Teid: 1}
+	targetFteid := jsonapi.Fteid{Addr: netip.MustParseAddr("127.0.2.2"), Teid: 2}
+	interArea := map[string][]netip.Addr{"area1": {upfi1, upfa1}, "area2": {upfi2, upfa2}}
+	sharedAnchor := map[string][]netip.Addr{"area1": {upfi1, upfa1}, "area2": {upfi2, upfa1}}
+	intraArea := map[string][]netip.Addr{"area1": {upfi1, upfa1}}
+
+	tests := []struct {
+		name               string
+		paths              map[string][]netip.Addr
+		targetArea         string // the source gNB is in area1
+		indirectForwarding bool
+		path               []netip.Addr // path of the PDU Session after the handover
+	}{
+		{name: "inter-area, direct forwarding", paths: interArea, targetArea: "area2", path: []netip.Addr{upfi2, upfa2}},
+		{name: "inter-area, indirect forwarding", paths: interArea, targetArea: "area2", indirectForwarding: true, path: []netip.Addr{upfi2, upfa2}},
+		{name: "shared UPF-A, direct forwarding", paths: sharedAnchor, targetArea: "area2", path: []netip.Addr{upfi2, upfa1}},
+		{name: "shared UPF-A, indirect forwarding", paths: sharedAnchor, targetArea: "area2", indirectForwarding: true, path: []netip.Addr{upfi2, upfa1}},
+		{name: "intra-area, direct forwarding", paths: intraArea, targetArea: "area1", path: []netip.Addr{upfi1, upfa1}},
+		{name: "intra-area, indirect forwarding", paths: intraArea, targetArea: "area1", indirectForwarding: true, path: []netip.Addr{upfi1, upfa1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := newTestbed(t, tt.paths, nil)
+			ue := testControlURI(t, "http://192.0.2.6:8080")
+			source := tb.gnbs["area1"][0]
+			target := tb.gnbs[tt.targetArea][1]
+			addr := tb.establish(t, ue, source, sourceFteid).UeInfo.Addr
+			cmd := tb.prepareHandover(t, ue, source, target, addr, targetFteid, tt.indirectForwarding)
+			forward := *cmd.Sessions[0].ForwardDownlinkFteid
+			if _, _, ok := tb.pdrOnFteid(forward); ok != tt.indirectForwarding {
+				t.Fatalf("got forwarding rules %t, want %t", ok, tt.indirectForwarding)
+			}
+
+			tb.amf.HandleHandoverNotify(n1n2.HandoverNotify{
+				UeCtrl:    ue,
+				SourceGnb: source,
+				TargetGnb: target,
+				Sessions:  []n1n2.Session{{Addr: addr, Dnn: testDnn}},
+			})
+
+			checkUeContext(t, tb.amf, ue, UeStateActive)
+			if nodeID, pdr, ok := tb.pdrOnFteid(forward); ok {
+				t.Fatalf("UPF %s: forwarding PDR %d has not been removed", nodeID, pdr.ID)
+			}
+			// rules of the source path are removed, and downlink packets are sent to the target gNB
+			tb.checkDownlinkPath(t, tt.path, targetFteid)
+			if len(tb.received) > 0 {
+				t.Fatalf("unexpected message sent to gNB: %s", (<-tb.received).path)
+			}
+		})
+	}
+}
+
+func TestHandoverNotifyFlushesBufferedPackets(t *testing.T) {
+	upfi1 := netip.MustParseAddr("127.0.0.2")
+	upfi2 := netip.MustParseAddr("127.0.0.3")
+	upfa1 := netip.MustParseAddr("127.0.0.4")
+	upfa2 := netip.MustParseAddr("127.0.0.5")
+	tb := newTestbed(t, map[string][]netip.Addr{"area1": {upfi1, upfa1}, "area2": {upfi2, upfa2}}, func(s *config.Slice) {
+		s.Handover = config.HandoverBuffering
+	})
+	ue := testControlURI(t, "http://192.0.2.6:8080")
+	gnb1 := tb.gnbs["area1"][0]
+	gnb2 := tb.gnbs["area2"][0]
+	gnb1Fteid := jsonapi.Fteid{Addr: netip.MustParseAddr("127.0.2.1"), Teid: 1}
+	gnb2Fteid := jsonapi.Fteid{Addr: netip.MustParseAddr("127.0.2.2"), Teid: 2}
+	addr := tb.establish(t, ue, gnb1, gnb1Fteid).UeInfo.Addr
+
+	// handover toward another UPF-A: downlink packets are buffered by the UPF-A of the source path
+	tb.prepareHandover(t, ue, gnb1, gnb2, addr, gnb2Fteid, false)
+	tb.downlinkData(t, upfa1)
+	tb.downlinkData(t, upfa1)
+	drain, ok := tb.findPdr(upfa1, func(pdr mockupf.Pdr) bool { return pdr.SourceInterface == "core" && pdr.Fteid == nil })
+	if !ok {
+		t.Fatal("no downlink PDR on the source UPF-A")
+	}
+	if far, _ := tb.findFar(upfa1, drain.FarID); far.Buffered != 2 {
+		t.Fatalf("got %d buffered packets, want 2", far.Buffered)
+	}
+	tb.amf.HandleHandoverNotify(n1n2.HandoverNotify{
+		UeCtrl:    ue,
+		SourceGnb: gnb1,
+		TargetGnb: gnb2,
+		Sessions:  []n1n2.Session{{Addr: addr, Dnn: testDnn}},
+	})
+	checkUeContext(t, tb.amf, ue, UeStateActive)
+
+	// buffered packets are forwarded on the new path, and the rules of the source UPF-A are kept
+	far, ok := tb.findFar(upfa1, drain.FarID)
+	if !ok {
+		t.Fatal("FAR buffering packets on the source UPF-A has been removed")
+	}
+	if far.Buffered != 0 || !slices.Contains(far.ApplyAction, "FORW") || far.OuterHeaderCreation == nil {
+		t.Fatalf("buffered packets have not been forwarded: %+v", far)
+	}
+	if _, ok := tb.findPdr(upfi2, func(pdr mockupf.Pdr) bool { return pdr.Fteid != nil && *pdr.Fteid == *far.OuterHeaderCreation }); !ok {
+		t.Fatalf("buffered packets are sent to %v, which is not a F-TEID of the target UPF-i", *far.OuterHeaderCreation)
+	}
+	if _, ok := tb.findPdr(upfi1, func(mockupf.Pdr) bool { return true }); ok {
+		t.Fatal("rules of the source UPF-i have not been removed")
+	}
+
+	// the rules of the source UPF-A are released at the next change of path
+	tb.prepareHandover(t, ue, gnb2, gnb1, addr, gnb1Fteid, false)
+	tb.amf.HandleHandoverNotify(n1n2.HandoverNotify{
+		UeCtrl:    ue,
+		SourceGnb: gnb2,
+		TargetGnb: gnb1,
+		Sessions:  []n1n2.Session{{Addr: addr, Dnn: testDnn}},
+	})
+	checkUeContext(t, tb.amf, ue, UeStateActive)
+	for _, s := range tb.upfs[upfa1].Sessions() {
+		if len(s.Pdrs) != 2 || len(s.Fars) != 2 {
+			t.Fatalf("got %d PDRs and %d FARs on the UPF-A, want 2 of each", len(s.Pdrs), len(s.Fars))
+		}
+	}
+	if len(tb.received) > 0 {
+		t.Fatalf("unexpected message sent to gNB: %s", (<-tb.received).path)
+	}
+}
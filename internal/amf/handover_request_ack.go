@@ -6,9 +6,8 @@
 package amf
 
 import (
-	"bytes"
-	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/nextmn/json-api/jsonapi"
 	"github.com/nextmn/json-api/jsonapi/n1n2"
@@ -36,16 +35,43 @@ func (amf *Amf) HandoverRequestAck(c *gin.Context) {
 // Handover Request Ack is send by the target gNB to the Control Plane.
 // Upon reception of Handover Request Ack, the Control Plane:
 // 1. if indirect forwarding is used: configure UPF-i with a DL rule to target gNB (existing DL rule to source gNB is preserved until Handover Notify reception)
+// if buffering is used: configure UPF-A to buffer DL packets until Handover Notify reception
 // 2. send Handover Command to source gNB
+// Rules created for PDU Sessions that cannot be handed over are released.
+// If the target gNB does not send Handover Notify before TRELOCoverall expires, the handover is rolled back,
+// and the target gNB is sent an UE Context Release Command.
 func (amf *Amf) HandleHandoverRequestAck(m n1n2.HandoverRequestAck) {
+	c := amf.ues.acquire(m.UeCtrl)
+	defer amf.ues.release(c)
+	proc := amf.metrics.StartProcedure("handover-request-ack")
+	defer proc.End()
 	ctx := amf.Context()
-	// TODO: if UPF-i change, push new DL rules
+	// the downlink path of the target area is created at Handover Notify
+
+	ho := c.handover
+	if c.state != UeStateHandoverPreparing || ho.sourceGnb.String() != m.SourcegNB.String() || ho.targetGnb.String() != m.TargetgNB.String() {
+		logrus.WithFields(logrus.Fields{
+			"ue":         m.UeCtrl.String(),
+			"gnb-source": m.SourcegNB.String(),
+			"gnb-target": m.TargetgNB.String(),
+			"state":      c.state,
+		}).Warn("Unexpected Handover Request Ack: no handover preparation in progress toward this gNB")
+		return
+	}
+	ho.timer.Stop()
+	// failure of the handover: PDU Sessions stay on the source gNB
+	fail := func(cause Cause, failed []SessionFailure) {
+		amf.rollbackHandover(c)
+		amf.failHandoverPreparation(ctx, m.UeCtrl, m.SourcegNB, m.TargetgNB, cause, failed)
+		amf.settle(c)
+	}
 
 	sourceArea, ok := amf.smf.Areas.Area(m.SourcegNB)
 	if !ok {
 		logrus.WithFields(logrus.Fields{
 			"source-gnb": m.SourcegNB,
 		}).Error("Unknown Area for source gNB")
+		fail(CauseUnknownArea, nil)
 		return
 	}
 	targetArea, ok := amf.smf.Areas.Area(m.TargetgNB)
@@ -53,45 +79,62 @@ func (amf *Amf) HandleHandoverRequestAck(m n1n2.HandoverRequestAck) {
 		logrus.WithFields(logrus.Fields{
 			"target-gnb": m.TargetgNB,
 		}).Error("Unknown Area for target gNB")
+		fail(CauseUnknownArea, nil)
 		return
 	}
 
+	// PDU Sessions that already failed during reception of Handover Required
+	failed := ho.failed
+	// the PDU Session stays on the source gNB
+	abort := func(key sessionKey, hs *handoverSession, cause Cause) {
+		amf.rollbackHandoverSession(m.UeCtrl, key, hs)
+		delete(ho.sessions, key)
+		failed = append(failed, SessionFailure{Addr: key.addr, Dnn: key.dnn, Cause: cause})
+	}
+
 	// send Handover Command to source gNB with "forwarding rule to targetGNB" (direct forwarding)
-	sessions := make([]n1n2.Session, len(m.Sessions))
-	for i, s := range m.Sessions {
-		indirectForwardingRequired, err := amf.smf.GetSessionIndirectForwardingRequired(m.UeCtrl, s.Addr, s.Dnn)
+	sessions := make([]n1n2.Session, 0, len(m.Sessions))
+	acked := make(map[sessionKey]struct{}, len(m.Sessions))
+	for _, s := range m.Sessions {
+		key := sessionKey{addr: s.Addr, dnn: s.Dnn}
+		hs, ok := ho.sessions[key]
+		if !ok {
+			logrus.WithFields(logrus.Fields{
+				"ue":      m.UeCtrl.String(),
+				"ue-addr": s.Addr,
+				"dnn":     s.Dnn,
+			}).Error("PDU Session is not part of the handover")
+			failed = append(failed, SessionFailure{Addr: s.Addr, Dnn: s.Dnn, Cause: CauseUnknownPduSession})
+			continue
+		}
+		if _, ok := acked[key]; ok {
+			// duplicated PDU Session
+			continue
+		}
+		if s.DownlinkFteid == nil {
+			logrus.Error("downlink fteid is nil")
+			abort(key, hs, CauseInvalidMessage)
+			continue
+		}
+		dl, err := amf.smf.GetSessionDownlinkFteid(m.UeCtrl, s.Addr, s.Dnn)
 		if err != nil {
-			// TODO: notify of failure
+			logrus.WithError(err).Error("could not get session downlink fteid")
+			abort(key, hs, CauseFromError(err))
 			continue
 		}
-		if indirectForwardingRequired {
-			dl, err := amf.smf.GetSessionDownlinkFteid(m.UeCtrl, s.Addr, s.Dnn)
-			if err != nil {
-				logrus.WithError(err).Error("could not get session downlink fteid")
-				// TODO: notify of failure
-				continue
-			}
+		// store DownlinkFteid to update the DL path upon reception of Handover Notify
+		hs.nextDownlinkFteid = s.DownlinkFteid
+		if hs.indirectForwarding {
 			upfiFwTarget, err := amf.smf.SessionFirstUpf(m.UeCtrl, s.Addr, s.Dnn, m.TargetgNB)
 			if err != nil {
 				logrus.WithError(err).Error("upfi-fw-target not found")
-				// TODO: notify failure
+				abort(key, hs, CauseFromError(err))
 				continue
 			}
 			upfiFwSource, err := amf.smf.SessionFirstUpf(m.UeCtrl, s.Addr, s.Dnn, m.SourcegNB)
 			if err != nil {
 				logrus.WithError(err).Error("upfi-fw-source not found")
-				// TODO: notify failure
-				continue
-			}
-			if s.DownlinkFteid == nil {
-				// TODO: notify failure
-				logrus.WithError(err).Error("downlink fteid si nil")
-				continue
-			}
-			// store DownlinkFteid to update the DL path upon reception of Handover Notfify
-			if err := amf.smf.StoreNextDownlinkFteid(m.UeCtrl, s.Addr, s.Dnn, s.DownlinkFteid); err != nil {
-				logrus.WithError(err).Error("Could not store next downlink fteid")
-				// TODO: notify of failure
+				abort(key, hs, CauseFromError(err))
 				continue
 			}
 			// push new (temporary) DL rule on target UPF-i only (FAR: to target gNB) [DL-TI]
@@ -105,77 +148,86 @@ func (amf *Amf) HandleHandoverRequestAck(m n1n2.HandoverRequestAck) {
 					"downlink-gtp-addr": s.DownlinkFteid.Addr,
 					"downlink-teid":     s.DownlinkFteid.Teid,
 				}).Error("Could not push temporary DL rule on target UPF-i")
-				// TODO: notify failure
+				abort(key, hs, CauseFromError(err))
 				continue
 			}
+			fwFteid := fwFteidTarget
 			if sourceArea != targetArea {
 				// push (temporary) forwarding rule on source UPF-i only (FAR: to <DL-TI>))
-				fwFteidSource, err := amf.smf.CreateSessionDownlinkFWUpfIContext(ctx, m.UeCtrl, s.Addr, s.Dnn, upfiFwSource, *fwFteidTarget)
+				fwFteid, err = amf.smf.CreateSessionDownlinkFWUpfIContext(ctx, m.UeCtrl, s.Addr, s.Dnn, upfiFwSource, *fwFteidTarget)
 				if err != nil {
 					logrus.WithError(err).Error("Could not push temporary DL rule on source UPF-i")
-					// TODO: notify failure
+					abort(key, hs, CauseFromError(err))
 					continue
 				}
-				sessions[i] = n1n2.Session{
-					Addr:                 s.Addr,
-					Dnn:                  s.Dnn,
-					UplinkFteid:          s.UplinkFteid,
-					DownlinkFteid:        dl,
-					ForwardDownlinkFteid: fwFteidSource,
-				}
-			} else {
-				sessions[i] = n1n2.Session{
-					Addr:                 s.Addr,
-					Dnn:                  s.Dnn,
-					UplinkFteid:          s.UplinkFteid,
-					DownlinkFteid:        dl,
-					ForwardDownlinkFteid: fwFteidTarget,
-				}
 			}
+			sessions = append(sessions, n1n2.Session{
+				Addr:                 s.Addr,
+				Dnn:                  s.Dnn,
+				UplinkFteid:          s.UplinkFteid,
+				DownlinkFteid:        dl,
+				ForwardDownlinkFteid: fwFteid,
+			})
 		} else {
 			// direct forwarding: no modification of UPF-i: forward directly to target gNB
-			dl, err := amf.smf.GetSessionDownlinkFteid(m.UeCtrl, s.Addr, s.Dnn)
-			if err != nil {
-				// TODO: notify of failure
-				continue
+			// (upon reception of Handover Notify, UPF-i will be updated to use the DL FTEID of the target gNB)
+			if hs.buffering {
+				// UPF-A buffers downlink packets until the reception of Handover Notify
+				if err := amf.smf.BufferSessionDownlink(m.UeCtrl, s.Addr, s.Dnn, false); err != nil {
+					logrus.WithError(err).WithFields(logrus.Fields{
+						"ue-ctrl": m.UeCtrl,
+						"ue-addr": s.Addr,
+						"dnn":     s.Dnn,
+					}).Error("Could not buffer downlink packets on UPF-A")
+					abort(key, hs, CauseFromError(err))
+					continue
+				}
 			}
-			sessions[i] = n1n2.Session{
+			sessions = append(sessions, n1n2.Session{
 				Addr:                 s.Addr,
 				Dnn:                  s.Dnn,
 				UplinkFteid:          s.UplinkFteid,
 				DownlinkFteid:        dl,
 				ForwardDownlinkFteid: s.DownlinkFteid,
-			}
-			// we store the DL FTEID: upon reception of Handover Notify, UPF-i will be updated to use it
-			if err := amf.smf.StoreNextDownlinkFteid(m.UeCtrl, s.Addr, s.Dnn, s.DownlinkFteid); err != nil {
-				// TODO: notify of failure
-				continue
-			}
+			})
 		}
+		acked[key] = struct{}{}
 	}
-
-	// forward to UE
-	resp := n1n2.HandoverCommand{
-		Cp:        m.Cp,
-		TargetGnb: m.TargetgNB,
-		SourceGnb: m.SourcegNB,
-		UeCtrl:    m.UeCtrl,
-		Sessions:  sessions,
+	// PDU Sessions not admitted by the target gNB stay on the source gNB
+	for key, hs := range ho.sessions {
+		if _, ok := acked[key]; !ok {
+			amf.rollbackHandoverSession(m.UeCtrl, key, hs)
+			delete(ho.sessions, key)
+		}
 	}
-
-	reqBody, err := json.Marshal(resp)
-	if err != nil {
-		logrus.WithError(err).Error("Could not marshal n1n2.HandoverRequest")
+	if len(sessions) == 0 {
+		// no PDU Session can be handed over
+		cause := CauseUnknownPduSession
+		if len(failed) > 0 {
+			cause = failed[0].Cause
+		}
+		fail(cause, failed)
 		return
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.SourcegNB.JoinPath("ps/handover-command").String(), bytes.NewBuffer(reqBody))
-	if err != nil {
-		logrus.WithError(err).Error("Could not create request for ps/handover-command")
-		return
+
+	// forward to UE
+	resp := HandoverCommand{
+		HandoverCommand: n1n2.HandoverCommand{
+			Cp:        m.Cp,
+			TargetGnb: m.TargetgNB,
+			SourceGnb: m.SourcegNB,
+			UeCtrl:    m.UeCtrl,
+			Sessions:  sessions,
+		},
+		FailedSessions: failed,
 	}
-	req.Header.Set("User-Agent", amf.userAgent)
-	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	if _, err := amf.client.Do(req); err != nil {
+	if err := amf.sendToGnb(ctx, m.SourcegNB, "ps/handover-command", resp); err != nil {
 		logrus.WithError(err).Error("Could not send ps/handover-command")
+		amf.rollbackHandover(c)
+		amf.settle(c)
+		return
 	}
+	ho.timer = time.AfterFunc(amf.timers.RelocOverall, func() { amf.handoverExecutionTimeout(m.UeCtrl, ho) })
+	amf.ues.setState(c, UeStateHandoverExecuting)
+	proc.Succeed()
 }
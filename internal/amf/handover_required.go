@@ -6,9 +6,10 @@
 package amf
 
 import (
-	"bytes"
-	"encoding/json"
 	"net/http"
+	"time"
+
+	"github.com/nextmn/cp-lite/internal/config"
 
 	"github.com/nextmn/json-api/jsonapi"
 	"github.com/nextmn/json-api/jsonapi/n1n2"
@@ -37,14 +38,29 @@ func (amf *Amf) HandoverRequired(c *gin.Context) {
 // Upon reception of Handover Required, the Control Plane
 // 1. configure new UL path for each session
 // 2. send an Handover Request to the target gNB with the configured UL FTEIDs
+// If the target gNB does not answer before TRELOCprep expires, the new UL paths are released.
 func (amf *Amf) HandleHandoverRequired(m n1n2.HandoverRequired) {
+	c := amf.ues.acquire(m.Ue)
+	defer amf.ues.release(c)
+	proc := amf.metrics.StartProcedure("handover-required")
+	defer proc.End()
 	ctx := amf.Context()
 
+	if c.state != UeStateActive {
+		logrus.WithFields(logrus.Fields{
+			"ue":    m.Ue.String(),
+			"state": c.state,
+		}).Warn("Handover Required received during another procedure")
+		amf.failHandoverPreparation(ctx, m.Ue, m.SourcegNB, m.TargetgNB, CauseInvalidState, nil)
+		return
+	}
+
 	sourceArea, ok := amf.smf.Areas.Area(m.SourcegNB)
 	if !ok {
 		logrus.WithFields(logrus.Fields{
 			"source-gnb": m.SourcegNB,
 		}).Error("Unknown Area for source gNB")
+		amf.failHandoverPreparation(ctx, m.Ue, m.SourcegNB, m.TargetgNB, CauseUnknownArea, nil)
 		return
 	}
 	targetArea, ok := amf.smf.Areas.Area(m.TargetgNB)
@@ -52,22 +68,49 @@ func (amf *Amf) HandleHandoverRequired(m n1n2.HandoverRequired) {
 		logrus.WithFields(logrus.Fields{
 			"target-gnb": m.TargetgNB,
 		}).Error("Unknown Area for target gNB")
+		amf.failHandoverPreparation(ctx, m.Ue, m.SourcegNB, m.TargetgNB, CauseUnknownArea, nil)
 		return
 	}
 
 	// send handover-request to target with UPF-i FTEID
-	sessions := make([]n1n2.Session, len(m.Sessions))
-	for i, s := range m.Sessions {
-		// store type of forwarding for later
-		if m.IndirectForwarding {
-			if err := amf.smf.SetSessionIndirectForwardingRequired(m.Ue, s.Addr, s.Dnn, true); err != nil {
-				logrus.WithError(err).WithFields(logrus.Fields{
-					"ue":      m.Ue,
-					"ue-addr": s.Addr,
-					"dnn":     s.Dnn,
-				}).Error("Could not set Indirect Forwarding Required for handover")
-				continue
-			}
+	ho := &handover{
+		sourceGnb: m.SourcegNB,
+		targetGnb: m.TargetgNB,
+		sessions:  make(map[sessionKey]*handoverSession),
+		failed:    make([]SessionFailure, 0),
+	}
+	sessions := make([]n1n2.Session, 0, len(m.Sessions))
+	for _, s := range m.Sessions {
+		key := sessionKey{addr: s.Addr, dnn: s.Dnn}
+		if _, ok := ho.sessions[key]; ok {
+			// duplicated PDU Session
+			continue
+		}
+		// this also ensures the PDU Session exists before a new uplink path is created for it
+		uplinkfteid, err := amf.smf.GetSessionUplinkFteid(m.Ue, s.Addr, s.Dnn)
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"ue":      m.Ue,
+				"ue-addr": s.Addr,
+				"dnn":     s.Dnn,
+			}).Error("Could not find Uplink FTEID for handover")
+			ho.failed = append(ho.failed, SessionFailure{Addr: s.Addr, Dnn: s.Dnn, Cause: CauseFromError(err)})
+			continue
+		}
+		strategy, err := amf.smf.HandoverStrategy(s.Dnn)
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"ue":      m.Ue,
+				"ue-addr": s.Addr,
+				"dnn":     s.Dnn,
+			}).Error("Could not find handover strategy")
+			ho.failed = append(ho.failed, SessionFailure{Addr: s.Addr, Dnn: s.Dnn, Cause: CauseFromError(err)})
+			continue
+		}
+		hs := &handoverSession{
+			// with buffering, the source gNB only forwards directly packets it has already received
+			indirectForwarding: m.IndirectForwarding && strategy != config.HandoverBuffering,
+			buffering:          strategy == config.HandoverBuffering,
 		}
 		if sourceArea != targetArea {
 			// we could recycle common UL rules, but this is harder than simply
@@ -80,34 +123,34 @@ func (amf *Amf) HandleHandoverRequired(m n1n2.HandoverRequired) {
 					"dnn":        s.Dnn,
 					"target-gnb": m.TargetgNB,
 				}).Error("Could not establish new uplink path")
+				ho.failed = append(ho.failed, SessionFailure{Addr: s.Addr, Dnn: s.Dnn, Cause: CauseFromError(err)})
 				continue
 			}
-			sessions[i] = n1n2.Session{
-				Addr:        s.Addr,
-				Dnn:         s.Dnn,
-				UplinkFteid: pduSessionN3.UplinkFteid,
-			}
-		} else {
-			// fully reuse existing path
-			uplinkfteid, err := amf.smf.GetSessionUplinkFteid(m.Ue, s.Addr, s.Dnn)
-			if err != nil {
-				// TODO: notify gnb of failure
-				logrus.WithError(err).WithFields(logrus.Fields{
-					"ue":      m.Ue,
-					"ue-addr": s.Addr,
-					"dnn":     s.Dnn,
-				}).Error("Could not find Uplink FTEID for handover")
-				continue
-			}
-			sessions[i] = n1n2.Session{
-				Addr:        s.Addr,
-				Dnn:         s.Dnn,
-				UplinkFteid: uplinkfteid,
-			}
+			hs.newUplink = true
+			uplinkfteid = pduSessionN3.UplinkFteid
 		}
-
+		// otherwise, the existing path is fully reused
+		ho.sessions[key] = hs
+		sessions = append(sessions, n1n2.Session{
+			Addr:        s.Addr,
+			Dnn:         s.Dnn,
+			UplinkFteid: uplinkfteid,
+		})
+	}
+	if len(sessions) == 0 {
+		// no PDU Session can be handed over
+		cause := CauseUnknownPduSession
+		if len(ho.failed) > 0 {
+			cause = ho.failed[0].Cause
+		}
+		amf.failHandoverPreparation(ctx, m.Ue, m.SourcegNB, m.TargetgNB, cause, ho.failed)
+		return
 	}
-	// send PseAccept to UE
+	// PDU Sessions that could not be prepared are not sent to the target gNB:
+	// the source gNB will be notified of their failure in the Handover Command
+	ho.timer = time.AfterFunc(amf.timers.RelocPrep, func() { amf.handoverPreparationTimeout(m.Ue, ho) })
+	c.handover = ho
+
 	resp := n1n2.HandoverRequest{
 		// Header
 		UeCtrl:    m.Ue,
@@ -118,19 +161,12 @@ func (amf *Amf) HandleHandoverRequired(m n1n2.HandoverRequired) {
 		SourcegNB: m.SourcegNB,
 		Sessions:  sessions,
 	}
-	reqBody, err := json.Marshal(resp)
-	if err != nil {
-		logrus.WithError(err).Error("Could not marshal n1n2.HandoverRequest")
-		return
-	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TargetgNB.JoinPath("ps/handover-request").String(), bytes.NewBuffer(reqBody))
-	if err != nil {
-		logrus.WithError(err).Error("Could not create request for ps/handover-request")
-		return
-	}
-	req.Header.Set("User-Agent", amf.userAgent)
-	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	if _, err := amf.client.Do(req); err != nil {
+	if err := amf.sendToGnb(ctx, m.TargetgNB, "ps/handover-request", resp); err != nil {
 		logrus.WithError(err).Error("Could not send ps/handover-request")
+		amf.rollbackHandover(c)
+		amf.failHandoverPreparation(ctx, m.Ue, m.SourcegNB, m.TargetgNB, CauseSystemFailure, nil)
+		return
 	}
+	amf.ues.setState(c, UeStateHandoverPreparing)
+	proc.Succeed()
 }
@@ -27,7 +27,25 @@ func (amf *Amf) N2EstablishmentResponse(c *gin.Context) {
 }
 
 func (amf *Amf) HandleN2EstablishmentResponse(ps n1n2.N2PduSessionRespMsg) {
+	c := amf.ues.acquire(ps.UeInfo.Header.Ue)
+	defer amf.ues.release(c)
+	proc := amf.metrics.StartProcedure("n2-establishment-response")
+	defer proc.End()
 	ctx := amf.Context()
+
+	e, ok := c.establishments[ps.UeInfo.Addr]
+	if !ok {
+		logrus.WithFields(logrus.Fields{
+			"ue":         ps.UeInfo.Header.Ue.String(),
+			"ue-ip-addr": ps.UeInfo.Addr,
+			"state":      c.state,
+		}).Warn("Unexpected N2 PDU Session Response: no establishment in progress for this PDU Session")
+		return
+	}
+	e.timer.Stop()
+	delete(c.establishments, ps.UeInfo.Addr)
+	defer amf.settle(c)
+
 	pduSession, err := amf.smf.CreateSessionDownlinkContext(ctx, ps.UeInfo.Header.Ue, ps.UeInfo.Addr, ps.UeInfo.Header.Dnn, ps.UeInfo.Header.Gnb, ps.DownlinkFteid)
 	if err != nil {
 		logrus.WithError(err).WithFields(logrus.Fields{
@@ -36,6 +54,11 @@ func (amf *Amf) HandleN2EstablishmentResponse(ps n1n2.N2PduSessionRespMsg) {
 			"gnb":        ps.UeInfo.Header.Gnb,
 			"dnn":        ps.UeInfo.Header.Dnn,
 		}).Error("could not create downlink path")
+		// the uplink path and the UE IP Address are released
+		if err := amf.smf.ReleaseSessionContext(ctx, ps.UeInfo.Header.Ue, ps.UeInfo.Addr, ps.UeInfo.Header.Dnn); err != nil {
+			logrus.WithError(err).Error("Could not release PDU Session")
+		}
+		amf.rejectEstablishment(ctx, ps.UeInfo.Header, CauseFromError(err))
 		return
 	}
 	logrus.WithFields(logrus.Fields{
@@ -48,4 +71,5 @@ func (amf *Amf) HandleN2EstablishmentResponse(ps n1n2.N2PduSessionRespMsg) {
 		"gtp-downlink-teid": pduSession.DownlinkFteid.Teid,
 		"dnn":               ps.UeInfo.Header.Dnn,
 	}).Info("New PDU Session Established")
+	proc.Succeed()
 }
@@ -0,0 +1,73 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"net/netip"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Paging, sent to gNBs of the last known RAN area of the UE so it sends a Service Request
+type Paging struct {
+	UeCtrl jsonapi.ControlURI `json:"ue-ctrl"`
+	Cp     jsonapi.ControlURI `json:"cp"`
+}
+
+// Downlink Data Report is send by the UPF-A when downlink packets arrive for an inactive UE.
+// Upon reception of Downlink Data Report, the Control Plane sends Paging to every gNB
+// of the RAN area of the PDU Session. The UE is paged again on each report until it sends a Service Request.
+func (amf *Amf) HandleDownlinkData(ue jsonapi.ControlURI, ueAddr netip.Addr, dnn string) {
+	c := amf.ues.acquire(ue)
+	defer amf.ues.release(c)
+	proc := amf.metrics.StartProcedure("paging")
+	defer proc.End()
+	ctx := amf.Context()
+
+	if c.state != UeStateInactive && c.state != UeStatePaging {
+		logrus.WithFields(logrus.Fields{
+			"ue":      ue.String(),
+			"ue-addr": ueAddr,
+			"dnn":     dnn,
+			"state":   c.state,
+		}).Warn("Downlink Data Report for an UE that is not inactive")
+		return
+	}
+	area, err := amf.smf.GetSessionArea(ue, ueAddr, dnn)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"ue":      ue.String(),
+			"ue-addr": ueAddr,
+			"dnn":     dnn,
+		}).Error("Could not find RAN area of the UE")
+		return
+	}
+	msg := Paging{
+		UeCtrl: ue,
+		Cp:     amf.control,
+	}
+	paged := false
+	for _, gnb := range amf.smf.Areas.Gnbs(area) {
+		if err := amf.sendToGnb(ctx, gnb, "ps/paging", msg); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"gnb": gnb.String(),
+			}).Error("Could not send ps/paging")
+			continue
+		}
+		paged = true
+	}
+	if !paged {
+		return
+	}
+	amf.ues.setState(c, UeStatePaging)
+	logrus.WithFields(logrus.Fields{
+		"ue":   ue.String(),
+		"area": area,
+	}).Info("UE paged")
+	proc.Succeed()
+}
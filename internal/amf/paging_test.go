@@ -0,0 +1,94 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/nextmn/cp-lite/internal/mockupf"
+
+	"github.com/nextmn/json-api/jsonapi"
+	"github.com/nextmn/json-api/jsonapi/n1n2"
+)
+
+func TestPagingAndServiceRequest(t *testing.T) {
+	upfi1 := netip.MustParseAddr("127.0.0.2")
+	upfi2 := netip.MustParseAddr("127.0.0.3")
+	upfa := netip.MustParseAddr("127.0.0.4")
+	sourceFteid := jsonapi.Fteid{Addr: netip.MustParseAddr("127.0.2.1"), Teid: 1}
+	targetFteid := jsonapi.Fteid{Addr: netip.MustParseAddr("127.0.2.2"), Teid: 2}
+
+	tests := []struct {
+		name       string
+		targetArea string       // the UE was connected to a gNB of area1
+		path       []netip.Addr // path of the PDU Session after the Service Request
+	}{
+		{name: "same area", targetArea: "area1", path: []netip.Addr{upfi1, upfa}},
+		{name: "other area", targetArea: "area2", path: []netip.Addr{upfi2, upfa}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := newTestbed(t, map[string][]netip.Addr{"area1": {upfi1, upfa}, "area2": {upfi2, upfa}}, nil)
+			ue := testControlURI(t, "http://192.0.2.6:8080")
+			source := tb.gnbs["area1"][0]
+			target := tb.gnbs[tt.targetArea][1]
+			addr := tb.establish(t, ue, source, sourceFteid).UeInfo.Addr
+
+			tb.amf.HandleAnReleaseRequest(AnReleaseRequest{UeCtrl: ue, Cp: tb.amf.control, Gnb: source})
+			var cmd AnReleaseCommand
+			tb.receive(t, "ps/an-release-command", &cmd)
+			checkUeContext(t, tb.amf, ue, UeStateInactive)
+
+			// the first downlink packet is reported, and the UE is paged by every gNB of its last area
+			tb.downlinkData(t, upfa)
+			for range tb.gnbs["area1"] {
+				var paging Paging
+				tb.receive(t, "ps/paging", &paging)
+				if paging.UeCtrl != ue {
+					t.Fatalf("got Paging for UE %s, want %s", paging.UeCtrl.String(), ue.String())
+				}
+			}
+			checkUeContext(t, tb.amf, ue, UeStatePaging)
+			tb.downlinkData(t, upfa)
+			drain, ok := tb.findPdr(upfa, func(pdr mockupf.Pdr) bool { return pdr.SourceInterface == "core" && pdr.Fteid == nil })
+			if !ok {
+				t.Fatal("no downlink PDR on the UPF-A")
+			}
+			if far, _ := tb.findFar(upfa, drain.FarID); far.Buffered != 2 {
+				t.Fatalf("got %d buffered packets, want 2", far.Buffered)
+			}
+
+			tb.amf.HandleServiceRequest(ServiceRequest{
+				UeCtrl:   ue,
+				Cp:       tb.amf.control,
+				Gnb:      target,
+				Sessions: []n1n2.Session{{Addr: addr, Dnn: testDnn, DownlinkFteid: &targetFteid}},
+			})
+			var accept ServiceAccept
+			tb.receive(t, "ps/service-accept", &accept)
+			checkUeContext(t, tb.amf, ue, UeStateActive)
+			if len(accept.Sessions) != 1 || len(accept.ReleasedSessions) != 0 {
+				t.Fatalf("got %d activated and %d released PDU Sessions, want 1 activated", len(accept.Sessions), len(accept.ReleasedSessions))
+			}
+			if accept.Sessions[0].UplinkFteid == nil {
+				t.Fatal("no uplink F-TEID in the Service Accept")
+			}
+			if nodeID, _, ok := tb.pdrOnFteid(*accept.Sessions[0].UplinkFteid); !ok || nodeID != tt.path[0] {
+				t.Fatalf("got uplink packets sent to UPF %s, want %s", nodeID, tt.path[0])
+			}
+			// buffered packets are flushed, and downlink packets are sent to the gNB of the Service Request
+			tb.checkDownlinkPath(t, tt.path, targetFteid)
+			drain, _ = tb.findPdr(upfa, func(pdr mockupf.Pdr) bool { return pdr.SourceInterface == "core" && pdr.Fteid == nil })
+			if far, _ := tb.findFar(upfa, drain.FarID); far.Buffered != 0 {
+				t.Fatalf("got %d buffered packets, want none", far.Buffered)
+			}
+			if len(tb.received) > 0 {
+				t.Fatalf("unexpected message sent to gNB: %s", (<-tb.received).path)
+			}
+		})
+	}
+}
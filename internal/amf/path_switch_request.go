@@ -0,0 +1,229 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"net/http"
+
+	"github.com/nextmn/json-api/jsonapi"
+	"github.com/nextmn/json-api/jsonapi/n1n2"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Path Switch Request, sent by the target gNB once the UE is connected to it (Xn handover)
+type PathSwitchRequest struct {
+	UeCtrl    jsonapi.ControlURI `json:"ue-ctrl"`
+	Cp        jsonapi.ControlURI `json:"cp"`
+	SourceGnb jsonapi.ControlURI `json:"source-gnb"`
+	TargetGnb jsonapi.ControlURI `json:"target-gnb"`
+	Sessions  []n1n2.Session     `json:"sessions"` // contains new DL FTeid
+}
+
+// Path Switch Request Acknowledge, sent to the target gNB
+type PathSwitchRequestAck struct {
+	UeCtrl           jsonapi.ControlURI `json:"ue-ctrl"`
+	Cp               jsonapi.ControlURI `json:"cp"`
+	TargetGnb        jsonapi.ControlURI `json:"target-gnb"`
+	Sessions         []n1n2.Session     `json:"sessions"`                    // contains UL FTeid
+	ReleasedSessions []SessionFailure   `json:"released-sessions,omitempty"` // PDU Sessions that could not be switched
+}
+
+// Path Switch Request Failure, sent to the target gNB when no PDU Session could be switched
+type PathSwitchRequestFailure struct {
+	UeCtrl           jsonapi.ControlURI `json:"ue-ctrl"`
+	Cp               jsonapi.ControlURI `json:"cp"`
+	TargetGnb        jsonapi.ControlURI `json:"target-gnb"`
+	Cause            Cause              `json:"cause"`
+	ReleasedSessions []SessionFailure   `json:"released-sessions,omitempty"`
+}
+
+func (amf *Amf) PathSwitchRequest(c *gin.Context) {
+	var m PathSwitchRequest
+	if err := c.BindJSON(&m); err != nil {
+		logrus.WithError(err).Error("could not deserialize")
+		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "could not deserialize", Error: err})
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"ue":         m.UeCtrl.String(),
+		"gnb-source": m.SourceGnb.String(),
+		"gnb-target": m.TargetGnb.String(),
+	}).Info("New Path Switch Request")
+	go amf.HandlePathSwitchRequest(m)
+	c.JSON(http.StatusAccepted, jsonapi.Message{Message: "please refer to logs for more information"})
+}
+
+// Path Switch Request is send by the target gNB to the Control Plane, after an Xn handover.
+// Upon reception of Path Switch Request, the Control Plane, for each PDU Session:
+// 1. if source area == target area: updates the DL FAR of the UPF-i to forward to the target gNB
+// 2. otherwise: creates new UL and DL paths toward the target area, and releases the old ones
+// Then it sends a Path Switch Request Acknowledge to the target gNB with the UL FTEIDs.
+// PDU Sessions that could not be switched are released.
+func (amf *Amf) HandlePathSwitchRequest(m PathSwitchRequest) {
+	c := amf.ues.acquire(m.UeCtrl)
+	defer amf.ues.release(c)
+	proc := amf.metrics.StartProcedure("path-switch-request")
+	defer proc.End()
+	ctx := amf.Context()
+
+	released := make([]SessionFailure, 0)
+	// the UE is already connected to the target gNB: the PDU Session cannot stay on the source gNB
+	release := func(s n1n2.Session, cause Cause) {
+		if err := amf.smf.ReleaseSessionContext(ctx, m.UeCtrl, s.Addr, s.Dnn); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"ue":      m.UeCtrl.String(),
+				"ue-addr": s.Addr,
+				"dnn":     s.Dnn,
+			}).Error("Could not release PDU Session")
+		}
+		released = append(released, SessionFailure{Addr: s.Addr, Dnn: s.Dnn, Cause: cause})
+	}
+	fail := func(cause Cause) {
+		msg := PathSwitchRequestFailure{
+			UeCtrl:           m.UeCtrl,
+			Cp:               amf.control,
+			TargetGnb:        m.TargetGnb,
+			Cause:            cause,
+			ReleasedSessions: released,
+		}
+		if err := amf.sendToGnb(ctx, m.TargetGnb, "ps/path-switch-request-failure", msg); err != nil {
+			logrus.WithError(err).Error("Could not send ps/path-switch-request-failure")
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"ue":         m.UeCtrl.String(),
+			"gnb-source": m.SourceGnb.String(),
+			"gnb-target": m.TargetGnb.String(),
+			"cause":      cause,
+		}).Info("Path Switch Request Failure")
+	}
+
+	if c.state != UeStateActive {
+		logrus.WithFields(logrus.Fields{
+			"ue":    m.UeCtrl.String(),
+			"state": c.state,
+		}).Warn("Path Switch Request received during another procedure")
+		fail(CauseInvalidState)
+		return
+	}
+	sourceArea, ok := amf.smf.Areas.Area(m.SourceGnb)
+	if !ok {
+		logrus.WithFields(logrus.Fields{
+			"source-gnb": m.SourceGnb,
+		}).Error("Unknown Area for source gNB")
+		fail(CauseUnknownArea)
+		return
+	}
+	targetArea, ok := amf.smf.Areas.Area(m.TargetGnb)
+	if !ok {
+		logrus.WithFields(logrus.Fields{
+			"target-gnb": m.TargetGnb,
+		}).Error("Unknown Area for target gNB")
+		fail(CauseUnknownArea)
+		return
+	}
+	amf.ues.setState(c, UeStatePathSwitching)
+	defer amf.settle(c)
+
+	sessions := make([]n1n2.Session, 0, len(m.Sessions))
+	for _, s := range m.Sessions {
+		if s.DownlinkFteid == nil {
+			logrus.WithFields(logrus.Fields{
+				"ue":      m.UeCtrl.String(),
+				"ue-addr": s.Addr,
+				"dnn":     s.Dnn,
+			}).Error("Path Switch Request: downlink fteid is nil")
+			release(s, CauseInvalidMessage)
+			continue
+		}
+		uplinkFteid, err := amf.smf.GetSessionUplinkFteid(m.UeCtrl, s.Addr, s.Dnn)
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"ue":      m.UeCtrl.String(),
+				"ue-addr": s.Addr,
+				"dnn":     s.Dnn,
+			}).Error("Path Switch Request: could not find Uplink FTEID")
+			released = append(released, SessionFailure{Addr: s.Addr, Dnn: s.Dnn, Cause: CauseFromError(err)})
+			continue
+		}
+		if sourceArea == targetArea {
+			// only the DL FAR of the UPF-i is updated
+			if err := amf.smf.UpdateSessionDownlinkContext(ctx, m.UeCtrl, s.Addr, s.Dnn, m.SourceGnb, *s.DownlinkFteid); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"ue":      m.UeCtrl.String(),
+					"ue-addr": s.Addr,
+					"dnn":     s.Dnn,
+				}).Error("Path Switch Request: could not update session downlink path")
+				release(s, CauseFromError(err))
+				continue
+			}
+		} else {
+			pduSession, err := amf.smf.CreateSessionUplinkContext(ctx, m.UeCtrl, s.Addr, m.TargetGnb, s.Dnn)
+			if err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"ue":         m.UeCtrl.String(),
+					"ue-addr":    s.Addr,
+					"dnn":        s.Dnn,
+					"target-gnb": m.TargetGnb,
+				}).Error("Path Switch Request: could not establish new uplink path")
+				release(s, CauseFromError(err))
+				continue
+			}
+			uplinkFteid = pduSession.UplinkFteid
+			// old DL rules are removed when new DL rules are created
+			if _, err := amf.smf.CreateSessionDownlinkContext(ctx, m.UeCtrl, s.Addr, s.Dnn, m.TargetGnb, *s.DownlinkFteid); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"ue":         m.UeCtrl.String(),
+					"ue-addr":    s.Addr,
+					"dnn":        s.Dnn,
+					"target-gnb": m.TargetGnb,
+				}).Error("Path Switch Request: could not create new downlink path")
+				release(s, CauseFromError(err))
+				continue
+			}
+			if err := amf.smf.ReleaseSessionPreviousUplink(m.UeCtrl, s.Addr, s.Dnn); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"ue":      m.UeCtrl.String(),
+					"ue-addr": s.Addr,
+					"dnn":     s.Dnn,
+				}).Error("Path Switch Request: could not release old uplink path")
+			}
+		}
+		sessions = append(sessions, n1n2.Session{
+			Addr:        s.Addr,
+			Dnn:         s.Dnn,
+			UplinkFteid: uplinkFteid,
+		})
+	}
+	if len(sessions) == 0 {
+		cause := CauseUnknownPduSession
+		if len(released) > 0 {
+			cause = released[0].Cause
+		}
+		fail(cause)
+		return
+	}
+
+	resp := PathSwitchRequestAck{
+		UeCtrl:           m.UeCtrl,
+		Cp:               amf.control,
+		TargetGnb:        m.TargetGnb,
+		Sessions:         sessions,
+		ReleasedSessions: released,
+	}
+	if err := amf.sendToGnb(ctx, m.TargetGnb, "ps/path-switch-request-ack", resp); err != nil {
+		logrus.WithError(err).Error("Could not send ps/path-switch-request-ack")
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"ue":         m.UeCtrl.String(),
+		"gnb-source": m.SourceGnb.String(),
+		"gnb-target": m.TargetGnb.String(),
+	}).Info("Path Switched")
+	proc.Succeed()
+}
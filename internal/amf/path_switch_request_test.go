@@ -0,0 +1,66 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/nextmn/json-api/jsonapi"
+	"github.com/nextmn/json-api/jsonapi/n1n2"
+)
+
+func TestPathSwitchRequest(t *testing.T) {
+	upfi1 := netip.MustParseAddr("127.0.0.2")
+	upfi2 := netip.MustParseAddr("127.0.0.3")
+	upfa := netip.MustParseAddr("127.0.0.4")
+	sourceFteid := jsonapi.Fteid{Addr: netip.MustParseAddr("127.0.2.1"), Teid: 1}
+	targetFteid := jsonapi.Fteid{Addr: netip.MustParseAddr("127.0.2.2"), Teid: 2}
+
+	tests := []struct {
+		name       string
+		targetArea string       // the source gNB is in area1
+		path       []netip.Addr // path of the PDU Session after the path switch
+	}{
+		{name: "intra-area", targetArea: "area1", path: []netip.Addr{upfi1, upfa}},
+		{name: "inter-area", targetArea: "area2", path: []netip.Addr{upfi2, upfa}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := newTestbed(t, map[string][]netip.Addr{"area1": {upfi1, upfa}, "area2": {upfi2, upfa}}, nil)
+			ue := testControlURI(t, "http://192.0.2.6:8080")
+			source := tb.gnbs["area1"][0]
+			target := tb.gnbs[tt.targetArea][1]
+			addr := tb.establish(t, ue, source, sourceFteid).UeInfo.Addr
+
+			tb.amf.HandlePathSwitchRequest(PathSwitchRequest{
+				UeCtrl:    ue,
+				Cp:        tb.amf.control,
+				SourceGnb: source,
+				TargetGnb: target,
+				Sessions:  []n1n2.Session{{Addr: addr, Dnn: testDnn, DownlinkFteid: &targetFteid}},
+			})
+			var ack PathSwitchRequestAck
+			tb.receive(t, "ps/path-switch-request-ack", &ack)
+			checkUeContext(t, tb.amf, ue, UeStateActive)
+			if len(ack.Sessions) != 1 || len(ack.ReleasedSessions) != 0 {
+				t.Fatalf("got %d switched and %d released PDU Sessions, want 1 switched", len(ack.Sessions), len(ack.ReleasedSessions))
+			}
+			// uplink packets are sent to the first UPF of the path
+			if ack.Sessions[0].UplinkFteid == nil {
+				t.Fatal("no uplink F-TEID in the Path Switch Request Acknowledge")
+			}
+			if nodeID, _, ok := tb.pdrOnFteid(*ack.Sessions[0].UplinkFteid); !ok || nodeID != tt.path[0] {
+				t.Fatalf("got uplink packets sent to UPF %s, want %s", nodeID, tt.path[0])
+			}
+			// downlink packets are sent to the target gNB, and rules of the source path are removed
+			tb.checkDownlinkPath(t, tt.path, targetFteid)
+			if len(tb.received) > 0 {
+				t.Fatalf("unexpected message sent to gNB: %s", (<-tb.received).path)
+			}
+		})
+	}
+}
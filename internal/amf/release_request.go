@@ -0,0 +1,113 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// PDU Session Release Request, sent by the gNB on behalf of the UE (UE-initiated release),
+// or on its own initiative (gNB-initiated release)
+type PduSessionReleaseReqMsg struct {
+	Ue   jsonapi.ControlURI `json:"ue"`
+	Gnb  jsonapi.ControlURI `json:"gnb"`
+	Addr netip.Addr         `json:"ue-addr"`
+	Dnn  string             `json:"dnn"`
+}
+
+// PDU Session Release Command, sent to the gNB once the PDU Session is released
+type PduSessionReleaseCommandMsg struct {
+	Cp     jsonapi.ControlURI      `json:"cp"`
+	UeInfo PduSessionReleaseReqMsg `json:"ue-info"`         // copy of the PDU Session Release Request
+	Cause  Cause                   `json:"cause,omitempty"` // set when the release is initiated by the Control Plane
+}
+
+func (amf *Amf) ReleaseRequest(c *gin.Context) {
+	var m PduSessionReleaseReqMsg
+	if err := c.BindJSON(&m); err != nil {
+		logrus.WithError(err).Error("could not deserialize")
+		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "could not deserialize", Error: err})
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"ue":      m.Ue.String(),
+		"gnb":     m.Gnb.String(),
+		"ue-addr": m.Addr,
+		"dnn":     m.Dnn,
+	}).Info("New PDU Session Release Request")
+	go amf.HandleReleaseRequest(m)
+	c.JSON(http.StatusAccepted, jsonapi.Message{Message: "please refer to logs for more information"})
+}
+
+// PDU Session Release Request is send by the gNB to the Control Plane.
+// Upon reception of PDU Session Release Request, the Control Plane:
+// 1. deletes PFCP Sessions on UPFs, and releases F-TEIDs and UE IP Address of the PDU Session
+// 2. sends a PDU Session Release Command to the gNB, so it can release its context
+func (amf *Amf) HandleReleaseRequest(m PduSessionReleaseReqMsg) {
+	c := amf.ues.acquire(m.Ue)
+	defer amf.ues.release(c)
+	proc := amf.metrics.StartProcedure("release-request")
+	defer proc.End()
+	switch c.state {
+	case UeStateIdle, UeStateActive, UeStateEstablishing:
+	default:
+		logrus.WithFields(logrus.Fields{
+			"ue":      m.Ue.String(),
+			"ue-addr": m.Addr,
+			"state":   c.state,
+		}).Warn("PDU Session Release Request received during another procedure")
+		return
+	}
+	if e, ok := c.establishments[m.Addr]; ok {
+		// the establishment is aborted
+		e.timer.Stop()
+		delete(c.establishments, m.Addr)
+	}
+	amf.ues.setState(c, UeStateReleasing)
+	defer amf.settle(c)
+	if amf.releaseSession(amf.Context(), m, "") {
+		proc.Succeed()
+	}
+}
+
+// Releases the PDU Session and sends a PDU Session Release Command to the gNB.
+// Cause is empty when the release has been requested by the gNB.
+func (amf *Amf) releaseSession(ctx context.Context, m PduSessionReleaseReqMsg, cause Cause) bool {
+	if err := amf.smf.ReleaseSessionContext(ctx, m.Ue, m.Addr, m.Dnn); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"ue":      m.Ue.String(),
+			"gnb":     m.Gnb.String(),
+			"ue-addr": m.Addr,
+			"dnn":     m.Dnn,
+		}).Error("Could not release PDU Session")
+		// the gNB is notified anyway: it has no reason to keep its context
+	}
+
+	resp := PduSessionReleaseCommandMsg{
+		Cp:     amf.control,
+		UeInfo: m,
+		Cause:  cause,
+	}
+	if err := amf.sendToGnb(ctx, m.Gnb, "ps/release-command", resp); err != nil {
+		logrus.WithError(err).Error("Could not send ps/release-command")
+		return false
+	}
+	logrus.WithFields(logrus.Fields{
+		"ue":      m.Ue.String(),
+		"gnb":     m.Gnb.String(),
+		"ue-addr": m.Addr,
+		"dnn":     m.Dnn,
+		"cause":   cause,
+	}).Info("PDU Session Released")
+	return true
+}
@@ -0,0 +1,243 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"net/http"
+
+	"github.com/nextmn/json-api/jsonapi"
+	"github.com/nextmn/json-api/jsonapi/n1n2"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Service Request, sent by the gNB when an inactive UE connects again (e.g. after Paging)
+type ServiceRequest struct {
+	UeCtrl   jsonapi.ControlURI `json:"ue-ctrl"`
+	Cp       jsonapi.ControlURI `json:"cp"`
+	Gnb      jsonapi.ControlURI `json:"gnb"`
+	Sessions []n1n2.Session     `json:"sessions"` // contains new DL FTeid
+}
+
+// Service Accept, sent to the gNB
+type ServiceAccept struct {
+	UeCtrl           jsonapi.ControlURI `json:"ue-ctrl"`
+	Cp               jsonapi.ControlURI `json:"cp"`
+	Gnb              jsonapi.ControlURI `json:"gnb"`
+	Sessions         []n1n2.Session     `json:"sessions"`                    // contains UL FTeid
+	ReleasedSessions []SessionFailure   `json:"released-sessions,omitempty"` // PDU Sessions that could not be activated
+}
+
+// Service Reject, sent to the gNB when no PDU Session could be activated
+type ServiceReject struct {
+	UeCtrl           jsonapi.ControlURI `json:"ue-ctrl"`
+	Cp               jsonapi.ControlURI `json:"cp"`
+	Gnb              jsonapi.ControlURI `json:"gnb"`
+	Cause            Cause              `json:"cause"`
+	ReleasedSessions []SessionFailure   `json:"released-sessions,omitempty"`
+}
+
+func (amf *Amf) ServiceRequest(c *gin.Context) {
+	var m ServiceRequest
+	if err := c.BindJSON(&m); err != nil {
+		logrus.WithError(err).Error("could not deserialize")
+		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "could not deserialize", Error: err})
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"ue":  m.UeCtrl.String(),
+		"gnb": m.Gnb.String(),
+	}).Info("New Service Request")
+	go amf.HandleServiceRequest(m)
+	c.JSON(http.StatusAccepted, jsonapi.Message{Message: "please refer to logs for more information"})
+}
+
+// Service Request is send by the gNB to the Control Plane, when an inactive UE connects again.
+// Upon reception of Service Request, the Control Plane, for each PDU Session:
+// 1. if the RAN area is unchanged: updates the DL FAR of the UPF-i to forward to the new F-TEID of the gNB,
+// and the DL FAR of the UPF-A to forward buffered packets
+// 2. otherwise: creates new UL and DL paths toward the new area (buffered packets are forwarded on the new DL path),
+// and releases the old UL path
+// Then it sends a Service Accept to the gNB with the UL FTEIDs.
+// PDU Sessions that could not be activated, or that are missing from the Service Request, are released.
+func (amf *Amf) HandleServiceRequest(m ServiceRequest) {
+	c := amf.ues.acquire(m.UeCtrl)
+	defer amf.ues.release(c)
+	proc := amf.metrics.StartProcedure("service-request")
+	defer proc.End()
+	ctx := amf.Context()
+
+	released := make([]SessionFailure, 0)
+	release := func(addr sessionKey, cause Cause) {
+		if err := amf.smf.ReleaseSessionContext(ctx, m.UeCtrl, addr.addr, addr.dnn); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"ue":      m.UeCtrl.String(),
+				"ue-addr": addr.addr,
+				"dnn":     addr.dnn,
+			}).Error("Could not release PDU Session")
+		}
+		released = append(released, SessionFailure{Addr: addr.addr, Dnn: addr.dnn, Cause: cause})
+	}
+	fail := func(cause Cause) {
+		msg := ServiceReject{
+			UeCtrl:           m.UeCtrl,
+			Cp:               amf.control,
+			Gnb:              m.Gnb,
+			Cause:            cause,
+			ReleasedSessions: released,
+		}
+		if err := amf.sendToGnb(ctx, m.Gnb, "ps/service-reject", msg); err != nil {
+			logrus.WithError(err).Error("Could not send ps/service-reject")
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"ue":    m.UeCtrl.String(),
+			"gnb":   m.Gnb.String(),
+			"cause": cause,
+		}).Info("Service Reject")
+	}
+
+	if c.state != UeStateInactive && c.state != UeStatePaging {
+		logrus.WithFields(logrus.Fields{
+			"ue":    m.UeCtrl.String(),
+			"state": c.state,
+		}).Warn("Service Request received for an UE that is not inactive")
+		fail(CauseInvalidState)
+		return
+	}
+	area, ok := amf.smf.Areas.Area(m.Gnb)
+	if !ok {
+		logrus.WithFields(logrus.Fields{
+			"gnb": m.Gnb,
+		}).Error("Unknown Area for gNB")
+		fail(CauseUnknownArea)
+		return
+	}
+	defer amf.settle(c)
+
+	// PDU Sessions of the UE that are not part of the Service Request are released
+	pending := make(map[sessionKey]struct{})
+	for _, s := range amf.smf.SessionsStatus(&m.UeCtrl) {
+		pending[sessionKey{addr: s.UeIpAddr, dnn: s.Dnn}] = struct{}{}
+	}
+
+	sessions := make([]n1n2.Session, 0, len(m.Sessions))
+	for _, s := range m.Sessions {
+		key := sessionKey{addr: s.Addr, dnn: s.Dnn}
+		if _, ok := pending[key]; !ok {
+			logrus.WithFields(logrus.Fields{
+				"ue":      m.UeCtrl.String(),
+				"ue-addr": s.Addr,
+				"dnn":     s.Dnn,
+			}).Error("Service Request: unknown PDU Session")
+			released = append(released, SessionFailure{Addr: s.Addr, Dnn: s.Dnn, Cause: CauseUnknownPduSession})
+			continue
+		}
+		delete(pending, key)
+		if s.DownlinkFteid == nil {
+			logrus.WithFields(logrus.Fields{
+				"ue":      m.UeCtrl.String(),
+				"ue-addr": s.Addr,
+				"dnn":     s.Dnn,
+			}).Error("Service Request: downlink fteid is nil")
+			release(key, CauseInvalidMessage)
+			continue
+		}
+		uplinkFteid, err := amf.smf.GetSessionUplinkFteid(m.UeCtrl, s.Addr, s.Dnn)
+		if err != nil {
+			release(key, CauseFromError(err))
+			continue
+		}
+		sessionArea, err := amf.smf.GetSessionArea(m.UeCtrl, s.Addr, s.Dnn)
+		if err != nil {
+			release(key, CauseFromError(err))
+			continue
+		}
+		if sessionArea == area {
+			// step 1: only DL FARs are updated
+			if err := amf.smf.ActivateSessionDownlinkContext(ctx, m.UeCtrl, s.Addr, s.Dnn, *s.DownlinkFteid); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"ue":      m.UeCtrl.String(),
+					"ue-addr": s.Addr,
+					"dnn":     s.Dnn,
+				}).Error("Service Request: could not activate session downlink path")
+				release(key, CauseFromError(err))
+				continue
+			}
+		} else {
+			// step 2: new paths toward the new area
+			pduSession, err := amf.smf.CreateSessionUplinkContext(ctx, m.UeCtrl, s.Addr, m.Gnb, s.Dnn)
+			if err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"ue":      m.UeCtrl.String(),
+					"ue-addr": s.Addr,
+					"dnn":     s.Dnn,
+					"gnb":     m.Gnb,
+				}).Error("Service Request: could not establish new uplink path")
+				release(key, CauseFromError(err))
+				continue
+			}
+			uplinkFteid = pduSession.UplinkFteid
+			// old DL rules are removed when new DL rules are created
+			if _, err := amf.smf.CreateSessionDownlinkContext(ctx, m.UeCtrl, s.Addr, s.Dnn, m.Gnb, *s.DownlinkFteid); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"ue":      m.UeCtrl.String(),
+					"ue-addr": s.Addr,
+					"dnn":     s.Dnn,
+					"gnb":     m.Gnb,
+				}).Error("Service Request: could not create new downlink path")
+				release(key, CauseFromError(err))
+				continue
+			}
+			if err := amf.smf.ReleaseSessionPreviousUplink(m.UeCtrl, s.Addr, s.Dnn); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"ue":      m.UeCtrl.String(),
+					"ue-addr": s.Addr,
+					"dnn":     s.Dnn,
+				}).Error("Service Request: could not release old uplink path")
+			}
+		}
+		sessions = append(sessions, n1n2.Session{
+			Addr:        s.Addr,
+			Dnn:         s.Dnn,
+			UplinkFteid: uplinkFteid,
+		})
+	}
+	for key := range pending {
+		logrus.WithFields(logrus.Fields{
+			"ue":      m.UeCtrl.String(),
+			"ue-addr": key.addr,
+			"dnn":     key.dnn,
+		}).Error("Service Request: PDU Session is missing")
+		release(key, CauseInvalidMessage)
+	}
+	if len(sessions) == 0 {
+		cause := CauseUnknownPduSession
+		if len(released) > 0 {
+			cause = released[0].Cause
+		}
+		fail(cause)
+		return
+	}
+
+	resp := ServiceAccept{
+		UeCtrl:           m.UeCtrl,
+		Cp:               amf.control,
+		Gnb:              m.Gnb,
+		Sessions:         sessions,
+		ReleasedSessions: released,
+	}
+	if err := amf.sendToGnb(ctx, m.Gnb, "ps/service-accept", resp); err != nil {
+		logrus.WithError(err).Error("Could not send ps/service-accept")
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"ue":  m.UeCtrl.String(),
+		"gnb": m.Gnb.String(),
+	}).Info("Service Accepted")
+	proc.Succeed()
+}
@@ -0,0 +1,286 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nextmn/cp-lite/internal/config"
+	"github.com/nextmn/cp-lite/internal/metrics"
+	"github.com/nextmn/cp-lite/internal/mockupf"
+	"github.com/nextmn/cp-lite/internal/smf"
+
+	"github.com/nextmn/go-pfcp-networking/pfcputil"
+	"github.com/nextmn/json-api/jsonapi"
+	"github.com/nextmn/json-api/jsonapi/n1n2"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testDnn = "internet"
+
+var testSmfAddr = netip.MustParseAddr("127.0.0.1")
+
+// Control Plane running against mock UPFs (over loopback) and test gNBs
+type testbed struct {
+	amf      *Amf
+	upfs     map[netip.Addr]*mockupf.MockUpf // by Node ID
+	gnbs     map[string][]jsonapi.ControlURI // by area
+	received chan gnbMessage
+}
+
+// Returns the address of the GTP-U interface of the mock UPF: 127.0.1.x for the Node ID 127.0.0.x
+func testUpfInterface(nodeID netip.Addr) netip.Addr {
+	b := nodeID.As4()
+	b[2] = 1
+	return netip.AddrFrom4(b)
+}
+
+// Starts a mock UPF for each Node ID of the paths of the slice testDnn, and a SMF using them.
+// Each area has two gNBs. The slice can be modified with edit before the SMF is started.
+func newTestbed(t *testing.T, paths map[string][]netip.Addr, edit func(*config.Slice)) *testbed {
+	t.Helper()
+	ctx, cancel := context.WithCancel(t.Context())
+	tb := &testbed{
+		upfs:     make(map[netip.Addr]*mockupf.MockUpf),
+		gnbs:     make(map[string][]jsonapi.ControlURI),
+		received: make(chan gnbMessage, 10),
+	}
+	var s *smf.Smf
+	t.Cleanup(func() {
+		cancel()
+		// PFCP servers only notice the end of their context when they receive a packet
+		for nodeID := range tb.upfs {
+			wakeUpPfcpServer(t, nodeID)
+		}
+		if s != nil {
+			wakeUpPfcpServer(t, testSmfAddr)
+		}
+		ctxShutdown, cancelShutdown := context.WithTimeout(context.Background(), time.Second)
+		defer cancelShutdown()
+		if s != nil {
+			s.WaitShutdown(ctxShutdown)
+		}
+		for _, upf := range tb.upfs {
+			upf.WaitShutdown(ctxShutdown)
+		}
+	})
+
+	slice := config.Slice{Pool: netip.MustParsePrefix("10.0.0.0/24")}
+	areas := make(map[string]config.Area, len(paths))
+	for name, path := range paths {
+		area := config.Area{
+			Gnbs:  []jsonapi.ControlURI{newTestGnb(t, tb.received), newTestGnb(t, tb.received)},
+			Paths: map[string][]config.GTPInterface{testDnn: {}},
+		}
+		for _, nodeID := range path {
+			iface := testUpfInterface(nodeID)
+			area.Paths[testDnn] = append(area.Paths[testDnn], config.GTPInterface{NodeID: nodeID, InterfaceAddr: iface})
+			if _, ok := tb.upfs[nodeID]; ok {
+				continue
+			}
+			upf := mockupf.NewMockUpf(nodeID, []netip.Addr{iface}, netip.Prefix{}, netip.AddrPortFrom(nodeID, 0))
+			if err := upf.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			tb.upfs[nodeID] = upf
+			slice.Upfs = append(slice.Upfs, config.Upf{NodeID: nodeID, Interfaces: []config.Interface{{Type: "N3", Addr: iface}}})
+		}
+		areas[name] = area
+		tb.gnbs[name] = area.Gnbs
+	}
+	if edit != nil {
+		edit(&slice)
+	}
+
+	m := metrics.NewMetrics()
+	s = smf.NewSmf(testSmfAddr, map[string]config.Slice{testDnn: slice}, areas, nil, nil, m, nil)
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tb.amf = NewAmf(netip.MustParseAddrPort("127.0.0.1:0"), testControlURI(t, "http://127.0.0.1:8000"), "test", &config.Timers{}, s, m)
+	if err := tb.amf.InitContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return tb
+}
+
+// Sends an empty datagram to the PFCP server
+func wakeUpPfcpServer(t *testing.T, addr netip.Addr) {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, pfcputil.PFCP_PORT)))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write(nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// Decodes the next message sent to a gNB
+func (tb *testbed) receive(t *testing.T, path string, msg any) {
+	t.Helper()
+	select {
+	case m := <-tb.received:
+		if m.path != "/"+path {
+			t.Fatalf("got message %s, want /%s", m.path, path)
+		}
+		if err := json.Unmarshal(m.body, msg); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message /%s has not been sent", path)
+	}
+}
+
+// Establishes a PDU Session of the UE on the gNB, and returns the N2 PDU Session Request
+func (tb *testbed) establish(t *testing.T, ue jsonapi.ControlURI, gnb jsonapi.ControlURI, downlink jsonapi.Fteid) N2PduSessionReq {
+	t.Helper()
+	tb.amf.HandleEstablishmentRequest(n1n2.PduSessionEstabReqMsg{Ue: ue, Gnb: gnb, Dnn: testDnn})
+	var req N2PduSessionReq
+	tb.receive(t, "ps/n2-establishment-request", &req)
+	tb.amf.HandleN2EstablishmentResponse(n1n2.N2PduSessionRespMsg{UeInfo: req.UeInfo.PduSessionEstabAcceptMsg, DownlinkFteid: downlink})
+	checkUeContext(t, tb.amf, ue, UeStateActive)
+	return req
+}
+
+// Prepares the handover of the PDU Session, and returns the Handover Command
+func (tb *testbed) prepareHandover(t *testing.T, ue jsonapi.ControlURI, source jsonapi.ControlURI, target jsonapi.ControlURI, addr netip.Addr, downlink jsonapi.Fteid, indirectForwarding bool) HandoverCommand {
+	t.Helper()
+	tb.amf.HandleHandoverRequired(n1n2.HandoverRequired{
+		Cp:                 tb.amf.control,
+		SourcegNB:          source,
+		TargetgNB:          target,
+		Ue:                 ue,
+		Sessions:           []n1n2.Session{{Addr: addr, Dnn: testDnn}},
+		IndirectForwarding: indirectForwarding,
+	})
+	var req n1n2.HandoverRequest
+	tb.receive(t, "ps/handover-request", &req)
+	if len(req.Sessions) != 1 {
+		t.Fatalf("got %d PDU Sessions in the Handover Request, want 1", len(req.Sessions))
+	}
+	tb.amf.HandleHandoverRequestAck(n1n2.HandoverRequestAck{
+		Cp:        tb.amf.control,
+		SourcegNB: source,
+		TargetgNB: target,
+		UeCtrl:    ue,
+		Sessions: []n1n2.Session{{
+			Addr:          addr,
+			Dnn:           testDnn,
+			UplinkFteid:   req.Sessions[0].UplinkFteid,
+			DownlinkFteid: &downlink,
+		}},
+	})
+	var cmd HandoverCommand
+	tb.receive(t, "ps/handover-command", &cmd)
+	if len(cmd.Sessions) != 1 {
+		t.Fatalf("got %d PDU Sessions in the Handover Command, want 1", len(cmd.Sessions))
+	}
+	checkUeContext(t, tb.amf, ue, UeStateHandoverExecuting)
+	return cmd
+}
+
+// Simulates the arrival of a downlink packet on each PFCP Session of the UPF
+func (tb *testbed) downlinkData(t *testing.T, nodeID netip.Addr) {
+	t.Helper()
+	upf := tb.upfs[nodeID]
+	for _, s := range upf.Sessions() {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Params = gin.Params{{Key: "seid", Value: strconv.FormatUint(s.LocalSeid, 10)}}
+		c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+		upf.DownlinkData(c)
+		if w.Code != http.StatusOK {
+			t.Fatalf("UPF %s: got status %d for downlink data: %s", nodeID, w.Code, w.Body)
+		}
+	}
+}
+
+// Returns the PDR of the UPF matching f, if any
+func (tb *testbed) findPdr(nodeID netip.Addr, f func(mockupf.Pdr) bool) (mockupf.Pdr, bool) {
+	for _, s := range tb.upfs[nodeID].Sessions() {
+		if i := slices.IndexFunc(s.Pdrs, f); i >= 0 {
+			return s.Pdrs[i], true
+		}
+	}
+	return mockupf.Pdr{}, false
+}
+
+// Returns the FAR of the UPF with this ID, if any
+func (tb *testbed) findFar(nodeID netip.Addr, id uint32) (mockupf.Far, bool) {
+	for _, s := range tb.upfs[nodeID].Sessions() {
+		if i := slices.IndexFunc(s.Fars, func(far mockupf.Far) bool { return far.ID == id }); i >= 0 {
+			return s.Fars[i], true
+		}
+	}
+	return mockupf.Far{}, false
+}
+
+// Returns the PDR of the UPF matching packets sent to the F-TEID, if any
+func (tb *testbed) pdrOnFteid(fteid jsonapi.Fteid) (netip.Addr, mockupf.Pdr, bool) {
+	for nodeID := range tb.upfs {
+		if pdr, ok := tb.findPdr(nodeID, func(pdr mockupf.Pdr) bool { return pdr.Fteid != nil && *pdr.Fteid == fteid }); ok {
+			return nodeID, pdr, true
+		}
+	}
+	return netip.Addr{}, mockupf.Pdr{}, false
+}
+
+// Checks that downlink packets of the single PDU Session go from the anchor of the path to the gNB,
+// and that UPFs have no other rule than the uplink and downlink ones of this path
+func (tb *testbed) checkDownlinkPath(t *testing.T, path []netip.Addr, gnb jsonapi.Fteid) {
+	t.Helper()
+	for nodeID, upf := range tb.upfs {
+		pdrs, fars := 0, 0
+		for _, s := range upf.Sessions() {
+			pdrs += len(s.Pdrs)
+			fars += len(s.Fars)
+		}
+		want := 0
+		if slices.Contains(path, nodeID) {
+			want = 2
+		}
+		if pdrs != want || fars != want {
+			t.Fatalf("UPF %s: got %d PDRs and %d FARs, want %d of each", nodeID, pdrs, fars, want)
+		}
+	}
+	anchor := path[len(path)-1]
+	pdr, ok := tb.findPdr(anchor, func(pdr mockupf.Pdr) bool { return pdr.SourceInterface == "core" && pdr.Fteid == nil })
+	if !ok {
+		t.Fatalf("UPF %s: no downlink PDR for the UE", anchor)
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		far, ok := tb.findFar(path[i], pdr.FarID)
+		if !ok {
+			t.Fatalf("UPF %s: FAR %d not found", path[i], pdr.FarID)
+		}
+		if far.OuterHeaderCreation == nil || !slices.Contains(far.ApplyAction, "FORW") {
+			t.Fatalf("UPF %s: FAR %d does not forward packets", path[i], far.ID)
+		}
+		if i == 0 {
+			if *far.OuterHeaderCreation != gnb {
+				t.Fatalf("UPF %s: got downlink packets sent to %v, want %v", path[i], *far.OuterHeaderCreation, gnb)
+			}
+			return
+		}
+		next := *far.OuterHeaderCreation
+		if pdr, ok = tb.findPdr(path[i-1], func(pdr mockupf.Pdr) bool { return pdr.Fteid != nil && *pdr.Fteid == next }); !ok {
+			t.Fatalf("UPF %s: got downlink packets sent to %v, which is not a F-TEID of UPF %s", path[i], next, path[i-1])
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultEstablishmentTimer = 10 * time.Second
+	DefaultRelocPrepTimer     = 5 * time.Second
+	DefaultRelocOverallTimer  = 10 * time.Second
+)
+
+// The gNB did not send the N2 PDU Session Response: the PDU Session is released
+func (amf *Amf) establishmentTimeout(ue jsonapi.ControlURI, addr netip.Addr, e *establishment) {
+	c := amf.ues.acquire(ue)
+	defer amf.ues.release(c)
+	if c.establishments[addr] != e {
+		// the N2 PDU Session Response has been received meanwhile
+		return
+	}
+	delete(c.establishments, addr)
+	logrus.WithFields(logrus.Fields{
+		"ue":      ue.String(),
+		"gnb":     e.req.Gnb.String(),
+		"ue-addr": addr,
+		"dnn":     e.req.Dnn,
+	}).Warn("No N2 PDU Session Response from the gNB")
+	amf.ues.setState(c, UeStateReleasing)
+	amf.releaseSession(amf.Context(), PduSessionReleaseReqMsg{Ue: ue, Gnb: e.req.Gnb, Addr: addr, Dnn: e.req.Dnn}, CauseTimeout)
+	amf.settle(c)
+}
+
+// TRELOCprep expired: the target gNB did not send the Handover Request Ack
+func (amf *Amf) handoverPreparationTimeout(ue jsonapi.ControlURI, ho *handover) {
+	c := amf.ues.acquire(ue)
+	defer amf.ues.release(c)
+	if c.handover != ho || c.state != UeStateHandoverPreparing {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"ue":         ue.String(),
+		"gnb-source": ho.sourceGnb.String(),
+		"gnb-target": ho.targetGnb.String(),
+	}).Warn("TRELOCprep expired: no Handover Request Ack from the target gNB")
+	amf.rollbackHandover(c)
+	amf.failHandoverPreparation(amf.Context(), ue, ho.sourceGnb, ho.targetGnb, CauseTimeout, nil)
+	amf.settle(c)
+}
+
+// TRELOCoverall expired: the target gNB did not send the Handover Notify
+func (amf *Amf) handoverExecutionTimeout(ue jsonapi.ControlURI, ho *handover) {
+	c := amf.ues.acquire(ue)
+	defer amf.ues.release(c)
+	if c.handover != ho || c.state != UeStateHandoverExecuting {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"ue":         ue.String(),
+		"gnb-source": ho.sourceGnb.String(),
+		"gnb-target": ho.targetGnb.String(),
+	}).Warn("TRELOCoverall expired: no Handover Notify from the target gNB")
+	amf.rollbackHandover(c)
+	amf.settle(c)
+	// PDU Sessions stay on the source gNB: resources allocated by the target gNB are released
+	amf.releaseHandoverTarget(amf.Context(), ue, ho.targetGnb, CauseTimeout)
+}
@@ -0,0 +1,105 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestHandoverTimers(t *testing.T) {
+	received := make(chan gnbMessage, 10)
+	source := newTestGnb(t, received)
+	target := newTestGnb(t, received)
+	ue := testControlURI(t, "http://192.0.2.6:8080")
+
+	tests := []struct {
+		name    string
+		state   UeState
+		timeout func(*Amf, *handover)
+		path    string // message sent on expiry
+		gnb     string // host of the receiver of the message
+	}{
+		{
+			name:    "TRELOCprep",
+			state:   UeStateHandoverPreparing,
+			timeout: func(amf *Amf, ho *handover) { amf.handoverPreparationTimeout(ue, ho) },
+			path:    "/ps/handover-preparation-failure",
+			gnb:     source.Host,
+		},
+		{
+			name:    "TRELOCoverall",
+			state:   UeStateHandoverExecuting,
+			timeout: func(amf *Amf, ho *handover) { amf.handoverExecutionTimeout(ue, ho) },
+			path:    "/ps/ue-context-release-command",
+			gnb:     target.Host,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" rolls back the handover", func(t *testing.T) {
+			amf := newTestAmf(t)
+			ho := newTestHandover(source, target)
+			setUeContext(amf, ue, tt.state, ho)
+			expired := make(chan struct{})
+			c := amf.ues.acquire(ue)
+			ho.timer = time.AfterFunc(10*time.Millisecond, func() {
+				tt.timeout(amf, ho)
+				close(expired)
+			})
+			amf.ues.release(c)
+			<-expired
+
+			// the UE has no PDU Session
+			if got := checkUeContext(t, amf, ue, UeStateIdle); got != nil {
+				t.Fatal("handover has not been rolled back")
+			}
+			msg := <-received
+			if msg.path != tt.path || msg.host != tt.gnb {
+				t.Fatalf("got message %s sent to %s, want %s sent to %s", msg.path, msg.host, tt.path, tt.gnb)
+			}
+			var header struct {
+				Cause Cause `json:"cause"`
+			}
+			if err := json.Unmarshal(msg.body, &header); err != nil {
+				t.Fatal(err)
+			}
+			if header.Cause != CauseTimeout {
+				t.Fatalf("got cause %q, want %q", header.Cause, CauseTimeout)
+			}
+			if len(received) > 0 {
+				t.Fatalf("unexpected message sent to gNB: %s", (<-received).path)
+			}
+		})
+
+		t.Run(tt.name+" of a previous handover is ignored", func(t *testing.T) {
+			amf := newTestAmf(t)
+			previous := newTestHandover(source, target)
+			ho := newTestHandover(source, target)
+			setUeContext(amf, ue, tt.state, ho)
+			tt.timeout(amf, previous)
+			if got := checkUeContext(t, amf, ue, tt.state); got != ho {
+				t.Fatal("handover in progress has been modified")
+			}
+			if len(received) > 0 {
+				t.Fatalf("unexpected message sent to gNB: %s", (<-received).path)
+			}
+		})
+	}
+
+	t.Run("TRELOCprep after the Handover Request Ack is ignored", func(t *testing.T) {
+		amf := newTestAmf(t)
+		ho := newTestHandover(source, target)
+		setUeContext(amf, ue, UeStateHandoverExecuting, ho)
+		amf.handoverPreparationTimeout(ue, ho)
+		if got := checkUeContext(t, amf, ue, UeStateHandoverExecuting); got != ho {
+			t.Fatal("handover in progress has been modified")
+		}
+		if len(received) > 0 {
+			t.Fatalf("unexpected message sent to gNB: %s", (<-received).path)
+		}
+	})
+}
@@ -0,0 +1,135 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nextmn/json-api/jsonapi"
+	"github.com/nextmn/json-api/jsonapi/n1n2"
+)
+
+// State of the UE, regarding procedures of its PDU Sessions
+type UeState string
+
+const (
+	UeStateIdle              UeState = "idle"               // no PDU Session
+	UeStateEstablishing      UeState = "establishing"       // waiting for the N2 PDU Session Response of the gNB
+	UeStateActive            UeState = "active"             // PDU Sessions established, no procedure in progress
+	UeStateHandoverPreparing UeState = "handover-preparing" // waiting for the Handover Request Ack of the target gNB
+	UeStateHandoverExecuting UeState = "handover-executing" // waiting for the Handover Notify of the target gNB
+	UeStatePathSwitching     UeState = "path-switching"     // switching paths after an Xn handover
+	UeStateInactive          UeState = "inactive"           // PDU Sessions established, but the UE is not connected: downlink packets are buffered
+	UeStatePaging            UeState = "paging"             // downlink packets are waiting for the UE, which has been paged
+	UeStateReleasing         UeState = "releasing"
+)
+
+// Context of an UE.
+// Procedures of a same UE are serialized: the lock is held from the reception of a message to the end of its handling.
+type ueContext struct {
+	ue    jsonapi.ControlURI
+	refs  int     // number of procedures running or waiting, protected by the lock of ueContexts
+	state UeState // protected by the lock of ueContexts, so it can be read while a procedure is running
+
+	establishments map[netip.Addr]*establishment // PDU Sessions waiting for the N2 PDU Session Response
+	handover       *handover                     // handover in progress, if any
+	sync.Mutex
+}
+
+// PDU Session Establishment waiting for the N2 PDU Session Response
+type establishment struct {
+	req   n1n2.PduSessionEstabReqMsg
+	timer *time.Timer
+}
+
+// Contexts of UEs; procedures of different UEs run concurrently
+type ueContexts struct {
+	m map[string]*ueContext // UE control URI: context
+	sync.Mutex
+}
+
+// UE with a procedure in progress or with PDU Sessions
+type UeStatus struct {
+	Ue    jsonapi.ControlURI `json:"ue"`
+	State UeState            `json:"state"`
+}
+
+func newUeContexts() ueContexts {
+	return ueContexts{
+		m: make(map[string]*ueContext),
+	}
+}
+
+// Waits until no other procedure is running for this UE, and returns its context.
+// The context must be released once the procedure is over.
+func (u *ueContexts) acquire(ue jsonapi.ControlURI) *ueContext {
+	key := ue.String()
+	u.Lock()
+	c, ok := u.m[key]
+	if !ok {
+		c = &ueContext{
+			ue:             ue,
+			state:          UeStateIdle,
+			establishments: make(map[netip.Addr]*establishment),
+		}
+		u.m[key] = c
+	}
+	c.refs += 1
+	u.Unlock()
+
+	c.Lock()
+	return c
+}
+
+// Releases the context of the UE; it is forgotten once idle
+func (u *ueContexts) release(c *ueContext) {
+	c.Unlock()
+	u.Lock()
+	defer u.Unlock()
+	c.refs -= 1
+	if c.refs == 0 && c.state == UeStateIdle {
+		delete(u.m, c.ue.String())
+	}
+}
+
+// Caller must hold the lock of the context.
+func (u *ueContexts) setState(c *ueContext, state UeState) {
+	u.Lock()
+	defer u.Unlock()
+	c.state = state
+}
+
+// Returns UEs that are not idle
+func (u *ueContexts) Status() []UeStatus {
+	u.Lock()
+	defer u.Unlock()
+	r := make([]UeStatus, 0, len(u.m))
+	for _, c := range u.m {
+		if c.state == UeStateIdle {
+			continue
+		}
+		r = append(r, UeStatus{Ue: c.ue, State: c.state})
+	}
+	slices.SortFunc(r, func(a, b UeStatus) int { return cmp.Compare(a.Ue.String(), b.Ue.String()) })
+	return r
+}
+
+// Sets the state of the UE once the procedure is over and no handover is in progress.
+// Caller must hold the lock of the context.
+func (amf *Amf) settle(c *ueContext) {
+	switch {
+	case len(c.establishments) > 0:
+		amf.ues.setState(c, UeStateEstablishing)
+	case amf.smf.HasSessions(c.ue):
+		amf.ues.setState(c, UeStateActive)
+	default:
+		amf.ues.setState(c, UeStateIdle)
+	}
+}
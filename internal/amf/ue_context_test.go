@@ -0,0 +1,235 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package amf
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/nextmn/cp-lite/internal/config"
+	"github.com/nextmn/cp-lite/internal/metrics"
+	"github.com/nextmn/cp-lite/internal/smf"
+
+	"github.com/nextmn/json-api/jsonapi"
+	"github.com/nextmn/json-api/jsonapi/n1n2"
+)
+
+// Message received by a gNB
+type gnbMessage struct {
+	host string // host of the gNB control URI
+	path string
+	body []byte
+}
+
+// Returns the control URI of a gNB recording messages it receives
+func newTestGnb(t *testing.T, received chan<- gnbMessage) jsonapi.ControlURI {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- gnbMessage{host: r.Host, path: r.URL.Path, body: body}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(srv.Close)
+	return testControlURI(t, srv.URL)
+}
+
+func testControlURI(t *testing.T, s string) jsonapi.ControlURI {
+	t.Helper()
+	u, err := jsonapi.ParseControlURI(s)
+	if err != nil {
+		t.Fatalf("could not parse control URI %q: %v", s, err)
+	}
+	return *u
+}
+
+// Returns an AMF whose SMF has no slice: UEs have no PDU Session
+func newTestAmf(t *testing.T) *Amf {
+	t.Helper()
+	m := metrics.NewMetrics()
+	s := smf.NewSmf(netip.MustParseAddr("127.0.0.1"), nil, nil, nil, nil, m, nil)
+	amf := NewAmf(netip.MustParseAddrPort("127.0.0.1:0"), testControlURI(t, "http://127.0.0.1:8000"), "test", &config.Timers{}, s, m)
+	if err := amf.InitContext(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	return amf
+}
+
+// Sets the handover and the state of the UE, as if a procedure had been running
+func setUeContext(amf *Amf, ue jsonapi.ControlURI, state UeState, ho *handover) {
+	c := amf.ues.acquire(ue)
+	defer amf.ues.release(c)
+	c.handover = ho
+	amf.ues.setState(c, state)
+}
+
+func newTestHandover(source jsonapi.ControlURI, target jsonapi.ControlURI) *handover {
+	return &handover{
+		sourceGnb: source,
+		targetGnb: target,
+		sessions:  make(map[sessionKey]*handoverSession),
+		failed:    make([]SessionFailure, 0),
+		timer:     time.NewTimer(time.Hour),
+	}
+}
+
+// Checks the UE context, and returns its handover
+func checkUeContext(t *testing.T, amf *Amf, ue jsonapi.ControlURI, state UeState) *handover {
+	t.Helper()
+	c := amf.ues.acquire(ue)
+	defer amf.ues.release(c)
+	if c.state != state {
+		t.Fatalf("got state %q, want %q", c.state, state)
+	}
+	return c.handover
+}
+
+func TestAcquireSerializesProcedures(t *testing.T) {
+	amf := newTestAmf(t)
+	ue := testControlURI(t, "http://192.0.2.6:8080")
+
+	c := amf.ues.acquire(ue)
+	acquired := make(chan *ueContext)
+	go func() {
+		acquired <- amf.ues.acquire(ue)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("context acquired while another procedure is running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	amf.ues.setState(c, UeStateEstablishing)
+	amf.ues.release(c)
+
+	other := <-acquired
+	if other != c {
+		t.Fatal("a new context has been created while another procedure was waiting")
+	}
+	if other.state != UeStateEstablishing {
+		t.Fatalf("got state %q, want %q", other.state, UeStateEstablishing)
+	}
+	// without PDU Session nor procedure in progress, the UE is idle, and its context is forgotten
+	amf.settle(other)
+	amf.ues.release(other)
+	if len(amf.ues.Status()) != 0 {
+		t.Fatalf("idle UE is reported: %v", amf.ues.Status())
+	}
+	amf.ues.Lock()
+	defer amf.ues.Unlock()
+	if _, ok := amf.ues.m[ue.String()]; ok {
+		t.Fatal("context of idle UE has not been forgotten")
+	}
+}
+
+func TestUnexpectedMessagesAreIgnored(t *testing.T) {
+	received := make(chan gnbMessage, 10)
+	source := newTestGnb(t, received)
+	target := newTestGnb(t, received)
+	other := newTestGnb(t, received)
+	ue := testControlURI(t, "http://192.0.2.6:8080")
+
+	tests := []struct {
+		name    string
+		state   UeState
+		handler func(*Amf)
+	}{
+		{
+			name:  "Handover Request Ack without handover",
+			state: UeStateIdle,
+			handler: func(amf *Amf) {
+				amf.HandleHandoverRequestAck(n1n2.HandoverRequestAck{UeCtrl: ue, SourcegNB: source, TargetgNB: target})
+			},
+		},
+		{
+			name:  "Handover Request Ack during handover execution",
+			state: UeStateHandoverExecuting,
+			handler: func(amf *Amf) {
+				amf.HandleHandoverRequestAck(n1n2.HandoverRequestAck{UeCtrl: ue, SourcegNB: source, TargetgNB: target})
+			},
+		},
+		{
+			name:  "Handover Request Ack from another gNB",
+			state: UeStateHandoverPreparing,
+			handler: func(amf *Amf) {
+				amf.HandleHandoverRequestAck(n1n2.HandoverRequestAck{UeCtrl: ue, SourcegNB: source, TargetgNB: other})
+			},
+		},
+		{
+			name:  "Handover Notify during handover preparation",
+			state: UeStateHandoverPreparing,
+			handler: func(amf *Amf) {
+				amf.HandleHandoverNotify(n1n2.HandoverNotify{UeCtrl: ue, SourceGnb: source, TargetGnb: target})
+			},
+		},
+		{
+			name:  "Handover Notify from another gNB",
+			state: UeStateHandoverExecuting,
+			handler: func(amf *Amf) {
+				amf.HandleHandoverNotify(n1n2.HandoverNotify{UeCtrl: ue, SourceGnb: source, TargetGnb: other})
+			},
+		},
+		{
+			name:  "N2 PDU Session Response without establishment",
+			state: UeStateActive,
+			handler: func(amf *Amf) {
+				amf.HandleN2EstablishmentResponse(n1n2.N2PduSessionRespMsg{
+					UeInfo: n1n2.PduSessionEstabAcceptMsg{
+						Header: n1n2.PduSessionEstabReqMsg{Ue: ue, Gnb: target, Dnn: "internet"},
+						Addr:   netip.MustParseAddr("10.0.0.1"),
+					},
+				})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			amf := newTestAmf(t)
+			var ho *handover
+			if tt.state == UeStateHandoverPreparing || tt.state == UeStateHandoverExecuting {
+				ho = newTestHandover(source, target)
+			}
+			setUeContext(amf, ue, tt.state, ho)
+			tt.handler(amf)
+			if got := checkUeContext(t, amf, ue, tt.state); got != ho {
+				t.Fatal("handover in progress has been modified")
+			}
+			if len(received) > 0 {
+				t.Fatalf("unexpected message sent to gNB: %s", (<-received).path)
+			}
+		})
+	}
+}
+
+func TestHandoverRequiredDuringHandover(t *testing.T) {
+	received := make(chan gnbMessage, 10)
+	source := newTestGnb(t, received)
+	target := newTestGnb(t, received)
+	ue := testControlURI(t, "http://192.0.2.6:8080")
+	amf := newTestAmf(t)
+	ho := newTestHandover(source, target)
+	setUeContext(amf, ue, UeStateHandoverPreparing, ho)
+
+	amf.HandleHandoverRequired(n1n2.HandoverRequired{Ue: ue, SourcegNB: source, TargetgNB: target})
+
+	if got := checkUeContext(t, amf, ue, UeStateHandoverPreparing); got != ho {
+		t.Fatal("handover in progress has been modified")
+	}
+	msg := <-received
+	if msg.path != "/ps/handover-preparation-failure" {
+		t.Fatalf("got message %s, want /ps/handover-preparation-failure", msg.path)
+	}
+	var failure HandoverPreparationFailure
+	if err := json.Unmarshal(msg.body, &failure); err != nil {
+		t.Fatal(err)
+	}
+	if failure.Cause != CauseInvalidState {
+		t.Fatalf("got cause %q, want %q", failure.Cause, CauseInvalidState)
+	}
+}
@@ -10,7 +10,9 @@ import (
 	"time"
 
 	"github.com/nextmn/cp-lite/internal/amf"
+	"github.com/nextmn/cp-lite/internal/cdr"
 	"github.com/nextmn/cp-lite/internal/config"
+	"github.com/nextmn/cp-lite/internal/metrics"
 	"github.com/nextmn/cp-lite/internal/smf"
 )
 
@@ -18,14 +20,22 @@ type Setup struct {
 	config *config.CPConfig
 	amf    *amf.Amf
 	smf    *smf.Smf
+	cdrs   *cdr.Recorder
 }
 
 func NewSetup(config *config.CPConfig) *Setup {
-	smf := smf.NewSmf(config.Pfcp, config.Slices, config.Areas)
+	metrics := metrics.NewMetrics()
+	cdrFile := ""
+	if config.Cdr != nil {
+		cdrFile = config.Cdr.File
+	}
+	cdrs := cdr.NewRecorder(cdrFile)
+	smf := smf.NewSmf(config.Pfcp, config.Slices, config.Areas, config.Association, config.Heartbeat, metrics, cdrs)
 	return &Setup{
 		config: config,
-		amf:    amf.NewAmf(config.Control.BindAddr, config.Control.Uri, "go-github-nextmn-cp-lite", smf),
+		amf:    amf.NewAmf(config.Control.BindAddr, config.Control.Uri, "go-github-nextmn-cp-lite", config.Timers, smf, metrics),
 		smf:    smf,
+		cdrs:   cdrs,
 	}
 }
 
@@ -39,10 +49,14 @@ func (s *Setup) waitShutdown(ctx context.Context) {
 }
 
 func (s *Setup) Run(ctx context.Context) error {
+	if err := s.cdrs.Open(); err != nil {
+		return err
+	}
 	defer func() {
 		ctxShutdown, cancel := context.WithTimeout(context.WithoutCancel(ctx), 1*time.Second)
 		defer cancel()
 		s.waitShutdown(ctxShutdown)
+		s.cdrs.Close()
 	}()
 	if err := s.smf.Start(ctx); err != nil {
 		return err
@@ -0,0 +1,107 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+// Package cdr records the usage of PDU Sessions reported by UPFs, as charging-data-record-like entries.
+package cdr
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nextmn/json-api/jsonapi"
+)
+
+// Number of records kept in memory
+const MaxRecords = 1000
+
+// Usage of a PDU Session measured by an UPF, from a PFCP Usage Report
+type Record struct {
+	Ue       jsonapi.ControlURI `json:"ue"`
+	UeIpAddr netip.Addr         `json:"ue-addr"`
+	Dnn      string             `json:"dnn"`
+	Upf      netip.Addr         `json:"upf"`
+	Trigger  []string           `json:"trigger"` // e.g. "periodic", "volume-threshold", "termination"
+	Sequence uint32             `json:"sequence"`
+	Uplink   uint64             `json:"uplink-bytes"`
+	Downlink uint64             `json:"downlink-bytes"`
+	Start    time.Time          `json:"start,omitzero"`
+	Stop     time.Time          `json:"stop,omitzero"`
+}
+
+type Recorder struct {
+	path   string
+	file   *os.File
+	recent []Record // most recent records, oldest first
+	sync.Mutex
+}
+
+// Creates a Recorder; records are appended to the JSON Lines file at path once opened, if path is not empty
+func NewRecorder(path string) *Recorder {
+	return &Recorder{
+		path:   path,
+		recent: make([]Record, 0),
+	}
+}
+
+// Opens the JSON Lines file
+func (r *Recorder) Open() error {
+	if r.path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.file = f
+	return nil
+}
+
+// Closes the JSON Lines file
+func (r *Recorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// Adds a record to the JSON Lines file, and to the most recent records
+func (r *Recorder) Add(record Record) error {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.recent) >= MaxRecords {
+		r.recent = slices.Delete(r.recent, 0, len(r.recent)-MaxRecords+1)
+	}
+	r.recent = append(r.recent, record)
+	if r.file == nil {
+		return nil
+	}
+	return json.NewEncoder(r.file).Encode(record)
+}
+
+// Returns the most recent records, oldest first. If ue is not nil, only records of this UE are returned.
+func (r *Recorder) List(ue *jsonapi.ControlURI) []Record {
+	r.Lock()
+	defer r.Unlock()
+	if ue == nil {
+		return slices.Clone(r.recent)
+	}
+	records := make([]Record, 0)
+	for _, record := range r.recent {
+		if record.Ue.String() == ue.String() {
+			records = append(records, record)
+		}
+	}
+	return records
+}
@@ -0,0 +1,113 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package cdr
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nextmn/json-api/jsonapi"
+)
+
+func testControlURI(t *testing.T, s string) jsonapi.ControlURI {
+	t.Helper()
+	var u jsonapi.ControlURI
+	if err := u.UnmarshalText([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestRecorderFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cdr.jsonl")
+	ue := testControlURI(t, "http://192.0.2.6:8080")
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	records := []Record{
+		{
+			Ue:       ue,
+			UeIpAddr: netip.MustParseAddr("10.0.0.2"),
+			Dnn:      "internet",
+			Upf:      netip.MustParseAddr("127.0.0.4"),
+			Trigger:  []string{"periodic"},
+			Sequence: 1,
+			Uplink:   100,
+			Downlink: 200,
+			Start:    start,
+			Stop:     start.Add(time.Minute),
+		},
+		{
+			Ue:       ue,
+			UeIpAddr: netip.MustParseAddr("10.0.0.2"),
+			Dnn:      "internet",
+			Upf:      netip.MustParseAddr("127.0.0.4"),
+			Trigger:  []string{"termination"},
+			Sequence: 2,
+		},
+	}
+	want := `{"ue":"http://192.0.2.6:8080","ue-addr":"10.0.0.2","dnn":"internet","upf":"127.0.0.4","trigger":["periodic"],"sequence":1,"uplink-bytes":100,"downlink-bytes":200,"start":"2026-01-02T03:04:05Z","stop":"2026-01-02T03:05:05Z"}
+{"ue":"http://192.0.2.6:8080","ue-addr":"10.0.0.2","dnn":"internet","upf":"127.0.0.4","trigger":["termination"],"sequence":2,"uplink-bytes":0,"downlink-bytes":0}
+`
+
+	// records are appended to the file across restarts
+	for _, record := range records {
+		r := NewRecorder(path)
+		if err := r.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Add(record); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRecorderList(t *testing.T) {
+	ue1 := testControlURI(t, "http://192.0.2.6:8080")
+	ue2 := testControlURI(t, "http://192.0.2.7:8080")
+	r := NewRecorder("")
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := range MaxRecords + 2 {
+		ue := ue1
+		if i%2 == 1 {
+			ue = ue2
+		}
+		if err := r.Add(Record{Ue: ue, Sequence: uint32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the most recent records are kept, oldest first
+	all := r.List(nil)
+	if len(all) != MaxRecords {
+		t.Fatalf("got %d records, want %d", len(all), MaxRecords)
+	}
+	if all[0].Sequence != 2 || all[MaxRecords-1].Sequence != MaxRecords+1 {
+		t.Fatalf("got records %d to %d, want 2 to %d", all[0].Sequence, all[MaxRecords-1].Sequence, MaxRecords+1)
+	}
+	ue2Records := r.List(&ue2)
+	if len(ue2Records) != MaxRecords/2 {
+		t.Fatalf("got %d records of the UE, want %d", len(ue2Records), MaxRecords/2)
+	}
+	for _, record := range ue2Records {
+		if record.Ue.String() != ue2.String() {
+			t.Fatalf("got record of UE %s, want %s", record.Ue.String(), ue2.String())
+		}
+	}
+}
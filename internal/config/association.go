@@ -0,0 +1,17 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+package config
+
+import (
+	"net/netip"
+	"time"
+)
+
+type Association struct {
+	Retry          bool          `yaml:"retry"`              // retry PFCP associations in background instead of exiting when an UPF is not available
+	InitialBackoff time.Duration `yaml:"initial-backoff"`    // delay before the first retry, doubled after each failure
+	MaxBackoff     time.Duration `yaml:"max-backoff"`        // maximum delay between two retries
+	Required       []netip.Addr  `yaml:"required,omitempty"` // node IDs of UPFs that must be associated to be ready; all UPFs by default
+}
@@ -28,15 +28,22 @@ func ParseConf(file string) (*CPConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
 	return &conf, nil
 }
 
 type CPConfig struct {
-	Control Control          `yaml:"control"`
-	Pfcp    netip.Addr       `yaml:"pfcp"`
-	Slices  map[string]Slice `yaml:"slices"`
-	Areas   map[string]Area  `yaml:"areas"`
-	Logger  *Logger          `yaml:"logger,omitempty"`
+	Control     Control          `yaml:"control"`
+	Pfcp        netip.Addr       `yaml:"pfcp"`
+	Slices      map[string]Slice `yaml:"slices"`
+	Areas       map[string]Area  `yaml:"areas"`
+	Association *Association     `yaml:"association,omitempty"`
+	Heartbeat   *Heartbeat       `yaml:"heartbeat,omitempty"`
+	Timers      *Timers          `yaml:"timers,omitempty"`
+	Logger      *Logger          `yaml:"logger,omitempty"`
+	Cdr         *Cdr             `yaml:"cdr,omitempty"`
 }
 
 type Control struct {
@@ -45,13 +52,40 @@ type Control struct {
 }
 
 type Slice struct {
-	Pool netip.Prefix `yaml:"pool"`
-	Upfs []Upf        `yaml:"upfs"`
+	Type     PduSessionType `yaml:"pdu-session-type,omitempty"` // default: ipv4
+	Pool     netip.Prefix   `yaml:"pool,omitempty"`             // IPv4 pool, required for ipv4 and ipv4v6 PDU Sessions
+	Gateway  netip.Addr     `yaml:"gateway,omitempty"`          // never allocated to UEs
+	Excluded []netip.Addr   `yaml:"excluded,omitempty"`         // never allocated to UEs
+	Static   []StaticUeAddr `yaml:"static,omitempty"`           // addresses reserved for a given UE
+	Upfs     []Upf          `yaml:"upfs"`
+
+	// IPv6 pool, required for ipv6 and ipv4v6 PDU Sessions: a prefix is allocated to each PDU Session
+	Ipv6Pool         netip.Prefix `yaml:"ipv6-pool,omitempty"`
+	Ipv6PrefixLength int          `yaml:"ipv6-prefix-length,omitempty"` // default: 64
+
+	UeIpAllocation UeIpAllocation `yaml:"ue-ip-allocation,omitempty"` // default: cp
+
+	UeMacs []UeMac `yaml:"ue-macs,omitempty"` // MAC addresses of UEs, for ethernet PDU Sessions
+
+	// when the downlink path is switched during handover,
+	// UPFs send GTP-U End Marker packets on the previous tunnel
+	EndMarker bool `yaml:"end-marker,omitempty"`
+
+	Handover HandoverStrategy `yaml:"handover,omitempty"` // default: forwarding
+
+	Qos   *Qos   `yaml:"qos,omitempty"`   // no QoS rules are pushed to UPFs if nil
+	Usage *Usage `yaml:"usage,omitempty"` // no URR is pushed to UPFs if nil
+}
+
+type StaticUeAddr struct {
+	Ue   jsonapi.ControlURI `yaml:"ue"`
+	Addr netip.Addr         `yaml:"addr"`
 }
 
 type Upf struct {
-	NodeID     netip.Addr  `yaml:"node-id"`
-	Interfaces []Interface `yaml:"interfaces"`
+	NodeID          netip.Addr      `yaml:"node-id"`
+	Interfaces      []Interface     `yaml:"interfaces"`
+	FteidAllocation FteidAllocation `yaml:"fteid-allocation,omitempty"` // default: cp
 }
 
 type Interface struct {
@@ -65,6 +99,6 @@ type Area struct {
 }
 
 type GTPInterface struct {
-	NodeID        netip.Addr `yaml:"node-id"`
-	InterfaceAddr netip.Addr `yaml:"interface-addr"`
+	NodeID        netip.Addr `yaml:"node-id" json:"node-id"`
+	InterfaceAddr netip.Addr `yaml:"interface-addr" json:"interface-addr"`
 }
@@ -0,0 +1,43 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+package config
+
+import (
+	"errors"
+)
+
+var (
+	ErrInvalidControlURI      = errors.New("invalid control URI")
+	ErrDuplicateGnb           = errors.New("gNB declared more than once")
+	ErrUnknownSlice           = errors.New("unknown slice")
+	ErrEmptyPath              = errors.New("empty path")
+	ErrUpfNotInSlice          = errors.New("UPF not declared in slice")
+	ErrInterfaceNotFound      = errors.New("interface not declared on UPF")
+	ErrUnknownInterfaceType   = errors.New("unknown interface type")
+	ErrInvalidPool            = errors.New("invalid UE IP pool")
+	ErrInvalidIpv6Pool        = errors.New("invalid UE IPv6 pool")
+	ErrInvalidPrefixLength    = errors.New("IPv6 prefix length must be between the length of the IPv6 pool and 64")
+	ErrUnknownPduSessionType  = errors.New("unknown PDU Session type")
+	ErrUnexpectedUeMacs       = errors.New("MAC addresses of UEs are only used by ethernet PDU Sessions")
+	ErrDuplicateUeMac         = errors.New("UE with several MAC addresses")
+	ErrMissingUeMacs          = errors.New("ethernet PDU Sessions require MAC addresses of UEs")
+	ErrInvalidMacAddr         = errors.New("MAC address must be a 48-bit address")
+	ErrOverlappingPools       = errors.New("overlapping UE IP pools")
+	ErrUnknownUpf             = errors.New("unknown UPF")
+	ErrUnknownHandover        = errors.New("unknown handover strategy")
+	ErrInvalidQfi             = errors.New("invalid QFI")
+	ErrDuplicateQfi           = errors.New("QFI used by more than one QoS Flow")
+	ErrInvalidPrecedence      = errors.New("precedence of QoS Flow must be lower than 255")
+	ErrMissingSdfFilter       = errors.New("QoS Flow without SDF filter")
+	ErrInvalidSdfFilter       = errors.New("SDF filter must start with \"permit out\"")
+	ErrInvalidGbr             = errors.New("GBR requires a MBR, and must not exceed it")
+	ErrInvalidUsage           = errors.New("usage thresholds and period must be a whole number of seconds")
+	ErrMissingCdrFile         = errors.New("missing CDR file")
+	ErrPfcpAddressFamily      = errors.New("UPF Node ID and PFCP address must be of the same address family")
+	ErrUnknownFteidAllocation = errors.New("unknown F-TEID allocation")
+	ErrUnknownUeIpAllocation  = errors.New("unknown UE IP Address allocation")
+	ErrStaticUeAddr           = errors.New("static UE IP Addresses require UE IP Addresses to be allocated by the CP")
+	ErrUeIpAllocationType     = errors.New("UE IP Addresses can only be allocated by the UPF for ipv4 PDU Sessions")
+)
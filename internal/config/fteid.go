@@ -0,0 +1,18 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+package config
+
+// Allocation of the F-TEIDs on which an UPF receives GTP-U packets of PDU Sessions
+type FteidAllocation string
+
+const (
+	// TEIDs are allocated by the Control Plane on the interface of the path
+	FteidAllocationCp FteidAllocation = "cp"
+	// F-TEIDs are allocated by the UPF (CHOOSE flag), which must support the FTUP feature
+	FteidAllocationUp FteidAllocation = "up"
+)
+
+// F-TEID allocation modes supported by the Control Plane
+var FteidAllocations = []FteidAllocation{FteidAllocationCp, FteidAllocationUp}
@@ -0,0 +1,18 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+package config
+
+// Handling of downlink packets during the handover of a PDU Session
+type HandoverStrategy string
+
+const (
+	// downlink packets are forwarded to the target gNB, directly or indirectly as requested by the source gNB
+	HandoverForwarding HandoverStrategy = "forwarding"
+	// downlink packets are buffered by the UPF-A until the reception of Handover Notify
+	HandoverBuffering HandoverStrategy = "buffering"
+)
+
+// Handover strategies supported by the Control Plane
+var HandoverStrategies = []HandoverStrategy{HandoverForwarding, HandoverBuffering}
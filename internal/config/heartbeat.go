@@ -0,0 +1,12 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+package config
+
+import "time"
+
+type Heartbeat struct {
+	Interval         time.Duration `yaml:"interval"`          // time between two PFCP Heartbeat Requests sent to each UPF
+	FailureThreshold int           `yaml:"failure-threshold"` // number of consecutive failed PFCP Heartbeat Requests before declaring the UPF down
+}
@@ -0,0 +1,58 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+package config
+
+import (
+	"net"
+
+	"github.com/nextmn/json-api/jsonapi"
+)
+
+// Type of the PDU Sessions of a slice
+type PduSessionType string
+
+const (
+	PduSessionTypeIpv4   PduSessionType = "ipv4"   // an IPv4 address per PDU Session
+	PduSessionTypeIpv6   PduSessionType = "ipv6"   // an IPv6 prefix per PDU Session
+	PduSessionTypeIpv4v6 PduSessionType = "ipv4v6" // an IPv4 address and an IPv6 prefix per PDU Session
+
+	// Ethernet frames: PDU Sessions have no UE IP Address, and PDRs match MAC addresses
+	PduSessionTypeEthernet PduSessionType = "ethernet"
+)
+
+// PDU Session types supported by the Control Plane
+var PduSessionTypes = []PduSessionType{PduSessionTypeIpv4, PduSessionTypeIpv6, PduSessionTypeIpv4v6, PduSessionTypeEthernet}
+
+// Length of the IPv6 prefix allocated to each PDU Session, unless configured
+const DefaultIpv6PrefixLength = 64
+
+// MAC address of an UE, matched by PDRs of ethernet PDU Sessions
+type UeMac struct {
+	Ue  jsonapi.ControlURI `yaml:"ue"`
+	Mac MacAddr            `yaml:"mac"`
+}
+
+// MAC address, in the form "00:00:5e:00:53:01"
+type MacAddr net.HardwareAddr
+
+func (m MacAddr) String() string {
+	return net.HardwareAddr(m).String()
+}
+
+func (m MacAddr) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *MacAddr) UnmarshalText(text []byte) error {
+	mac, err := net.ParseMAC(string(text))
+	if err != nil {
+		return err
+	}
+	if len(mac) != 6 {
+		return ErrInvalidMacAddr
+	}
+	*m = MacAddr(mac)
+	return nil
+}
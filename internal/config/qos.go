@@ -0,0 +1,63 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	DefaultQfi           uint8  = 1   // QFI of the default QoS Flow, not available for additional QoS Flows
+	Default5qi           uint8  = 9   // 5QI of the default QoS Flow, unless configured
+	DefaultQosPrecedence uint32 = 128 // precedence of the PDRs of additional QoS Flows, unless configured
+	MaxQfi               uint8  = 63
+)
+
+// QoS of the PDU Sessions of a slice
+type Qos struct {
+	SessionAmbr *BitRate  `yaml:"session-ambr,omitempty" json:"session-ambr,omitempty"` // enforced by the UPF-A
+	Default5qi  uint8     `yaml:"default-5qi,omitempty" json:"default-5qi"`
+	Flows       []QosFlow `yaml:"flows,omitempty" json:"flows,omitempty"` // additional QoS Flows
+}
+
+type QosFlow struct {
+	Qfi        uint8    `yaml:"qfi" json:"qfi"`
+	FiveQi     uint8    `yaml:"5qi" json:"5qi"`
+	Precedence uint32   `yaml:"precedence,omitempty" json:"precedence"` // lower values take priority; the default QoS Flow uses 255
+	Filters    []string `yaml:"filters" json:"filters"`                 // SDF filters, as IPFilterRule (e.g. "permit out udp from 198.51.100.0/24 to assigned")
+	Mbr        *BitRate `yaml:"mbr,omitempty" json:"mbr,omitempty"`
+	Gbr        *BitRate `yaml:"gbr,omitempty" json:"gbr,omitempty"` // requires a MBR
+}
+
+// Bit rates, in kbps
+type BitRate struct {
+	Uplink   uint64 `yaml:"uplink" json:"uplink"`
+	Downlink uint64 `yaml:"downlink" json:"downlink"`
+}
+
+// Checks the QoS Flow is consistent, and returns all problems found
+func (flow QosFlow) validate() []error {
+	errs := make([]error, 0)
+	if flow.Qfi == 0 || flow.Qfi > MaxQfi || flow.Qfi == DefaultQfi {
+		errs = append(errs, ErrInvalidQfi)
+	}
+	if flow.Precedence >= 255 {
+		errs = append(errs, ErrInvalidPrecedence)
+	}
+	if len(flow.Filters) == 0 {
+		errs = append(errs, ErrMissingSdfFilter)
+	}
+	for _, f := range flow.Filters {
+		// downlink packets are classified by the UPF-A
+		if !strings.HasPrefix(f, "permit out ") {
+			errs = append(errs, fmt.Errorf("%w: %q", ErrInvalidSdfFilter, f))
+		}
+	}
+	if flow.Gbr != nil && (flow.Mbr == nil || flow.Gbr.Uplink > flow.Mbr.Uplink || flow.Gbr.Downlink > flow.Mbr.Downlink) {
+		errs = append(errs, ErrInvalidGbr)
+	}
+	return errs
+}
@@ -0,0 +1,13 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+package config
+
+import "time"
+
+type Timers struct {
+	Establishment time.Duration `yaml:"establishment"`  // maximum time to wait for the N2 PDU Session Response of the gNB
+	RelocPrep     time.Duration `yaml:"treloc-prep"`    // TRELOCprep: maximum time to wait for the Handover Request Ack of the target gNB
+	RelocOverall  time.Duration `yaml:"treloc-overall"` // TRELOCoverall: maximum time to wait for the Handover Notify of the target gNB
+}
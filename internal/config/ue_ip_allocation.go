@@ -0,0 +1,18 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+package config
+
+// Allocation of the UE IP Addresses of PDU Sessions of a slice
+type UeIpAllocation string
+
+const (
+	// addresses are allocated by the Control Plane from the pool of the slice
+	UeIpAllocationCp UeIpAllocation = "cp"
+	// addresses are allocated by the anchor UPF (CHV4 flag) from its own pool, which must be the pool of the slice
+	UeIpAllocationUp UeIpAllocation = "up"
+)
+
+// UE IP Address allocation modes supported by the Control Plane
+var UeIpAllocations = []UeIpAllocation{UeIpAllocationCp, UeIpAllocationUp}
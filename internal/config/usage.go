@@ -0,0 +1,20 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+package config
+
+import "time"
+
+// Usage reporting of the PDU Sessions of a slice.
+// UPFs always report usage when the PFCP Session is deleted.
+type Usage struct {
+	VolumeThreshold uint64        `yaml:"volume-threshold,omitempty"` // bytes, uplink and downlink
+	TimeThreshold   time.Duration `yaml:"time-threshold,omitempty"`
+	Period          time.Duration `yaml:"period,omitempty"` // periodic reporting
+}
+
+// Charging-data-record-like entries, built from usage reports
+type Cdr struct {
+	File string `yaml:"file"` // JSON Lines file, entries are appended
+}
@@ -0,0 +1,200 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nextmn/json-api/jsonapi"
+)
+
+// Interface types supported by UPFs
+var InterfaceTypes = []string{"N3", "N9", "N6"}
+
+// Checks the configuration is consistent, and returns all problems found
+func (conf *CPConfig) Validate() error {
+	errs := make([]error, 0)
+	if err := validateControlURI(conf.Control.Uri); err != nil {
+		errs = append(errs, fmt.Errorf("control: %w", err))
+	}
+
+	sliceNames := slices.Sorted(maps.Keys(conf.Slices))
+	upfs := make(map[netip.Addr]struct{})
+	for i, name := range sliceNames {
+		slice := conf.Slices[name]
+		sessionType := slice.Type
+		if sessionType == "" {
+			sessionType = PduSessionTypeIpv4
+		}
+		if !slices.Contains(PduSessionTypes, sessionType) {
+			errs = append(errs, fmt.Errorf("%w: slice %q: %q", ErrUnknownPduSessionType, name, slice.Type))
+		}
+		if (sessionType == PduSessionTypeIpv4 || sessionType == PduSessionTypeIpv4v6) && (!slice.Pool.IsValid() || !slice.Pool.Addr().Is4()) {
+			errs = append(errs, fmt.Errorf("%w: slice %q: an IPv4 pool is required", ErrInvalidPool, name))
+		}
+		if sessionType == PduSessionTypeIpv6 || sessionType == PduSessionTypeIpv4v6 {
+			if !slice.Ipv6Pool.IsValid() || slice.Ipv6Pool.Addr().Is4() {
+				errs = append(errs, fmt.Errorf("%w: slice %q: an IPv6 pool is required", ErrInvalidIpv6Pool, name))
+			} else if l := slice.Ipv6PrefixLength; l != 0 && (l < slice.Ipv6Pool.Bits() || l > 64) {
+				errs = append(errs, fmt.Errorf("%w: slice %q: /%d in %s", ErrInvalidPrefixLength, name, l, slice.Ipv6Pool))
+			} else if l == 0 && slice.Ipv6Pool.Bits() > DefaultIpv6PrefixLength {
+				errs = append(errs, fmt.Errorf("%w: slice %q: /%d in %s", ErrInvalidPrefixLength, name, DefaultIpv6PrefixLength, slice.Ipv6Pool))
+			}
+		}
+		for _, other := range sliceNames[:i] {
+			if pool := conf.Slices[other].Pool; pool.IsValid() && slice.Pool.IsValid() && pool.Overlaps(slice.Pool) {
+				errs = append(errs, fmt.Errorf("%w: slice %q (%s) and slice %q (%s)", ErrOverlappingPools, other, pool, name, slice.Pool))
+			}
+			if pool := conf.Slices[other].Ipv6Pool; pool.IsValid() && slice.Ipv6Pool.IsValid() && pool.Overlaps(slice.Ipv6Pool) {
+				errs = append(errs, fmt.Errorf("%w: slice %q (%s) and slice %q (%s)", ErrOverlappingPools, other, pool, name, slice.Ipv6Pool))
+			}
+		}
+		if slice.UeIpAllocation != "" && !slices.Contains(UeIpAllocations, slice.UeIpAllocation) {
+			errs = append(errs, fmt.Errorf("%w: slice %q: %q", ErrUnknownUeIpAllocation, name, slice.UeIpAllocation))
+		}
+		if slice.UeIpAllocation == UeIpAllocationUp && len(slice.Static) > 0 {
+			errs = append(errs, fmt.Errorf("%w: slice %q", ErrStaticUeAddr, name))
+		}
+		if slice.UeIpAllocation == UeIpAllocationUp && sessionType != PduSessionTypeIpv4 {
+			errs = append(errs, fmt.Errorf("%w: slice %q: %q", ErrUeIpAllocationType, name, sessionType))
+		}
+		if len(slice.UeMacs) > 0 && sessionType != PduSessionTypeEthernet {
+			errs = append(errs, fmt.Errorf("%w: slice %q", ErrUnexpectedUeMacs, name))
+		}
+		if len(slice.UeMacs) == 0 && sessionType == PduSessionTypeEthernet {
+			errs = append(errs, fmt.Errorf("%w: slice %q", ErrMissingUeMacs, name))
+		}
+		ueMacs := make(map[string]struct{}, len(slice.UeMacs))
+		for _, m := range slice.UeMacs {
+			if _, ok := ueMacs[m.Ue.String()]; ok {
+				errs = append(errs, fmt.Errorf("%w: slice %q: %s", ErrDuplicateUeMac, name, m.Ue.String()))
+			}
+			ueMacs[m.Ue.String()] = struct{}{}
+		}
+		if slice.Handover != "" && !slices.Contains(HandoverStrategies, slice.Handover) {
+			errs = append(errs, fmt.Errorf("%w: slice %q: %q", ErrUnknownHandover, name, slice.Handover))
+		}
+		if slice.Qos != nil {
+			qfis := make(map[uint8]struct{})
+			for _, flow := range slice.Qos.Flows {
+				for _, err := range flow.validate() {
+					errs = append(errs, fmt.Errorf("%w: slice %q: QoS Flow %d", err, name, flow.Qfi))
+				}
+				if _, ok := qfis[flow.Qfi]; ok {
+					errs = append(errs, fmt.Errorf("%w: slice %q: QFI %d", ErrDuplicateQfi, name, flow.Qfi))
+				}
+				qfis[flow.Qfi] = struct{}{}
+			}
+		}
+		if slice.Usage != nil {
+			// PFCP expresses durations in seconds
+			for _, d := range []time.Duration{slice.Usage.TimeThreshold, slice.Usage.Period} {
+				if d < 0 || d%time.Second != 0 {
+					errs = append(errs, fmt.Errorf("%w: slice %q: %s", ErrInvalidUsage, name, d))
+				}
+			}
+		}
+		for _, upf := range slice.Upfs {
+			upfs[upf.NodeID] = struct{}{}
+			if upf.FteidAllocation != "" && !slices.Contains(FteidAllocations, upf.FteidAllocation) {
+				errs = append(errs, fmt.Errorf("%w: slice %q: UPF %s: %q", ErrUnknownFteidAllocation, name, upf.NodeID, upf.FteidAllocation))
+			}
+			// a single PFCP socket is used to reach all UPFs
+			if conf.Pfcp.IsValid() && upf.NodeID.Is4() != conf.Pfcp.Is4() {
+				errs = append(errs, fmt.Errorf("%w: slice %q: UPF %s, pfcp %s", ErrPfcpAddressFamily, name, upf.NodeID, conf.Pfcp))
+			}
+			for _, iface := range upf.Interfaces {
+				if !slices.ContainsFunc(InterfaceTypes, func(t string) bool { return strings.EqualFold(t, iface.Type) }) {
+					errs = append(errs, fmt.Errorf("%w: slice %q: UPF %s: interface %s has type %q", ErrUnknownInterfaceType, name, upf.NodeID, iface.Addr, iface.Type))
+				}
+			}
+		}
+	}
+
+	gnbs := make(map[string]string) // gNB control URI: area name
+	for _, name := range slices.Sorted(maps.Keys(conf.Areas)) {
+		area := conf.Areas[name]
+		for _, gnb := range area.Gnbs {
+			if err := validateControlURI(gnb); err != nil {
+				errs = append(errs, fmt.Errorf("area %q: gNB %q: %w", name, gnb.String(), err))
+			}
+			if other, ok := gnbs[gnb.String()]; ok {
+				errs = append(errs, fmt.Errorf("%w: gNB %q in area %q and area %q", ErrDuplicateGnb, gnb.String(), other, name))
+				continue
+			}
+			gnbs[gnb.String()] = name
+		}
+		for _, sliceName := range slices.Sorted(maps.Keys(area.Paths)) {
+			slice, ok := conf.Slices[sliceName]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%w: area %q: path for slice %q", ErrUnknownSlice, name, sliceName))
+				continue
+			}
+			path := area.Paths[sliceName]
+			if len(path) == 0 {
+				errs = append(errs, fmt.Errorf("%w: area %q: slice %q", ErrEmptyPath, name, sliceName))
+			}
+			for _, hop := range path {
+				if err := slice.checkInterface(hop); err != nil {
+					errs = append(errs, fmt.Errorf("%w: area %q: slice %q: node %s: interface %s", err, name, sliceName, hop.NodeID, hop.InterfaceAddr))
+				}
+			}
+		}
+	}
+
+	if conf.Association != nil {
+		for _, nodeID := range conf.Association.Required {
+			if _, ok := upfs[nodeID]; !ok {
+				errs = append(errs, fmt.Errorf("%w: association: required UPF %s", ErrUnknownUpf, nodeID))
+			}
+		}
+	}
+	if conf.Cdr != nil && conf.Cdr.File == "" {
+		errs = append(errs, ErrMissingCdrFile)
+	}
+	return errors.Join(errs...)
+}
+
+// Checks the GTP interface is declared on an UPF of the slice
+func (slice Slice) checkInterface(hop GTPInterface) error {
+	i := slices.IndexFunc(slice.Upfs, func(upf Upf) bool { return upf.NodeID == hop.NodeID })
+	if i < 0 {
+		return ErrUpfNotInSlice
+	}
+	if !slices.ContainsFunc(slice.Upfs[i].Interfaces, func(iface Interface) bool { return iface.Addr == hop.InterfaceAddr }) {
+		return ErrInterfaceNotFound
+	}
+	return nil
+}
+
+// Checks the control URI is an http(s) URI with a valid host and port
+func validateControlURI(u jsonapi.ControlURI) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme must be http or https", ErrInvalidControlURI)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("%w: missing host", ErrInvalidControlURI)
+	}
+	// hosts made only of digits and dots are IPv4 addresses (e.g. `192.0.2.4.8080` is a typo for `192.0.2.4:8080`)
+	if strings.Trim(host, "0123456789.") == "" {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return fmt.Errorf("%w: invalid IPv4 address %q", ErrInvalidControlURI, host)
+		}
+	}
+	if port := u.Port(); port != "" {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return fmt.Errorf("%w: invalid port %q", ErrInvalidControlURI, port)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,412 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+package config
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"gopkg.in/yaml.v3"
+)
+
+const sampleConfig = "../../config/config.yaml"
+const sampleSlice = "nextmn-lite"
+
+func TestParseSampleConfig(t *testing.T) {
+	if _, err := ParseConf(sampleConfig); err != nil {
+		t.Fatalf("sample configuration is invalid: %v", err)
+	}
+}
+
+// Returns the sample configuration, without validating it
+func loadSample(t *testing.T) *CPConfig {
+	t.Helper()
+	data, err := os.ReadFile(sampleConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conf CPConfig
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		t.Fatal(err)
+	}
+	return &conf
+}
+
+func controlURI(t *testing.T, s string) jsonapi.ControlURI {
+	t.Helper()
+	u, err := jsonapi.ParseControlURI(s)
+	if err != nil {
+		t.Fatalf("could not parse control URI %q: %v", s, err)
+	}
+	return *u
+}
+
+// Edits the slice of the sample configuration
+func editSlice(conf *CPConfig, edit func(*Slice)) {
+	slice := conf.Slices[sampleSlice]
+	edit(&slice)
+	conf.Slices[sampleSlice] = slice
+}
+
+// Edits the QoS of the slice of the sample configuration, with a single additional QoS Flow
+func editQosFlow(conf *CPConfig, edit func(*QosFlow)) {
+	editSlice(conf, func(s *Slice) {
+		flow := QosFlow{
+			Qfi:     2,
+			FiveQi:  1,
+			Filters: []string{"permit out udp from 198.51.100.0/24 to assigned"},
+		}
+		edit(&flow)
+		s.Qos = &Qos{Flows: []QosFlow{flow}}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*testing.T, *CPConfig)
+		err  error
+	}{
+		{
+			name: "typo in control URI",
+			edit: func(t *testing.T, c *CPConfig) { c.Control.Uri = controlURI(t, "http://192.0.2.4.8080") },
+			err:  ErrInvalidControlURI,
+		},
+		{
+			name: "typo in gNB control URI",
+			edit: func(t *testing.T, c *CPConfig) {
+				area := c.Areas["area1"]
+				area.Gnbs[1] = controlURI(t, "http://192.0.2.4.8080")
+			},
+			err: ErrInvalidControlURI,
+		},
+		{
+			name: "invalid scheme in control URI",
+			edit: func(t *testing.T, c *CPConfig) { c.Control.Uri = controlURI(t, "ftp://192.0.2.3:8080") },
+			err:  ErrInvalidControlURI,
+		},
+		{
+			name: "invalid port in control URI",
+			edit: func(t *testing.T, c *CPConfig) { c.Control.Uri = controlURI(t, "http://192.0.2.3:80800") },
+			err:  ErrInvalidControlURI,
+		},
+		{
+			name: "gNB in two areas",
+			edit: func(t *testing.T, c *CPConfig) {
+				area := c.Areas["area2"]
+				area.Gnbs = append(area.Gnbs, controlURI(t, "http://192.0.2.2:8080"))
+				c.Areas["area2"] = area
+			},
+			err: ErrDuplicateGnb,
+		},
+		{
+			name: "path for an unknown slice",
+			edit: func(t *testing.T, c *CPConfig) {
+				c.Areas["area1"].Paths["unknown"] = c.Areas["area1"].Paths[sampleSlice]
+			},
+			err: ErrUnknownSlice,
+		},
+		{
+			name: "empty path",
+			edit: func(t *testing.T, c *CPConfig) { c.Areas["area1"].Paths[sampleSlice] = nil },
+			err:  ErrEmptyPath,
+		},
+		{
+			name: "path through an UPF not in the slice",
+			edit: func(t *testing.T, c *CPConfig) {
+				c.Areas["area1"].Paths[sampleSlice][0].NodeID = netip.MustParseAddr("203.0.113.9")
+			},
+			err: ErrUpfNotInSlice,
+		},
+		{
+			name: "path through an undeclared interface",
+			edit: func(t *testing.T, c *CPConfig) {
+				c.Areas["area1"].Paths[sampleSlice][0].InterfaceAddr = netip.MustParseAddr("198.51.100.99")
+			},
+			err: ErrInterfaceNotFound,
+		},
+		{
+			name: "unknown interface type",
+			edit: func(t *testing.T, c *CPConfig) {
+				editSlice(c, func(s *Slice) { s.Upfs[0].Interfaces[0].Type = "N4" })
+			},
+			err: ErrUnknownInterfaceType,
+		},
+		{
+			name: "missing IPv4 pool",
+			edit: func(t *testing.T, c *CPConfig) {
+				editSlice(c, func(s *Slice) { s.Pool = netip.Prefix{} })
+			},
+			err: ErrInvalidPool,
+		},
+		{
+			name: "IPv6 pool as IPv4 pool",
+			edit: func(t *testing.T, c *CPConfig) {
+				editSlice(c, func(s *Slice) { s.Pool = netip.MustParsePrefix("fd00::/64") })
+			},
+			err: ErrInvalidPool,
+		},
+		{
+			name: "missing IPv6 pool",
+			edit: func(t *testing.T, c *CPConfig) {
+				editSlice(c, func(s *Slice) { s.Type = PduSessionTypeIpv4v6 })
+			},
+			err: ErrInvalidIpv6Pool,
+		},
+		{
+			name: "IPv6 prefix longer than 64",
+			edit: func(t *testing.T, c *CPConfig) {
+				editSlice(c, func(s *Slice) {
+					s.Type = PduSessionTypeIpv6
+					s.Ipv6Pool = netip.MustParsePrefix("fd00::/56")
+					s.Ipv6PrefixLength = 72
+				})
+			},
+			err: ErrInvalidPrefixLength,
+		},
+		{
+			name: "IPv6 pool smaller than the default prefix",
+			edit: func(t *testing.T, c *CPConfig) {
+				editSlice(c, func(s *Slice) {
+					s.Type = PduSessionTypeIpv6
+					s.Ipv6Pool = netip.MustParsePrefix("fd00::/96")
+				})
+			},
+			err: ErrInvalidPrefixLength,
+		},
+		{
+			name: "unknown PDU Session type",
+			edit: func(t *testing.T, c *CPConfig) {
+				editSlice(c, func(s *Slice) { s.Type = "ipv5" })
+			},
+			err: ErrUnknownPduSessionType,
+		},
+		{
+			name: "MAC addresses for an ipv4 slice",
+			edit: func(t *testing.T, c *CPConfig) {
+				editSlice(c, func(s *Slice) {
+					s.UeMacs = []UeMac{{Ue: controlURI(t, "http://192.0.2.6:8080"), Mac: MacAddr{0x02, 0, 0, 0, 0, 0x06}}}
+				})
+			},
+			err: ErrUnexpectedUeMacs,
+		},
+		{
+			name: "ethernet slice without MAC addresses",
+			edit: func(t *testing.T, c *CPConfig) {
+				editSlice(c, func(s *Slice) { s.Type = PduSessionTypeEthernet })
+			},
+			err: ErrMissingUeMacs,
+		},
+		{
+			name: "UE with two MAC addresses",
+			edit: func(t *testing.T, c *CPConfig) {
+				editSlice(c, func(s *Slice) {
+					s.Type = PduSessionTypeEthernet
+					s.UeMacs = []UeMac{
+						{Ue: controlURI(t, "http://192.0.2.6:8080"), Mac: MacAddr{0x02, 0, 0, 0, 0, 0x06}},
+						{Ue: controlURI(t, "http://192.0.2.6:8080"), Mac: MacAddr{0x02, 0, 0, 0, 0, 0x07}},
+					}
+				})
+			},
+			err: ErrDuplicateUeMac,
+		},
+		{
+			name: "overlapping IPv4 pools",
+			edit: func(t *testing.T, c *CPConfig) {
+				other := c.Slices[sampleSlice]
+				other.Pool = netip.MustParsePrefix("10.0.0.128/25")
+				c.Slices["other"] = other
+			},
+			err: ErrOverlappingPools,
+		},
+		{
+			name: "overlapping IPv6 pools",
+			edit: func(t *testing.T, c *CPConfig) {
+				editSlice(c, func(s *Slice) {
+					s.Type = PduSessionTypeIpv6
+					s.Ipv6Pool = netip.MustParsePrefix("fd00::/56")
+				})
+				other := c.Slices[sampleSlice]
+				other.Pool = netip.MustParsePrefix("10.0.1.0/24")
+				other.Ipv6Pool = netip.MustParsePrefix("fd00::/60")
+				c.Slices["other"] = other
+			},
+			err: ErrOverlappingPools,
+		},
+		{
+			name: "unknown required UPF",
+			edit: func(t *testing.T, c *CPConfig) {
+				c.Association = &Association{Required: []netip.Addr{netip.MustParseAddr("203.0.113.9")}}
+			},
+			err: ErrUnknownUpf,
+		},
+		{
+			name: "unknown handover strategy",
+			edit: func(t *testing.T, c *CPConfig) {
+				editSlice(c, func(s *Slice) { s.Handover = "teleport" })
+			},
+			err: ErrUnknownHandover,
+		},
+		{
+			name: "QFI of the default QoS Flow",
+			edit: func(t *testing.T, c *CPConfig) {
+				editQosFlow(c, func(f *QosFlow) { f.Qfi = DefaultQfi })
+			},
+			err: ErrInvalidQfi,
+		},
+		{
+			name: "QFI too large",
+			edit: func(t *testing.T, c *CPConfig) {
+				editQosFlow(c, func(f *QosFlow) { f.Qfi = MaxQfi + 1 })
+			},
+			err: ErrInvalidQfi,
+		},
+		{
+			name: "duplicate QFI",
+			edit: func(t *testing.T, c *CPConfig) {
+				editQosFlow(c, func(f *QosFlow) {})
+				editSlice(c, func(s *Slice) { s.Qos.Flows = append(s.Qos.Flows, s.Qos.Flows[0]) })
+			},
+			err: ErrDuplicateQfi,
+		},
+		{
+			name: "precedence of the default QoS Flow",
+			edit: func(t *testing.T, c *CPConfig) {
+				editQosFlow(c, func(f *QosFlow) { f.Precedence = 255 })
+			},
+			err: ErrInvalidPrecedence,
+		},
+		{
+			name: "QoS Flow without SDF filter",
+			edit: func(t *testing.T, c *CPConfig) {
+				editQosFlow(c, func(f *QosFlow) { f.Filters = nil })
+			},
+			err: ErrMissingSdfFilter,
+		},
+		{
+			name: "uplink SDF filter",
+			edit: func(t *testing.T, c *CPConfig) {
+				editQosFlow(c, func(f *QosFlow) { f.Filters = []string{"permit in udp from assigned to 198.51.100.0/24"} })
+			},
+			err: ErrInvalidSdfFilter,
+		},
+		{
+			name: "GBR without MBR",
+			edit: func(t *testing.T, c *CPConfig) {
+				editQosFlow(c, func(f *QosFlow) { f.Gbr = &BitRate{Uplink: 500, Downlink: 500} })
+			},
+			err: ErrInvalidGbr,
+		},
+		{
+			name: "GBR above MBR",
+			edit: func(t *testing.T, c *CPConfig) {
+				editQosFlow(c, func(f *QosFlow) {
+					f.Mbr = &BitRate{Uplink: 1000, Downlink: 1000}
+					f.Gbr = &BitRate{Uplink: 500, Downlink: 2000}
+				})
+			},
+			err: ErrInvalidGbr,
+		},
+		{
+			name: "usage period not in seconds",
+			edit: func(t *testing.T, c *CPConfig) {
+				editSlice(c, func(s *Slice) { s.Usage = &Usage{Period: 1500 * time.Millisecond} })
+			},
+			err: ErrInvalidUsage,
+		},
+		{
+			name: "missing CDR file",
+			edit: func(t *testing.T, c *CPConfig) { c.Cdr = &Cdr{} },
+			err:  ErrMissingCdrFile,
+		},
+		{
+			name: "IPv6 PFCP address with IPv4 UPF",
+			edit: func(t *testing.T, c *CPConfig) { c.Pfcp = netip.MustParseAddr("2001:db8::1") },
+			err:  ErrPfcpAddressFamily,
+		},
+		{
+			name: "unknown F-TEID allocation",
+			edit: func(t *testing.T, c *CPConfig) {
+				editSlice(c, func(s *Slice) { s.Upfs[0].FteidAllocation = "random" })
+			},
+			err: ErrUnknownFteidAllocation,
+		},
+		{
+			name: "unknown UE IP Address allocation",
+			edit: func(t *testing.T, c *CPConfig) {
+				editSlice(c, func(s *Slice) { s.UeIpAllocation = "dhcp" })
+			},
+			err: ErrUnknownUeIpAllocation,
+		},
+		{
+			name: "static UE IP Address allocated by the UPF",
+			edit: func(t *testing.T, c *CPConfig) {
+				editSlice(c, func(s *Slice) {
+					s.UeIpAllocation = UeIpAllocationUp
+					s.Static = []StaticUeAddr{{Ue: controlURI(t, "http://192.0.2.6:8080"), Addr: netip.MustParseAddr("10.0.0.10")}}
+				})
+			},
+			err: ErrStaticUeAddr,
+		},
+		{
+			name: "ipv4v6 UE IP Addresses allocated by the UPF",
+			edit: func(t *testing.T, c *CPConfig) {
+				editSlice(c, func(s *Slice) {
+					s.Type = PduSessionTypeIpv4v6
+					s.Ipv6Pool = netip.MustParsePrefix("fd00::/56")
+					s.UeIpAllocation = UeIpAllocationUp
+				})
+			},
+			err: ErrUeIpAllocationType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := loadSample(t)
+			tt.edit(t, conf)
+			if err := conf.Validate(); !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidateReportsAllErrors(t *testing.T) {
+	conf := loadSample(t)
+	conf.Control.Uri = controlURI(t, "http://192.0.2.4.8080")
+	conf.Cdr = &Cdr{}
+	err := conf.Validate()
+	for _, want := range []error{ErrInvalidControlURI, ErrMissingCdrFile} {
+		if !errors.Is(err, want) {
+			t.Errorf("got error %v, want %v", err, want)
+		}
+	}
+}
+
+func TestMacAddr(t *testing.T) {
+	tests := []struct {
+		text string
+		err  error
+	}{
+		{"02:00:00:00:00:06", nil},
+		{"02-00-00-00-00-06", nil},
+		{"02:00:00:00:00:00:00:06", ErrInvalidMacAddr}, // EUI-64
+	}
+	for _, tt := range tests {
+		var mac MacAddr
+		err := yaml.Unmarshal([]byte(tt.text), &mac)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%q: got error %v, want %v", tt.text, err, tt.err)
+		}
+		if err == nil && mac.String() != "02:00:00:00:00:06" {
+			t.Errorf("%q: got %s", tt.text, mac)
+		}
+	}
+}
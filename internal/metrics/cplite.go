@@ -0,0 +1,85 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"time"
+)
+
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Metrics of the Control Plane
+type Metrics struct {
+	*Registry
+
+	Procedures        *CounterVec
+	ProcedureDuration *HistogramVec
+	PfcpRequests      *CounterVec
+}
+
+func NewMetrics() *Metrics {
+	m := Metrics{
+		Registry: NewRegistry(),
+		Procedures: NewCounterVec("cplite_procedures_total",
+			"Number of procedures handled, by procedure and result.",
+			"procedure", "result"),
+		ProcedureDuration: NewHistogramVec("cplite_procedure_duration_seconds",
+			"Duration of procedures, by procedure.",
+			[]float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+			"procedure"),
+		PfcpRequests: NewCounterVec("cplite_pfcp_requests_total",
+			"Number of PFCP requests sent to UPFs, by UPF node ID, request and result.",
+			"node_id", "request", "result"),
+	}
+	m.Register(m.Procedures)
+	m.Register(m.ProcedureDuration)
+	m.Register(m.PfcpRequests)
+	return &m
+}
+
+// Procedure being handled
+type Procedure struct {
+	metrics *Metrics
+	name    string
+	start   time.Time
+	success bool
+}
+
+// Starts measuring a procedure; `End()` must be called once the procedure is over
+func (m *Metrics) StartProcedure(name string) *Procedure {
+	return &Procedure{
+		metrics: m,
+		name:    name,
+		start:   time.Now(),
+	}
+}
+
+// Marks the procedure as successful
+func (p *Procedure) Succeed() {
+	p.success = true
+}
+
+// Records the result and the duration of the procedure
+func (p *Procedure) End() {
+	result := ResultFailure
+	if p.success {
+		result = ResultSuccess
+	}
+	p.metrics.Procedures.Inc(p.name, result)
+	p.metrics.ProcedureDuration.Observe(time.Since(p.start).Seconds(), p.name)
+}
+
+// Records the result of a PFCP request
+func (m *Metrics) PfcpRequest(nodeID string, request string, err error) {
+	result := ResultSuccess
+	if err != nil {
+		result = ResultFailure
+	}
+	m.PfcpRequests.Inc(nodeID, request, result)
+}
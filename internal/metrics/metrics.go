@@ -0,0 +1,235 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+// Package metrics exposes metrics using the Prometheus text-based exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Collector interface {
+	// Writes HELP, TYPE and samples of the metric
+	Collect(w io.Writer)
+}
+
+type Registry struct {
+	collectors []Collector
+	sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make([]Collector, 0),
+	}
+}
+
+func (r *Registry) Register(c Collector) {
+	r.Lock()
+	defer r.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Writes all metrics of the registry
+func (r *Registry) Write(w io.Writer) error {
+	r.RLock()
+	defer r.RUnlock()
+	bw := bufio.NewWriter(w)
+	for _, c := range r.collectors {
+		c.Collect(bw)
+	}
+	return bw.Flush()
+}
+
+// Counter with labels
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64 // formatted labels: value
+	sync.Mutex
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.Lock()
+	defer c.Unlock()
+	c.values[key] += v
+}
+
+func (c *CounterVec) Collect(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatValue(c.values[key]))
+	}
+}
+
+// Histogram with labels
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64 // upper bounds, sorted, without +Inf
+	values  map[string]*histogram
+	sync.Mutex
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative
+	count       uint64
+	sum         float64
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	b := slices.Clone(buckets)
+	slices.Sort(b)
+	return &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: b,
+		values:  make(map[string]*histogram),
+	}
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := formatLabels(h.labels, labelValues)
+	h.Lock()
+	defer h.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{
+			labelValues: slices.Clone(labelValues),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = hist
+	}
+	hist.count += 1
+	hist.sum += v
+	if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.buckets) {
+		hist.counts[i] += 1
+	}
+}
+
+func (h *HistogramVec) Collect(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	labels := append(slices.Clone(h.labels), "le")
+	for _, key := range sortedKeys(h.values) {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, append(slices.Clone(hist.labelValues), formatValue(le))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, append(slices.Clone(hist.labelValues), "+Inf")), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatValue(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, hist.count)
+	}
+}
+
+// Gauge with labels, whose values are computed when metrics are collected
+type GaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func(set func(v float64, labelValues ...string))
+}
+
+func NewGaugeFunc(name string, help string, labels []string, collect func(set func(v float64, labelValues ...string))) *GaugeFunc {
+	return &GaugeFunc{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		collect: collect,
+	}
+}
+
+func (g *GaugeFunc) Collect(w io.Writer) {
+	values := make(map[string]float64)
+	g.collect(func(v float64, labelValues ...string) {
+		values[formatLabels(g.labels, labelValues)] = v
+	})
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, key, formatValue(values[key]))
+	}
+}
+
+func writeHeader(w io.Writer, name string, help string, t string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, t)
+}
+
+// Returns labels in the form `{label1="value1",label2="value2"}`.
+// Missing values are replaced by empty strings.
+func formatLabels(labels []string, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		b.WriteString(l)
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,145 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	tests := []struct {
+		name      string
+		collector func() Collector
+		want      string
+	}{
+		{
+			name: "counter",
+			collector: func() Collector {
+				c := NewCounterVec("requests_total", "Number of requests.", "method", "code")
+				c.Inc("GET", "200")
+				c.Add(2, "GET", "200")
+				c.Inc("POST", "500")
+				return c
+			},
+			want: `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{method="GET",code="200"} 3
+requests_total{method="POST",code="500"} 1
+`,
+		},
+		{
+			name: "counter without samples",
+			collector: func() Collector {
+				return NewCounterVec("requests_total", "Number of requests.", "method")
+			},
+			want: `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+`,
+		},
+		{
+			name: "escaped help and label values, missing label values",
+			collector: func() Collector {
+				c := NewCounterVec("errors_total", "Errors\nby `path\\`.", "path", "reason")
+				c.Inc(`C:\"tmp"` + "\n")
+				return c
+			},
+			want: `# HELP errors_total Errors\nby ` + "`path\\\\`" + `.
+# TYPE errors_total counter
+errors_total{path="C:\\\"tmp\"\n",reason=""} 1
+`,
+		},
+		{
+			name: "histogram",
+			collector: func() Collector {
+				h := NewHistogramVec("duration_seconds", "Duration.", []float64{1, 0.25}, "procedure")
+				h.Observe(0.25, "attach") // upper bounds are inclusive
+				h.Observe(0.5, "attach")
+				h.Observe(2, "attach")
+				return h
+			},
+			want: `# HELP duration_seconds Duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{procedure="attach",le="0.25"} 1
+duration_seconds_bucket{procedure="attach",le="1"} 2
+duration_seconds_bucket{procedure="attach",le="+Inf"} 3
+duration_seconds_sum{procedure="attach"} 2.75
+duration_seconds_count{procedure="attach"} 3
+`,
+		},
+		{
+			name: "gauge",
+			collector: func() Collector {
+				return NewGaugeFunc("pool_size", "Size of pools.", []string{"pool"}, func(set func(float64, ...string)) {
+					set(math.Inf(1), "b")
+					set(254, "a")
+				})
+			},
+			want: `# HELP pool_size Size of pools.
+# TYPE pool_size gauge
+pool_size{pool="a"} 254
+pool_size{pool="b"} +Inf
+`,
+		},
+		{
+			name: "gauge without labels",
+			collector: func() Collector {
+				return NewGaugeFunc("up", "Up.", nil, func(set func(float64, ...string)) { set(1) })
+			},
+			want: `# HELP up Up.
+# TYPE up gauge
+up 1
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry()
+			r.Register(tt.collector())
+			var b strings.Builder
+			if err := r.Write(&b); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != tt.want {
+				t.Fatalf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	p := m.StartProcedure("registration")
+	p.Succeed()
+	p.End()
+	m.StartProcedure("registration").End()
+	m.PfcpRequest("127.0.0.2", "establishment", nil)
+	m.PfcpRequest("127.0.0.2", "establishment", errors.New("timeout"))
+
+	var b strings.Builder
+	if err := m.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	got := b.String()
+	for _, want := range []string{
+		`cplite_procedures_total{procedure="registration",result="failure"} 1` + "\n",
+		`cplite_procedures_total{procedure="registration",result="success"} 1` + "\n",
+		`cplite_procedure_duration_seconds_count{procedure="registration"} 2` + "\n",
+		`cplite_procedure_duration_seconds_bucket{procedure="registration",le="+Inf"} 2` + "\n",
+		`cplite_pfcp_requests_total{node_id="127.0.0.2",request="establishment",result="failure"} 1` + "\n",
+		`cplite_pfcp_requests_total{node_id="127.0.0.2",request="establishment",result="success"} 1` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("missing sample %q in:\n%s", want, got)
+		}
+	}
+	// metrics are written in the order of registration
+	if i, j, k := strings.Index(got, "# TYPE cplite_procedures_total"), strings.Index(got, "# TYPE cplite_procedure_duration_seconds"), strings.Index(got, "# TYPE cplite_pfcp_requests_total"); i < 0 || i > j || j > k {
+		t.Fatalf("metrics are not in the order of registration:\n%s", got)
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package mockupf
+
+import (
+	"errors"
+)
+
+var (
+	ErrUnexpectedMessage = errors.New("unexpected PFCP message")
+	ErrPdrNotFound       = errors.New("PDR not found")
+	ErrFarNotFound       = errors.New("FAR not found")
+	ErrPdrAlreadyExists  = errors.New("PDR already exists")
+	ErrFarAlreadyExists  = errors.New("FAR already exists")
+	ErrQerNotFound       = errors.New("QER not found")
+	ErrQerAlreadyExists  = errors.New("QER already exists")
+	ErrUrrNotFound       = errors.New("URR not found")
+	ErrUrrAlreadyExists  = errors.New("URR already exists")
+	ErrBarNotFound       = errors.New("BAR not found")
+	ErrBarAlreadyExists  = errors.New("BAR already exists")
+	ErrReportRejected    = errors.New("PFCP Session Report Request rejected")
+	ErrChooseNotAllowed  = errors.New("allocation by the UPF is only allowed in Create PDR")
+	ErrNoGtpuAddr        = errors.New("no GTP-U address of the requested address family")
+	ErrNoUeIpPool        = errors.New("no UE IP pool")
+	ErrNoUeIpAvailable   = errors.New("no UE IP Address available in pool")
+)
@@ -0,0 +1,385 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package mockupf
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	pfcp "github.com/nextmn/go-pfcp-networking/pfcp"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+func (upf *MockUpf) handleSessionEstablishmentRequest(ctx context.Context, msg pfcp.ReceivedMessage) (*pfcp.OutcomingMessage, error) {
+	m, ok := msg.Message.(*message.SessionEstablishmentRequest)
+	if !ok {
+		return nil, ErrUnexpectedMessage
+	}
+	reject := func(seid uint64, cause uint8) (*pfcp.OutcomingMessage, error) {
+		logrus.WithFields(logrus.Fields{
+			"cause": cause,
+		}).Info("PFCP Session Establishment Request rejected")
+		return msg.NewResponse(message.NewSessionEstablishmentResponse(0, 0, seid, msg.Sequence(), 0, msg.Entity.NodeID(), ie.NewCause(cause)))
+	}
+	if m.CPFSEID == nil {
+		return reject(0, ie.CauseMandatoryIEMissing)
+	}
+	fseid, err := m.CPFSEID.FSEID()
+	if err != nil {
+		return reject(0, ie.CauseMandatoryIEIncorrect)
+	}
+	if m.NodeID == nil {
+		return reject(fseid.SEID, ie.CauseMandatoryIEMissing)
+	}
+	nodeID, err := m.NodeID.NodeID()
+	if err != nil {
+		return reject(fseid.SEID, ie.CauseMandatoryIEIncorrect)
+	}
+	if _, err := msg.Entity.GetPFCPAssociation(nodeID); err != nil {
+		return reject(fseid.SEID, ie.CauseNoEstablishedPFCPAssociation)
+	}
+
+	s := &session{
+		remoteSeid: fseid.SEID,
+		cpNodeID:   nodeID,
+		pdrs:       make(map[uint16]*Pdr),
+		fars:       make(map[uint32]*Far),
+		qers:       make(map[uint32]*Qer),
+		urrs:       make(map[uint32]*Urr),
+		bars:       make(map[uint8]*Bar),
+	}
+	// a single UE IP Address is allocated to the PFCP Session
+	if slices.ContainsFunc(m.CreatePDR, choosesUeIpAddr) {
+		if s.ueIpAddr, err = upf.ueIps.next(); err != nil {
+			logrus.WithError(err).Info("Could not allocate UE IP Address")
+			return reject(fseid.SEID, ie.CauseNoResourcesAvailable)
+		}
+	}
+	created, err := s.apply(changes{
+		createPdrs: m.CreatePDR,
+		createFars: m.CreateFAR,
+		createQers: m.CreateQER,
+		createUrrs: m.CreateURR,
+		createBar:  m.CreateBAR,
+	}, upf.allocateFteid)
+	if err != nil {
+		upf.ueIps.release(s.ueIpAddr)
+		logrus.WithError(err).Info("Could not create rules")
+		return reject(fseid.SEID, ie.CauseRuleCreationModificationFailure)
+	}
+
+	upf.Lock()
+	upf.lastSeid += 1
+	seid := upf.lastSeid
+	upf.sessions[seid] = s
+	upf.Unlock()
+
+	var localFseid *ie.IE
+	if upf.pfcpAddr.Is4() {
+		localFseid = ie.NewFSEID(seid, upf.pfcpAddr.AsSlice(), nil)
+	} else {
+		localFseid = ie.NewFSEID(seid, nil, upf.pfcpAddr.AsSlice())
+	}
+	logrus.WithFields(logrus.Fields{
+		"local-seid":  seid,
+		"remote-seid": fseid.SEID,
+		"pdrs":        len(s.pdrs),
+		"fars":        len(s.fars),
+	}).Info("PFCP Session established")
+	return msg.NewResponse(message.NewSessionEstablishmentResponse(0, 0, fseid.SEID, msg.Sequence(), 0,
+		append([]*ie.IE{msg.Entity.NodeID(), ie.NewCause(ie.CauseRequestAccepted), localFseid}, created...)...))
+}
+
+func (upf *MockUpf) handleSessionModificationRequest(ctx context.Context, msg pfcp.ReceivedMessage) (*pfcp.OutcomingMessage, error) {
+	m, ok := msg.Message.(*message.SessionModificationRequest)
+	if !ok {
+		return nil, ErrUnexpectedMessage
+	}
+	upf.Lock()
+	defer upf.Unlock()
+	s, ok := upf.sessions[msg.SEID()]
+	if !ok {
+		return msg.NewResponse(message.NewSessionModificationResponse(0, 0, 0, msg.Sequence(), 0, ie.NewCause(ie.CauseSessionContextNotFound)))
+	}
+	previousUeIpAddr := s.ueIpAddr
+	if !s.ueIpAddr.IsValid() && slices.ContainsFunc(m.CreatePDR, choosesUeIpAddr) {
+		addr, err := upf.ueIps.next()
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"local-seid": msg.SEID(),
+			}).Info("Could not allocate UE IP Address")
+			return msg.NewResponse(message.NewSessionModificationResponse(0, 0, s.remoteSeid, msg.Sequence(), 0, ie.NewCause(ie.CauseNoResourcesAvailable)))
+		}
+		s.ueIpAddr = addr
+	}
+	created, err := s.apply(changes{
+		removePdrs: m.RemovePDR,
+		removeFars: m.RemoveFAR,
+		removeQers: m.RemoveQER,
+		removeUrrs: m.RemoveURR,
+		removeBar:  m.RemoveBAR,
+		createPdrs: m.CreatePDR,
+		createFars: m.CreateFAR,
+		createQers: m.CreateQER,
+		createUrrs: m.CreateURR,
+		createBar:  m.CreateBAR,
+		updatePdrs: m.UpdatePDR,
+		updateFars: m.UpdateFAR,
+	}, upf.allocateFteid)
+	if err != nil {
+		if s.ueIpAddr != previousUeIpAddr {
+			upf.ueIps.release(s.ueIpAddr)
+			s.ueIpAddr = previousUeIpAddr
+		}
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"local-seid": msg.SEID(),
+		}).Info("PFCP Session Modification Request rejected")
+		return msg.NewResponse(message.NewSessionModificationResponse(0, 0, s.remoteSeid, msg.Sequence(), 0, ie.NewCause(ie.CauseRuleCreationModificationFailure)))
+	}
+	logrus.WithFields(logrus.Fields{
+		"local-seid": msg.SEID(),
+		"pdrs":       len(s.pdrs),
+		"fars":       len(s.fars),
+	}).Info("PFCP Session modified")
+	return msg.NewResponse(message.NewSessionModificationResponse(0, 0, s.remoteSeid, msg.Sequence(), 0,
+		append([]*ie.IE{ie.NewCause(ie.CauseRequestAccepted)}, created...)...))
+}
+
+func (upf *MockUpf) handleSessionDeletionRequest(ctx context.Context, msg pfcp.ReceivedMessage) (*pfcp.OutcomingMessage, error) {
+	if _, ok := msg.Message.(*message.SessionDeletionRequest); !ok {
+		return nil, ErrUnexpectedMessage
+	}
+	upf.Lock()
+	defer upf.Unlock()
+	s, ok := upf.sessions[msg.SEID()]
+	if !ok {
+		return msg.NewResponse(message.NewSessionDeletionResponse(0, 0, 0, msg.Sequence(), 0, ie.NewCause(ie.CauseSessionContextNotFound)))
+	}
+	delete(upf.sessions, msg.SEID())
+	upf.ueIps.release(s.ueIpAddr)
+	// final usage of each URR is reported in the response
+	ies := []*ie.IE{ie.NewCause(ie.CauseRequestAccepted)}
+	for _, id := range slices.Sorted(maps.Keys(s.urrs)) {
+		ies = append(ies, ie.NewUsageReportWithinSessionDeletionResponse(s.usageReport(id, time.Now(), TriggerTermr)...))
+	}
+	logrus.WithFields(logrus.Fields{
+		"local-seid": msg.SEID(),
+		"urrs":       len(s.urrs),
+	}).Info("PFCP Session deleted")
+	return msg.NewResponse(message.NewSessionDeletionResponse(0, 0, s.remoteSeid, msg.Sequence(), 0, ies...))
+}
+
+// Rules of a PFCP Session Establishment/Modification Request
+type changes struct {
+	removePdrs, removeFars, removeQers, removeUrrs []*ie.IE
+	removeBar                                      *ie.IE
+	createPdrs, createFars, createQers, createUrrs []*ie.IE
+	createBar                                      *ie.IE
+	updatePdrs, updateFars                         []*ie.IE
+}
+
+// Applies rules to the session. Either all rules are applied, or none.
+// F-TEIDs requested with the CHOOSE flag are allocated with allocate; Create PDRs with the same CHOOSE ID share the same F-TEID.
+// UE IP Addresses requested with the CHV4 flag are the UE IP Address of the session.
+// Allocated values are returned as Created PDR IEs.
+func (s *session) apply(c changes, allocate func(v4 bool) (*jsonapi.Fteid, error)) ([]*ie.IE, error) {
+	chosen := make(map[uint8]*jsonapi.Fteid)
+	chooseFteid := func(f *ie.FTEIDFields) (*jsonapi.Fteid, error) {
+		if fteid, ok := chosen[f.ChooseID]; ok && f.HasChID() {
+			return fteid, nil
+		}
+		fteid, err := allocate(f.HasIPv4())
+		if err != nil {
+			return nil, err
+		}
+		if f.HasChID() {
+			chosen[f.ChooseID] = fteid
+		}
+		return fteid, nil
+	}
+	choose := &chooser{fteid: chooseFteid, ueIpAddr: s.ueIpAddr}
+	created := make([]*ie.IE, 0)
+	pdrs := maps.Clone(s.pdrs)
+	fars := maps.Clone(s.fars)
+	qers := maps.Clone(s.qers)
+	urrs := maps.Clone(s.urrs)
+	bars := maps.Clone(s.bars)
+	for _, i := range c.removePdrs {
+		id, err := i.PDRID()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := pdrs[id]; !ok {
+			return nil, ErrPdrNotFound
+		}
+		delete(pdrs, id)
+	}
+	for _, i := range c.removeFars {
+		id, err := i.FARID()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := fars[id]; !ok {
+			return nil, ErrFarNotFound
+		}
+		delete(fars, id)
+	}
+	for _, i := range c.removeQers {
+		id, err := i.QERID()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := qers[id]; !ok {
+			return nil, ErrQerNotFound
+		}
+		delete(qers, id)
+	}
+	for _, i := range c.removeUrrs {
+		id, err := i.URRID()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := urrs[id]; !ok {
+			return nil, ErrUrrNotFound
+		}
+		delete(urrs, id)
+	}
+	if c.removeBar != nil {
+		id, err := c.removeBar.BARID()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := bars[id]; !ok {
+			return nil, ErrBarNotFound
+		}
+		delete(bars, id)
+	}
+	for _, i := range c.createPdrs {
+		pdr := &Pdr{}
+		if err := pdr.apply(i, choose); err != nil {
+			return nil, err
+		}
+		if _, ok := pdrs[pdr.ID]; ok {
+			return nil, ErrPdrAlreadyExists
+		}
+		pdrs[pdr.ID] = pdr
+		ies := make([]*ie.IE, 0, 2)
+		if choosesFteid(i) {
+			ies = append(ies, newFteid(pdr.Fteid))
+		}
+		if choosesUeIpAddr(i) {
+			ies = append(ies, ie.NewUEIPAddress(0x02, pdr.UeIpAddr.String(), "", 0, 0))
+		}
+		if len(ies) > 0 {
+			created = append(created, ie.NewCreatedPDR(append([]*ie.IE{ie.NewPDRID(pdr.ID)}, ies...)...))
+		}
+	}
+	for _, i := range c.createFars {
+		far := &Far{}
+		if err := far.apply(i); err != nil {
+			return nil, err
+		}
+		if _, ok := fars[far.ID]; ok {
+			return nil, ErrFarAlreadyExists
+		}
+		fars[far.ID] = far
+	}
+	for _, i := range c.createQers {
+		qer := &Qer{}
+		if err := qer.apply(i); err != nil {
+			return nil, err
+		}
+		if _, ok := qers[qer.ID]; ok {
+			return nil, ErrQerAlreadyExists
+		}
+		qers[qer.ID] = qer
+	}
+	for _, i := range c.createUrrs {
+		urr := &Urr{}
+		if err := urr.apply(i); err != nil {
+			return nil, err
+		}
+		if _, ok := urrs[urr.ID]; ok {
+			return nil, ErrUrrAlreadyExists
+		}
+		urrs[urr.ID] = urr
+	}
+	if c.createBar != nil {
+		id, err := c.createBar.BARID()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := bars[id]; ok {
+			return nil, ErrBarAlreadyExists
+		}
+		bars[id] = &Bar{ID: id}
+	}
+	for _, i := range c.updatePdrs {
+		id, err := i.PDRID()
+		if err != nil {
+			return nil, err
+		}
+		old, ok := pdrs[id]
+		if !ok {
+			return nil, ErrPdrNotFound
+		}
+		pdr := *old
+		if err := pdr.apply(i, nil); err != nil {
+			return nil, err
+		}
+		pdrs[id] = &pdr
+	}
+	for _, i := range c.updateFars {
+		id, err := i.FARID()
+		if err != nil {
+			return nil, err
+		}
+		old, ok := fars[id]
+		if !ok {
+			return nil, ErrFarNotFound
+		}
+		far := *old
+		if err := far.apply(i); err != nil {
+			return nil, err
+		}
+		fars[id] = &far
+	}
+	// each PDR must be associated with an existing FAR, and existing QERs and URRs
+	for _, pdr := range pdrs {
+		if _, ok := fars[pdr.FarID]; !ok {
+			return nil, ErrFarNotFound
+		}
+		for _, id := range pdr.QerIDs {
+			if _, ok := qers[id]; !ok {
+				return nil, ErrQerNotFound
+			}
+		}
+		for _, id := range pdr.UrrIDs {
+			if _, ok := urrs[id]; !ok {
+				return nil, ErrUrrNotFound
+			}
+		}
+	}
+	// each FAR buffering packets must be associated with an existing BAR
+	for _, far := range fars {
+		if _, ok := bars[far.BarID]; slices.Contains(far.ApplyAction, "BUFF") && !ok {
+			return nil, ErrBarNotFound
+		}
+	}
+	s.pdrs = pdrs
+	s.fars = fars
+	s.qers = qers
+	s.urrs = urrs
+	s.bars = bars
+	return created, nil
+}
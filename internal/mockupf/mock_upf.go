@@ -0,0 +1,339 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+// Package mockupf provides an UPF that speaks PFCP, but does not forward any packet.
+// Rules received from the Control Plane are exposed over HTTP/JSON.
+package mockupf
+
+import (
+	"cmp"
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nextmn/cp-lite/internal/common"
+
+	pfcp "github.com/nextmn/go-pfcp-networking/pfcp"
+	"github.com/nextmn/go-pfcp-networking/pfcputil"
+	"github.com/nextmn/json-api/healthcheck"
+	"github.com/nextmn/json-api/jsonapi"
+	"github.com/nextmn/logrus-formatter/ginlogger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+// PFCP Session, as seen by the UPF
+type Session struct {
+	LocalSeid  uint64     `json:"local-seid"`
+	RemoteSeid uint64     `json:"remote-seid"`
+	UeIpAddr   netip.Addr `json:"ue-addr,omitzero"` // allocated by the UPF
+	Pdrs       []Pdr      `json:"pdrs"`             // sorted by PDR ID
+	Fars       []Far      `json:"fars"`             // sorted by FAR ID
+	Qers       []Qer      `json:"qers"`             // sorted by QER ID
+	Urrs       []Urr      `json:"urrs"`             // sorted by URR ID
+	Bars       []Bar      `json:"bars"`             // sorted by BAR ID
+}
+
+type session struct {
+	remoteSeid uint64
+	cpNodeID   string     // Node ID of the Control Plane, used to send Session Report Requests
+	ueIpAddr   netip.Addr // UE IP Address allocated by the UPF, if any
+	pdrs       map[uint16]*Pdr
+	fars       map[uint32]*Far
+	qers       map[uint32]*Qer
+	urrs       map[uint32]*Urr
+	bars       map[uint8]*Bar
+}
+
+type MockUpf struct {
+	common.WithContext
+
+	pfcpAddr  netip.Addr
+	gtpuAddrs []netip.Addr // addresses of F-TEIDs allocated by the UPF
+	lastTeid  atomic.Uint32
+	ueIps     *ueIpPool // nil if UE IP Addresses cannot be allocated by the UPF
+	pfcpSrv   *pfcp.PFCPEntityUP
+	httpSrv   *http.Server
+	closed    chan struct{}
+
+	sessions map[uint64]*session // local SEID: session
+	lastSeid uint64
+	sync.RWMutex
+}
+
+// If ueIpPool is valid, the UPF allocates UE IP Addresses from it
+func NewMockUpf(pfcpAddr netip.Addr, gtpuAddrs []netip.Addr, ueIpPool netip.Prefix, httpAddr netip.AddrPort) *MockUpf {
+	upf := MockUpf{
+		pfcpAddr:  pfcpAddr,
+		gtpuAddrs: gtpuAddrs,
+		pfcpSrv:   pfcp.NewPFCPEntityUP(pfcpAddr.String(), pfcpAddr),
+		closed:    make(chan struct{}),
+		sessions:  make(map[uint64]*session),
+	}
+	if ueIpPool.IsValid() {
+		upf.ueIps = newUeIpPool(ueIpPool)
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	r := ginlogger.Default()
+	r.GET("/status", Status)
+	r.GET("/sessions", upf.GetSessions)
+	r.GET("/sessions/:seid", upf.GetSession)
+	r.POST("/sessions/:seid/downlink-data", upf.DownlinkData)
+	r.POST("/sessions/:seid/traffic", upf.Traffic)
+	upf.httpSrv = &http.Server{
+		Addr:    httpAddr.String(),
+		Handler: r,
+	}
+	return &upf
+}
+
+func (upf *MockUpf) Start(ctx context.Context) error {
+	if err := upf.InitContext(ctx); err != nil {
+		return err
+	}
+	// go-pfcp-networking's default handlers are not able to remove rules nor to delete sessions
+	if err := upf.pfcpSrv.AddHandlers(map[pfcputil.MessageType]pfcp.PFCPMessageHandler{
+		message.MsgTypeSessionEstablishmentRequest: upf.handleSessionEstablishmentRequest,
+		message.MsgTypeSessionModificationRequest:  upf.handleSessionModificationRequest,
+		message.MsgTypeSessionDeletionRequest:      upf.handleSessionDeletionRequest,
+	}); err != nil {
+		return err
+	}
+	logrus.Info("Starting PFCP Server")
+	pfcpClosed := make(chan struct{})
+	go func() {
+		defer close(pfcpClosed)
+		if err := upf.pfcpSrv.ListenAndServeContext(ctx); err != nil {
+			logrus.WithError(err).Info("PFCP server stopped")
+		}
+	}()
+	ctxTimeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := upf.pfcpSrv.WaitReady(ctxTimeout); err != nil {
+		return err
+	}
+	go upf.reportUsage(ctx)
+
+	l, err := net.Listen("tcp", upf.httpSrv.Addr)
+	if err != nil {
+		return err
+	}
+	go func(ln net.Listener) {
+		logrus.Info("Starting HTTP Server")
+		if err := upf.httpSrv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logrus.WithError(err).Error("Http Server error")
+		}
+	}(l)
+	go func(ctx context.Context) {
+		defer close(upf.closed)
+		<-ctx.Done()
+		ctxShutdown, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := upf.httpSrv.Shutdown(ctxShutdown); err == nil {
+			logrus.Info("HTTP Server Shutdown")
+		}
+		<-pfcpClosed
+	}(ctx)
+	return nil
+}
+
+func (upf *MockUpf) WaitShutdown(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-upf.closed:
+		return nil
+	}
+}
+
+func (upf *MockUpf) Run(ctx context.Context) error {
+	defer func() {
+		ctxShutdown, cancel := context.WithTimeout(context.WithoutCancel(ctx), 1*time.Second)
+		defer cancel()
+		upf.WaitShutdown(ctxShutdown)
+	}()
+	if err := upf.Start(ctx); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// Allocates a F-TEID on the first GTP-U address of the requested address family
+func (upf *MockUpf) allocateFteid(v4 bool) (*jsonapi.Fteid, error) {
+	i := slices.IndexFunc(upf.gtpuAddrs, func(addr netip.Addr) bool { return addr.Is4() == v4 })
+	if i < 0 {
+		return nil, ErrNoGtpuAddr
+	}
+	return &jsonapi.Fteid{Addr: upf.gtpuAddrs[i], Teid: upf.lastTeid.Add(1)}, nil
+}
+
+// Returns a copy of the session, caller must hold the lock
+func (s *session) view(localSeid uint64) Session {
+	r := Session{
+		LocalSeid:  localSeid,
+		RemoteSeid: s.remoteSeid,
+		UeIpAddr:   s.ueIpAddr,
+		Pdrs:       make([]Pdr, 0, len(s.pdrs)),
+		Fars:       make([]Far, 0, len(s.fars)),
+		Qers:       make([]Qer, 0, len(s.qers)),
+		Urrs:       make([]Urr, 0, len(s.urrs)),
+		Bars:       make([]Bar, 0, len(s.bars)),
+	}
+	for _, pdr := range s.pdrs {
+		r.Pdrs = append(r.Pdrs, *pdr)
+	}
+	for _, far := range s.fars {
+		r.Fars = append(r.Fars, *far)
+	}
+	for _, qer := range s.qers {
+		r.Qers = append(r.Qers, *qer)
+	}
+	for _, urr := range s.urrs {
+		r.Urrs = append(r.Urrs, *urr)
+	}
+	for _, bar := range s.bars {
+		r.Bars = append(r.Bars, *bar)
+	}
+	slices.SortFunc(r.Pdrs, func(a, b Pdr) int { return cmp.Compare(a.ID, b.ID) })
+	slices.SortFunc(r.Fars, func(a, b Far) int { return cmp.Compare(a.ID, b.ID) })
+	slices.SortFunc(r.Qers, func(a, b Qer) int { return cmp.Compare(a.ID, b.ID) })
+	slices.SortFunc(r.Urrs, func(a, b Urr) int { return cmp.Compare(a.ID, b.ID) })
+	slices.SortFunc(r.Bars, func(a, b Bar) int { return cmp.Compare(a.ID, b.ID) })
+	return r
+}
+
+// Returns a copy of PFCP Sessions, sorted by local SEID
+func (upf *MockUpf) Sessions() []Session {
+	upf.RLock()
+	defer upf.RUnlock()
+	r := make([]Session, 0, len(upf.sessions))
+	for seid, s := range upf.sessions {
+		r = append(r, s.view(seid))
+	}
+	slices.SortFunc(r, func(a, b Session) int { return cmp.Compare(a.LocalSeid, b.LocalSeid) })
+	return r
+}
+
+// List PFCP Sessions
+func (upf *MockUpf) GetSessions(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	c.JSON(http.StatusOK, upf.Sessions())
+}
+
+// Get a PFCP Session by its local SEID
+func (upf *MockUpf) GetSession(c *gin.Context) {
+	seid, err := strconv.ParseUint(c.Param("seid"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "could not parse SEID", Error: err})
+		return
+	}
+	upf.RLock()
+	defer upf.RUnlock()
+	s, ok := upf.sessions[seid]
+	if !ok {
+		c.JSON(http.StatusNotFound, jsonapi.Message{Message: "PFCP Session not found"})
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.JSON(http.StatusOK, s.view(seid))
+}
+
+// Simulates the arrival of a downlink packet on a PFCP Session.
+// The packet is buffered by FARs with the BUFF apply action; if the FAR also has the NOCP apply action,
+// the arrival of the first buffered packet is reported to the Control Plane with a Downlink Data Report.
+func (upf *MockUpf) DownlinkData(c *gin.Context) {
+	seid, err := strconv.ParseUint(c.Param("seid"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "could not parse SEID", Error: err})
+		return
+	}
+	upf.Lock()
+	s, ok := upf.sessions[seid]
+	if !ok {
+		upf.Unlock()
+		c.JSON(http.StatusNotFound, jsonapi.Message{Message: "PFCP Session not found"})
+		return
+	}
+	reports := make([]*ie.IE, 0)
+	for _, pdr := range s.pdrs {
+		if pdr.SourceInterface != "core" {
+			continue
+		}
+		far, ok := s.fars[pdr.FarID]
+		if !ok || !slices.Contains(far.ApplyAction, "BUFF") {
+			continue
+		}
+		// FARs are replaced, not modified, when rules are applied
+		buffering := *far
+		buffering.Buffered += 1
+		s.fars[pdr.FarID] = &buffering
+		if buffering.Buffered == 1 && slices.Contains(far.ApplyAction, "NOCP") {
+			reports = append(reports, ie.NewPDRID(pdr.ID))
+		}
+	}
+	remoteSeid := s.remoteSeid
+	cpNodeID := s.cpNodeID
+	upf.Unlock()
+
+	if len(reports) == 0 {
+		c.JSON(http.StatusOK, jsonapi.Message{Message: "no Downlink Data Report sent"})
+		return
+	}
+	if err := upf.sendReport(cpNodeID, remoteSeid,
+		ie.NewReportType(0, 0, 0, 1),
+		ie.NewDownlinkDataReport(reports...),
+	); err != nil {
+		c.JSON(http.StatusBadGateway, jsonapi.MessageWithError{Message: "could not send Downlink Data Report", Error: err})
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"local-seid": seid,
+		"pdrs":       len(reports),
+	}).Info("Downlink Data Report sent")
+	c.JSON(http.StatusOK, jsonapi.Message{Message: "Downlink Data Report sent"})
+}
+
+// Sends a PFCP Session Report Request to the Control Plane
+func (upf *MockUpf) sendReport(cpNodeID string, remoteSeid uint64, ies ...*ie.IE) error {
+	association, err := upf.pfcpSrv.GetPFCPAssociation(cpNodeID)
+	if err != nil {
+		return err
+	}
+	resp, err := association.Send(message.NewSessionReportRequest(0, 0, remoteSeid, 0, 0, ies...))
+	if err != nil {
+		return err
+	}
+	srr, ok := resp.(*message.SessionReportResponse)
+	if !ok {
+		return ErrUnexpectedMessage
+	}
+	if srr.Cause == nil {
+		return ErrReportRejected
+	}
+	if cause, err := srr.Cause.Cause(); err != nil || cause != ie.CauseRequestAccepted {
+		return ErrReportRejected
+	}
+	return nil
+}
+
+// get status of the mock UPF
+func Status(c *gin.Context) {
+	status := healthcheck.Status{
+		Ready: true,
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.JSON(http.StatusOK, status)
+}
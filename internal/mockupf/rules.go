@@ -0,0 +1,452 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package mockupf
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+type Pdr struct {
+	ID                 uint16         `json:"id"`
+	Precedence         uint32         `json:"precedence"`
+	SourceInterface    string         `json:"source-interface,omitempty"`
+	Fteid              *jsonapi.Fteid `json:"fteid,omitempty"`
+	NetworkInstance    string         `json:"network-instance,omitempty"`
+	UeIpAddr           netip.Addr     `json:"ue-addr,omitzero"`
+	UeIpv6Prefix       netip.Prefix   `json:"ue-ipv6-prefix,omitzero"`
+	Ethernet           bool           `json:"ethernet,omitempty"` // Ethernet PDU Session
+	SourceMac          string         `json:"source-mac,omitempty"`
+	DestinationMac     string         `json:"destination-mac,omitempty"`
+	Qfi                uint8          `json:"qfi,omitempty"`
+	SdfFilters         []string       `json:"sdf-filters,omitempty"`
+	OuterHeaderRemoval bool           `json:"outer-header-removal"`
+	FarID              uint32         `json:"far-id"`
+	QerIDs             []uint32       `json:"qer-ids,omitempty"`
+	UrrIDs             []uint32       `json:"urr-ids,omitempty"`
+}
+
+type Far struct {
+	ID                   uint32         `json:"id"`
+	ApplyAction          []string       `json:"apply-action"`
+	DestinationInterface string         `json:"destination-interface,omitempty"`
+	NetworkInstance      string         `json:"network-instance,omitempty"`
+	OuterHeaderCreation  *jsonapi.Fteid `json:"outer-header-creation,omitempty"`
+	EndMarkers           int            `json:"end-markers"` // number of updates requesting End Marker packets on the previous tunnel
+	Ethernet             bool           `json:"ethernet,omitempty"`
+	BarID                uint8          `json:"bar-id,omitempty"`
+	Buffered             int            `json:"buffered"` // number of downlink packets buffered since the FAR started buffering
+}
+
+type Qer struct {
+	ID  uint32   `json:"id"`
+	Qfi uint8    `json:"qfi,omitempty"`
+	Mbr *BitRate `json:"mbr,omitempty"`
+	Gbr *BitRate `json:"gbr,omitempty"`
+}
+
+// Bit rates, in kbps
+type BitRate struct {
+	Uplink   uint64 `json:"uplink"`
+	Downlink uint64 `json:"downlink"`
+}
+
+type Urr struct {
+	ID              uint32        `json:"id"`
+	Triggers        []string      `json:"reporting-triggers"`
+	VolumeThreshold uint64        `json:"volume-threshold,omitempty"` // bytes
+	TimeThreshold   time.Duration `json:"time-threshold,omitempty"`
+	Period          time.Duration `json:"period,omitempty"`
+	Sequence        uint32        `json:"sequence"` // number of Usage Reports sent
+	Start           time.Time     `json:"start"`    // start of the current measurement
+	Uplink          uint64        `json:"uplink-bytes"`
+	Downlink        uint64        `json:"downlink-bytes"`
+}
+
+type Bar struct {
+	ID uint8 `json:"id"`
+}
+
+// Allocation of the values requested by the Control Plane with CHOOSE flags
+type chooser struct {
+	fteid    func(f *ie.FTEIDFields) (*jsonapi.Fteid, error) // F-TEID for a F-TEID IE with the CHOOSE flag
+	ueIpAddr netip.Addr                                      // UE IP Address of the PFCP Session, for UE IP Address IEs with the CHV4 flag
+}
+
+// Creates or updates a PDR from a Create PDR or an Update PDR IE.
+// Only IEs present in the Update PDR are modified.
+// F-TEIDs and UE IP Addresses with CHOOSE flags are allocated with choose; they are rejected if choose is nil.
+func (pdr *Pdr) apply(i *ie.IE, choose *chooser) error {
+	id, err := i.PDRID()
+	if err != nil {
+		return err
+	}
+	pdr.ID = id
+	if slices.ContainsFunc(i.ChildIEs, func(child *ie.IE) bool { return child.Type == ie.QERID }) {
+		// QER IDs are replaced as a whole
+		pdr.QerIDs = nil
+	}
+	if slices.ContainsFunc(i.ChildIEs, func(child *ie.IE) bool { return child.Type == ie.URRID }) {
+		// URR IDs are replaced as a whole
+		pdr.UrrIDs = nil
+	}
+	for _, child := range i.ChildIEs {
+		switch child.Type {
+		case ie.Precedence:
+			if pdr.Precedence, err = child.Precedence(); err != nil {
+				return err
+			}
+		case ie.OuterHeaderRemoval:
+			pdr.OuterHeaderRemoval = true
+		case ie.FARID:
+			if pdr.FarID, err = child.FARID(); err != nil {
+				return err
+			}
+		case ie.QERID:
+			qer, err := child.QERID()
+			if err != nil {
+				return err
+			}
+			pdr.QerIDs = append(pdr.QerIDs, qer)
+		case ie.URRID:
+			urr, err := child.URRID()
+			if err != nil {
+				return err
+			}
+			pdr.UrrIDs = append(pdr.UrrIDs, urr)
+		case ie.PDI:
+			if err := pdr.applyPdi(child, choose); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PDI is always replaced as a whole
+func (pdr *Pdr) applyPdi(pdi *ie.IE, choose *chooser) error {
+	pdr.SourceInterface = ""
+	pdr.Fteid = nil
+	pdr.NetworkInstance = ""
+	pdr.UeIpAddr = netip.Addr{}
+	pdr.UeIpv6Prefix = netip.Prefix{}
+	pdr.Ethernet = false
+	pdr.SourceMac = ""
+	pdr.DestinationMac = ""
+	pdr.Qfi = 0
+	pdr.SdfFilters = nil
+	for _, child := range pdi.ChildIEs {
+		switch child.Type {
+		case ie.SourceInterface:
+			src, err := child.SourceInterface()
+			if err != nil {
+				return err
+			}
+			pdr.SourceInterface = interfaceName(src)
+		case ie.FTEID:
+			f, err := child.FTEID()
+			if err != nil {
+				return err
+			}
+			if !f.HasCh() {
+				pdr.Fteid = &jsonapi.Fteid{Addr: transportAddr(f.HasIPv4(), f.IPv4Address, f.IPv6Address), Teid: f.TEID}
+				continue
+			}
+			if choose == nil {
+				return ErrChooseNotAllowed
+			}
+			if pdr.Fteid, err = choose.fteid(f); err != nil {
+				return err
+			}
+		case ie.NetworkInstance:
+			ni, err := child.NetworkInstance()
+			if err != nil {
+				return err
+			}
+			pdr.NetworkInstance = ni
+		case ie.UEIPAddress:
+			if child.HasCHV4() {
+				if choose == nil || !choose.ueIpAddr.IsValid() {
+					return ErrChooseNotAllowed
+				}
+				pdr.UeIpAddr = choose.ueIpAddr
+				continue
+			}
+			ue, err := child.UEIPAddress()
+			if err != nil {
+				return err
+			}
+			pdr.UeIpAddr, _ = netip.AddrFromSlice(ue.IPv4Address.To4())
+			if v6, ok := netip.AddrFromSlice(ue.IPv6Address.To16()); ok {
+				// the prefix is a /64, unless IPv6 prefix delegation bits are present (IPv6D flag)
+				bits := 64
+				if ue.Flags&0x08 != 0 {
+					bits -= int(ue.IPv6PrefixDelegationBits)
+				}
+				pdr.UeIpv6Prefix = netip.PrefixFrom(v6, bits)
+			}
+		case ie.EthernetPDUSessionInformation:
+			pdr.Ethernet = child.HasETHI()
+		case ie.EthernetPacketFilter:
+			filter, err := child.EthernetPacketFilter()
+			if err != nil {
+				return err
+			}
+			for _, f := range filter {
+				if f.Type != ie.MACAddress {
+					continue
+				}
+				mac, err := f.MACAddress()
+				if err != nil {
+					return err
+				}
+				if mac.HasSOUR() {
+					pdr.SourceMac = mac.SourceMACAddress.String()
+				}
+				if mac.HasDEST() {
+					pdr.DestinationMac = mac.DestinationMACAddress.String()
+				}
+			}
+		case ie.QFI:
+			qfi, err := child.QFI()
+			if err != nil {
+				return err
+			}
+			pdr.Qfi = qfi
+		case ie.SDFFilter:
+			f, err := child.SDFFilter()
+			if err != nil {
+				return err
+			}
+			pdr.SdfFilters = append(pdr.SdfFilters, f.FlowDescription)
+		}
+	}
+	return nil
+}
+
+// Creates a QER from a Create QER IE
+func (qer *Qer) apply(i *ie.IE) error {
+	id, err := i.QERID()
+	if err != nil {
+		return err
+	}
+	qer.ID = id
+	for _, child := range i.ChildIEs {
+		switch child.Type {
+		case ie.QFI:
+			if qer.Qfi, err = child.QFI(); err != nil {
+				return err
+			}
+		case ie.MBR:
+			ul, err := child.MBRUL()
+			if err != nil {
+				return err
+			}
+			dl, err := child.MBRDL()
+			if err != nil {
+				return err
+			}
+			qer.Mbr = &BitRate{Uplink: ul, Downlink: dl}
+		case ie.GBR:
+			ul, err := child.GBRUL()
+			if err != nil {
+				return err
+			}
+			dl, err := child.GBRDL()
+			if err != nil {
+				return err
+			}
+			qer.Gbr = &BitRate{Uplink: ul, Downlink: dl}
+		}
+	}
+	return nil
+}
+
+// Creates an URR from a Create URR IE; the measurement starts now
+func (urr *Urr) apply(i *ie.IE) error {
+	id, err := i.URRID()
+	if err != nil {
+		return err
+	}
+	urr.ID = id
+	urr.Start = time.Now()
+	for _, child := range i.ChildIEs {
+		switch child.Type {
+		case ie.ReportingTriggers:
+			urr.Triggers = reportingTriggersNames(child)
+		case ie.VolumeThreshold:
+			v, err := child.VolumeThreshold()
+			if err != nil {
+				return err
+			}
+			urr.VolumeThreshold = v.TotalVolume
+		case ie.TimeThreshold:
+			if urr.TimeThreshold, err = child.TimeThreshold(); err != nil {
+				return err
+			}
+		case ie.MeasurementPeriod:
+			if urr.Period, err = child.MeasurementPeriod(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Creates or updates a FAR from a Create FAR or an Update FAR IE.
+// Only IEs present in the Update FAR are modified.
+func (far *Far) apply(i *ie.IE) error {
+	id, err := i.FARID()
+	if err != nil {
+		return err
+	}
+	far.ID = id
+	for _, child := range i.ChildIEs {
+		switch child.Type {
+		case ie.ApplyAction:
+			far.ApplyAction = applyActionNames(child)
+			if !child.HasBUFF() {
+				// buffered packets are flushed
+				far.Buffered = 0
+			}
+		case ie.ForwardingParameters, ie.UpdateForwardingParameters:
+			if err := far.applyForwardingParameters(child); err != nil {
+				return err
+			}
+		case ie.BARID:
+			bar, err := child.BARID()
+			if err != nil {
+				return err
+			}
+			far.BarID = bar
+		}
+	}
+	return nil
+}
+
+func (far *Far) applyForwardingParameters(params *ie.IE) error {
+	for _, child := range params.ChildIEs {
+		switch child.Type {
+		case ie.DestinationInterface:
+			dst, err := child.DestinationInterface()
+			if err != nil {
+				return err
+			}
+			far.DestinationInterface = interfaceName(dst)
+		case ie.NetworkInstance:
+			ni, err := child.NetworkInstance()
+			if err != nil {
+				return err
+			}
+			far.NetworkInstance = ni
+		case ie.OuterHeaderCreation:
+			ohc, err := child.OuterHeaderCreation()
+			if err != nil {
+				return err
+			}
+			far.OuterHeaderCreation = &jsonapi.Fteid{Addr: transportAddr(ohc.HasIPv4(), ohc.IPv4Address, ohc.IPv6Address), Teid: ohc.TEID}
+		case ie.PFCPSMReqFlags:
+			if child.HasSNDEM() {
+				far.EndMarkers += 1
+			}
+		case ie.EthernetPDUSessionInformation:
+			far.Ethernet = child.HasETHI()
+		}
+	}
+	return nil
+}
+
+func applyActionNames(i *ie.IE) []string {
+	r := make([]string, 0)
+	if i.HasDROP() {
+		r = append(r, "DROP")
+	}
+	if i.HasFORW() {
+		r = append(r, "FORW")
+	}
+	if i.HasBUFF() {
+		r = append(r, "BUFF")
+	}
+	if i.HasNOCP() {
+		r = append(r, "NOCP")
+	}
+	if i.HasDUPL() {
+		r = append(r, "DUPL")
+	}
+	return r
+}
+
+func reportingTriggersNames(i *ie.IE) []string {
+	r := make([]string, 0)
+	if i.HasPERIO() {
+		r = append(r, "PERIO")
+	}
+	if i.HasVOLTH() {
+		r = append(r, "VOLTH")
+	}
+	if i.HasTIMTH() {
+		r = append(r, "TIMTH")
+	}
+	return r
+}
+
+// Returns true if the F-TEID of the PDI of a Create PDR IE has the CHOOSE flag
+func choosesFteid(pdr *ie.IE) bool {
+	i := slices.IndexFunc(pdr.ChildIEs, func(child *ie.IE) bool { return child.Type == ie.PDI })
+	if i < 0 {
+		return false
+	}
+	f, err := pdr.ChildIEs[i].FTEID()
+	return err == nil && f.HasCh()
+}
+
+// Returns true if the UE IP Address of the PDI of a Create PDR IE has the CHV4 flag
+func choosesUeIpAddr(pdr *ie.IE) bool {
+	i := slices.IndexFunc(pdr.ChildIEs, func(child *ie.IE) bool { return child.Type == ie.PDI })
+	if i < 0 {
+		return false
+	}
+	return slices.ContainsFunc(pdr.ChildIEs[i].ChildIEs, func(child *ie.IE) bool { return child.HasCHV4() })
+}
+
+// Returns a F-TEID IE
+func newFteid(fteid *jsonapi.Fteid) *ie.IE {
+	if fteid.Addr.Is4() {
+		return ie.NewFTEID(0x01, fteid.Teid, fteid.Addr.AsSlice(), nil, 0)
+	}
+	return ie.NewFTEID(0x02, fteid.Teid, nil, fteid.Addr.AsSlice(), 0)
+}
+
+// Returns the IPv4 address if v4 is true, the IPv6 address otherwise
+func transportAddr(v4 bool, ipv4 net.IP, ipv6 net.IP) netip.Addr {
+	if v4 {
+		addr, _ := netip.AddrFromSlice(ipv4.To4())
+		return addr
+	}
+	addr, _ := netip.AddrFromSlice(ipv6.To16())
+	return addr
+}
+
+func interfaceName(i uint8) string {
+	switch i {
+	case ie.SrcInterfaceAccess:
+		return "access"
+	case ie.SrcInterfaceCore:
+		return "core"
+	case ie.SrcInterfaceSGiLANN6LAN:
+		return "n6-lan"
+	case ie.SrcInterfaceCPFunction:
+		return "cp-function"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package mockupf
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+var (
+	testGtpu    = netip.MustParseAddr("127.0.1.2")
+	testUeIp    = netip.MustParseAddr("10.0.0.2")
+	testForward = &jsonapi.Fteid{Addr: netip.MustParseAddr("127.0.2.1"), Teid: 100}
+)
+
+func newTestSession() *session {
+	return &session{
+		pdrs: make(map[uint16]*Pdr),
+		fars: make(map[uint32]*Far),
+		qers: make(map[uint32]*Qer),
+		urrs: make(map[uint32]*Urr),
+		bars: make(map[uint8]*Bar),
+	}
+}
+
+// Returns an allocator of F-TEIDs on testGtpu, with consecutive TEIDs
+func newTestAllocator() func(v4 bool) (*jsonapi.Fteid, error) {
+	var teid uint32
+	return func(v4 bool) (*jsonapi.Fteid, error) {
+		if !v4 {
+			return nil, ErrNoGtpuAddr
+		}
+		teid += 1
+		return &jsonapi.Fteid{Addr: testGtpu, Teid: teid}, nil
+	}
+}
+
+// Returns a Create PDR IE matching uplink packets on a F-TEID chosen by the UPF with this CHOOSE ID
+func newChoosePdr(id uint16, farId uint32, chooseId uint8) *ie.IE {
+	return ie.NewCreatePDR(ie.NewPDRID(id), ie.NewPrecedence(255),
+		ie.NewPDI(ie.NewSourceInterface(ie.SrcInterfaceAccess), ie.NewFTEID(0x01|0x04|0x08, 0, nil, nil, chooseId)),
+		ie.NewOuterHeaderRemoval(0, 0),
+		ie.NewFARID(farId),
+	)
+}
+
+func newCreateFar(id uint32) *ie.IE {
+	return ie.NewCreateFAR(ie.NewFARID(id), ie.NewApplyAction(0x02),
+		ie.NewForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceCore),
+			ie.NewOuterHeaderCreation(0x0100, testForward.Teid, testForward.Addr.String(), "", 0, 0, 0),
+		),
+	)
+}
+
+func TestSessionApplyChoose(t *testing.T) {
+	s := newTestSession()
+	s.ueIpAddr = testUeIp
+	created, err := s.apply(changes{
+		createPdrs: []*ie.IE{
+			newChoosePdr(1, 1, 1),
+			newChoosePdr(2, 1, 1), // same CHOOSE ID: same F-TEID
+			newChoosePdr(3, 2, 2),
+			ie.NewCreatePDR(ie.NewPDRID(4), ie.NewPrecedence(255),
+				ie.NewPDI(ie.NewSourceInterface(ie.SrcInterfaceCore), ie.NewUEIPAddress(0x02|0x10, "", "", 0, 0)),
+				ie.NewFARID(2),
+			),
+		},
+		createFars: []*ie.IE{newCreateFar(1), newCreateFar(2)},
+	}, newTestAllocator())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint16]jsonapi.Fteid{1: {Addr: testGtpu, Teid: 1}, 2: {Addr: testGtpu, Teid: 1}, 3: {Addr: testGtpu, Teid: 2}}
+	for id, fteid := range want {
+		if got := s.pdrs[id].Fteid; got == nil || *got != fteid {
+			t.Fatalf("PDR %d: got F-TEID %v, want %v", id, got, fteid)
+		}
+	}
+	if got := s.pdrs[4].UeIpAddr; got != testUeIp {
+		t.Fatalf("got UE IP Address %s, want %s", got, testUeIp)
+	}
+	// allocated values are returned in Created PDR IEs
+	if len(created) != 4 {
+		t.Fatalf("got %d Created PDR IEs, want 4", len(created))
+	}
+	for _, c := range created {
+		id, err := c.PDRID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == 4 {
+			if i := slices.IndexFunc(c.ChildIEs, func(i *ie.IE) bool { return i.Type == ie.UEIPAddress }); i < 0 {
+				t.Fatal("no UE IP Address in the Created PDR IE")
+			}
+			continue
+		}
+		f, err := c.FTEID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.TEID != want[id].Teid {
+			t.Fatalf("PDR %d: got TEID %d in the Created PDR IE, want %d", id, f.TEID, want[id].Teid)
+		}
+	}
+}
+
+func TestSessionApply(t *testing.T) {
+	tests := []struct {
+		name  string
+		c     changes
+		err   error
+		check func(t *testing.T, s *session)
+	}{
+		{
+			name: "remove rules",
+			c:    changes{removePdrs: []*ie.IE{ie.NewRemovePDR(ie.NewPDRID(1))}, removeFars: []*ie.IE{ie.NewRemoveFAR(ie.NewFARID(1))}},
+			check: func(t *testing.T, s *session) {
+				if len(s.pdrs) != 0 || len(s.fars) != 0 {
+					t.Fatalf("got %d PDRs and %d FARs, want none", len(s.pdrs), len(s.fars))
+				}
+			},
+		},
+		{
+			name: "remove unknown PDR",
+			c:    changes{removePdrs: []*ie.IE{ie.NewRemovePDR(ie.NewPDRID(1)), ie.NewRemovePDR(ie.NewPDRID(2))}},
+			err:  ErrPdrNotFound,
+		},
+		{
+			name: "remove FAR still used by a PDR",
+			c:    changes{removeFars: []*ie.IE{ie.NewRemoveFAR(ie.NewFARID(1))}},
+			err:  ErrFarNotFound,
+		},
+		{
+			name: "create PDR with an existing ID",
+			c:    changes{createPdrs: []*ie.IE{newChoosePdr(1, 1, 1)}},
+			err:  ErrPdrAlreadyExists,
+		},
+		{
+			name: "update PDR with a F-TEID chosen by the UPF",
+			c: changes{updatePdrs: []*ie.IE{ie.NewUpdatePDR(ie.NewPDRID(1),
+				ie.NewPDI(ie.NewSourceInterface(ie.SrcInterfaceAccess), ie.NewFTEID(0x01|0x04, 0, nil, nil, 0)),
+			)}},
+			err: ErrChooseNotAllowed,
+		},
+		{
+			name: "buffer without BAR",
+			c:    changes{updateFars: []*ie.IE{ie.NewUpdateFAR(ie.NewFARID(1), ie.NewApplyAction(0x04), ie.NewBARID(1))}},
+			err:  ErrBarNotFound,
+		},
+		{
+			name: "buffer, then forward on a new tunnel",
+			c: changes{
+				createBar:  ie.NewCreateBAR(ie.NewBARID(1)),
+				updateFars: []*ie.IE{ie.NewUpdateFAR(ie.NewFARID(1), ie.NewApplyAction(0x04), ie.NewBARID(1))},
+			},
+			check: func(t *testing.T, s *session) {
+				far := s.fars[1]
+				if !slices.Equal(far.ApplyAction, []string{"BUFF"}) || far.OuterHeaderCreation == nil || *far.OuterHeaderCreation != *testForward {
+					t.Fatalf("got FAR %+v, want buffering, with forwarding parameters kept", far)
+				}
+				far.Buffered = 3
+				forward := &jsonapi.Fteid{Addr: netip.MustParseAddr("127.0.2.2"), Teid: 200}
+				if _, err := s.apply(changes{updateFars: []*ie.IE{ie.NewUpdateFAR(ie.NewFARID(1), ie.NewApplyAction(0x02),
+					ie.NewUpdateForwardingParameters(
+						ie.NewOuterHeaderCreation(0x0100, forward.Teid, forward.Addr.String(), "", 0, 0, 0),
+						ie.NewPFCPSMReqFlags(0x02),
+					),
+				)}}, nil); err != nil {
+					t.Fatal(err)
+				}
+				far = s.fars[1]
+				if far.Buffered != 0 || *far.OuterHeaderCreation != *forward || far.EndMarkers != 1 || far.DestinationInterface != "core" {
+					t.Fatalf("got FAR %+v, want buffered packets flushed to %v with an End Marker", far, forward)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSession()
+			if _, err := s.apply(changes{createPdrs: []*ie.IE{newChoosePdr(1, 1, 1)}, createFars: []*ie.IE{newCreateFar(1)}}, newTestAllocator()); err != nil {
+				t.Fatal(err)
+			}
+			pdr, far := *s.pdrs[1], *s.fars[1]
+
+			_, err := s.apply(tt.c, newTestAllocator())
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				// rejected changes are not applied at all
+				if len(s.pdrs) != 1 || len(s.fars) != 1 || len(s.bars) != 0 || *s.pdrs[1].Fteid != *pdr.Fteid || !slices.Equal(s.fars[1].ApplyAction, far.ApplyAction) {
+					t.Fatalf("rejected changes have been applied: %+v %+v", s.pdrs, s.fars)
+				}
+				return
+			}
+			tt.check(t, s)
+		})
+	}
+}
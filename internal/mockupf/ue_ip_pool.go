@@ -0,0 +1,51 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package mockupf
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// UE IP Addresses allocated by the UPF, for UE IP Address IEs with the CHV4 flag
+type ueIpPool struct {
+	pool   netip.Prefix
+	leases map[netip.Addr]struct{}
+	sync.Mutex
+}
+
+func newUeIpPool(pool netip.Prefix) *ueIpPool {
+	return &ueIpPool{
+		pool:   pool.Masked(),
+		leases: make(map[netip.Addr]struct{}),
+	}
+}
+
+// Allocates the lowest free address of the pool; the network address is never allocated
+func (p *ueIpPool) next() (netip.Addr, error) {
+	if p == nil {
+		return netip.Addr{}, ErrNoUeIpPool
+	}
+	p.Lock()
+	defer p.Unlock()
+	for addr := p.pool.Addr().Next(); addr.IsValid() && p.pool.Contains(addr); addr = addr.Next() {
+		if _, ok := p.leases[addr]; !ok {
+			p.leases[addr] = struct{}{}
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, ErrNoUeIpAvailable
+}
+
+// Returns an address to the pool
+func (p *ueIpPool) release(addr netip.Addr) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	delete(p.leases, addr)
+}
@@ -0,0 +1,199 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package mockupf
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// Octets of the Usage Report Trigger IE
+var (
+	TriggerPerio = []uint8{0x01, 0x00} // Periodic Reporting
+	TriggerVolth = []uint8{0x02, 0x00} // Volume Threshold
+	TriggerTimth = []uint8{0x04, 0x00} // Time Threshold
+	TriggerTermr = []uint8{0x00, 0x08} // Termination Report
+)
+
+// Interval between checks of periodic and time threshold reporting
+const usageCheckInterval = 1 * time.Second
+
+// Simulated traffic, in bytes
+type Traffic struct {
+	Uplink   uint64 `json:"uplink"`
+	Downlink uint64 `json:"downlink"`
+}
+
+// Usage Reports to send in a PFCP Session Report Request
+type pendingReports struct {
+	cpNodeID   string
+	remoteSeid uint64
+	localSeid  uint64
+	reports    []*ie.IE
+}
+
+// Returns the IEs of an Usage Report of the URR, and starts a new measurement.
+// Caller must hold the lock.
+func (s *session) usageReport(id uint32, now time.Time, trigger []uint8) []*ie.IE {
+	urr := *s.urrs[id]
+	ies := []*ie.IE{
+		ie.NewURRID(urr.ID),
+		ie.NewURSEQN(urr.Sequence),
+		ie.NewUsageReportTrigger(trigger...),
+		ie.NewStartTime(urr.Start),
+		ie.NewEndTime(now),
+		ie.NewVolumeMeasurement(0x07, urr.Uplink+urr.Downlink, urr.Uplink, urr.Downlink, 0, 0, 0),
+		ie.NewDurationMeasurement(now.Sub(urr.Start)),
+	}
+	// URRs are replaced, not modified, when rules are applied
+	urr.Sequence += 1
+	urr.Start = now
+	urr.Uplink = 0
+	urr.Downlink = 0
+	s.urrs[id] = &urr
+	return ies
+}
+
+// Simulates traffic on a PFCP Session.
+// Uplink bytes are counted by URRs of access PDRs, and downlink bytes by URRs of core PDRs.
+// An Usage Report is sent to the Control Plane for each URR reaching its volume threshold.
+func (upf *MockUpf) Traffic(c *gin.Context) {
+	seid, err := strconv.ParseUint(c.Param("seid"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "could not parse SEID", Error: err})
+		return
+	}
+	var traffic Traffic
+	if err := c.BindJSON(&traffic); err != nil {
+		c.JSON(http.StatusBadRequest, jsonapi.MessageWithError{Message: "could not deserialize", Error: err})
+		return
+	}
+	upf.Lock()
+	s, ok := upf.sessions[seid]
+	if !ok {
+		upf.Unlock()
+		c.JSON(http.StatusNotFound, jsonapi.Message{Message: "PFCP Session not found"})
+		return
+	}
+	uplink := make(map[uint32]struct{})
+	downlink := make(map[uint32]struct{})
+	for _, pdr := range s.pdrs {
+		for _, id := range pdr.UrrIDs {
+			switch pdr.SourceInterface {
+			case "access":
+				uplink[id] = struct{}{}
+			case "core":
+				downlink[id] = struct{}{}
+			}
+		}
+	}
+	now := time.Now()
+	r := pendingReports{
+		cpNodeID:   s.cpNodeID,
+		remoteSeid: s.remoteSeid,
+		localSeid:  seid,
+	}
+	for _, id := range slices.Sorted(maps.Keys(s.urrs)) {
+		_, ul := uplink[id]
+		_, dl := downlink[id]
+		if !ul && !dl {
+			continue
+		}
+		urr := *s.urrs[id]
+		if ul {
+			urr.Uplink += traffic.Uplink
+		}
+		if dl {
+			urr.Downlink += traffic.Downlink
+		}
+		s.urrs[id] = &urr
+		if slices.Contains(urr.Triggers, "VOLTH") && urr.VolumeThreshold > 0 && urr.Uplink+urr.Downlink >= urr.VolumeThreshold {
+			r.reports = append(r.reports, ie.NewUsageReportWithinSessionReportRequest(s.usageReport(id, now, TriggerVolth)...))
+		}
+	}
+	upf.Unlock()
+
+	if len(r.reports) == 0 {
+		c.JSON(http.StatusOK, jsonapi.Message{Message: "no Usage Report sent"})
+		return
+	}
+	if err := upf.sendUsageReports(r); err != nil {
+		c.JSON(http.StatusBadGateway, jsonapi.MessageWithError{Message: "could not send Usage Report", Error: err})
+		return
+	}
+	c.JSON(http.StatusOK, jsonapi.Message{Message: "Usage Report sent"})
+}
+
+// Sends periodic and time threshold Usage Reports until the context is done
+func (upf *MockUpf) reportUsage(ctx context.Context) {
+	ticker := time.NewTicker(usageCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, r := range upf.dueUsageReports(now) {
+				if err := upf.sendUsageReports(r); err != nil {
+					logrus.WithError(err).WithFields(logrus.Fields{
+						"local-seid": r.localSeid,
+					}).Error("Could not send Usage Report")
+				}
+			}
+		}
+	}
+}
+
+// Returns Usage Reports of URRs whose measurement period or time threshold is reached
+func (upf *MockUpf) dueUsageReports(now time.Time) []pendingReports {
+	upf.Lock()
+	defer upf.Unlock()
+	due := make([]pendingReports, 0)
+	for _, seid := range slices.Sorted(maps.Keys(upf.sessions)) {
+		s := upf.sessions[seid]
+		r := pendingReports{
+			cpNodeID:   s.cpNodeID,
+			remoteSeid: s.remoteSeid,
+			localSeid:  seid,
+		}
+		for _, id := range slices.Sorted(maps.Keys(s.urrs)) {
+			urr := s.urrs[id]
+			elapsed := now.Sub(urr.Start)
+			switch {
+			case slices.Contains(urr.Triggers, "PERIO") && urr.Period > 0 && elapsed >= urr.Period:
+				r.reports = append(r.reports, ie.NewUsageReportWithinSessionReportRequest(s.usageReport(id, now, TriggerPerio)...))
+			case slices.Contains(urr.Triggers, "TIMTH") && urr.TimeThreshold > 0 && elapsed >= urr.TimeThreshold:
+				r.reports = append(r.reports, ie.NewUsageReportWithinSessionReportRequest(s.usageReport(id, now, TriggerTimth)...))
+			}
+		}
+		if len(r.reports) > 0 {
+			due = append(due, r)
+		}
+	}
+	return due
+}
+
+// Sends Usage Reports in a PFCP Session Report Request
+func (upf *MockUpf) sendUsageReports(r pendingReports) error {
+	if err := upf.sendReport(r.cpNodeID, r.remoteSeid, append([]*ie.IE{ie.NewReportType(0, 0, 1, 0)}, r.reports...)...); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"local-seid": r.localSeid,
+		"reports":    len(r.reports),
+	}).Info("Usage Report sent")
+	return nil
+}
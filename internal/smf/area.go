@@ -36,6 +36,11 @@ func (a AreasMap) Area(gnb jsonapi.ControlURI) (string, bool) {
 	return "", false
 }
 
+// Returns gNBs of the area
+func (a AreasMap) Gnbs(areaName string) []jsonapi.ControlURI {
+	return slices.Clone(a.content[areaName])
+}
+
 func (a AreasMap) Contains(areaName string, gnb jsonapi.ControlURI) bool {
 	if area, ok := a.content[areaName]; ok {
 		if slices.Contains(area, gnb) {
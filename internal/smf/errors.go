@@ -14,12 +14,22 @@ var (
 	ErrPDUSessionNotFound = errors.New("PDU Session not found")
 	ErrAreaNotFound       = errors.New("RAN Area not found for this gNB")
 	ErrPathNotFound       = errors.New("path not found for this RAN Area")
+	ErrNoDownlinkPath     = errors.New("no downlink path for this PDU Session")
+	ErrUeMacNotFound      = errors.New("MAC address of the UE not configured for this DNN")
 
-	ErrUpfNotAssociated    = errors.New("UPF not associated")
-	ErrUpfNotFound         = errors.New("UPF not found")
-	ErrInterfaceNotFound   = errors.New("interface not found")
-	ErrNoPFCPRule          = errors.New("no PFCP rule to push")
-	ErrNoIpAvailableInPool = errors.New("no IP address available in pool")
+	ErrUpfNotAssociated      = errors.New("UPF not associated")
+	ErrUpfNotFound           = errors.New("UPF not found")
+	ErrInterfaceNotFound     = errors.New("interface not found")
+	ErrNoPFCPRule            = errors.New("no PFCP rule to push")
+	ErrPfcpRequestRejected   = errors.New("PFCP request rejected")
+	ErrPfcpUnexpectedMessage = errors.New("unexpected PFCP message")
+	ErrNoIpAvailableInPool   = errors.New("no IP address available in pool")
+	ErrUeIpAddrNotInPool     = errors.New("UE IP Address not in pool")
+	ErrUeIpAddrUnavailable   = errors.New("UE IP Address reserved or already in use")
+	ErrUeIpAddrNotAllocated  = errors.New("UE IP Address not allocated")
+	ErrRollbackFailed        = errors.New("could not roll back PFCP rules")
+	ErrFteidNotAllocated     = errors.New("F-TEID not allocated")
+	ErrNoRuleIdAvailable     = errors.New("no rule ID available in this PFCP Session")
 
 	ErrNilCtx            = errors.New("nil context")
 	ErrSmfNotStarted     = errors.New("SMF not started")
@@ -0,0 +1,104 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package smf
+
+import (
+	"net/netip"
+
+	"github.com/nextmn/cp-lite/internal/metrics"
+)
+
+// Registers gauges computed from the state of the SMF
+func (smf *Smf) registerMetrics(m *metrics.Metrics) {
+	m.Register(metrics.NewGaugeFunc("cplite_pdu_sessions",
+		"Number of active PDU Sessions, by slice and RAN area.",
+		[]string{"slice", "area"},
+		func(set func(v float64, labelValues ...string)) {
+			smf.slices.Range(func(key, value any) bool {
+				for area, n := range value.(*Slice).sessions.LenPerArea() {
+					set(float64(n), key.(string), area)
+				}
+				return true
+			})
+		}))
+	m.Register(metrics.NewGaugeFunc("cplite_ue_ip_pool_capacity",
+		"Number of UE IP Addresses available for dynamic allocation, by slice.",
+		[]string{"slice"},
+		func(set func(v float64, labelValues ...string)) {
+			smf.slices.Range(func(key, value any) bool {
+				set(float64(value.(*Slice).Pool.Status().Capacity), key.(string))
+				return true
+			})
+		}))
+	m.Register(metrics.NewGaugeFunc("cplite_ue_ip_pool_leases",
+		"Number of UE IP Addresses in use, by slice.",
+		[]string{"slice"},
+		func(set func(v float64, labelValues ...string)) {
+			smf.slices.Range(func(key, value any) bool {
+				set(float64(value.(*Slice).Pool.Status().Leases), key.(string))
+				return true
+			})
+		}))
+	m.Register(metrics.NewGaugeFunc("cplite_ue_ipv6_pool_capacity",
+		"Number of UE IPv6 prefixes available for allocation, by slice.",
+		[]string{"slice"},
+		func(set func(v float64, labelValues ...string)) {
+			smf.slices.Range(func(key, value any) bool {
+				if status := value.(*Slice).Ipv6Pool.Status(); status.Pool.IsValid() {
+					set(float64(status.Capacity), key.(string))
+				}
+				return true
+			})
+		}))
+	m.Register(metrics.NewGaugeFunc("cplite_ue_ipv6_pool_leases",
+		"Number of UE IPv6 prefixes in use, by slice.",
+		[]string{"slice"},
+		func(set func(v float64, labelValues ...string)) {
+			smf.slices.Range(func(key, value any) bool {
+				if status := value.(*Slice).Ipv6Pool.Status(); status.Pool.IsValid() {
+					set(float64(status.Leases), key.(string))
+				}
+				return true
+			})
+		}))
+	m.Register(metrics.NewGaugeFunc("cplite_teids",
+		"Number of TEIDs in use, by UPF node ID and interface.",
+		[]string{"node_id", "interface"},
+		func(set func(v float64, labelValues ...string)) {
+			smf.upfs.Range(func(key, value any) bool {
+				for addr, iface := range value.(*Upf).interfaces {
+					set(float64(iface.Teids.Len()), key.(netip.Addr).String(), addr.String())
+				}
+				return true
+			})
+		}))
+	m.Register(metrics.NewGaugeFunc("cplite_upf_associated",
+		"Whether the PFCP Association with the UPF is established, by UPF node ID.",
+		[]string{"node_id"},
+		func(set func(v float64, labelValues ...string)) {
+			smf.upfs.Range(func(key, value any) bool {
+				associated := 0.0
+				if value.(*Upf).Association() != nil {
+					associated = 1
+				}
+				set(associated, key.(netip.Addr).String())
+				return true
+			})
+		}))
+	m.Register(metrics.NewGaugeFunc("cplite_upf_up",
+		"Whether the UPF answers PFCP Heartbeat Requests, by UPF node ID.",
+		[]string{"node_id"},
+		func(set func(v float64, labelValues ...string)) {
+			smf.upfs.Range(func(key, value any) bool {
+				up := 0.0
+				if value.(*Upf).HealthStatus().State == UpfHealthUp {
+					up = 1
+				}
+				set(up, key.(netip.Addr).String())
+				return true
+			})
+		}))
+}
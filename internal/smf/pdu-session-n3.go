@@ -8,16 +8,72 @@ package smf
 import (
 	"net/netip"
 
+	"github.com/nextmn/cp-lite/internal/config"
+
 	"github.com/nextmn/json-api/jsonapi"
 )
 
+// Addresses of the UE matched by PDRs
+type UeIpAddrs struct {
+	Ipv4 netip.Addr   // invalid for ipv6 and ethernet PDU Sessions
+	Ipv6 netip.Prefix // invalid for ipv4 and ethernet PDU Sessions
+
+	// ethernet PDU Sessions have no UE IP Address
+	SessionId netip.Addr     // identifies the PDU Session (see ethernetSessionId), invalid for IP PDU Sessions
+	Mac       config.MacAddr // MAC address of the UE, for ethernet PDU Sessions
+}
+
+// Returns the address identifying the PDU Session: the IPv4 address, the first address of the IPv6 prefix,
+// or the identifier of ethernet PDU Sessions
+func (a UeIpAddrs) Key() netip.Addr {
+	switch {
+	case a.SessionId.IsValid():
+		return a.SessionId
+	case a.Ipv4.IsValid():
+		return a.Ipv4
+	}
+	return a.Ipv6.Addr()
+}
+
+// PFCP rules pushed on an UPF for a PDU Session
+type UpfRules struct {
+	NodeID netip.Addr     `json:"node-id"`
+	Ids    RuleIds        `json:"ids"`
+	Fteid  *jsonapi.Fteid `json:"fteid,omitempty"` // F-TEID allocated for the PDR, nil if the PDR does not match on a F-TEID
+}
+
 type PduSessionN3 struct {
-	UeIpAddr      netip.Addr
-	UplinkFteid   *jsonapi.Fteid
-	DownlinkFteid *jsonapi.Fteid
+	UeIpAddr      netip.Addr     `json:"ue-addr"` // see UeIpAddrs.Key
+	Area          string         `json:"area"`    // RAN area of the gNB serving the UE
+	UplinkFteid   *jsonapi.Fteid `json:"uplink-fteid,omitempty"`
+	DownlinkFteid *jsonapi.Fteid `json:"downlink-fteid,omitempty"`
+
+	// PDU Session type, IPv6 prefix of ipv6 and ipv4v6 PDU Sessions, and MAC address of ethernet PDU Sessions
+	Type         config.PduSessionType `json:"type"`
+	UeIpv6Prefix netip.Prefix          `json:"ue-ipv6-prefix,omitzero"`
+	UeMac        config.MacAddr        `json:"ue-mac,omitempty"`
+
+	// Rules of the current path, ordered from the UPF-i to the UPF-A
+	UplinkRules   []UpfRules `json:"uplink-rules,omitempty"`
+	DownlinkRules []UpfRules `json:"downlink-rules,omitempty"`
 
 	// Handover
-	NextDownlinkFteid          *jsonapi.Fteid
-	DlFarId                    uint32
-	IndirectForwardingRequired bool
+	DlFarId             uint32     `json:"dl-far-id"`
+	PreviousUplinkRules []UpfRules `json:"previous-uplink-rules,omitempty"` // uplink path in use before the handover
+	ForwardingRules     []UpfRules `json:"forwarding-rules,omitempty"`      // temporary downlink rules used for indirect forwarding
+	Buffering           bool       `json:"buffering,omitempty"`             // the downlink FAR of the UPF-A buffers packets
+	// downlink rules of the previous UPF-A, forwarding packets it buffered during the handover on the new path;
+	// they are released at the next change of the downlink path
+	DrainRules []UpfRules `json:"drain-rules,omitempty"`
+}
+
+// Returns the addresses of the UE matched by PDRs
+func (s *PduSessionN3) UeIpAddrs() UeIpAddrs {
+	if s.Type == config.PduSessionTypeEthernet {
+		return UeIpAddrs{SessionId: s.UeIpAddr, Mac: s.UeMac}
+	}
+	if s.UeIpAddr.Is4() {
+		return UeIpAddrs{Ipv4: s.UeIpAddr, Ipv6: s.UeIpv6Prefix}
+	}
+	return UeIpAddrs{Ipv6: s.UeIpv6Prefix}
 }
@@ -5,12 +5,155 @@
 
 package smf
 
+import (
+	"net"
+	"net/netip"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
 // PFCP Constants
 const (
 	FteidTypeIPv4                  = 0x01
+	FteidTypeIPv6                  = 0x02
+	FteidFlagCh                    = 0x04 // CHOOSE: the F-TEID is allocated by the UPF
+	FteidFlagChid                  = 0x08 // CHOOSE ID: PDRs with the same CHOOSE ID share the F-TEID
 	UEIpAddrTypeIPv4Source         = 0x02
 	UEIpAddrTypeIPv4Destination    = 0x02 | 0x04 // S/D Flag = 1
+	UEIpAddrFlagV6                 = 0x01
+	UEIpAddrFlagV4                 = 0x02
+	UEIpAddrFlagSd                 = 0x04 // S/D: the addresses are destination addresses
+	UEIpAddrFlagIpv6d              = 0x08 // IPv6D: IPv6 prefix delegation bits are present
+	UEIpAddrFlagChv4               = 0x10 // CHV4: the IPv4 address is allocated by the UPF
+	EthernetPduSessionInfoEthi     = 0x01 // ETHI: Ethernet PDU Session
 	OuterHeaderRemoveGtpuUdpIpv4   = 0x00
+	OuterHeaderRemoveGtpuUdpIpv6   = 0x01
 	ApplyActionForw                = 0x02
+	ApplyActionBuff                = 0x04
+	ApplyActionNocp                = 0x08
 	OuterHeaderCreationGtpuUdpIpv4 = 0x0100
+	OuterHeaderCreationGtpuUdpIpv6 = 0x0200
+	PfcpsmReqFlagsSndem            = 0x02 // Send End Marker Packets
+	ReportingTriggersPerio         = 0x01 // Periodic Reporting
+	ReportingTriggersVolth         = 0x02 // Volume Threshold
+	ReportingTriggersTimth         = 0x04 // Time Threshold
+	VolumeThresholdTovol           = 0x01 // Total Volume
 )
+
+// Returns a F-TEID IE, with the IPv4 or IPv6 flag depending on the address family
+func newFteid(fteid *jsonapi.Fteid) *ie.IE {
+	if fteid.Addr.Is4() {
+		return ie.NewFTEID(FteidTypeIPv4, fteid.Teid, fteid.Addr.AsSlice(), nil, 0)
+	}
+	return ie.NewFTEID(FteidTypeIPv6, fteid.Teid, nil, fteid.Addr.AsSlice(), 0)
+}
+
+// Returns a F-TEID IE requesting the UPF to allocate a F-TEID of the address family of addr.
+// PDRs of a message with the same CHOOSE ID share the same F-TEID.
+func newChooseFteid(addr netip.Addr, chid uint8) *ie.IE {
+	var flags uint8 = FteidFlagCh | FteidFlagChid
+	if addr.Is4() {
+		flags |= FteidTypeIPv4
+	} else {
+		flags |= FteidTypeIPv6
+	}
+	return ie.NewFTEID(flags, 0, nil, nil, chid)
+}
+
+// Returns the F-TEID of a F-TEID IE, or of the F-TEID IE of a Created PDR IE
+func parseFteid(i *ie.IE) (*jsonapi.Fteid, error) {
+	f, err := i.FTEID()
+	if err != nil {
+		return nil, err
+	}
+	var addr netip.Addr
+	var ok bool
+	if f.HasIPv4() {
+		addr, ok = netip.AddrFromSlice(f.IPv4Address.To4())
+	} else if f.HasIPv6() {
+		addr, ok = netip.AddrFromSlice(f.IPv6Address.To16())
+	}
+	if !ok {
+		return nil, ErrFteidNotAllocated
+	}
+	return &jsonapi.Fteid{Addr: addr, Teid: f.TEID}, nil
+}
+
+// Returns the IPv4 address of an UE IP Address IE, or of the UE IP Address IE of a Created PDR IE
+func parseUeIpAddr(i *ie.IE) (netip.Addr, error) {
+	f, err := i.UEIPAddress()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr, ok := netip.AddrFromSlice(f.IPv4Address.To4())
+	if !ok {
+		return netip.Addr{}, ErrUeIpAddrNotAllocated
+	}
+	return addr, nil
+}
+
+// Returns an UE IP Address IE with the IPv4 address and the IPv6 prefix of the UE, if valid.
+// If the IPv4 address is unspecified (0.0.0.0), it is to be allocated by the UPF.
+// Prefixes shorter than /64 are encoded with IPv6 prefix delegation bits.
+func newUeIpAddress(ue UeIpAddrs, destination bool) *ie.IE {
+	var flags, delegationBits uint8
+	var v4, v6 string
+	switch {
+	case ue.Ipv4.IsUnspecified():
+		flags |= UEIpAddrFlagV4 | UEIpAddrFlagChv4
+	case ue.Ipv4.IsValid():
+		flags |= UEIpAddrFlagV4
+		v4 = ue.Ipv4.String()
+	}
+	if ue.Ipv6.IsValid() {
+		flags |= UEIpAddrFlagV6
+		v6 = ue.Ipv6.Addr().String()
+		if bits := ue.Ipv6.Bits(); bits < 64 {
+			flags |= UEIpAddrFlagIpv6d
+			delegationBits = uint8(64 - bits)
+		}
+	}
+	if destination {
+		flags |= UEIpAddrFlagSd
+	}
+	return ie.NewUEIPAddress(flags, v4, v6, delegationBits, 0)
+}
+
+// Returns the IEs of a PDI matching packets of the UE: the UE IP Address IE or, for ethernet PDU Sessions,
+// the Ethernet PDU Session Information IE and an Ethernet Packet Filter on the MAC address of the UE
+func newUePdi(ue UeIpAddrs, destination bool) []*ie.IE {
+	if !ue.SessionId.IsValid() {
+		return []*ie.IE{newUeIpAddress(ue, destination)}
+	}
+	ies := []*ie.IE{ie.NewEthernetPDUSessionInformation(EthernetPduSessionInfoEthi)}
+	if destination {
+		return append(ies, ie.NewEthernetPacketFilter(ie.NewMACAddress(nil, net.HardwareAddr(ue.Mac), nil, nil)))
+	}
+	return append(ies, ie.NewEthernetPacketFilter(ie.NewMACAddress(net.HardwareAddr(ue.Mac), nil, nil, nil)))
+}
+
+// Returns the IEs of Forwarding Parameters specific to the PDU Session type of the UE
+func newUeForwardingParameters(ue UeIpAddrs) []*ie.IE {
+	if !ue.SessionId.IsValid() {
+		return nil
+	}
+	return []*ie.IE{ie.NewEthernetPDUSessionInformation(EthernetPduSessionInfoEthi)}
+}
+
+// Returns an Outer Header Removal IE for GTP-U packets received on this address
+func newOuterHeaderRemoval(addr netip.Addr) *ie.IE {
+	if addr.Is4() {
+		return ie.NewOuterHeaderRemoval(OuterHeaderRemoveGtpuUdpIpv4, 0)
+	}
+	return ie.NewOuterHeaderRemoval(OuterHeaderRemoveGtpuUdpIpv6, 0)
+}
+
+// Returns an Outer Header Creation IE for GTP-U packets sent to this F-TEID
+func newOuterHeaderCreation(fteid *jsonapi.Fteid) *ie.IE {
+	if fteid.Addr.Is4() {
+		return ie.NewOuterHeaderCreation(OuterHeaderCreationGtpuUdpIpv4, fteid.Teid, fteid.Addr.String(), "", 0, 0, 0)
+	}
+	return ie.NewOuterHeaderCreation(OuterHeaderCreationGtpuUdpIpv6, fteid.Teid, "", fteid.Addr.String(), 0, 0, 0)
+}
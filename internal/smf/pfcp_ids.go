@@ -0,0 +1,43 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package smf
+
+import (
+	"slices"
+)
+
+// Allocates rule IDs of a PFCP Session, starting from 1.
+// Released IDs are reused, lowest first, so IDs stay small during long handover sequences.
+type idAllocator[T uint16 | uint32] struct {
+	last T   // highest ID allocated so far
+	free []T // released IDs, sorted
+}
+
+// Returns an unused ID, or ErrNoRuleIdAvailable if all IDs are in use
+func (a *idAllocator[T]) next() (T, error) {
+	if len(a.free) > 0 {
+		id := a.free[0]
+		a.free = a.free[1:]
+		return id, nil
+	}
+	if a.last == ^T(0) {
+		return 0, ErrNoRuleIdAvailable
+	}
+	a.last += 1
+	return a.last, nil
+}
+
+// Makes the ID available again; it must no longer be used on the UPF
+func (a *idAllocator[T]) release(id T) {
+	if id == 0 || id > a.last {
+		return
+	}
+	i, found := slices.BinarySearch(a.free, id)
+	if found {
+		return
+	}
+	a.free = slices.Insert(a.free, i, id)
+}
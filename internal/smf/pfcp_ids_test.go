@@ -0,0 +1,88 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package smf
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestIdAllocator(t *testing.T) {
+	tests := []struct {
+		name    string
+		next    int      // IDs allocated first
+		release []uint16 // IDs released, in order
+		want    []uint16 // IDs allocated next
+	}{
+		{
+			name: "IDs start from 1",
+			want: []uint16{1, 2, 3},
+		},
+		{
+			name:    "lowest released ID is reused first",
+			next:    5,
+			release: []uint16{4, 2, 3},
+			want:    []uint16{2, 3, 4, 6},
+		},
+		{
+			name:    "ID released twice is reused once",
+			next:    3,
+			release: []uint16{2, 2},
+			want:    []uint16{2, 4},
+		},
+		{
+			name:    "ID never allocated is ignored",
+			next:    3,
+			release: []uint16{0, 4, 10},
+			want:    []uint16{4, 5},
+		},
+		{
+			name:    "highest ID released",
+			next:    3,
+			release: []uint16{3},
+			want:    []uint16{3, 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var a idAllocator[uint16]
+			for range tt.next {
+				if _, err := a.next(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, id := range tt.release {
+				a.release(id)
+			}
+			for i, want := range tt.want {
+				if got, err := a.next(); err != nil || got != want {
+					t.Fatalf("ID %d: got %d (%v), want %d", i, got, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestIdAllocatorExhausted(t *testing.T) {
+	var a idAllocator[uint16]
+	for range math.MaxUint16 {
+		if _, err := a.next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// IDs never wrap around to IDs still in use
+	if id, err := a.next(); !errors.Is(err, ErrNoRuleIdAvailable) {
+		t.Fatalf("got ID %d (%v), want error %v", id, err, ErrNoRuleIdAvailable)
+	}
+	a.release(42)
+	if id, err := a.next(); err != nil || id != 42 {
+		t.Fatalf("got ID %d (%v), want 42", id, err)
+	}
+	if id, err := a.next(); !errors.Is(err, ErrNoRuleIdAvailable) {
+		t.Fatalf("got ID %d (%v), want error %v", id, err, ErrNoRuleIdAvailable)
+	}
+}
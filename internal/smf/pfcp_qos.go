@@ -0,0 +1,137 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package smf
+
+import (
+	"slices"
+
+	"github.com/nextmn/cp-lite/internal/config"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// Precedence of the PDRs of the default QoS Flow
+const defaultPrecedence uint32 = 255
+
+// Returns QER ID IEs of the QERs applied to a QoS Flow.
+// The Session-AMBR QER is added if ambr is true and a Session-AMBR is configured.
+// Caller must hold the lock.
+func (r *Pfcprules) flowQers(qos *config.Qos, flow *config.QosFlow, ambr bool) ([]*ie.IE, error) {
+	var key uint8
+	var ies []*ie.IE
+	if flow == nil {
+		// the default QoS Flow is a Non-GBR QoS Flow
+		key = config.DefaultQfi
+		ies = []*ie.IE{ie.NewQFI(config.DefaultQfi)}
+	} else {
+		key = flow.Qfi
+		ies = []*ie.IE{ie.NewQFI(flow.Qfi)}
+		if flow.Mbr != nil {
+			ies = append(ies, ie.NewMBR(flow.Mbr.Uplink, flow.Mbr.Downlink))
+		}
+		if flow.Gbr != nil {
+			ies = append(ies, ie.NewGBR(flow.Gbr.Uplink, flow.Gbr.Downlink))
+		}
+	}
+	id, err := r.qer(key, ies...)
+	if err != nil {
+		return nil, err
+	}
+	qers := []*ie.IE{ie.NewQERID(id)}
+	if ambr && qos.SessionAmbr != nil {
+		id, err := r.qer(ambrQerKey, ie.NewMBR(qos.SessionAmbr.Uplink, qos.SessionAmbr.Downlink))
+		if err != nil {
+			return nil, err
+		}
+		qers = append(qers, ie.NewQERID(id))
+	}
+	return qers, nil
+}
+
+// Adds Create PDR IEs matching uplink packets of the PDU Session.
+// Without QoS, a single PDR is created. Otherwise, a PDR is created for the default QoS Flow
+// and for each additional QoS Flow, matching on the QFI; all PDRs share the FAR of ids.
+// pdi contains the IEs of the PDI, and ies the other IEs of the PDR (except PDR ID, Precedence, and FAR ID).
+// On error, PDRs already added are left in the pending rules: the caller must remove ids.
+// Caller must hold the lock.
+func (r *Pfcprules) createUplinkPdrs(ids RuleIds, qos *config.Qos, ambr bool, pdi []*ie.IE, ies ...*ie.IE) error {
+	if qos == nil {
+		r.createpdrs = append(r.createpdrs, newCreatePdr(ids.Pdr, defaultPrecedence, ids.Far, pdi, ies))
+		return nil
+	}
+	qers, err := r.flowQers(qos, nil, ambr)
+	if err != nil {
+		return err
+	}
+	r.createpdrs = append(r.createpdrs, newCreatePdr(ids.Pdr, defaultPrecedence, ids.Far,
+		slices.Concat(pdi, []*ie.IE{ie.NewQFI(config.DefaultQfi)}),
+		slices.Concat(ies, qers),
+	))
+	for i := range qos.Flows {
+		flow := &qos.Flows[i]
+		id, err := r.nextFlowPdrId(ids.Far)
+		if err != nil {
+			return err
+		}
+		qers, err := r.flowQers(qos, flow, ambr)
+		if err != nil {
+			return err
+		}
+		r.createpdrs = append(r.createpdrs, newCreatePdr(id, flow.Precedence, ids.Far,
+			slices.Concat(pdi, []*ie.IE{ie.NewQFI(flow.Qfi)}),
+			slices.Concat(ies, qers),
+		))
+	}
+	return nil
+}
+
+// Adds Create PDR IEs matching downlink packets of the PDU Session at the UPF-A.
+// Without QoS, a single PDR is created. Otherwise, a PDR is created for the default QoS Flow
+// and for each additional QoS Flow, matching on its SDF filters; all PDRs share the FAR of ids.
+// On error, PDRs already added are left in the pending rules: the caller must remove ids.
+// Caller must hold the lock.
+func (r *Pfcprules) createDownlinkAnchorPdrs(ids RuleIds, qos *config.Qos, pdi []*ie.IE, ies ...*ie.IE) error {
+	if qos == nil {
+		r.createpdrs = append(r.createpdrs, newCreatePdr(ids.Pdr, defaultPrecedence, ids.Far, pdi, ies))
+		return nil
+	}
+	qers, err := r.flowQers(qos, nil, true)
+	if err != nil {
+		return err
+	}
+	r.createpdrs = append(r.createpdrs, newCreatePdr(ids.Pdr, defaultPrecedence, ids.Far,
+		pdi,
+		slices.Concat(ies, qers),
+	))
+	for i := range qos.Flows {
+		flow := &qos.Flows[i]
+		filters := make([]*ie.IE, 0, len(flow.Filters))
+		for _, f := range flow.Filters {
+			filters = append(filters, ie.NewSDFFilter(f, "", "", "", 0))
+		}
+		id, err := r.nextFlowPdrId(ids.Far)
+		if err != nil {
+			return err
+		}
+		qers, err := r.flowQers(qos, flow, true)
+		if err != nil {
+			return err
+		}
+		r.createpdrs = append(r.createpdrs, newCreatePdr(id, flow.Precedence, ids.Far,
+			slices.Concat(pdi, filters),
+			slices.Concat(ies, qers),
+		))
+	}
+	return nil
+}
+
+func newCreatePdr(id uint16, precedence uint32, farId uint32, pdi []*ie.IE, ies []*ie.IE) *ie.IE {
+	children := make([]*ie.IE, 0, len(ies)+4)
+	children = append(children, ie.NewPDRID(id), ie.NewPrecedence(precedence), ie.NewPDI(pdi...))
+	children = append(children, ies...)
+	children = append(children, ie.NewFARID(farId))
+	return ie.NewCreatePDR(children...)
+}
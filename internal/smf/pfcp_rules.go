@@ -6,30 +6,467 @@
 package smf
 
 import (
+	"maps"
+	"math"
+	"slices"
 	"sync"
 
-	pfcpapi "github.com/nextmn/go-pfcp-networking/pfcp/api"
+	"github.com/nextmn/cp-lite/internal/config"
+
+	"github.com/nextmn/json-api/jsonapi"
 
 	"github.com/wmnsk/go-pfcp/ie"
 )
 
+// PDR and FAR created together on an UPF
+type RuleIds struct {
+	Pdr uint16 `json:"pdr"`
+	Far uint32 `json:"far"`
+}
+
+// Purpose of a PDR and its FAR in the PDU Session
+type RulePurpose string
+
+const (
+	RulePurposeUplink             RulePurpose = "uplink"
+	RulePurposeDownlink           RulePurpose = "downlink"
+	RulePurposeDownlinkForwarding RulePurpose = "downlink-forwarding" // indirect forwarding during handover
+)
+
+// Entry of the index of rules of a PFCP Session
+type RuleInfo struct {
+	Ids     RuleIds        `json:"ids"`
+	Purpose RulePurpose    `json:"purpose"`
+	Anchor  bool           `json:"anchor"`            // rules of the UPF-A of the path
+	Listen  *jsonapi.Fteid `json:"listen,omitempty"`  // F-TEID matched by the PDR, nil if the PDR does not match on a F-TEID
+	Forward *jsonapi.Fteid `json:"forward,omitempty"` // F-TEID of the next hop, nil if packets are not sent in a GTP tunnel
+	Flows   []uint16       `json:"flows,omitempty"`   // PDRs of additional QoS Flows, sharing the FAR
+}
+
+// A single BAR is used per PFCP Session
+const barId uint8 = 1
+
+// A single URR is used per PFCP Session
+const urrId uint32 = 1
+
+// Key of the Session-AMBR QER in Pfcprules.qers; QFI 0 is never used by a QoS Flow
+const ambrQerKey uint8 = 0
+
 type Pfcprules struct {
-	createpdrs   []*ie.IE
-	createfars   []*ie.IE
-	updatepdrs   []*ie.IE
-	updatefars   []*ie.IE
-	currentpdrid uint16
-	currentfarid uint32
-	session      pfcpapi.PFCPSessionInterface
+	createpdrs    []*ie.IE
+	createfars    []*ie.IE
+	updatepdrs    []*ie.IE
+	updatefars    []*ie.IE
+	removepdrs    []*ie.IE
+	removefars    []*ie.IE
+	createbar     *ie.IE
+	createurr     *ie.IE
+	createqers    []*ie.IE
+	chooseids     map[uint32]uint8 // CHOOSE ID of pending PDRs with a F-TEID allocated by the UPF, by FAR ID
+	pdrids        idAllocator[uint16]
+	farids        idAllocator[uint32]
+	qerids        idAllocator[uint32]
+	index         map[uint32]*RuleInfo // rules of the PFCP Session by FAR ID, including pending ones
+	qers          map[uint8]uint32     // QER of each QoS Flow by QFI, and Session-AMBR QER, including pending ones
+	installedpdrs map[uint16]*ie.IE    // Create PDR IEs of rules already pushed to the UPF
+	installedfars map[uint32]*ie.IE    // Create FAR IEs of rules already pushed to the UPF
+	installedqers map[uint32]*ie.IE    // Create QER IEs of rules already pushed to the UPF
+	installedbar  *ie.IE               // Create BAR IE, if already pushed to the UPF
+	installedurr  *ie.IE               // Create URR IE, if already pushed to the UPF
+	ue            UeIpAddrs            // addresses of the UE, if its IPv4 address is allocated by the UPF
+	session       *PfcpSession
 
 	sync.Mutex
 }
 
 func NewPfcpRules() *Pfcprules {
 	return &Pfcprules{
-		createpdrs: make([]*ie.IE, 0),
-		createfars: make([]*ie.IE, 0),
-		updatepdrs: make([]*ie.IE, 0),
-		updatefars: make([]*ie.IE, 0),
+		createpdrs:    make([]*ie.IE, 0),
+		createfars:    make([]*ie.IE, 0),
+		updatepdrs:    make([]*ie.IE, 0),
+		updatefars:    make([]*ie.IE, 0),
+		removepdrs:    make([]*ie.IE, 0),
+		removefars:    make([]*ie.IE, 0),
+		createqers:    make([]*ie.IE, 0),
+		chooseids:     make(map[uint32]uint8),
+		index:         make(map[uint32]*RuleInfo),
+		qers:          make(map[uint8]uint32),
+		installedpdrs: make(map[uint16]*ie.IE),
+		installedfars: make(map[uint32]*ie.IE),
+		installedqers: make(map[uint32]*ie.IE),
+	}
+}
+
+// Allocates IDs for a new PDR and its FAR, and adds them to the index.
+// Caller must hold the lock.
+func (r *Pfcprules) nextIds(info RuleInfo) (RuleIds, error) {
+	pdr, err := r.pdrids.next()
+	if err != nil {
+		return RuleIds{}, err
+	}
+	far, err := r.farids.next()
+	if err != nil {
+		r.pdrids.release(pdr)
+		return RuleIds{}, err
+	}
+	info.Ids = RuleIds{Pdr: pdr, Far: far}
+	info.Flows = nil
+	r.index[info.Ids.Far] = &info
+	return info.Ids, nil
+}
+
+// Allocates the ID of a PDR of an additional QoS Flow, sharing the FAR of the PDR of RuleIds.
+// Caller must hold the lock.
+func (r *Pfcprules) nextFlowPdrId(farId uint32) (uint16, error) {
+	id, err := r.pdrids.next()
+	if err != nil {
+		return 0, err
+	}
+	if info, ok := r.index[farId]; ok {
+		info.Flows = append(info.Flows, id)
+	}
+	return id, nil
+}
+
+// Returns the CHOOSE ID shared by the PDRs of this FAR in the pending rules,
+// or ErrNoRuleIdAvailable if all CHOOSE IDs are used by the pending rules.
+// Caller must hold the lock.
+func (r *Pfcprules) chooseId(farId uint32) (uint8, error) {
+	if id, ok := r.chooseids[farId]; ok {
+		return id, nil
+	}
+	if len(r.chooseids) >= math.MaxUint8 {
+		return 0, ErrNoRuleIdAvailable
+	}
+	id := uint8(len(r.chooseids) + 1)
+	r.chooseids[farId] = id
+	return id, nil
+}
+
+// Returns copies of the index entries, sorted by FAR ID.
+// Caller must hold the lock.
+func (r *Pfcprules) rules() []RuleInfo {
+	infos := make([]RuleInfo, 0, len(r.index))
+	for _, id := range slices.Sorted(maps.Keys(r.index)) {
+		info := *r.index[id]
+		info.Flows = slices.Clone(info.Flows)
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Adds Remove PDR and Remove FAR IEs to the pending rules.
+// PDRs of additional QoS Flows sharing the FAR are removed as well.
+// Rules not pushed to the UPF yet are dropped from the pending rules instead, and their IDs are released,
+// as well as pending QERs and URR they were the only ones to use.
+// Unknown rules are ignored.
+// Caller must hold the lock.
+func (r *Pfcprules) remove(ids RuleIds) {
+	info, ok := r.index[ids.Far]
+	if !ok || info.Ids != ids {
+		return
+	}
+	delete(r.index, ids.Far)
+	pdrs := append([]uint16{ids.Pdr}, info.Flows...)
+	isPdr := func(i *ie.IE) bool {
+		id, err := i.PDRID()
+		return err == nil && slices.Contains(pdrs, id)
+	}
+	isFar := func(i *ie.IE) bool {
+		id, err := i.FARID()
+		return err == nil && id == ids.Far
+	}
+	r.updatepdrs = slices.DeleteFunc(r.updatepdrs, isPdr)
+	r.updatefars = slices.DeleteFunc(r.updatefars, isFar)
+	if _, installed := r.installedpdrs[ids.Pdr]; !installed {
+		r.createpdrs = slices.DeleteFunc(r.createpdrs, isPdr)
+		r.createfars = slices.DeleteFunc(r.createfars, isFar)
+		for _, id := range pdrs {
+			r.pdrids.release(id)
+		}
+		r.farids.release(ids.Far)
+		r.dropUnreferenced()
+		return
+	}
+	for _, id := range pdrs {
+		r.removepdrs = append(r.removepdrs, ie.NewRemovePDR(ie.NewPDRID(id)))
+	}
+	r.removefars = append(r.removefars, ie.NewRemoveFAR(ie.NewFARID(ids.Far)))
+}
+
+// Drops pending Create QER and Create URR IEs no longer referenced by a pending Create PDR IE, and releases their IDs.
+// Caller must hold the lock.
+func (r *Pfcprules) dropUnreferenced() {
+	referenced := func(t uint16, id uint32) bool {
+		return slices.ContainsFunc(r.createpdrs, func(pdr *ie.IE) bool {
+			return slices.ContainsFunc(pdr.ChildIEs, func(c *ie.IE) bool {
+				if c.Type != t {
+					return false
+				}
+				if t == ie.QERID {
+					v, err := c.QERID()
+					return err == nil && v == id
+				}
+				v, err := c.URRID()
+				return err == nil && v == id
+			})
+		})
+	}
+	for key, id := range r.qers {
+		if _, ok := r.installedqers[id]; ok || referenced(ie.QERID, id) {
+			continue
+		}
+		delete(r.qers, key)
+		r.createqers = slices.DeleteFunc(r.createqers, func(i *ie.IE) bool {
+			v, err := i.QERID()
+			return err == nil && v == id
+		})
+		r.qerids.release(id)
+	}
+	if r.createurr != nil && !referenced(ie.URRID, urrId) {
+		r.createurr = nil
+	}
+}
+
+// Returns the ID of the BAR of the PFCP Session, adding a Create BAR IE to the pending rules if needed.
+// Caller must hold the lock.
+func (r *Pfcprules) bar() uint8 {
+	if r.installedbar == nil && r.createbar == nil {
+		r.createbar = ie.NewCreateBAR(ie.NewBARID(barId))
+	}
+	return barId
+}
+
+// Returns the ID of the QER with this key (QFI, or ambrQerKey), adding a Create QER IE to the pending rules if needed.
+// QERs are kept for the lifetime of the PFCP Session.
+// Caller must hold the lock.
+func (r *Pfcprules) qer(key uint8, ies ...*ie.IE) (uint32, error) {
+	if id, ok := r.qers[key]; ok {
+		return id, nil
+	}
+	id, err := r.qerids.next()
+	if err != nil {
+		return 0, err
+	}
+	r.qers[key] = id
+	r.createqers = append(r.createqers, ie.NewCreateQER(append([]*ie.IE{
+		ie.NewQERID(id),
+		ie.NewGateStatus(ie.GateStatusOpen, ie.GateStatusOpen),
+	}, ies...)...))
+	return id, nil
+}
+
+// Returns URR ID IEs linking a PDR to the URR of the PFCP Session, adding a Create URR IE to the pending rules if needed.
+// No URR is used if usage is nil.
+// Caller must hold the lock.
+func (r *Pfcprules) urr(usage *config.Usage) []*ie.IE {
+	if usage == nil {
+		return nil
+	}
+	if r.installedurr == nil && r.createurr == nil {
+		r.createurr = newCreateUrr(usage)
+	}
+	return []*ie.IE{ie.NewURRID(urrId)}
+}
+
+// Returns true if no PDR will remain in the PFCP Session once pending rules are pushed.
+// Caller must hold the lock.
+func (r *Pfcprules) empty() bool {
+	return len(r.index) == 0
+}
+
+// Returns pending rules as a list of IEs.
+// Caller must hold the lock.
+func (r *Pfcprules) pending() []*ie.IE {
+	ies := make([]*ie.IE, 0, len(r.createpdrs)+len(r.createfars)+len(r.createqers)+len(r.updatepdrs)+len(r.updatefars)+len(r.removepdrs)+len(r.removefars)+2)
+	ies = append(ies, r.removepdrs...)
+	ies = append(ies, r.removefars...)
+	ies = append(ies, r.createpdrs...)
+	ies = append(ies, r.createfars...)
+	ies = append(ies, r.createqers...)
+	if r.createurr != nil {
+		ies = append(ies, r.createurr)
+	}
+	if r.createbar != nil {
+		ies = append(ies, r.createbar)
+	}
+	ies = append(ies, r.updatepdrs...)
+	ies = append(ies, r.updatefars...)
+	return ies
+}
+
+// Clears pending rules once they have been pushed.
+// Caller must hold the lock.
+func (r *Pfcprules) clear() {
+	r.createpdrs = make([]*ie.IE, 0)
+	r.createfars = make([]*ie.IE, 0)
+	r.updatepdrs = make([]*ie.IE, 0)
+	r.updatefars = make([]*ie.IE, 0)
+	r.removepdrs = make([]*ie.IE, 0)
+	r.removefars = make([]*ie.IE, 0)
+	r.createqers = make([]*ie.IE, 0)
+	r.createurr = nil
+	r.createbar = nil
+	clear(r.chooseids)
+	// QERs that have not been pushed will be created again if needed
+	for key, id := range r.qers {
+		if _, ok := r.installedqers[id]; !ok {
+			delete(r.qers, key)
+			r.qerids.release(id)
+		}
+	}
+}
+
+// Records pending rules as installed on the UPF, then clears them.
+// IDs of removed rules are released, since they are no longer used on the UPF.
+// F-TEIDs allocated by the UPF are read from the Created PDR IEs of the response.
+// Caller must hold the lock.
+func (r *Pfcprules) commit(created []*ie.IE) {
+	for _, i := range r.removepdrs {
+		if id, err := i.PDRID(); err == nil {
+			delete(r.installedpdrs, id)
+			r.pdrids.release(id)
+		}
+	}
+	for _, i := range r.removefars {
+		if id, err := i.FARID(); err == nil {
+			delete(r.installedfars, id)
+			r.farids.release(id)
+		}
+	}
+	for _, i := range r.createpdrs {
+		if id, err := i.PDRID(); err == nil {
+			r.installedpdrs[id] = i
+		}
+	}
+	for _, i := range r.createfars {
+		if id, err := i.FARID(); err == nil {
+			r.installedfars[id] = i
+		}
+	}
+	for _, i := range created {
+		r.allocated(i)
+	}
+	for _, i := range r.createqers {
+		if id, err := i.QERID(); err == nil {
+			r.installedqers[id] = i
+		}
+	}
+	if r.createurr != nil {
+		r.installedurr = r.createurr
+	}
+	if r.createbar != nil {
+		r.installedbar = r.createbar
+	}
+	for _, i := range r.updatepdrs {
+		if id, err := i.PDRID(); err == nil {
+			if installed, ok := r.installedpdrs[id]; ok {
+				r.installedpdrs[id] = applyUpdate(installed, i)
+			}
+		}
+	}
+	for _, i := range r.updatefars {
+		if id, err := i.FARID(); err == nil {
+			if installed, ok := r.installedfars[id]; ok {
+				r.installedfars[id] = applyUpdate(installed, i)
+			}
+		}
+	}
+	r.clear()
+}
+
+// Records the F-TEID and the UE IP Address allocated by the UPF for a PDR, from a Created PDR IE.
+// The installed PDR is updated, so the same values are used if the PFCP Session is established again.
+// Caller must hold the lock.
+func (r *Pfcprules) allocated(created *ie.IE) {
+	id, err := created.PDRID()
+	if err != nil {
+		return
+	}
+	replaced := make([]*ie.IE, 0, 2)
+	if fteid, err := parseFteid(created); err == nil {
+		replaced = append(replaced, newFteid(fteid))
+		for _, info := range r.index {
+			if info.Ids.Pdr == id {
+				info.Listen = fteid
+			}
+		}
+	}
+	if addr, err := parseUeIpAddr(created); err == nil {
+		// UE IP Addresses are only allocated by the UPF for uplink PDRs of the anchor
+		r.ue.Ipv4 = addr
+		replaced = append(replaced, newUeIpAddress(r.ue, false))
+	}
+	if installed, ok := r.installedpdrs[id]; ok {
+		r.installedpdrs[id] = withPdi(installed, replaced...)
+	}
+}
+
+// Returns rules installed on the UPF as Create PDR/Create FAR/Create QER/Create URR/Create BAR IEs,
+// to establish the PFCP Session again (e.g. after an UPF restart).
+// Caller must hold the lock.
+func (r *Pfcprules) installed() []*ie.IE {
+	ies := make([]*ie.IE, 0, len(r.installedpdrs)+len(r.installedfars)+len(r.installedqers)+2)
+	for _, id := range slices.Sorted(maps.Keys(r.installedpdrs)) {
+		ies = append(ies, r.installedpdrs[id])
+	}
+	for _, id := range slices.Sorted(maps.Keys(r.installedfars)) {
+		ies = append(ies, r.installedfars[id])
+	}
+	for _, id := range slices.Sorted(maps.Keys(r.installedqers)) {
+		ies = append(ies, r.installedqers[id])
+	}
+	if r.installedurr != nil {
+		ies = append(ies, r.installedurr)
+	}
+	if r.installedbar != nil {
+		ies = append(ies, r.installedbar)
+	}
+	return ies
+}
+
+// Returns a copy of the Create PDR IE, with IEs of its PDI replaced by the IEs of the same type
+func withPdi(pdr *ie.IE, replaced ...*ie.IE) *ie.IE {
+	children := slices.Clone(pdr.ChildIEs)
+	for i, c := range children {
+		if c.Type != ie.PDI {
+			continue
+		}
+		pdi := slices.Clone(c.ChildIEs)
+		for j, p := range pdi {
+			if k := slices.IndexFunc(replaced, func(r *ie.IE) bool { return r.Type == p.Type }); k >= 0 {
+				pdi[j] = replaced[k]
+			}
+		}
+		children[i] = ie.NewPDI(pdi...)
+	}
+	return ie.NewGroupedIE(pdr.Type, children...)
+}
+
+// Returns a copy of the Create PDR/Create FAR IE with the IEs of the Update PDR/Update FAR IE applied.
+// Update Forwarding Parameters are merged into Forwarding Parameters.
+// PFCPSMReq-Flags only apply to the request, and are not part of the installed rule.
+func applyUpdate(installed *ie.IE, update *ie.IE) *ie.IE {
+	children := slices.Clone(installed.ChildIEs)
+	for _, u := range update.ChildIEs {
+		t := u.Type
+		if t == ie.PFCPSMReqFlags {
+			continue
+		}
+		if t == ie.UpdateForwardingParameters {
+			t = ie.ForwardingParameters
+		}
+		i := slices.IndexFunc(children, func(c *ie.IE) bool { return c.Type == t })
+		switch {
+		case t == ie.ForwardingParameters && i >= 0:
+			children[i] = applyUpdate(children[i], u)
+		case t == ie.ForwardingParameters:
+			children = append(children, ie.NewForwardingParameters(u.ChildIEs...))
+		case i >= 0:
+			children[i] = u
+		default:
+			children = append(children, u)
+		}
 	}
+	return ie.NewGroupedIE(installed.Type, children...)
 }
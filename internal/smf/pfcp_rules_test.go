@@ -0,0 +1,408 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package smf
+
+import (
+	"errors"
+	"math"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/nextmn/cp-lite/internal/config"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+var (
+	testUe      = UeIpAddrs{Ipv4: netip.MustParseAddr("10.0.0.2")}
+	testListen  = &jsonapi.Fteid{Addr: netip.MustParseAddr("127.0.1.11"), Teid: 1}
+	testForward = &jsonapi.Fteid{Addr: netip.MustParseAddr("127.0.2.1"), Teid: 100}
+	testQos     = &config.Qos{
+		SessionAmbr: &config.BitRate{Uplink: 1000, Downlink: 2000},
+		Flows:       []config.QosFlow{{Qfi: 2, FiveQi: 1, Precedence: 10, Filters: []string{"permit out udp from 198.51.100.0/24 to assigned"}}},
+	}
+)
+
+func newTestUpf() *Upf {
+	return NewUpf(config.Upf{NodeID: netip.MustParseAddr("127.0.0.2")}, nil, nil)
+}
+
+// Returns the first IE of this type, searching grouped IEs recursively
+func findIe(ies []*ie.IE, t uint16) *ie.IE {
+	for _, i := range ies {
+		if i.Type == t {
+			return i
+		}
+		if found := findIe(i.ChildIEs, t); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// Returns the Create PDR IE with this PDR ID
+func findPdr(t *testing.T, ies []*ie.IE, id uint16) *ie.IE {
+	t.Helper()
+	for _, i := range ies {
+		if got, err := i.PDRID(); err == nil && i.Type == ie.CreatePDR && got == id {
+			return i
+		}
+	}
+	t.Fatalf("PDR %d not found", id)
+	return nil
+}
+
+// Returns the Create FAR IE with this FAR ID
+func findFar(t *testing.T, ies []*ie.IE, id uint32) *ie.IE {
+	t.Helper()
+	for _, i := range ies {
+		if got, err := i.FARID(); err == nil && i.Type == ie.CreateFAR && got == id {
+			return i
+		}
+	}
+	t.Fatalf("FAR %d not found", id)
+	return nil
+}
+
+func countIes(ies []*ie.IE, t uint16) int {
+	n := 0
+	for _, i := range ies {
+		if i.Type == t {
+			n += 1
+		}
+	}
+	return n
+}
+
+func TestPfcpRulesRemove(t *testing.T) {
+	tests := []struct {
+		name  string
+		qos   *config.Qos
+		usage *config.Usage
+		pdrs  int // PDRs sharing the FAR
+	}{
+		{name: "without QoS", pdrs: 1},
+		{name: "with QoS Flows", qos: testQos, pdrs: 2},
+		{name: "with usage reporting", usage: &config.Usage{Period: time.Minute}, pdrs: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+": rules removed before commit produce no IE", func(t *testing.T) {
+			upf := newTestUpf()
+			upf.usage["internet"] = tt.usage
+			ids, err := upf.CreateUplinkIntermediateWithFteid(testUe, "internet", testListen, testForward, tt.qos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := upf.Rules(testUe.Key())
+			r.Lock()
+			defer r.Unlock()
+			r.remove(ids)
+			if ies := r.pending(); len(ies) != 0 {
+				t.Fatalf("got %d pending IEs, want none", len(ies))
+			}
+			if !r.empty() {
+				t.Fatal("rules are still indexed")
+			}
+			if got, _ := r.nextIds(RuleInfo{}); got != (RuleIds{Pdr: 1, Far: 1}) {
+				t.Fatalf("IDs have not been released: got %+v", got)
+			}
+		})
+
+		t.Run(tt.name+": rules removed after commit", func(t *testing.T) {
+			upf := newTestUpf()
+			ids, err := upf.CreateUplinkIntermediateWithFteid(testUe, "internet", testListen, testForward, tt.qos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := upf.Rules(testUe.Key())
+			r.Lock()
+			defer r.Unlock()
+			r.commit(nil)
+			r.remove(ids)
+			ies := r.pending()
+			if got := countIes(ies, ie.RemovePDR); got != tt.pdrs {
+				t.Fatalf("got %d Remove PDR IEs, want %d", got, tt.pdrs)
+			}
+			if got := countIes(ies, ie.RemoveFAR); got != 1 {
+				t.Fatalf("got %d Remove FAR IEs, want 1", got)
+			}
+			if len(ies) != tt.pdrs+1 {
+				t.Fatalf("got %d pending IEs, want %d", len(ies), tt.pdrs+1)
+			}
+			// IDs are only reused once rules are removed from the UPF
+			if got, _ := r.nextIds(RuleInfo{}); got.Pdr <= uint16(tt.pdrs) || got.Far == ids.Far {
+				t.Fatalf("IDs reused before commit: got %+v", got)
+			}
+			r.clear()
+			r.remove(ids) // already removed: ignored
+			if ies := r.pending(); len(ies) != 0 {
+				t.Fatalf("got %d pending IEs, want none", len(ies))
+			}
+		})
+
+		t.Run(tt.name+": pending updates of removed rules are dropped", func(t *testing.T) {
+			upf := newTestUpf()
+			ids, err := upf.UpdateDownlinkIntermediateWithFteid(testUe, "internet", testListen, testForward)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := upf.Rules(testUe.Key())
+			r.Lock()
+			r.commit(nil)
+			r.Unlock()
+			upf.BufferDownlink(testUe.Key(), ids.Far, false)
+			upf.RemoveRules(testUe.Key(), ids)
+			r.Lock()
+			defer r.Unlock()
+			if ies := r.pending(); findIe(ies, ie.UpdateFAR) != nil {
+				t.Fatal("Update FAR IE of a removed rule is pending")
+			}
+			r.commit(nil)
+			if ies := r.installed(); findIe(ies, ie.CreatePDR) != nil || findIe(ies, ie.CreateFAR) != nil {
+				t.Fatal("removed rules are still installed")
+			}
+			if got, _ := r.nextIds(RuleInfo{}); got != ids {
+				t.Fatalf("IDs have not been released: got %+v, want %+v", got, ids)
+			}
+		})
+	}
+}
+
+func TestPfcpRulesInstalledAfterUpdate(t *testing.T) {
+	newForward := &jsonapi.Fteid{Addr: netip.MustParseAddr("127.0.2.3"), Teid: 300}
+	tests := []struct {
+		name    string
+		updates []func(upf *Upf, ids RuleIds) // each update is committed
+		forward *jsonapi.Fteid                // F-TEID of the Outer Header Creation of the installed FAR
+		buffer  bool
+	}{
+		{
+			name: "forward to a new F-TEID",
+			updates: []func(*Upf, RuleIds){
+				func(upf *Upf, ids RuleIds) {
+					upf.UpdateDownlinkIntermediateDirectForward(testUe.Key(), "internet", ids.Far, newForward, true)
+				},
+			},
+			forward: newForward,
+		},
+		{
+			name: "buffer",
+			updates: []func(*Upf, RuleIds){
+				func(upf *Upf, ids RuleIds) { upf.BufferDownlink(testUe.Key(), ids.Far, true) },
+			},
+			forward: testForward,
+			buffer:  true,
+		},
+		{
+			name: "buffer, then forward to a new F-TEID",
+			updates: []func(*Upf, RuleIds){
+				func(upf *Upf, ids RuleIds) { upf.BufferDownlink(testUe.Key(), ids.Far, false) },
+				func(upf *Upf, ids RuleIds) {
+					upf.UpdateDownlinkIntermediateDirectForward(testUe.Key(), "internet", ids.Far, newForward, false)
+				},
+			},
+			forward: newForward,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upf := newTestUpf()
+			ids, err := upf.UpdateDownlinkIntermediateWithFteid(testUe, "internet", testListen, testForward)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := upf.Rules(testUe.Key())
+			r.Lock()
+			r.commit(nil)
+			r.Unlock()
+			for _, update := range tt.updates {
+				update(upf, ids)
+				r.Lock()
+				r.commit(nil)
+				r.Unlock()
+			}
+
+			r.Lock()
+			defer r.Unlock()
+			ies := r.installed()
+			far := findFar(t, ies, ids.Far)
+			if got := far.HasBUFF(); got != tt.buffer {
+				t.Fatalf("got BUFF %t, want %t", got, tt.buffer)
+			}
+			if got := far.HasFORW(); got == tt.buffer {
+				t.Fatalf("got FORW %t, want %t", got, !tt.buffer)
+			}
+			if findIe(far.ChildIEs, ie.PFCPSMReqFlags) != nil {
+				t.Fatal("PFCPSMReq-Flags IE is installed")
+			}
+			if findIe(far.ChildIEs, ie.UpdateForwardingParameters) != nil {
+				t.Fatal("Update Forwarding Parameters IE is installed")
+			}
+			if got := countIes(far.ChildIEs, ie.ForwardingParameters); got != 1 {
+				t.Fatalf("got %d Forwarding Parameters IEs, want 1", got)
+			}
+			ohc, err := findIe(far.ChildIEs, ie.OuterHeaderCreation).OuterHeaderCreation()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := netip.AddrFrom4([4]byte(ohc.IPv4Address.To4())); ohc.TEID != tt.forward.Teid || got != tt.forward.Addr {
+				t.Fatalf("got Outer Header Creation %s/%d, want %s/%d", got, ohc.TEID, tt.forward.Addr, tt.forward.Teid)
+			}
+			if findIe(far.ChildIEs, ie.DestinationInterface) == nil || findIe(far.ChildIEs, ie.NetworkInstance) == nil {
+				t.Fatal("Forwarding Parameters of the installed FAR are missing")
+			}
+			if tt.buffer && findIe(ies, ie.CreateBAR) == nil {
+				t.Fatal("BAR is not installed")
+			}
+			if info := r.index[ids.Far]; *info.Forward != *tt.forward {
+				t.Fatalf("got forward F-TEID %v in the index, want %v", info.Forward, tt.forward)
+			}
+		})
+	}
+}
+
+func TestPfcpRulesAllocatedFteid(t *testing.T) {
+	upf := newTestUpf()
+	ids, err := upf.createUplinkIntermediate(testUe, "internet", testListen.Addr, nil, testForward, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocated := &jsonapi.Fteid{Addr: testListen.Addr, Teid: 42}
+	r := upf.Rules(testUe.Key())
+	r.Lock()
+	defer r.Unlock()
+	pending := findPdr(t, r.pending(), ids.Pdr)
+	if f, err := findIe(pending.ChildIEs, ie.FTEID).FTEID(); err != nil || !f.HasCh() {
+		t.Fatalf("F-TEID is not chosen by the UPF: %v", err)
+	}
+
+	r.commit([]*ie.IE{ie.NewCreatedPDR(ie.NewPDRID(ids.Pdr), newFteid(allocated))})
+
+	pdr := findPdr(t, r.installed(), ids.Pdr)
+	got, err := parseFteid(findIe(pdr.ChildIEs, ie.FTEID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *allocated {
+		t.Fatalf("got installed F-TEID %v, want %v", got, allocated)
+	}
+	// other IEs of the PDI are kept
+	for _, typ := range []uint16{ie.SourceInterface, ie.NetworkInstance, ie.UEIPAddress} {
+		if findIe(findIe(pdr.ChildIEs, ie.PDI).ChildIEs, typ) == nil {
+			t.Fatalf("IE %d of the PDI is missing", typ)
+		}
+	}
+	if findIe(pdr.ChildIEs, ie.OuterHeaderRemoval) == nil {
+		t.Fatal("Outer Header Removal IE is missing")
+	}
+	if info := r.index[ids.Far]; info.Listen == nil || *info.Listen != *allocated {
+		t.Fatalf("got listen F-TEID %v in the index, want %v", info.Listen, allocated)
+	}
+}
+
+func TestPfcpRulesIdsExhausted(t *testing.T) {
+	t.Run("CHOOSE IDs", func(t *testing.T) {
+		upf := newTestUpf()
+		for range math.MaxUint8 {
+			if _, err := upf.createUplinkIntermediate(testUe, "internet", testListen.Addr, nil, testForward, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := upf.createUplinkIntermediate(testUe, "internet", testListen.Addr, nil, testForward, nil); !errors.Is(err, ErrNoRuleIdAvailable) {
+			t.Fatalf("got error %v, want %v", err, ErrNoRuleIdAvailable)
+		}
+		r := upf.Rules(testUe.Key())
+		r.Lock()
+		defer r.Unlock()
+		if got := countIes(r.pending(), ie.CreatePDR); got != math.MaxUint8 {
+			t.Fatalf("got %d Create PDR IEs, want %d", got, math.MaxUint8)
+		}
+		// CHOOSE IDs are only used in pending rules
+		r.commit(nil)
+		if _, err := upf.newPdrFteid(r, 0, testListen.Addr, nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("PDR IDs of QoS Flows", func(t *testing.T) {
+		upf := newTestUpf()
+		r := upf.Rules(testUe.Key())
+		r.Lock()
+		r.pdrids.last = math.MaxUint16 - 1 // room for the PDR of the default QoS Flow only
+		r.Unlock()
+		if _, err := upf.CreateUplinkIntermediateWithFteid(testUe, "internet", testListen, testForward, testQos); !errors.Is(err, ErrNoRuleIdAvailable) {
+			t.Fatalf("got error %v, want %v", err, ErrNoRuleIdAvailable)
+		}
+		r.Lock()
+		defer r.Unlock()
+		// partially created rules are dropped
+		if ies := r.pending(); len(ies) != 0 {
+			t.Fatalf("got %d pending IEs, want none", len(ies))
+		}
+		if !r.empty() {
+			t.Fatal("rules are still indexed")
+		}
+		if got, err := r.pdrids.next(); err != nil || got != math.MaxUint16 {
+			t.Fatalf("PDR ID has not been released: got %d (%v)", got, err)
+		}
+	})
+}
+
+func TestRemoveRulesUnknownSession(t *testing.T) {
+	upf := newTestUpf()
+	upf.RemoveRules(testUe.Key(), RuleIds{Pdr: 1, Far: 1})
+	if _, ok := upf.lookupRules(testUe.Key()); ok {
+		t.Fatal("rules have been created")
+	}
+}
+
+func TestPfcpRulesAllocatedUeIpAddr(t *testing.T) {
+	allocated := netip.MustParseAddr("10.0.0.5")
+	tests := []struct {
+		name string
+		ipv6 netip.Prefix // IPv6 prefix of the UE, allocated by the SMF
+	}{
+		{name: "ipv4"},
+		{name: "ipv4v6", ipv6: netip.MustParsePrefix("2001:db8:0:1::/64")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upf := newTestUpf()
+			r := NewPfcpRules()
+			r.Lock()
+			defer r.Unlock()
+			r.ue = UeIpAddrs{Ipv4: netip.IPv4Unspecified(), Ipv6: tt.ipv6}
+			ids, err := upf.addUplinkAnchor(r, []*ie.IE{newUeIpAddress(r.ue, false)}, nil, "internet", testListen.Addr, testListen, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pending := findIe(findPdr(t, r.pending(), ids.Pdr).ChildIEs, ie.UEIPAddress)
+			if f, err := pending.UEIPAddress(); err != nil || !pending.HasCHV4() || f.IPv4Address != nil || tt.ipv6.IsValid() != (f.Flags&UEIpAddrFlagV6 != 0) {
+				t.Fatalf("UE IPv4 Address is not chosen by the UPF: %+v (%v)", f, err)
+			}
+
+			r.commit([]*ie.IE{ie.NewCreatedPDR(ie.NewPDRID(ids.Pdr), ie.NewUEIPAddress(UEIpAddrFlagV4, allocated.String(), "", 0, 0))})
+
+			if r.ue.Ipv4 != allocated {
+				t.Fatalf("got UE IP Address %s, want %s", r.ue.Ipv4, allocated)
+			}
+			installed := findIe(findPdr(t, r.installed(), ids.Pdr).ChildIEs, ie.UEIPAddress)
+			f, err := installed.UEIPAddress()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if installed.HasCHV4() || installed.HasSD() || !f.IPv4Address.Equal(allocated.AsSlice()) {
+				t.Fatalf("got installed UE IP Address %+v, want source address %s", f, allocated)
+			}
+			if got, ok := netip.AddrFromSlice(f.IPv6Address); tt.ipv6.IsValid() != (f.Flags&UEIpAddrFlagV6 != 0) || (ok && got != tt.ipv6.Addr()) {
+				t.Fatalf("got installed UE IPv6 prefix %v, want %v", f.IPv6Address, tt.ipv6)
+			}
+		})
+	}
+}
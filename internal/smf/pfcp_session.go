@@ -0,0 +1,115 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package smf
+
+import (
+	pfcpapi "github.com/nextmn/go-pfcp-networking/pfcp/api"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+// PfcpSession is a PFCP Session established by the SMF on an UPF.
+// go-pfcp-networking's CP sessions are not used because they
+// are not able to remove rules, nor to delete sessions.
+type PfcpSession struct {
+	association pfcpapi.PFCPAssociationInterface
+	localFseid  *ie.IE
+	localSeid   uint64
+	remoteSeid  uint64
+}
+
+// Establish a new PFCP Session with the given Create PDR/Create FAR IEs, and returns Created PDR IEs of the response
+func EstablishPfcpSession(association pfcpapi.PFCPAssociationInterface, ies ...*ie.IE) (*PfcpSession, []*ie.IE, error) {
+	if association == nil {
+		return nil, nil, ErrUpfNotAssociated
+	}
+	seid := association.GetNextSEID()
+	localAddr := association.LocalEntity().ListenAddr()
+	var localFseid *ie.IE
+	if localAddr.Is4() {
+		localFseid = ie.NewFSEID(seid, localAddr.AsSlice(), nil)
+	} else {
+		localFseid = ie.NewFSEID(seid, nil, localAddr.AsSlice())
+	}
+	msgIes := make([]*ie.IE, 0, len(ies)+2)
+	msgIes = append(msgIes, association.LocalEntity().NodeID(), localFseid)
+	msgIes = append(msgIes, ies...)
+	resp, err := association.Send(message.NewSessionEstablishmentRequest(0, 0, 0, 0, 0, msgIes...))
+	if err != nil {
+		return nil, nil, err
+	}
+	ser, ok := resp.(*message.SessionEstablishmentResponse)
+	if !ok {
+		return nil, nil, ErrPfcpUnexpectedMessage
+	}
+	if err := checkCause(ser.Cause); err != nil {
+		return nil, nil, err
+	}
+	if ser.UPFSEID == nil {
+		return nil, nil, ErrPfcpUnexpectedMessage
+	}
+	remoteFseid, err := ser.UPFSEID.FSEID()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &PfcpSession{
+		association: association,
+		localFseid:  localFseid,
+		localSeid:   seid,
+		remoteSeid:  remoteFseid.SEID,
+	}, ser.CreatedPDR, nil
+}
+
+// Send a PFCP Session Modification Request with the given IEs, and returns Created PDR IEs of the response
+func (s *PfcpSession) Modify(ies ...*ie.IE) ([]*ie.IE, error) {
+	resp, err := s.association.Send(message.NewSessionModificationRequest(0, 0, s.remoteSeid, 0, 0, ies...))
+	if err != nil {
+		return nil, err
+	}
+	smr, ok := resp.(*message.SessionModificationResponse)
+	if !ok {
+		return nil, ErrPfcpUnexpectedMessage
+	}
+	if err := checkCause(smr.Cause); err != nil {
+		return nil, err
+	}
+	return smr.CreatedPDR, nil
+}
+
+// Send a PFCP Session Deletion Request, and returns Usage Reports of the response
+func (s *PfcpSession) Delete() ([]*ie.IE, error) {
+	resp, err := s.association.Send(message.NewSessionDeletionRequest(0, 0, s.remoteSeid, 0, 0))
+	if err != nil {
+		return nil, err
+	}
+	sdr, ok := resp.(*message.SessionDeletionResponse)
+	if !ok {
+		return nil, ErrPfcpUnexpectedMessage
+	}
+	if err := checkCause(sdr.Cause); err != nil {
+		return nil, err
+	}
+	return sdr.UsageReport, nil
+}
+
+func checkCause(cause *ie.IE) error {
+	if cause == nil {
+		return ErrPfcpUnexpectedMessage
+	}
+	c, err := cause.Cause()
+	if err != nil {
+		return err
+	}
+	if c != ie.CauseRequestAccepted {
+		logrus.WithFields(logrus.Fields{
+			"cause": c,
+		}).Debug("PFCP request rejected by the UPF")
+		return ErrPfcpRequestRejected
+	}
+	return nil
+}
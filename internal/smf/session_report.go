@@ -0,0 +1,85 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package smf
+
+import (
+	"context"
+	"net"
+	"net/netip"
+
+	pfcp "github.com/nextmn/go-pfcp-networking/pfcp"
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+// Called when downlink packets arrive for a PDU Session whose UE is not connected
+type DownlinkDataHandler func(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string)
+
+// Sets the handler of Downlink Data Reports; must be called before Start
+func (smf *Smf) OnDownlinkData(h DownlinkDataHandler) {
+	smf.downlinkData = h
+}
+
+// Handles PFCP Session Report Requests sent by UPFs.
+// Downlink Data Reports are passed to the Downlink Data handler, and Usage Reports are recorded as CDRs;
+// other reports are only acknowledged.
+func (smf *Smf) handleSessionReportRequest(ctx context.Context, msg pfcp.ReceivedMessage) (*pfcp.OutcomingMessage, error) {
+	m, ok := msg.Message.(*message.SessionReportRequest)
+	if !ok {
+		return nil, ErrPfcpUnexpectedMessage
+	}
+	nodeID, ueAddr, session, ok := smf.lookupSession(msg.SenderAddr, msg.SEID())
+	if !ok {
+		logrus.WithFields(logrus.Fields{
+			"upf":  msg.SenderAddr,
+			"seid": msg.SEID(),
+		}).Warn("PFCP Session Report Request for an unknown PFCP Session")
+		return msg.NewResponse(message.NewSessionReportResponse(0, 0, 0, msg.Sequence(), 0, ie.NewCause(ie.CauseSessionContextNotFound)))
+	}
+	if m.ReportType != nil && m.ReportType.HasDLDR() {
+		if ue, dnn, ok := smf.lookupPduSession(ueAddr); ok && smf.downlinkData != nil {
+			logrus.WithFields(logrus.Fields{
+				"ue":      ue.String(),
+				"ue-addr": ueAddr,
+				"dnn":     dnn,
+			}).Info("Downlink Data Report")
+			// the UE is paged once the response has been sent
+			go smf.downlinkData(ue, ueAddr, dnn)
+		}
+	}
+	if m.ReportType != nil && m.ReportType.HasUSAR() {
+		smf.recordUsage(nodeID, ueAddr, m.UsageReport)
+	}
+	return msg.NewResponse(message.NewSessionReportResponse(0, 0, session.remoteSeid, msg.Sequence(), 0, ie.NewCause(ie.CauseRequestAccepted)))
+}
+
+// Returns the Node ID of the UPF sending the request, the UE IP Address and the PFCP Session with this local SEID on this UPF
+func (smf *Smf) lookupSession(sender net.Addr, seid uint64) (netip.Addr, netip.Addr, *PfcpSession, bool) {
+	udpAddr, ok := sender.(*net.UDPAddr)
+	if !ok {
+		return netip.Addr{}, netip.Addr{}, nil, false
+	}
+	nodeID := udpAddr.AddrPort().Addr().Unmap()
+	upf_any, ok := smf.upfs.Load(nodeID)
+	if !ok {
+		return netip.Addr{}, netip.Addr{}, nil, false
+	}
+	ueAddr, session, ok := upf_any.(*Upf).lookupSession(seid)
+	return nodeID, ueAddr, session, ok
+}
+
+// Returns the UE and the DNN of the PDU Session with this UE IP Address
+func (smf *Smf) lookupPduSession(ueAddr netip.Addr) (ue jsonapi.ControlURI, dnn string, found bool) {
+	smf.slices.Range(func(key, value any) bool {
+		ue, found = value.(*Slice).sessions.Lookup(ueAddr)
+		dnn = key.(string)
+		return !found
+	})
+	return ue, dnn, found
+}
@@ -7,6 +7,7 @@ package smf
 
 import (
 	"net/netip"
+	"slices"
 	"sync"
 
 	"github.com/nextmn/json-api/jsonapi"
@@ -27,20 +28,23 @@ func NewSessionsMap() *SessionsMap {
 	}
 }
 
+// Returns a copy of the PDU Session: concurrent procedures update it only through the methods of SessionsMap
 func (s *SessionsMap) Get(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr) (*PduSessionN3, error) {
 	s.RLock()
 	defer s.RUnlock()
 	if sessions, ok := s.m[ueCtrl]; ok {
 		if session, ok := sessions.s[ueAddr]; ok {
-			return session, nil
+			return session.clone(), nil
 		}
 	}
 	return nil, ErrPDUSessionNotFound
 }
 
+// Stores a copy of the PDU Session
 func (s *SessionsMap) Add(ueCtrl jsonapi.ControlURI, session *PduSessionN3) {
 	s.Lock()
 	defer s.Unlock()
+	session = session.clone()
 	m, ok := s.m[ueCtrl]
 	if !ok {
 		s.m[ueCtrl] = &Sessions{
@@ -53,60 +57,229 @@ func (s *SessionsMap) Add(ueCtrl jsonapi.ControlURI, session *PduSessionN3) {
 	}
 }
 
-func (s *SessionsMap) SetNextDownlinkFteid(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, fteid *jsonapi.Fteid) error {
+func (s *SessionsMap) Remove(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr) error {
 	s.Lock()
 	defer s.Unlock()
 	if sessions, ok := s.m[ueCtrl]; ok {
-		if session, ok := sessions.s[ueAddr]; ok {
-			session.NextDownlinkFteid = fteid
+		if _, ok := sessions.s[ueAddr]; ok {
+			delete(sessions.s, ueAddr)
+			if len(sessions.s) == 0 {
+				delete(s.m, ueCtrl)
+			}
 			return nil
 		}
 	}
 	return ErrPDUSessionNotFound
 }
 
-func (s *SessionsMap) GetNextDownlinkFteid(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr) (*jsonapi.Fteid, error) {
+// Sets the downlink path, and the F-TEID of the gNB, and returns a copy of the updated PDU Session.
+// The FAR of the UPF-A of the new path forwards packets: the session is no longer buffering.
+func (s *SessionsMap) SetDownlinkPath(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, fteid *jsonapi.Fteid, dlFarId uint32, rules []UpfRules, drain []UpfRules, area string) (*PduSessionN3, error) {
 	s.Lock()
 	defer s.Unlock()
 	if sessions, ok := s.m[ueCtrl]; ok {
 		if session, ok := sessions.s[ueAddr]; ok {
-			return session.NextDownlinkFteid, nil
+			session.DownlinkFteid = fteid
+			session.DlFarId = dlFarId
+			session.DownlinkRules = slices.Clone(rules)
+			session.DrainRules = slices.Clone(drain)
+			session.Area = area
+			session.Buffering = false
+			return session.clone(), nil
 		}
 	}
 	return nil, ErrPDUSessionNotFound
 }
 
-func (s *SessionsMap) SetUplinkFteid(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, fteid *jsonapi.Fteid) error {
+func (s *SessionsMap) SetDownlinkFteid(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, fteid *jsonapi.Fteid) error {
+	s.Lock()
+	defer s.Unlock()
+	if sessions, ok := s.m[ueCtrl]; ok {
+		if session, ok := sessions.s[ueAddr]; ok {
+			session.DownlinkFteid = fteid
+			return nil
+		}
+	}
+	return ErrPDUSessionNotFound
+}
+
+// Sets a new uplink path, the current one is kept until released, and returns a copy of the updated PDU Session
+func (s *SessionsMap) SetUplinkPath(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, fteid *jsonapi.Fteid, rules []UpfRules) (*PduSessionN3, error) {
 	s.Lock()
 	defer s.Unlock()
 	if sessions, ok := s.m[ueCtrl]; ok {
 		if session, ok := sessions.s[ueAddr]; ok {
 			session.UplinkFteid = fteid
+			session.PreviousUplinkRules = append(session.PreviousUplinkRules, session.UplinkRules...)
+			session.UplinkRules = slices.Clone(rules)
+			return session.clone(), nil
+		}
+	}
+	return nil, ErrPDUSessionNotFound
+}
+
+// Returns rules of the previous uplink path, and forget them
+func (s *SessionsMap) TakePreviousUplinkRules(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr) ([]UpfRules, error) {
+	s.Lock()
+	defer s.Unlock()
+	if sessions, ok := s.m[ueCtrl]; ok {
+		if session, ok := sessions.s[ueAddr]; ok {
+			rules := session.PreviousUplinkRules
+			session.PreviousUplinkRules = nil
+			return rules, nil
+		}
+	}
+	return nil, ErrPDUSessionNotFound
+}
+
+// Restores the uplink path in use before the handover, and returns rules of the abandoned path.
+// If there is no previous uplink path, the current one is kept and no rule is returned.
+func (s *SessionsMap) RestorePreviousUplinkPath(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr) ([]UpfRules, error) {
+	s.Lock()
+	defer s.Unlock()
+	if sessions, ok := s.m[ueCtrl]; ok {
+		if session, ok := sessions.s[ueAddr]; ok {
+			if len(session.PreviousUplinkRules) == 0 {
+				return nil, nil
+			}
+			rules := session.UplinkRules
+			session.UplinkRules = session.PreviousUplinkRules
+			session.UplinkFteid = session.UplinkRules[0].Fteid // F-TEID of the UPF-i
+			session.PreviousUplinkRules = nil
+			return rules, nil
+		}
+	}
+	return nil, ErrPDUSessionNotFound
+}
+
+func (s *SessionsMap) AddForwardingRules(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, rules UpfRules) error {
+	s.Lock()
+	defer s.Unlock()
+	if sessions, ok := s.m[ueCtrl]; ok {
+		if session, ok := sessions.s[ueAddr]; ok {
+			session.ForwardingRules = append(session.ForwardingRules, rules)
 			return nil
 		}
 	}
 	return ErrPDUSessionNotFound
 }
 
-func (s *SessionsMap) SetIndirectForwardingRequired(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, value bool) error {
+// Returns temporary forwarding rules, and forget them
+func (s *SessionsMap) TakeForwardingRules(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr) ([]UpfRules, error) {
 	s.Lock()
 	defer s.Unlock()
 	if sessions, ok := s.m[ueCtrl]; ok {
 		if session, ok := sessions.s[ueAddr]; ok {
-			session.IndirectForwardingRequired = value
+			rules := session.ForwardingRules
+			session.ForwardingRules = nil
+			return rules, nil
+		}
+	}
+	return nil, ErrPDUSessionNotFound
+}
+
+// Marks downlink packets of the session as buffered by the UPF-A
+func (s *SessionsMap) SetBuffering(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr) error {
+	s.Lock()
+	defer s.Unlock()
+	if sessions, ok := s.m[ueCtrl]; ok {
+		if session, ok := sessions.s[ueAddr]; ok {
+			session.Buffering = true
 			return nil
 		}
 	}
 	return ErrPDUSessionNotFound
 }
 
-func (s *SessionsMap) GetIndirectForwardingRequired(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr) (bool, error) {
-	s.RLock()
-	defer s.RUnlock()
+// Returns true if downlink packets of the session are buffered, and forget it
+func (s *SessionsMap) TakeBuffering(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
 	if sessions, ok := s.m[ueCtrl]; ok {
 		if session, ok := sessions.s[ueAddr]; ok {
-			return session.IndirectForwardingRequired, nil
+			buffering := session.Buffering
+			session.Buffering = false
+			return buffering, nil
 		}
 	}
 	return false, ErrPDUSessionNotFound
 }
+
+// PDU Session of an UE, as returned by List
+type UePduSession struct {
+	Ue jsonapi.ControlURI `json:"ue"`
+	PduSessionN3
+}
+
+// Returns a copy of PDU Sessions. If ueCtrl is not nil, only PDU Sessions of this UE are returned.
+func (s *SessionsMap) List(ueCtrl *jsonapi.ControlURI) []UePduSession {
+	s.RLock()
+	defer s.RUnlock()
+	r := make([]UePduSession, 0)
+	for ue, sessions := range s.m {
+		if ueCtrl != nil && ue != *ueCtrl {
+			continue
+		}
+		for _, session := range sessions.s {
+			r = append(r, UePduSession{Ue: ue, PduSessionN3: *session.clone()})
+		}
+	}
+	return r
+}
+
+// Returns the UE of the PDU Session with this UE IP Address
+func (s *SessionsMap) Lookup(ueAddr netip.Addr) (jsonapi.ControlURI, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	for ue, sessions := range s.m {
+		if _, ok := sessions.s[ueAddr]; ok {
+			return ue, true
+		}
+	}
+	return jsonapi.ControlURI{}, false
+}
+
+// Returns true if the UE has at least one PDU Session
+func (s *SessionsMap) Has(ueCtrl jsonapi.ControlURI) bool {
+	s.RLock()
+	defer s.RUnlock()
+	sessions, ok := s.m[ueCtrl]
+	return ok && len(sessions.s) > 0
+}
+
+// Returns the number of PDU Sessions
+func (s *SessionsMap) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	n := 0
+	for _, sessions := range s.m {
+		n += len(sessions.s)
+	}
+	return n
+}
+
+// Returns the number of PDU Sessions per RAN area
+func (s *SessionsMap) LenPerArea() map[string]int {
+	s.RLock()
+	defer s.RUnlock()
+	r := make(map[string]int)
+	for _, sessions := range s.m {
+		for _, session := range sessions.s {
+			r[session.Area] += 1
+		}
+	}
+	return r
+}
+
+// Returns a deep copy of the PDU Session, not shared with the sessions map.
+// F-TEIDs are shared: they are never modified once allocated.
+func (s *PduSessionN3) clone() *PduSessionN3 {
+	c := *s
+	c.UplinkRules = slices.Clone(s.UplinkRules)
+	c.DownlinkRules = slices.Clone(s.DownlinkRules)
+	c.PreviousUplinkRules = slices.Clone(s.PreviousUplinkRules)
+	c.ForwardingRules = slices.Clone(s.ForwardingRules)
+	c.DrainRules = slices.Clone(s.DrainRules)
+	c.UeMac = slices.Clone(s.UeMac)
+	return &c
+}
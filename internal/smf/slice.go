@@ -7,9 +7,12 @@ package smf
 
 import (
 	"net/netip"
+	"slices"
 	"sync"
 
 	"github.com/nextmn/cp-lite/internal/config"
+
+	"github.com/nextmn/json-api/jsonapi"
 )
 
 type SlicesMap struct {
@@ -31,7 +34,40 @@ func NewSlicesMap(slices map[string]config.Slice, areas map[string]config.Area)
 			}
 		}
 
-		sl := NewSlice(slice.Pool, upfs, paths)
+		reserved := make([]netip.Addr, 0, len(slice.Excluded)+1)
+		if slice.Gateway.IsValid() {
+			reserved = append(reserved, slice.Gateway)
+		}
+		reserved = append(reserved, slice.Excluded...)
+		static := make(map[jsonapi.ControlURI]netip.Addr, len(slice.Static))
+		for _, s := range slice.Static {
+			static[s.Ue] = s.Addr
+		}
+
+		sl := NewSlice(NewUeIpPool(slice.Pool, reserved, static), upfs, paths)
+		sl.SessionType = slice.Type
+		if sl.SessionType == "" {
+			sl.SessionType = config.PduSessionTypeIpv4
+		}
+		prefixLength := slice.Ipv6PrefixLength
+		if prefixLength == 0 {
+			prefixLength = config.DefaultIpv6PrefixLength
+		}
+		sl.Ipv6Pool = NewUePrefixPool(slice.Ipv6Pool, prefixLength)
+		sl.UeMacs = make(map[jsonapi.ControlURI]config.MacAddr, len(slice.UeMacs))
+		for _, m := range slice.UeMacs {
+			sl.UeMacs[m.Ue] = m.Mac
+		}
+		sl.UeIpAllocation = slice.UeIpAllocation
+		if sl.UeIpAllocation == "" {
+			sl.UeIpAllocation = config.UeIpAllocationCp
+		}
+		sl.EndMarker = slice.EndMarker
+		sl.Handover = slice.Handover
+		if sl.Handover == "" {
+			sl.Handover = config.HandoverForwarding
+		}
+		sl.Qos = newQos(slice.Qos)
 		m.Store(k, sl)
 	}
 	return &m
@@ -39,16 +75,80 @@ func NewSlicesMap(slices map[string]config.Slice, areas map[string]config.Area)
 
 type Slice struct {
 	Upfs     []netip.Addr
-	Pool     *UeIpPool
+	Pool     *UeIpPool // IPv4 addresses
+	Ipv6Pool *UeIpPool // IPv6 prefixes
+
+	UeMacs map[jsonapi.ControlURI]config.MacAddr // MAC addresses of UEs, matched by PDRs of ethernet PDU Sessions
+
 	sessions *SessionsMap
 	Paths    map[string][]config.GTPInterface
+
+	SessionType    config.PduSessionType   // type of PDU Sessions, with their UE IP Addresses allocated from Pool and/or Ipv6Pool
+	UeIpAllocation config.UeIpAllocation   // allocation of UE IP Addresses, by the CP (from Pool) or by the anchor UPF
+	EndMarker      bool                    // send End Marker packets when the downlink path is switched during handover
+	Handover       config.HandoverStrategy // handling of downlink packets during handover
+	Qos            *config.Qos             // QoS of PDU Sessions, with defaults applied; nil if not configured
 }
 
-func NewSlice(pool netip.Prefix, upfs []netip.Addr, paths map[string][]config.GTPInterface) *Slice {
+// Returns a copy of the QoS configuration, with defaults applied
+func newQos(qos *config.Qos) *config.Qos {
+	if qos == nil {
+		return nil
+	}
+	r := *qos
+	if r.Default5qi == 0 {
+		r.Default5qi = config.Default5qi
+	}
+	r.Flows = slices.Clone(qos.Flows)
+	for i := range r.Flows {
+		if r.Flows[i].Precedence == 0 {
+			r.Flows[i].Precedence = config.DefaultQosPrecedence
+		}
+	}
+	return &r
+}
+
+func NewSlice(pool *UeIpPool, upfs []netip.Addr, paths map[string][]config.GTPInterface) *Slice {
 	return &Slice{
-		Pool:     NewUeIpPool(pool),
+		Pool:     pool,
 		Upfs:     upfs,
 		sessions: NewSessionsMap(),
 		Paths:    paths,
 	}
 }
+
+// Returns the pool of the addresses identifying PDU Sessions of this type,
+// or nil for ethernet PDU Sessions, which are identified by ethernetSessionId
+func (s *Slice) pool(sessionType config.PduSessionType) *UeIpPool {
+	switch sessionType {
+	case config.PduSessionTypeIpv6:
+		return s.Ipv6Pool
+	case config.PduSessionTypeEthernet:
+		return nil
+	}
+	return s.Pool
+}
+
+// Returns the identifier of the ethernet PDU Session of an UE on a DNN, since it has no UE IP Address:
+// the IPv6 link-local address derived from the MAC address of the UE (modified EUI-64, RFC 4291),
+// with the DNN as zone. It is not allocated from a pool, and never equals an address of an IP PDU Session.
+func ethernetSessionId(mac config.MacAddr, dnn string) netip.Addr {
+	var b [16]byte
+	b[0], b[1] = 0xfe, 0x80
+	b[8], b[9], b[10] = mac[0]^0x02, mac[1], mac[2]
+	b[11], b[12] = 0xff, 0xfe
+	b[13], b[14], b[15] = mac[3], mac[4], mac[5]
+	return netip.AddrFrom16(b).WithZone(dnn)
+}
+
+// Checks the MAC address of the UE is configured, if PDU Sessions of this slice are ethernet PDU Sessions:
+// otherwise, PDRs would match packets of any UE
+func (s *Slice) checkUeMac(ueCtrl jsonapi.ControlURI) error {
+	if s.SessionType != config.PduSessionTypeEthernet {
+		return nil
+	}
+	if _, ok := s.UeMacs[ueCtrl]; !ok {
+		return ErrUeMacNotFound
+	}
+	return nil
+}
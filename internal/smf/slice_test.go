@@ -0,0 +1,56 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package smf
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/nextmn/cp-lite/internal/config"
+
+	"github.com/nextmn/json-api/jsonapi"
+)
+
+func TestCheckUeMac(t *testing.T) {
+	known := mustControlURI(t, "http://192.0.2.6:8080")
+	unknown := mustControlURI(t, "http://192.0.2.7:8080")
+	macs := map[jsonapi.ControlURI]config.MacAddr{known: {0x02, 0, 0, 0, 0, 0x06}}
+	tests := []struct {
+		name        string
+		sessionType config.PduSessionType
+		ue          jsonapi.ControlURI
+		err         error
+	}{
+		{"ethernet, known UE", config.PduSessionTypeEthernet, known, nil},
+		{"ethernet, unknown UE", config.PduSessionTypeEthernet, unknown, ErrUeMacNotFound},
+		{"ipv4", config.PduSessionTypeIpv4, unknown, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Slice{SessionType: tt.sessionType, UeMacs: macs}
+			if err := s.checkUeMac(tt.ue); !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestEthernetSessionId(t *testing.T) {
+	mac := config.MacAddr{0x02, 0, 0, 0, 0, 0x06}
+	id := ethernetSessionId(mac, "internet")
+	if want := netip.MustParseAddr("fe80::ff:fe00:6%internet"); id != want {
+		t.Fatalf("got %s, want %s", id, want)
+	}
+	if other := ethernetSessionId(mac, "ims"); other == id {
+		t.Fatalf("PDU Sessions on different DNNs have the same identifier %s", id)
+	}
+	// identifiers are sent in n1n2 messages
+	var parsed netip.Addr
+	if err := parsed.UnmarshalText([]byte(id.String())); err != nil || parsed != id {
+		t.Fatalf("got %s (%v) after a round trip, want %s", parsed, err, id)
+	}
+}
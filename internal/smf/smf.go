@@ -7,53 +7,101 @@ package smf
 
 import (
 	"context"
+	"errors"
 	"net/netip"
+	"slices"
+	"sync/atomic"
 	"time"
 
+	"github.com/nextmn/cp-lite/internal/cdr"
 	"github.com/nextmn/cp-lite/internal/common"
 	"github.com/nextmn/cp-lite/internal/config"
+	"github.com/nextmn/cp-lite/internal/metrics"
 
 	pfcp "github.com/nextmn/go-pfcp-networking/pfcp"
 	"github.com/nextmn/json-api/jsonapi"
 
 	"github.com/sirupsen/logrus"
-	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
 )
 
 type Smf struct {
 	common.WithContext
 
-	upfs    *UpfsMap
-	slices  *SlicesMap
-	Areas   AreasMap
-	srv     *pfcp.PFCPEntityCP
-	started bool
-	closed  chan struct{}
+	upfs         *UpfsMap
+	slices       *SlicesMap
+	Areas        AreasMap
+	srv          *pfcp.PFCPEntityCP
+	association  config.Association
+	requiredUpfs []netip.Addr // UPFs that must be associated to be ready
+	heartbeat    config.Heartbeat
+	started      atomic.Bool
+	closed       chan struct{}
+	downlinkData DownlinkDataHandler
+	cdrs         *cdr.Recorder
 }
 
-func NewSmf(addr netip.Addr, slices map[string]config.Slice, areas map[string]config.Area) *Smf {
+func NewSmf(addr netip.Addr, slices map[string]config.Slice, areas map[string]config.Area, association *config.Association, heartbeat *config.Heartbeat, metrics *metrics.Metrics, cdrs *cdr.Recorder) *Smf {
 	s := NewSlicesMap(slices, areas)
-	upfs := NewUpfsMap(slices)
-	return &Smf{
+	smf := Smf{
 		srv:    pfcp.NewPFCPEntityCP(addr.String(), addr),
 		slices: s,
-		upfs:   upfs,
 		Areas:  NewAreasMap(areas),
+		association: config.Association{
+			InitialBackoff: DefaultAssociationInitialBackoff,
+			MaxBackoff:     DefaultAssociationMaxBackoff,
+		},
+		heartbeat: config.Heartbeat{
+			Interval:         DefaultHeartbeatInterval,
+			FailureThreshold: DefaultHeartbeatFailureThreshold,
+		},
 		closed: make(chan struct{}),
+		cdrs:   cdrs,
+	}
+	upfs := NewUpfsMap(slices, metrics, smf.recordUsage)
+	smf.upfs = upfs
+	if association != nil {
+		smf.association.Retry = association.Retry
+		if association.InitialBackoff > 0 {
+			smf.association.InitialBackoff = association.InitialBackoff
+		}
+		if association.MaxBackoff > 0 {
+			smf.association.MaxBackoff = association.MaxBackoff
+		}
+		smf.requiredUpfs = append(smf.requiredUpfs, association.Required...)
+	}
+	if len(smf.requiredUpfs) == 0 {
+		upfs.Range(func(key, value any) bool {
+			smf.requiredUpfs = append(smf.requiredUpfs, key.(netip.Addr))
+			return true
+		})
 	}
+	if heartbeat != nil {
+		if heartbeat.Interval > 0 {
+			smf.heartbeat.Interval = heartbeat.Interval
+		}
+		if heartbeat.FailureThreshold > 0 {
+			smf.heartbeat.FailureThreshold = heartbeat.FailureThreshold
+		}
+	}
+	smf.registerMetrics(metrics)
+	return &smf
 }
 
 func (smf *Smf) Start(ctx context.Context) error {
-	if smf.started {
+	if smf.started.Load() {
 		return ErrSmfAlreadyStarted
 	}
 	if err := smf.InitContext(ctx); err != nil {
 		return err
 	}
+	if err := smf.srv.AddHandler(message.MsgTypeSessionReportRequest, smf.handleSessionReportRequest); err != nil {
+		return err
+	}
 	logrus.Info("Starting PFCP Server")
 	go func() {
 		defer func() {
-			smf.started = false
+			smf.started.Store(false)
 			close(smf.closed)
 		}()
 		if err := smf.srv.ListenAndServeContext(ctx); err != nil {
@@ -68,17 +116,16 @@ func (smf *Smf) Start(ctx context.Context) error {
 	}
 	var failure error
 	smf.upfs.Range(func(key, value any) bool {
-		nodeId := key.(netip.Addr)
 		upf := value.(*Upf)
-		association, err := smf.srv.NewEstablishedPFCPAssociation(ie.NewNodeIDHeuristic(nodeId.String()))
-		if err != nil {
-			logrus.WithError(err).WithFields(logrus.Fields{
-				"upf": nodeId,
-			}).Error("Could not perform PFCP association")
+		if err := upf.Init(ctx); err != nil {
 			failure = err
 			return false
 		}
-		if err := upf.Associate(ctx, association); err != nil {
+		if smf.association.Retry {
+			go smf.associateWithRetry(ctx, upf)
+			return true
+		}
+		if err := smf.associate(ctx, upf); err != nil {
 			failure = err
 			return false
 		}
@@ -87,17 +134,35 @@ func (smf *Smf) Start(ctx context.Context) error {
 	if failure != nil {
 		return failure
 	}
-	logrus.Info("PFCP Associations complete")
-	smf.started = true
+	if smf.association.Retry {
+		logrus.Info("PFCP Associations in progress")
+	} else {
+		logrus.Info("PFCP Associations complete")
+	}
+	smf.started.Store(true)
 	return nil
 }
 
+// Returns true once the SMF is started and required UPFs are associated and not known to be down
+func (smf *Smf) Ready() bool {
+	if !smf.started.Load() {
+		return false
+	}
+	for _, nodeID := range smf.requiredUpfs {
+		upf, ok := smf.upfs.Load(nodeID)
+		if !ok || !upf.(*Upf).Available() {
+			return false
+		}
+	}
+	return true
+}
+
 func (smf *Smf) CreateSessionDownlink(ueCtrl jsonapi.ControlURI, ueIp netip.Addr, dnn string, gnbCtrl jsonapi.ControlURI, gnbFteid jsonapi.Fteid) (*PduSessionN3, error) {
 	return smf.CreateSessionDownlinkContext(smf.Context(), ueCtrl, ueIp, dnn, gnbCtrl, gnbFteid)
 }
 
 func (smf *Smf) CreateSessionDownlinkContext(ctx context.Context, ueCtrl jsonapi.ControlURI, ueIp netip.Addr, dnn string, gnbCtrl jsonapi.ControlURI, gnbFteid jsonapi.Fteid) (*PduSessionN3, error) {
-	if !smf.started {
+	if !smf.started.Load() {
 		return nil, ErrSmfNotStarted
 	}
 	if ctx == nil {
@@ -123,11 +188,10 @@ func (smf *Smf) CreateSessionDownlinkContext(ctx context.Context, ueCtrl jsonapi
 	if err != nil {
 		return nil, err
 	}
-	session.DownlinkFteid = &gnbFteid
 	if len(slice.Upfs) == 0 {
 		return nil, ErrUpfNotFound
 	}
-	last_fteid := session.DownlinkFteid
+	last_fteid := &gnbFteid
 
 	area, ok := smf.Areas.Area(gnbCtrl)
 	if !ok {
@@ -139,6 +203,23 @@ func (smf *Smf) CreateSessionDownlinkContext(ctx context.Context, ueCtrl jsonapi
 		return nil, ErrPathNotFound
 	}
 
+	previousRules := session.DownlinkRules
+	var previousAnchor *UpfRules // downlink rule of the UPF-A of the previous path
+	if len(previousRules) > 0 {
+		previousAnchor = &previousRules[len(previousRules)-1]
+	}
+	// when the UPF-A changes while it buffers downlink packets, its rules are kept
+	// to forward buffered packets on the new path, until the next path change
+	var drain []UpfRules
+	var drainFteid *jsonapi.Fteid // F-TEID the UPF-A of the new path forwards packets to
+	if session.Buffering && previousAnchor != nil && len(path) > 0 && previousAnchor.NodeID != path[len(path)-1].NodeID {
+		drain = []UpfRules{*previousAnchor}
+		previousRules = slices.DeleteFunc(slices.Clone(previousRules), func(r UpfRules) bool { return r == drain[0] })
+	}
+	// rules draining a previous UPF-A are not needed anymore
+	previousRules = append(slices.Clone(previousRules), session.DrainRules...)
+	rules := make([]UpfRules, len(path))
+	var dlFarId uint32
 	for i, gtpInterface := range path {
 		upf_any, ok := smf.upfs.Load(gtpInterface.NodeID)
 		if !ok {
@@ -146,16 +227,67 @@ func (smf *Smf) CreateSessionDownlinkContext(ctx context.Context, ueCtrl jsonapi
 		}
 		upf := upf_any.(*Upf)
 
-		var far_id uint32
+		rules[i].NodeID = gtpInterface.NodeID
 		if i == len(path)-1 {
-			far_id = upf.UpdateDownlinkAnchor(session.UeIpAddr, dnn, last_fteid)
+			if previousAnchor != nil && previousAnchor.NodeID == gtpInterface.NodeID && slices.Contains(previousRules, *previousAnchor) {
+				// the UPF-A is unchanged: its FAR is updated instead of being replaced,
+				// so packets buffered during the handover are forwarded on the new path
+				upf.UpdateDownlinkIntermediateDirectForward(session.UeIpAddr, dnn, previousAnchor.Ids.Far, last_fteid, slice.EndMarker)
+				rules[i] = *previousAnchor
+				previousRules = slices.DeleteFunc(slices.Clone(previousRules), func(r UpfRules) bool { return r == *previousAnchor })
+			} else {
+				drainFteid = last_fteid
+				if rules[i].Ids, err = upf.UpdateDownlinkAnchor(session.UeIpAddrs(), dnn, last_fteid, slice.Qos); err != nil {
+					return nil, err
+				}
+			}
 		} else {
-			last_fteid, far_id, err = upf.UpdateDownlinkIntermediateContext(ctx, session.UeIpAddr, dnn, gtpInterface.InterfaceAddr, last_fteid)
+			last_fteid, rules[i].Ids, err = upf.UpdateDownlinkIntermediateContext(ctx, session.UeIpAddrs(), dnn, gtpInterface.InterfaceAddr, last_fteid)
 			if err != nil {
 				return nil, err
 			}
+			rules[i].Fteid = last_fteid
+		}
+		if i == 0 {
+			// FAR of the UPF-i, updated on handover
+			dlFarId = rules[i].Ids.Far
+		}
+		// Previous downlink rules on this UPF are removed in the same PFCP Session Modification Request,
+		// otherwise two PDRs would match downlink packets of the UE
+		var removed []UpfRules
+		removed, previousRules = removeRulesOnUpf(upf, gtpInterface.NodeID, session.UeIpAddr, previousRules)
+		if err := upf.UpdateSession(session.UeIpAddr); err != nil {
+			return nil, err
+		}
+		if i < len(path)-1 {
+			// the F-TEID may have been allocated by the UPF
+			if last_fteid, err = upf.ListenFteid(session.UeIpAddr, rules[i].Ids); err != nil {
+				return nil, err
+			}
+			rules[i].Fteid = last_fteid
+		}
+		for _, r := range removed {
+			upf.ReleaseFteid(r.Fteid)
+		}
+	}
+	session, err = slice.sessions.SetDownlinkPath(ueCtrl, ueIp, &gnbFteid, dlFarId, rules, drain, area)
+	if err != nil {
+		return nil, err
+	}
+
+	// Release previous downlink rules remaining on UPFs that are not on the new path
+	if err := smf.releaseRules(session.UeIpAddr, previousRules); err != nil {
+		return nil, err
+	}
+
+	for _, r := range drain {
+		// packets buffered by the previous UPF-A are flushed on the new path
+		upf_any, ok := smf.upfs.Load(r.NodeID)
+		if !ok {
+			return nil, ErrUpfNotFound
 		}
-		session.DlFarId = far_id
+		upf := upf_any.(*Upf)
+		upf.UpdateDownlinkIntermediateDirectForward(session.UeIpAddr, dnn, r.Ids.Far, drainFteid, slice.EndMarker)
 		if err := upf.UpdateSession(session.UeIpAddr); err != nil {
 			return nil, err
 		}
@@ -164,7 +296,7 @@ func (smf *Smf) CreateSessionDownlinkContext(ctx context.Context, ueCtrl jsonapi
 }
 
 func (smf *Smf) CreateSessionDownlinkFWUpfIContext(ctx context.Context, ueCtrl jsonapi.ControlURI, ueIp netip.Addr, dnn string, fwUpfi *config.GTPInterface, DlFteid jsonapi.Fteid) (*jsonapi.Fteid, error) {
-	if !smf.started {
+	if !smf.started.Load() {
 		return nil, ErrSmfNotStarted
 	}
 	if ctx == nil {
@@ -187,13 +319,35 @@ func (smf *Smf) CreateSessionDownlinkFWUpfIContext(ctx context.Context, ueCtrl j
 	}
 	upf := upf_any.(*Upf)
 
-	fteid, _, err := upf.UpdateDownlinkIntermediateContext(ctx, ueIp, dnn, fwUpfi.InterfaceAddr, &DlFteid)
+	s, ok := smf.slices.Load(dnn)
+	if !ok {
+		return nil, ErrDnnNotFound
+	}
+	slice := s.(*Slice)
+	session, err := slice.sessions.Get(ueCtrl, ueIp)
+	if err != nil {
+		return nil, err
+	}
+
+	fteid, ids, err := upf.CreateDownlinkForwardingContext(ctx, session.UeIpAddrs(), dnn, fwUpfi.InterfaceAddr, &DlFteid)
 	if err != nil {
 		return nil, err
 	}
 	if err := upf.UpdateSession(ueIp); err != nil {
 		return nil, err
 	}
+	// the F-TEID may have been allocated by the UPF
+	if fteid, err = upf.ListenFteid(ueIp, ids); err != nil {
+		return nil, err
+	}
+	// forwarding rules are temporary: they will be released at the end of the handover
+	if err := slice.sessions.AddForwardingRules(ueCtrl, ueIp, UpfRules{
+		NodeID: fwUpfi.NodeID,
+		Ids:    ids,
+		Fteid:  fteid,
+	}); err != nil {
+		return nil, err
+	}
 	return fteid, nil
 }
 
@@ -224,13 +378,32 @@ func (smf *Smf) SessionFirstUpf(ueCtrl jsonapi.ControlURI, ueIp netip.Addr, dnn
 
 }
 
-func (smf *Smf) GetNextUeIpAddr(dnn string) (netip.Addr, error) {
+// Allocates an UE IP Address from the pool of the slice, identifying the new PDU Session.
+// For ipv6 PDU Sessions, this is the first address of an IPv6 prefix.
+// Ethernet PDU Sessions have no UE IP Address: the identifier of the PDU Session is returned instead (see ethernetSessionId).
+// If UE IP Addresses are allocated by the anchor UPF, an invalid address is returned:
+// the address is known once the uplink path has been created by CreateSessionUplinkContext.
+func (smf *Smf) GetNextUeIpAddr(ueCtrl jsonapi.ControlURI, dnn string) (netip.Addr, error) {
 	s, ok := smf.slices.Load(dnn)
 	if !ok {
 		return netip.Addr{}, ErrDnnNotFound
 	}
 	slice := s.(*Slice)
-	return slice.Pool.Next()
+	if err := slice.checkUeMac(ueCtrl); err != nil {
+		return netip.Addr{}, err
+	}
+	if slice.UeIpAllocation == config.UeIpAllocationUp {
+		return netip.Addr{}, nil
+	}
+	if slice.SessionType == config.PduSessionTypeEthernet {
+		id := ethernetSessionId(slice.UeMacs[ueCtrl], dnn)
+		// PDRs could not tell two ethernet PDU Sessions of the UE on this DNN apart
+		if _, err := slice.sessions.Get(ueCtrl, id); err == nil {
+			return netip.Addr{}, ErrUeIpAddrUnavailable
+		}
+		return id, nil
+	}
+	return slice.pool(slice.SessionType).Next(ueCtrl)
 }
 
 func (smf *Smf) CreateSessionUplink(ueCtrl jsonapi.ControlURI, ueIpAddr netip.Addr, gnbCtrl jsonapi.ControlURI, dnn string) (*PduSessionN3, error) {
@@ -238,7 +411,7 @@ func (smf *Smf) CreateSessionUplink(ueCtrl jsonapi.ControlURI, ueIpAddr netip.Ad
 }
 
 func (smf *Smf) CreateSessionUplinkContext(ctx context.Context, ueCtrl jsonapi.ControlURI, ueIpAddr netip.Addr, gnbCtrl jsonapi.ControlURI, dnn string) (*PduSessionN3, error) {
-	if !smf.started {
+	if !smf.started.Load() {
 		return nil, ErrSmfNotStarted
 	}
 	if ctx == nil {
@@ -282,12 +455,92 @@ func (smf *Smf) CreateSessionUplinkContext(ctx context.Context, ueCtrl jsonapi.C
 		return nil, ErrUpfNotFound
 	}
 	upfa := upfa_any.(*Upf)
-	last_fteid, err := upfa.CreateUplinkAnchorContext(ctx, ueIpAddr, dnn, upfaInterface.InterfaceAddr)
-	if err != nil {
-		return nil, err
+	rules := make([]UpfRules, len(path))
+	// the UE IP Address is allocated by the UPF-A when the PFCP Session is established
+	allocatedByUpf := !ueIpAddr.IsValid()
+	if allocatedByUpf && slice.UeIpAllocation != config.UeIpAllocationUp {
+		return nil, ErrUeIpAddrNotAllocated
+	}
+	// the IPv6 prefix of ipv4v6 PDU Sessions is allocated with their first uplink path
+	ue := UeIpAddrs{}
+	allocatedPrefix := false
+	if session, err := slice.sessions.Get(ueCtrl, ueIpAddr); err == nil {
+		ue = session.UeIpAddrs()
+	} else {
+		switch slice.SessionType {
+		case config.PduSessionTypeIpv4:
+			ue.Ipv4 = ueIpAddr
+		case config.PduSessionTypeIpv6:
+			ue.Ipv6 = slice.Ipv6Pool.Prefix(ueIpAddr)
+		case config.PduSessionTypeIpv4v6:
+			prefix, err := slice.Ipv6Pool.NextPrefix(ueCtrl)
+			if err != nil {
+				return nil, err
+			}
+			ue = UeIpAddrs{Ipv4: ueIpAddr, Ipv6: prefix}
+			allocatedPrefix = true
+		case config.PduSessionTypeEthernet:
+			if err := slice.checkUeMac(ueCtrl); err != nil {
+				return nil, err
+			}
+			ue = UeIpAddrs{SessionId: ueIpAddr, Mac: slice.UeMacs[ueCtrl]}
+		}
 	}
-	if err := upfa.CreateSession(ueIpAddr); err != nil {
-		return nil, err
+	// rules already created are removed if the path cannot be fully created
+	rollback := func(err error, created []UpfRules) error {
+		if rbErr := smf.releaseRules(ueIpAddr, created); rbErr != nil {
+			logrus.WithError(rbErr).WithFields(logrus.Fields{
+				"ue-addr": ueIpAddr,
+				"dnn":     dnn,
+			}).Error("Could not roll back uplink path")
+			return errors.Join(err, ErrRollbackFailed)
+		}
+		if allocatedByUpf {
+			slice.Pool.Release(ueIpAddr)
+		}
+		if allocatedPrefix {
+			slice.Ipv6Pool.Release(ue.Ipv6.Addr())
+		}
+		return err
+	}
+	var last_fteid *jsonapi.Fteid
+	var ids RuleIds
+	var err error
+	if allocatedByUpf {
+		ueIpAddr, last_fteid, ids, err = upfa.EstablishUplinkAnchorContext(ctx, ue, dnn, upfaInterface.InterfaceAddr, slice.Qos)
+		if err != nil {
+			return nil, err
+		}
+		ue.Ipv4 = ueIpAddr
+		rules[len(path)-1] = UpfRules{
+			NodeID: upfaInterface.NodeID,
+			Ids:    ids,
+			Fteid:  last_fteid,
+		}
+		if err := slice.Pool.Lease(ueCtrl, ueIpAddr); err != nil {
+			// the address has not been leased: it must not be released
+			allocatedByUpf = false
+			return nil, rollback(err, rules[len(path)-1:])
+		}
+	} else {
+		last_fteid, ids, err = upfa.CreateUplinkAnchorContext(ctx, ue, dnn, upfaInterface.InterfaceAddr, slice.Qos)
+		if err != nil {
+			return nil, rollback(err, nil)
+		}
+		rules[len(path)-1] = UpfRules{
+			NodeID: upfaInterface.NodeID,
+			Ids:    ids,
+			Fteid:  last_fteid,
+		}
+		// on handover, the PFCP Session may already exist on this UPF
+		if err := upfa.CreateOrUpdateSession(ueIpAddr); err != nil {
+			return nil, rollback(err, rules[len(path)-1:])
+		}
+		// the F-TEID may have been allocated by the UPF
+		if last_fteid, err = upfa.ListenFteid(ueIpAddr, ids); err != nil {
+			return nil, rollback(err, rules[len(path)-1:])
+		}
+		rules[len(path)-1].Fteid = last_fteid
 	}
 
 	// 3. init path from anchor
@@ -295,75 +548,385 @@ func (smf *Smf) CreateSessionUplinkContext(ctx context.Context, ueCtrl jsonapi.C
 		gtpInterface := path[i]
 		upf_any, ok := smf.upfs.Load(gtpInterface.NodeID)
 		if !ok {
-			return nil, ErrUpfNotFound
+			return nil, rollback(ErrUpfNotFound, rules[i+1:])
 		}
 		upf := upf_any.(*Upf)
-		last_fteid, err = upf.CreateUplinkIntermediateContext(ctx, ueIpAddr, dnn, gtpInterface.InterfaceAddr, last_fteid)
+		// uplink packets are classified by QFI on the N3 interface
+		var qos *config.Qos
+		if i == 0 {
+			qos = slice.Qos
+		}
+		last_fteid, ids, err = upf.CreateUplinkIntermediateContext(ctx, ue, dnn, gtpInterface.InterfaceAddr, last_fteid, qos)
 		if err != nil {
 			logrus.WithError(err).Error("Could not create uplink intermediate")
-			return nil, err
+			return nil, rollback(err, rules[i+1:])
+		}
+		rules[i] = UpfRules{
+			NodeID: gtpInterface.NodeID,
+			Ids:    ids,
+			Fteid:  last_fteid,
 		}
-		if err := upf.CreateSession(ueIpAddr); err != nil {
+		if err := upf.CreateOrUpdateSession(ueIpAddr); err != nil {
 			logrus.WithError(err).Error("Could not create session uplink")
-			return nil, err
+			return nil, rollback(err, rules[i:])
 		}
+		if last_fteid, err = upf.ListenFteid(ueIpAddr, ids); err != nil {
+			return nil, rollback(err, rules[i:])
+		}
+		rules[i].Fteid = last_fteid
 	}
 
 	session, err := slice.sessions.Get(ueCtrl, ueIpAddr)
 	if err != nil {
 		// store session
 		session = &PduSessionN3{
-			UeIpAddr:    ueIpAddr,
-			UplinkFteid: last_fteid,
+			UeIpAddr:     ueIpAddr,
+			Area:         area,
+			UplinkFteid:  last_fteid,
+			UplinkRules:  rules,
+			Type:         slice.SessionType,
+			UeIpv6Prefix: ue.Ipv6,
+			UeMac:        ue.Mac,
 		}
 		slice.sessions.Add(ueCtrl, session)
 	} else {
 		// update session
-		if err := slice.sessions.SetUplinkFteid(ueCtrl, ueIpAddr, last_fteid); err != nil {
-			return nil, err
+		if session, err = slice.sessions.SetUplinkPath(ueCtrl, ueIpAddr, last_fteid, rules); err != nil {
+			return nil, rollback(err, rules)
 		}
 	}
 	return session, nil
 }
 
-func (smf *Smf) WaitShutdown(ctx context.Context) error {
+// Releases an UE IP Address that is not used by any PDU Session
+// (e.g. when the establishment of the PDU Session failed)
+func (smf *Smf) ReleaseUeIpAddr(ueAddr netip.Addr, dnn string) error {
+	s, ok := smf.slices.Load(dnn)
+	if !ok {
+		return ErrDnnNotFound
+	}
+	slice := s.(*Slice)
+	if pool := slice.pool(slice.SessionType); pool != nil {
+		pool.Release(ueAddr)
+	}
+	return nil
+}
+
+// Returns true if the UE has at least one PDU Session
+func (smf *Smf) HasSessions(ueCtrl jsonapi.ControlURI) bool {
+	found := false
+	smf.slices.Range(func(key, value any) bool {
+		found = value.(*Slice).sessions.Has(ueCtrl)
+		return !found
+	})
+	return found
+}
+
+func (smf *Smf) ReleaseSession(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string) error {
+	return smf.ReleaseSessionContext(smf.Context(), ueCtrl, ueAddr, dnn)
+}
+
+// Deletes PFCP Sessions of the PDU Session on every UPF of the slice,
+// and releases the F-TEIDs and the UE IP Address allocated to it
+func (smf *Smf) ReleaseSessionContext(ctx context.Context, ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string) error {
+	if !smf.started.Load() {
+		return ErrSmfNotStarted
+	}
+	if ctx == nil {
+		return ErrNilCtx
+	}
+	smfCtx := smf.Context()
 	select {
 	case <-ctx.Done():
+		// if ctx is over, abort
 		return ctx.Err()
-	case <-smf.closed:
-		return nil
+	case <-smfCtx.Done():
+		// if smf.ctx is over, abort
+		return smfCtx.Err()
+	default:
+	}
+	s, ok := smf.slices.Load(dnn)
+	if !ok {
+		return ErrDnnNotFound
+	}
+	slice := s.(*Slice)
+	session, err := slice.sessions.Get(ueCtrl, ueAddr)
+	if err != nil {
+		return err
+	}
+
+	rules := make([]UpfRules, 0)
+	rules = append(rules, session.UplinkRules...)
+	rules = append(rules, session.DownlinkRules...)
+	rules = append(rules, session.PreviousUplinkRules...)
+	rules = append(rules, session.ForwardingRules...)
+	rules = append(rules, session.DrainRules...)
+
+	// PFCP Session Deletion on every UPF of the session path
+	var failure error
+	deleted := make(map[netip.Addr]struct{}, len(rules))
+	for _, r := range rules {
+		if _, ok := deleted[r.NodeID]; ok {
+			continue
+		}
+		deleted[r.NodeID] = struct{}{}
+		upf_any, ok := smf.upfs.Load(r.NodeID)
+		if !ok {
+			continue
+		}
+		if err := upf_any.(*Upf).DeleteSession(ueAddr); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"upf":     r.NodeID,
+				"ue-addr": ueAddr,
+			}).Error("Could not delete PFCP Session")
+			failure = err
+		}
+	}
+	if failure != nil {
+		// some UPF may still have rules for this PDU Session: its F-TEIDs and its address must not be reused,
+		// and the PDU Session is kept so that its release can be retried
+		return failure
 	}
+
+	// Release F-TEIDs
+	for _, r := range rules {
+		if upf_any, ok := smf.upfs.Load(r.NodeID); ok {
+			upf_any.(*Upf).ReleaseFteid(r.Fteid)
+		}
+	}
+
+	if err := slice.sessions.Remove(ueCtrl, ueAddr); err != nil {
+		return err
+	}
+	if pool := slice.pool(session.Type); pool != nil {
+		pool.Release(ueAddr)
+	}
+	if session.Type == config.PduSessionTypeIpv4v6 {
+		slice.Ipv6Pool.Release(session.UeIpv6Prefix.Addr())
+	}
+	return nil
 }
 
-func (smf *Smf) GetSessionUplinkFteid(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string) (*jsonapi.Fteid, error) {
+// Release rules of the uplink path that was in use before the handover
+func (smf *Smf) ReleaseSessionPreviousUplink(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string) error {
 	slice, ok := smf.slices.Load(dnn)
 	if !ok {
-		return nil, ErrDnnNotFound
+		return ErrDnnNotFound
 	}
-	session, err := slice.(*Slice).sessions.Get(ueCtrl, ueAddr)
+	rules, err := slice.(*Slice).sessions.TakePreviousUplinkRules(ueCtrl, ueAddr)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return session.UplinkFteid, nil
+	return smf.releaseRules(ueAddr, rules)
 }
 
-func (smf *Smf) SetSessionIndirectForwardingRequired(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string, value bool) error {
+// Restores the uplink path in use before the handover, and releases rules of the new uplink path
+func (smf *Smf) RollbackSessionUplink(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string) error {
 	slice, ok := smf.slices.Load(dnn)
 	if !ok {
 		return ErrDnnNotFound
 	}
-	return slice.(*Slice).sessions.SetIndirectForwardingRequired(ueCtrl, ueAddr, value)
+	rules, err := slice.(*Slice).sessions.RestorePreviousUplinkPath(ueCtrl, ueAddr)
+	if err != nil {
+		return err
+	}
+	return smf.releaseRules(ueAddr, rules)
+}
+
+// Updates the downlink FAR of the UPF-A to buffer packets, until ResumeSessionDownlink is called.
+// If notify is true, the UPF-A reports the arrival of downlink packets (the UE is not connected).
+func (smf *Smf) BufferSessionDownlink(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string, notify bool) error {
+	s, ok := smf.slices.Load(dnn)
+	if !ok {
+		return ErrDnnNotFound
+	}
+	slice := s.(*Slice)
+	session, err := slice.sessions.Get(ueCtrl, ueAddr)
+	if err != nil {
+		return err
+	}
+	if len(session.DownlinkRules) == 0 {
+		return ErrNoDownlinkPath
+	}
+	anchor := session.DownlinkRules[len(session.DownlinkRules)-1]
+	upf_any, ok := smf.upfs.Load(anchor.NodeID)
+	if !ok {
+		return ErrUpfNotFound
+	}
+	upf := upf_any.(*Upf)
+	upf.BufferDownlink(ueAddr, anchor.Ids.Far, notify)
+	if err := upf.UpdateSession(ueAddr); err != nil {
+		return err
+	}
+	return slice.sessions.SetBuffering(ueCtrl, ueAddr)
+}
+
+// Updates the downlink FAR of the UPF-A to forward packets again, if they are buffered.
+// Buffered packets are flushed on the current downlink path.
+func (smf *Smf) ResumeSessionDownlink(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string) error {
+	s, ok := smf.slices.Load(dnn)
+	if !ok {
+		return ErrDnnNotFound
+	}
+	slice := s.(*Slice)
+	buffering, err := slice.sessions.TakeBuffering(ueCtrl, ueAddr)
+	if err != nil || !buffering {
+		return err
+	}
+	session, err := slice.sessions.Get(ueCtrl, ueAddr)
+	if err != nil {
+		return err
+	}
+	if len(session.DownlinkRules) == 0 {
+		return ErrNoDownlinkPath
+	}
+	anchor := session.DownlinkRules[len(session.DownlinkRules)-1]
+	upf_any, ok := smf.upfs.Load(anchor.NodeID)
+	if !ok {
+		return ErrUpfNotFound
+	}
+	upf := upf_any.(*Upf)
+	upf.ForwardDownlink(ueAddr, anchor.Ids.Far)
+	return upf.UpdateSession(ueAddr)
 }
 
-func (smf *Smf) GetSessionIndirectForwardingRequired(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string) (bool, error) {
+func (smf *Smf) ActivateSessionDownlink(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string, gnbFteid jsonapi.Fteid) error {
+	return smf.ActivateSessionDownlinkContext(smf.Context(), ueCtrl, ueAddr, dnn, gnbFteid)
+}
+
+// Updates the FAR of the UPF-i to forward downlink packets to the new F-TEID of the gNB,
+// then the downlink FAR of the UPF-A to forward buffered packets.
+// The RAN area of the gNB must be unchanged.
+func (smf *Smf) ActivateSessionDownlinkContext(ctx context.Context, ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string, gnbFteid jsonapi.Fteid) error {
+	if ctx == nil {
+		return ErrNilCtx
+	}
+	s, ok := smf.slices.Load(dnn)
+	if !ok {
+		return ErrDnnNotFound
+	}
+	slice := s.(*Slice)
+	session, err := slice.sessions.Get(ueCtrl, ueAddr)
+	if err != nil {
+		return err
+	}
+	if len(session.DownlinkRules) == 0 {
+		return ErrNoDownlinkPath
+	}
+	upfi := session.DownlinkRules[0]
+	anchor := session.DownlinkRules[len(session.DownlinkRules)-1]
+	upfi_any, ok := smf.upfs.Load(upfi.NodeID)
+	if !ok {
+		return ErrUpfNotFound
+	}
+	anchor_any, ok := smf.upfs.Load(anchor.NodeID)
+	if !ok {
+		return ErrUpfNotFound
+	}
+	buffering, err := slice.sessions.TakeBuffering(ueCtrl, ueAddr)
+	if err != nil {
+		return err
+	}
+	// the previous tunnel has already been released by the gNB: no End Marker
+	upfi_any.(*Upf).UpdateDownlinkIntermediateDirectForward(ueAddr, dnn, upfi.Ids.Far, &gnbFteid, false)
+	if buffering && anchor != upfi {
+		anchor_any.(*Upf).ForwardDownlink(ueAddr, anchor.Ids.Far)
+	}
+	// the UPF-i is updated first, so buffered packets are not sent to the previous F-TEID of the gNB
+	if err := upfi_any.(*Upf).UpdateSession(ueAddr); err != nil {
+		return err
+	}
+	if anchor.NodeID != upfi.NodeID {
+		if err := anchor_any.(*Upf).UpdateSession(ueAddr); err != nil {
+			return err
+		}
+	}
+	return slice.sessions.SetDownlinkFteid(ueCtrl, ueAddr, &gnbFteid)
+}
+
+// Returns the handover strategy of the slice
+func (smf *Smf) HandoverStrategy(dnn string) (config.HandoverStrategy, error) {
+	s, ok := smf.slices.Load(dnn)
+	if !ok {
+		return "", ErrDnnNotFound
+	}
+	return s.(*Slice).Handover, nil
+}
+
+// Returns the QoS of PDU Sessions of this DNN, or nil if QoS is not configured.
+// The returned value must not be modified.
+func (smf *Smf) SessionQos(dnn string) (*config.Qos, error) {
+	s, ok := smf.slices.Load(dnn)
+	if !ok {
+		return nil, ErrDnnNotFound
+	}
+	return s.(*Slice).Qos, nil
+}
+
+// Release temporary downlink rules used for indirect forwarding during the handover
+func (smf *Smf) ReleaseSessionForwarding(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string) error {
 	slice, ok := smf.slices.Load(dnn)
 	if !ok {
-		return false, ErrDnnNotFound
+		return ErrDnnNotFound
 	}
-	return slice.(*Slice).sessions.GetIndirectForwardingRequired(ueCtrl, ueAddr)
+	rules, err := slice.(*Slice).sessions.TakeForwardingRules(ueCtrl, ueAddr)
+	if err != nil {
+		return err
+	}
+	return smf.releaseRules(ueAddr, rules)
 }
 
-func (smf *Smf) GetSessionDownlinkFteid(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string) (*jsonapi.Fteid, error) {
+// Removes rules from UPFs, and releases their F-TEIDs
+func (smf *Smf) releaseRules(ueAddr netip.Addr, rules []UpfRules) error {
+	upfs := make([]netip.Addr, 0, len(rules))
+	for _, r := range rules {
+		upf_any, ok := smf.upfs.Load(r.NodeID)
+		if !ok {
+			return ErrUpfNotFound
+		}
+		upf_any.(*Upf).RemoveRules(ueAddr, r.Ids)
+		if !slices.Contains(upfs, r.NodeID) {
+			upfs = append(upfs, r.NodeID)
+		}
+	}
+	for _, nodeID := range upfs {
+		upf_any, _ := smf.upfs.Load(nodeID)
+		if err := upf_any.(*Upf).UpdateSession(ueAddr); err != nil {
+			return err
+		}
+	}
+	for _, r := range rules {
+		upf_any, _ := smf.upfs.Load(r.NodeID)
+		upf_any.(*Upf).ReleaseFteid(r.Fteid)
+	}
+	return nil
+}
+
+// Queues removal of rules installed on the given UPF, and returns removed and remaining rules
+func removeRulesOnUpf(upf *Upf, nodeID netip.Addr, ueAddr netip.Addr, rules []UpfRules) (removed []UpfRules, remaining []UpfRules) {
+	removed = make([]UpfRules, 0, len(rules))
+	remaining = make([]UpfRules, 0, len(rules))
+	for _, r := range rules {
+		if r.NodeID != nodeID {
+			remaining = append(remaining, r)
+			continue
+		}
+		upf.RemoveRules(ueAddr, r.Ids)
+		removed = append(removed, r)
+	}
+	return removed, remaining
+}
+
+func (smf *Smf) WaitShutdown(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-smf.closed:
+		return nil
+	}
+}
+
+func (smf *Smf) GetSessionUplinkFteid(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string) (*jsonapi.Fteid, error) {
 	slice, ok := smf.slices.Load(dnn)
 	if !ok {
 		return nil, ErrDnnNotFound
@@ -372,31 +935,41 @@ func (smf *Smf) GetSessionDownlinkFteid(ueCtrl jsonapi.ControlURI, ueAddr netip.
 	if err != nil {
 		return nil, err
 	}
-	return session.DownlinkFteid, nil
+	return session.UplinkFteid, nil
 }
 
-func (smf *Smf) StoreNextDownlinkFteid(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string, fteid *jsonapi.Fteid) error {
+// Returns the RAN area of the gNB serving the UE
+func (smf *Smf) GetSessionArea(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string) (string, error) {
 	slice, ok := smf.slices.Load(dnn)
 	if !ok {
-		return ErrDnnNotFound
+		return "", ErrDnnNotFound
+	}
+	session, err := slice.(*Slice).sessions.Get(ueCtrl, ueAddr)
+	if err != nil {
+		return "", err
 	}
-	return slice.(*Slice).sessions.SetNextDownlinkFteid(ueCtrl, ueAddr, fteid)
+	return session.Area, nil
 }
 
-func (smf *Smf) GetNextDownlinkFteid(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string) (*jsonapi.Fteid, error) {
+func (smf *Smf) GetSessionDownlinkFteid(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string) (*jsonapi.Fteid, error) {
 	slice, ok := smf.slices.Load(dnn)
 	if !ok {
 		return nil, ErrDnnNotFound
 	}
-	return slice.(*Slice).sessions.GetNextDownlinkFteid(ueCtrl, ueAddr)
+	session, err := slice.(*Slice).sessions.Get(ueCtrl, ueAddr)
+	if err != nil {
+		return nil, err
+	}
+	return session.DownlinkFteid, nil
 }
 
-func (smf *Smf) UpdateSessionDownlink(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string, oldGnbCtrl jsonapi.ControlURI) error {
-	return smf.UpdateSessionDownlinkContext(smf.Context(), ueCtrl, ueAddr, dnn, oldGnbCtrl)
+func (smf *Smf) UpdateSessionDownlink(ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string, oldGnbCtrl jsonapi.ControlURI, gnbFteid jsonapi.Fteid) error {
+	return smf.UpdateSessionDownlinkContext(smf.Context(), ueCtrl, ueAddr, dnn, oldGnbCtrl, gnbFteid)
 }
 
-// Updates Session to NextDownlinkFteid
-func (smf *Smf) UpdateSessionDownlinkContext(ctx context.Context, ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string, oldGnbCtrl jsonapi.ControlURI) error {
+// Updates the FAR of the UPF-i to forward downlink packets to the F-TEID of the target gNB.
+// End Marker packets are sent to the source gNB if enabled on the slice.
+func (smf *Smf) UpdateSessionDownlinkContext(ctx context.Context, ueCtrl jsonapi.ControlURI, ueAddr netip.Addr, dnn string, oldGnbCtrl jsonapi.ControlURI, gnbFteid jsonapi.Fteid) error {
 	s, ok := smf.slices.Load(dnn)
 	if !ok {
 		return ErrDnnNotFound
@@ -427,7 +1000,10 @@ func (smf *Smf) UpdateSessionDownlinkContext(ctx context.Context, ueCtrl jsonapi
 		return ErrUpfNotFound
 	}
 	upf := upf_any.(*Upf)
-	upf.UpdateDownlinkIntermediateDirectForward(ueAddr, dnn, session.DlFarId, session.NextDownlinkFteid)
+	upf.UpdateDownlinkIntermediateDirectForward(ueAddr, dnn, session.DlFarId, &gnbFteid, slice.EndMarker)
 
-	return upf.UpdateSession(session.UeIpAddr)
+	if err := upf.UpdateSession(session.UeIpAddr); err != nil {
+		return err
+	}
+	return slice.sessions.SetDownlinkFteid(ueCtrl, ueAddr, &gnbFteid)
 }
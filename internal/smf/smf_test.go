@@ -0,0 +1,357 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package smf
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/nextmn/cp-lite/internal/config"
+	"github.com/nextmn/cp-lite/internal/metrics"
+
+	pfcpapi "github.com/nextmn/go-pfcp-networking/pfcp/api"
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+const (
+	testDnn    = "internet"
+	testGnb1   = "http://192.0.2.2:8080"
+	testGnb2   = "http://192.0.2.4:8080"
+	testUeCtrl = "http://192.0.2.6:8080"
+)
+
+var (
+	testSmfAddr = netip.MustParseAddr("127.0.0.1")
+	testUpfi1   = netip.MustParseAddr("127.0.0.2")
+	testUpfi2   = netip.MustParseAddr("127.0.0.3")
+	testUpfa    = netip.MustParseAddr("127.0.0.4")
+	testGnbDl   = jsonapi.Fteid{Addr: netip.MustParseAddr("127.0.2.1"), Teid: 1}
+)
+
+// Local PFCP entity of the SMF, as seen by a testAssociation
+type testEntity struct {
+	pfcpapi.PFCPEntityInterface
+}
+
+func (testEntity) ListenAddr() netip.Addr {
+	return testSmfAddr
+}
+
+func (testEntity) NodeID() *ie.IE {
+	return ie.NewNodeIDHeuristic(testSmfAddr.String())
+}
+
+// PFCP Association with a fake UPF, which records requests and accepts them unless their type is rejected
+type testAssociation struct {
+	pfcpapi.PFCPAssociationInterface
+
+	nodeID   netip.Addr
+	lastSeid uint64
+	sent     []message.Message
+	reject   map[uint8]bool // types of requests rejected by the UPF
+	sync.Mutex
+}
+
+func (a *testAssociation) IsRunning() bool {
+	return true
+}
+
+func (a *testAssociation) LocalEntity() pfcpapi.PFCPEntityInterface {
+	return testEntity{}
+}
+
+func (a *testAssociation) GetNextSEID() pfcpapi.SEID {
+	a.Lock()
+	defer a.Unlock()
+	a.lastSeid += 1
+	return a.lastSeid
+}
+
+func (a *testAssociation) Send(msg message.Message) (message.Message, error) {
+	a.Lock()
+	defer a.Unlock()
+	a.sent = append(a.sent, msg)
+	cause := ie.NewCause(ie.CauseRequestAccepted)
+	if a.reject[msg.MessageType()] {
+		cause = ie.NewCause(ie.CauseRequestRejected)
+	}
+	switch msg.MessageType() {
+	case message.MsgTypeSessionEstablishmentRequest:
+		return message.NewSessionEstablishmentResponse(0, 0, 0, 0, 0, cause, ie.NewFSEID(msg.SEID()+1000, a.nodeID.AsSlice(), nil)), nil
+	case message.MsgTypeSessionModificationRequest:
+		return message.NewSessionModificationResponse(0, 0, 0, 0, 0, cause), nil
+	case message.MsgTypeSessionDeletionRequest:
+		return message.NewSessionDeletionResponse(0, 0, 0, 0, 0, cause), nil
+	}
+	return nil, ErrPfcpUnexpectedMessage
+}
+
+// Returns the number of requests of this type sent to the UPF
+func (a *testAssociation) count(t uint8) int {
+	a.Lock()
+	defer a.Unlock()
+	n := 0
+	for _, msg := range a.sent {
+		if msg.MessageType() == t {
+			n += 1
+		}
+	}
+	return n
+}
+
+// Rejects (or accepts) requests of this type
+func (a *testAssociation) setReject(t uint8, reject bool) {
+	a.Lock()
+	defer a.Unlock()
+	a.reject[t] = reject
+}
+
+func mustControlURI(t *testing.T, s string) jsonapi.ControlURI {
+	t.Helper()
+	u, err := jsonapi.ParseControlURI(s)
+	if err != nil {
+		t.Fatalf("could not parse control URI %q: %v", s, err)
+	}
+	return *u
+}
+
+// Returns a started SMF whose UPFs are fake: area1 (testGnb1) uses the path testUpfi1 → testUpfa,
+// and area2 (testGnb2) uses the path testUpfi2 → testUpfa.
+// The slice testDnn can be modified with edit.
+func newTestSmf(t *testing.T, edit func(*config.Slice)) (*Smf, map[netip.Addr]*testAssociation) {
+	t.Helper()
+	iface := func(nodeID netip.Addr) netip.Addr {
+		b := nodeID.As4()
+		b[2] = 1
+		return netip.AddrFrom4(b)
+	}
+	slice := config.Slice{Pool: netip.MustParsePrefix("10.0.0.0/24")}
+	for _, nodeID := range []netip.Addr{testUpfi1, testUpfi2, testUpfa} {
+		slice.Upfs = append(slice.Upfs, config.Upf{NodeID: nodeID, Interfaces: []config.Interface{{Type: "N3", Addr: iface(nodeID)}}})
+	}
+	if edit != nil {
+		edit(&slice)
+	}
+	path := func(upfi netip.Addr) map[string][]config.GTPInterface {
+		return map[string][]config.GTPInterface{testDnn: {
+			{NodeID: upfi, InterfaceAddr: iface(upfi)},
+			{NodeID: testUpfa, InterfaceAddr: iface(testUpfa)},
+		}}
+	}
+	areas := map[string]config.Area{
+		"area1": {Gnbs: []jsonapi.ControlURI{mustControlURI(t, testGnb1)}, Paths: path(testUpfi1)},
+		"area2": {Gnbs: []jsonapi.ControlURI{mustControlURI(t, testGnb2)}, Paths: path(testUpfi2)},
+	}
+
+	smf := NewSmf(testSmfAddr, map[string]config.Slice{testDnn: slice}, areas, nil, nil, metrics.NewMetrics(), nil)
+	if err := smf.InitContext(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	associations := make(map[netip.Addr]*testAssociation)
+	smf.upfs.Range(func(key, value any) bool {
+		upf := value.(*Upf)
+		if err := upf.Init(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		a := &testAssociation{nodeID: upf.nodeID, reject: make(map[uint8]bool)}
+		upf.Associate(a)
+		associations[upf.nodeID] = a
+		return true
+	})
+	smf.started.Store(true)
+	return smf, associations
+}
+
+// Establishes a PDU Session on testGnb1
+func establishTestSession(t *testing.T, smf *Smf, ue jsonapi.ControlURI) *PduSessionN3 {
+	t.Helper()
+	addr, err := smf.GetNextUeIpAddr(ue, testDnn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gnb := mustControlURI(t, testGnb1)
+	if _, err := smf.CreateSessionUplinkContext(t.Context(), ue, addr, gnb, testDnn); err != nil {
+		t.Fatal(err)
+	}
+	session, err := smf.CreateSessionDownlinkContext(t.Context(), ue, addr, testDnn, gnb, testGnbDl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+// Returns the number of TEIDs allocated by the SMF on the UPF
+func allocatedTeids(smf *Smf, nodeID netip.Addr) int {
+	upf, ok := smf.upfs.Load(nodeID)
+	if !ok {
+		return 0
+	}
+	n := 0
+	for _, iface := range upf.(*Upf).interfaces {
+		n += iface.Teids.Len()
+	}
+	return n
+}
+
+func TestReleaseSessionContext(t *testing.T) {
+	smf, associations := newTestSmf(t, nil)
+	ue := mustControlURI(t, testUeCtrl)
+	session := establishTestSession(t, smf, ue)
+	teids := allocatedTeids(smf, testUpfi1) + allocatedTeids(smf, testUpfa)
+	if teids == 0 {
+		t.Fatal("no TEID allocated")
+	}
+
+	// a failed PFCP Session Deletion keeps the PDU Session, its F-TEIDs and its address
+	associations[testUpfa].setReject(message.MsgTypeSessionDeletionRequest, true)
+	if err := smf.ReleaseSessionContext(t.Context(), ue, session.UeIpAddr, testDnn); !errors.Is(err, ErrPfcpRequestRejected) {
+		t.Fatalf("got error %v, want %v", err, ErrPfcpRequestRejected)
+	}
+	if _, err := smf.GetSessionUplinkFteid(ue, session.UeIpAddr, testDnn); err != nil {
+		t.Fatalf("PDU Session has been forgotten: %v", err)
+	}
+	if got := allocatedTeids(smf, testUpfi1) + allocatedTeids(smf, testUpfa); got != teids {
+		t.Fatalf("got %d allocated TEIDs, want %d", got, teids)
+	}
+	if addr, err := smf.GetNextUeIpAddr(mustControlURI(t, "http://192.0.2.7:8080"), testDnn); err != nil || addr == session.UeIpAddr {
+		t.Fatalf("address of the PDU Session has been reused (%v)", err)
+	}
+
+	// the release is retried: only the remaining PFCP Session is deleted
+	associations[testUpfa].setReject(message.MsgTypeSessionDeletionRequest, false)
+	if err := smf.ReleaseSessionContext(t.Context(), ue, session.UeIpAddr, testDnn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := smf.GetSessionUplinkFteid(ue, session.UeIpAddr, testDnn); !errors.Is(err, ErrPDUSessionNotFound) {
+		t.Fatalf("got error %v, want %v", err, ErrPDUSessionNotFound)
+	}
+	if got := allocatedTeids(smf, testUpfi1) + allocatedTeids(smf, testUpfa); got != 0 {
+		t.Fatalf("got %d allocated TEIDs, want none", got)
+	}
+	for nodeID, want := range map[netip.Addr]int{testUpfi1: 1, testUpfi2: 0, testUpfa: 2} {
+		if got := associations[nodeID].count(message.MsgTypeSessionDeletionRequest); got != want {
+			t.Fatalf("UPF %s: got %d PFCP Session Deletion Requests, want %d", nodeID, got, want)
+		}
+	}
+}
+
+func TestEthernetSessionIds(t *testing.T) {
+	ue := mustControlURI(t, testUeCtrl)
+	mac := config.MacAddr{0x02, 0, 0, 0, 0, 0x06}
+	smf, _ := newTestSmf(t, func(s *config.Slice) {
+		s.Type = config.PduSessionTypeEthernet
+		s.UeMacs = []config.UeMac{{Ue: ue, Mac: mac}}
+	})
+	session := establishTestSession(t, smf, ue)
+	if want := ethernetSessionId(mac, testDnn); session.UeIpAddr != want {
+		t.Fatalf("got PDU Session identifier %s, want %s", session.UeIpAddr, want)
+	}
+	if got := session.UeIpAddrs(); got.Ipv4.IsValid() || got.Ipv6.IsValid() {
+		t.Fatalf("ethernet PDU Session has an UE IP Address: %+v", got)
+	}
+	// a second ethernet PDU Session of the UE on this DNN could not be told apart by PDRs
+	if _, err := smf.GetNextUeIpAddr(ue, testDnn); !errors.Is(err, ErrUeIpAddrUnavailable) {
+		t.Fatalf("got error %v, want %v", err, ErrUeIpAddrUnavailable)
+	}
+	if err := smf.ReleaseSessionContext(t.Context(), ue, session.UeIpAddr, testDnn); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := smf.GetNextUeIpAddr(ue, testDnn); err != nil || id != session.UeIpAddr {
+		t.Fatalf("got PDU Session identifier %s (%v), want %s", id, err, session.UeIpAddr)
+	}
+}
+
+// Run with -race: procedures on PDU Sessions of different UEs, and reads of the same PDU Sessions, are concurrent
+func TestConcurrentProcedures(t *testing.T) {
+	smf, _ := newTestSmf(t, nil)
+	gnbs := []jsonapi.ControlURI{mustControlURI(t, testGnb1), mustControlURI(t, testGnb2)}
+	areas := []string{"area1", "area2"}
+	ues := make([]jsonapi.ControlURI, 4)
+	sessions := make([]*PduSessionN3, len(ues))
+	var wg sync.WaitGroup
+	for i := range ues {
+		ues[i] = mustControlURI(t, fmt.Sprintf("http://192.0.2.%d:8080", 10+i))
+		wg.Go(func() {
+			addr, err := smf.GetNextUeIpAddr(ues[i], testDnn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := smf.CreateSessionUplinkContext(t.Context(), ues[i], addr, gnbs[0], testDnn); err != nil {
+				t.Error(err)
+				return
+			}
+			if sessions[i], err = smf.CreateSessionDownlinkContext(t.Context(), ues[i], addr, testDnn, gnbs[0], testGnbDl); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	// path switches between area1 and area2
+	done := make(chan struct{})
+	for i := range ues {
+		wg.Go(func() {
+			addr := sessions[i].UeIpAddr
+			for n := 1; n <= 4; n++ {
+				if _, err := smf.CreateSessionUplinkContext(t.Context(), ues[i], addr, gnbs[n%2], testDnn); err != nil {
+					t.Error(err)
+					return
+				}
+				session, err := smf.CreateSessionDownlinkContext(t.Context(), ues[i], addr, testDnn, gnbs[n%2], testGnbDl)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err := smf.ReleaseSessionPreviousUplink(ues[i], addr, testDnn); err != nil {
+					t.Error(err)
+					return
+				}
+				if session.Area != areas[n%2] || len(session.DownlinkRules) != 2 {
+					t.Errorf("got area %q and %d downlink rules, want %q and 2", session.Area, len(session.DownlinkRules), areas[n%2])
+				}
+			}
+		})
+	}
+	var readers sync.WaitGroup
+	for i := range ues {
+		readers.Go(func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := smf.GetSessionArea(ues[i], sessions[i].UeIpAddr, testDnn); err != nil {
+					t.Error(err)
+					return
+				}
+				smf.SessionsStatus(&ues[i])
+			}
+		})
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	for i := range ues {
+		if area, err := smf.GetSessionArea(ues[i], sessions[i].UeIpAddr, testDnn); err != nil || area != "area1" {
+			t.Fatalf("UE %s: got area %q (%v), want area1", ues[i].String(), area, err)
+		}
+	}
+	if got := len(smf.SessionsStatus(nil)); got != len(ues) {
+		t.Fatalf("got %d PDU Sessions, want %d", got, len(ues))
+	}
+}
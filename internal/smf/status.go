@@ -0,0 +1,174 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package smf
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+
+	"github.com/nextmn/cp-lite/internal/config"
+
+	"github.com/nextmn/json-api/jsonapi"
+)
+
+type PduSessionStatus struct {
+	Dnn string `json:"dnn"`
+	UePduSession
+}
+
+type UpfStatus struct {
+	NodeID     netip.Addr           `json:"node-id"`
+	Associated bool                 `json:"associated"`
+	Health     UpfHealthStatus      `json:"health"`
+	Interfaces []UpfInterfaceStatus `json:"interfaces"`
+}
+
+// PFCP Session of an UE on an UPF
+type UpfSessionStatus struct {
+	UeIpAddr    netip.Addr `json:"ue-addr"`
+	Established bool       `json:"established"`
+	Rules       []RuleInfo `json:"rules"` // sorted by FAR ID
+}
+
+type UpfInterfaceStatus struct {
+	Addr  netip.Addr `json:"addr"`
+	Types []string   `json:"types"`
+	Teids int        `json:"allocated-teids"`
+}
+
+type SliceStatus struct {
+	Name          string                           `json:"name"`
+	Type          config.PduSessionType            `json:"pdu-session-type"`
+	Pool          UeIpPoolStatus                   `json:"pool"`
+	Ipv6Pool      UeIpPoolStatus                   `json:"ipv6-pool,omitzero"`
+	Upfs          []netip.Addr                     `json:"upfs"`
+	Paths         map[string][]config.GTPInterface `json:"paths"` // area name: path
+	Sessions      int                              `json:"sessions"`
+	Degraded      bool                             `json:"degraded"`       // at least one UPF of the slice is not available
+	DegradedPaths []string                         `json:"degraded-paths"` // areas whose path uses an UPF that is not available
+	EndMarker     bool                             `json:"end-marker"`
+	Handover      config.HandoverStrategy          `json:"handover"`
+	Qos           *config.Qos                      `json:"qos,omitempty"`
+}
+
+type AreaStatus struct {
+	Name string               `json:"name"`
+	Gnbs []jsonapi.ControlURI `json:"gnbs"`
+}
+
+// Returns PDU Sessions of all slices. If ueCtrl is not nil, only PDU Sessions of this UE are returned.
+func (smf *Smf) SessionsStatus(ueCtrl *jsonapi.ControlURI) []PduSessionStatus {
+	r := make([]PduSessionStatus, 0)
+	smf.slices.Range(func(key, value any) bool {
+		dnn := key.(string)
+		slice := value.(*Slice)
+		for _, s := range slice.sessions.List(ueCtrl) {
+			r = append(r, PduSessionStatus{Dnn: dnn, UePduSession: s})
+		}
+		return true
+	})
+	slices.SortFunc(r, func(a, b PduSessionStatus) int {
+		return cmp.Or(
+			cmp.Compare(a.Ue.String(), b.Ue.String()),
+			cmp.Compare(a.Dnn, b.Dnn),
+			a.UeIpAddr.Compare(b.UeIpAddr),
+		)
+	})
+	return r
+}
+
+func (smf *Smf) UpfsStatus() []UpfStatus {
+	r := make([]UpfStatus, 0)
+	smf.upfs.Range(func(key, value any) bool {
+		nodeID := key.(netip.Addr)
+		upf := value.(*Upf)
+		ifaces := make([]UpfInterfaceStatus, 0, len(upf.interfaces))
+		for addr, iface := range upf.interfaces {
+			ifaces = append(ifaces, UpfInterfaceStatus{
+				Addr:  addr,
+				Types: slices.Clone(iface.Types),
+				Teids: iface.Teids.Len(),
+			})
+		}
+		slices.SortFunc(ifaces, func(a, b UpfInterfaceStatus) int {
+			return a.Addr.Compare(b.Addr)
+		})
+		r = append(r, UpfStatus{
+			NodeID:     nodeID,
+			Associated: upf.Association() != nil,
+			Health:     upf.HealthStatus(),
+			Interfaces: ifaces,
+		})
+		return true
+	})
+	slices.SortFunc(r, func(a, b UpfStatus) int {
+		return a.NodeID.Compare(b.NodeID)
+	})
+	return r
+}
+
+// Returns PFCP Sessions of the UPF, with the index of their rules
+func (smf *Smf) UpfSessionsStatus(nodeID netip.Addr) ([]UpfSessionStatus, error) {
+	upf, ok := smf.upfs.Load(nodeID)
+	if !ok {
+		return nil, ErrUpfNotFound
+	}
+	return upf.(*Upf).SessionsStatus(), nil
+}
+
+func (smf *Smf) upfAvailable(nodeID netip.Addr) bool {
+	upf, ok := smf.upfs.Load(nodeID)
+	return ok && upf.(*Upf).Available()
+}
+
+func (smf *Smf) SlicesStatus() []SliceStatus {
+	r := make([]SliceStatus, 0)
+	smf.slices.Range(func(key, value any) bool {
+		name := key.(string)
+		slice := value.(*Slice)
+		degradedPaths := make([]string, 0)
+		for area, path := range slice.Paths {
+			if slices.ContainsFunc(path, func(i config.GTPInterface) bool { return !smf.upfAvailable(i.NodeID) }) {
+				degradedPaths = append(degradedPaths, area)
+			}
+		}
+		slices.Sort(degradedPaths)
+		r = append(r, SliceStatus{
+			Name:          name,
+			Type:          slice.SessionType,
+			Pool:          slice.Pool.Status(),
+			Ipv6Pool:      slice.Ipv6Pool.Status(),
+			Upfs:          slices.Clone(slice.Upfs),
+			Paths:         slice.Paths,
+			Sessions:      slice.sessions.Len(),
+			Degraded:      slices.ContainsFunc(slice.Upfs, func(nodeID netip.Addr) bool { return !smf.upfAvailable(nodeID) }),
+			DegradedPaths: degradedPaths,
+			EndMarker:     slice.EndMarker,
+			Handover:      slice.Handover,
+			Qos:           slice.Qos,
+		})
+		return true
+	})
+	slices.SortFunc(r, func(a, b SliceStatus) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return r
+}
+
+func (smf *Smf) AreasStatus() []AreaStatus {
+	r := make([]AreaStatus, 0, len(smf.Areas.content))
+	for name, gnbs := range smf.Areas.content {
+		r = append(r, AreaStatus{
+			Name: name,
+			Gnbs: slices.Clone(gnbs),
+		})
+	}
+	slices.SortFunc(r, func(a, b AreaStatus) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return r
+}
@@ -60,3 +60,10 @@ func (t *TEIDsPool) Delete(teid uint32) {
 	defer t.Unlock()
 	delete(t.teids, teid)
 }
+
+// Returns the number of allocated TEIDs
+func (t *TEIDsPool) Len() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.teids)
+}
@@ -6,26 +6,270 @@
 package smf
 
 import (
+	"math"
 	"net/netip"
+	"sync"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/sirupsen/logrus"
 )
 
 type UeIpPool struct {
-	pool    netip.Prefix
-	current netip.Addr
+	pool     netip.Prefix
+	bits     int                               // length of allocated prefixes: full address length when single addresses are allocated
+	current  netip.Addr                        // last allocated address: search of a free address starts after it
+	reserved map[netip.Addr]struct{}           // addresses never allocated
+	static   map[jsonapi.ControlURI]netip.Addr // addresses reserved for a given UE
+	owners   map[netip.Addr]jsonapi.ControlURI // owners of static addresses
+	leases   map[netip.Addr]jsonapi.ControlURI // addresses in use
+	capacity uint64                            // number of addresses available for dynamic allocation
+	dynamic  uint64                            // number of dynamically allocated addresses in use
+	sync.Mutex
 }
 
-func NewUeIpPool(pool netip.Prefix) *UeIpPool {
-	return &UeIpPool{
-		pool:    pool,
-		current: pool.Addr(),
+// Creates a new pool of UE IP Addresses.
+// Network address and broadcast address (IPv4) are reserved, as well as addresses from `reserved`.
+// Addresses from `static` can only be allocated to their UE.
+func NewUeIpPool(pool netip.Prefix, reserved []netip.Addr, static map[jsonapi.ControlURI]netip.Addr) *UeIpPool {
+	pool = pool.Masked()
+	p := UeIpPool{
+		pool:     pool,
+		bits:     pool.Addr().BitLen(),
+		current:  pool.Addr(),
+		reserved: make(map[netip.Addr]struct{}),
+		static:   make(map[jsonapi.ControlURI]netip.Addr),
+		owners:   make(map[netip.Addr]jsonapi.ControlURI),
+		leases:   make(map[netip.Addr]jsonapi.ControlURI),
+	}
+	if !pool.IsValid() {
+		return &p
+	}
+	p.reserved[pool.Addr()] = struct{}{}
+	if pool.Addr().Is4() && pool.Bits() < 31 {
+		p.reserved[lastAddr(pool)] = struct{}{}
 	}
+	for _, addr := range reserved {
+		if pool.Contains(addr) {
+			p.reserved[addr] = struct{}{}
+		}
+	}
+	for ue, addr := range static {
+		if !pool.Contains(addr) {
+			logrus.WithFields(logrus.Fields{
+				"ue":   ue.String(),
+				"addr": addr,
+				"pool": pool,
+			}).Warn("Static UE IP Address is not in the pool: ignored")
+			continue
+		}
+		if _, ok := p.reserved[addr]; ok {
+			logrus.WithFields(logrus.Fields{
+				"ue":   ue.String(),
+				"addr": addr,
+			}).Warn("Static UE IP Address is reserved: ignored")
+			continue
+		}
+		if _, ok := p.owners[addr]; ok {
+			logrus.WithFields(logrus.Fields{
+				"ue":   ue.String(),
+				"addr": addr,
+			}).Warn("Static UE IP Address is already reserved for another UE: ignored")
+			continue
+		}
+		p.static[ue] = addr
+		p.owners[addr] = ue
+	}
+
+	size := poolSize(pool, p.bits)
+	unavailable := uint64(len(p.reserved) + len(p.owners))
+	if size > unavailable {
+		p.capacity = size - unavailable
+	}
+	return &p
+}
+
+// Creates a new pool of IPv6 prefixes of length bits, one prefix being allocated to each PDU Session.
+// No prefix is reserved. Allocated prefixes are identified by their first address.
+func NewUePrefixPool(pool netip.Prefix, bits int) *UeIpPool {
+	pool = pool.Masked()
+	p := UeIpPool{
+		pool:     pool,
+		bits:     bits,
+		current:  pool.Addr(),
+		reserved: make(map[netip.Addr]struct{}),
+		static:   make(map[jsonapi.ControlURI]netip.Addr),
+		owners:   make(map[netip.Addr]jsonapi.ControlURI),
+		leases:   make(map[netip.Addr]jsonapi.ControlURI),
+	}
+	if pool.IsValid() {
+		p.capacity = poolSize(pool, bits)
+	}
+	return &p
+}
+
+// Returns the number of prefixes of length bits in the pool
+func poolSize(pool netip.Prefix, bits int) uint64 {
+	if hostBits := bits - pool.Bits(); hostBits < 64 {
+		return uint64(1) << hostBits
+	}
+	return math.MaxUint64
+}
+
+// Allocates an address to the UE. The static address of the UE is used when it is free,
+// otherwise the next free address after the last allocated one is used (wrapping around at the end of the pool).
+func (p *UeIpPool) Next(ue jsonapi.ControlURI) (netip.Addr, error) {
+	p.Lock()
+	defer p.Unlock()
+	if addr, ok := p.static[ue]; ok {
+		if _, used := p.leases[addr]; !used {
+			p.leases[addr] = ue
+			return addr, nil
+		}
+	}
+	if p.dynamic >= p.capacity {
+		return netip.Addr{}, ErrNoIpAvailableInPool
+	}
+	addr := p.current
+	for {
+		addr = nextPrefixAddr(addr, p.bits)
+		if !addr.IsValid() || !p.pool.Contains(addr) {
+			// wrap around
+			addr = p.pool.Addr()
+		}
+		if p.isFree(addr) {
+			p.current = addr
+			p.leases[addr] = ue
+			p.dynamic += 1
+			return addr, nil
+		}
+		if addr == p.current {
+			return netip.Addr{}, ErrNoIpAvailableInPool
+		}
+	}
+}
+
+// Allocates a prefix to the UE, from a pool created with NewUePrefixPool
+func (p *UeIpPool) NextPrefix(ue jsonapi.ControlURI) (netip.Prefix, error) {
+	addr, err := p.Next(ue)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return p.Prefix(addr), nil
+}
+
+// Returns the prefix allocated from this pool that starts with addr
+func (p *UeIpPool) Prefix(addr netip.Addr) netip.Prefix {
+	return netip.PrefixFrom(addr, p.bits)
 }
 
-func (p *UeIpPool) Next() (netip.Addr, error) {
-	addr := p.current.Next()
-	p.current = addr
+// Records an address allocated to the UE by an UPF, as a dynamically allocated address
+func (p *UeIpPool) Lease(ue jsonapi.ControlURI, addr netip.Addr) error {
+	p.Lock()
+	defer p.Unlock()
 	if !p.pool.Contains(addr) {
-		return addr, ErrNoIpAvailableInPool
+		return ErrUeIpAddrNotInPool
+	}
+	if !p.isFree(addr) {
+		return ErrUeIpAddrUnavailable
+	}
+	p.leases[addr] = ue
+	p.dynamic += 1
+	return nil
+}
+
+// Returns an address to the pool, so it can be used for a new PDU Session
+func (p *UeIpPool) Release(addr netip.Addr) {
+	p.Lock()
+	defer p.Unlock()
+	ue, ok := p.leases[addr]
+	if !ok {
+		return
+	}
+	delete(p.leases, addr)
+	if owner, ok := p.owners[addr]; !ok || owner != ue {
+		p.dynamic -= 1
+	}
+}
+
+// Caller must hold the lock
+func (p *UeIpPool) isFree(addr netip.Addr) bool {
+	if _, ok := p.reserved[addr]; ok {
+		return false
+	}
+	if _, ok := p.leases[addr]; ok {
+		return false
+	}
+	if _, ok := p.owners[addr]; ok {
+		return false
+	}
+	return true
+}
+
+// Returns the first address of the prefix of length bits following the prefix of addr;
+// the returned address is invalid on overflow
+func nextPrefixAddr(addr netip.Addr, bits int) netip.Addr {
+	if bits == addr.BitLen() {
+		return addr.Next()
+	}
+	a := addr.AsSlice()
+	// add 1 at the last bit of the prefix, with carry
+	i := (bits - 1) / 8
+	inc := uint16(1) << (7 - (bits-1)%8)
+	for ; i >= 0 && inc > 0; i-- {
+		sum := uint16(a[i]) + inc
+		a[i] = uint8(sum)
+		inc = sum >> 8
+	}
+	if inc > 0 {
+		return netip.Addr{}
+	}
+	next, _ := netip.AddrFromSlice(a)
+	return next
+}
+
+// Returns the last address of the prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	a := prefix.Addr().AsSlice()
+	bits := prefix.Bits()
+	for i := range a {
+		switch {
+		case bits >= 8:
+			bits -= 8
+		case bits > 0:
+			a[i] |= 0xff >> bits
+			bits = 0
+		default:
+			a[i] = 0xff
+		}
+	}
+	addr, _ := netip.AddrFromSlice(a)
+	return addr
+}
+
+// Utilisation of the pool
+type UeIpPoolStatus struct {
+	Pool     netip.Prefix `json:"pool"`
+	Capacity uint64       `json:"capacity"` // number of addresses available for dynamic allocation
+	Dynamic  uint64       `json:"dynamic"`  // number of dynamically allocated addresses in use
+	Static   int          `json:"static"`   // number of static addresses configured
+	Leases   int          `json:"leases"`   // number of addresses in use (dynamic and static)
+
+	Length int `json:"prefix-length,omitempty"` // length of allocated prefixes, for pools of prefixes
+}
+
+func (p *UeIpPool) Status() UeIpPoolStatus {
+	p.Lock()
+	defer p.Unlock()
+	status := UeIpPoolStatus{
+		Pool:     p.pool,
+		Capacity: p.capacity,
+		Dynamic:  p.dynamic,
+		Static:   len(p.static),
+		Leases:   len(p.leases),
+	}
+	if p.pool.IsValid() && p.bits < p.pool.Addr().BitLen() {
+		status.Length = p.bits
 	}
-	return addr, nil
+	return status
 }
@@ -0,0 +1,268 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package smf
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/nextmn/json-api/jsonapi"
+)
+
+func addrs(s ...string) []netip.Addr {
+	r := make([]netip.Addr, len(s))
+	for i, a := range s {
+		r[i] = netip.MustParseAddr(a)
+	}
+	return r
+}
+
+// step of a pool test: allocate (Next) for the UE, or release an address
+type poolStep struct {
+	ue      string     // UE allocating an address; empty to release
+	release netip.Addr // address released
+	want    netip.Addr // expected allocated address, invalid if an error is expected
+	err     error
+}
+
+func runPoolSteps(t *testing.T, p *UeIpPool, steps []poolStep) {
+	t.Helper()
+	for i, step := range steps {
+		if step.ue == "" {
+			p.Release(step.release)
+			continue
+		}
+		got, err := p.Next(mustControlURI(t, step.ue))
+		if !errors.Is(err, step.err) {
+			t.Fatalf("step %d: got error %v, want %v", i, err, step.err)
+		}
+		if got != step.want {
+			t.Fatalf("step %d: got %s, want %s", i, got, step.want)
+		}
+	}
+}
+
+func TestUeIpPool(t *testing.T) {
+	ue1 := "http://192.0.2.1:8080"
+	ue2 := "http://192.0.2.2:8080"
+	a := netip.MustParseAddr
+	tests := []struct {
+		name     string
+		pool     string
+		reserved []netip.Addr
+		static   map[string]string // UE: address
+		capacity uint64
+		steps    []poolStep
+	}{
+		{
+			name:     "network, broadcast, gateway and excluded addresses are skipped",
+			pool:     "10.0.0.0/29",
+			reserved: addrs("10.0.0.1", "10.0.0.3", "192.0.2.10"), // the last one is not in the pool
+			capacity: 4,
+			steps: []poolStep{
+				{ue: ue1, want: a("10.0.0.2")},
+				{ue: ue1, want: a("10.0.0.4")},
+				{ue: ue1, want: a("10.0.0.5")},
+				{ue: ue1, want: a("10.0.0.6")},
+				{ue: ue1, err: ErrNoIpAvailableInPool},
+			},
+		},
+		{
+			name:     "released addresses are reused after wrapping around",
+			pool:     "10.0.0.0/29",
+			capacity: 6,
+			steps: []poolStep{
+				{ue: ue1, want: a("10.0.0.1")},
+				{ue: ue1, want: a("10.0.0.2")},
+				{ue: ue1, want: a("10.0.0.3")},
+				{ue: ue1, want: a("10.0.0.4")},
+				{release: a("10.0.0.2")},
+				{ue: ue1, want: a("10.0.0.5")},
+				{ue: ue1, want: a("10.0.0.6")},
+				{ue: ue1, want: a("10.0.0.2")},
+				{ue: ue1, err: ErrNoIpAvailableInPool},
+				{release: a("10.0.0.7")}, // broadcast, never allocated
+				{ue: ue1, err: ErrNoIpAvailableInPool},
+			},
+		},
+		{
+			name:     "static addresses are only allocated to their UE",
+			pool:     "10.0.0.0/29",
+			static:   map[string]string{ue2: "10.0.0.2"},
+			capacity: 5,
+			steps: []poolStep{
+				{ue: ue1, want: a("10.0.0.1")},
+				{ue: ue1, want: a("10.0.0.3")},
+				{ue: ue2, want: a("10.0.0.2")},
+				// the static address is in use: a dynamic address is allocated
+				{ue: ue2, want: a("10.0.0.4")},
+				{release: a("10.0.0.2")},
+				{ue: ue1, want: a("10.0.0.5")},
+				{ue: ue2, want: a("10.0.0.2")},
+			},
+		},
+		{
+			name:     "/31 pool",
+			pool:     "10.0.0.0/31",
+			capacity: 1,
+			steps: []poolStep{
+				{ue: ue1, want: a("10.0.0.1")},
+				{ue: ue1, err: ErrNoIpAvailableInPool},
+				{release: a("10.0.0.1")},
+				{ue: ue1, want: a("10.0.0.1")},
+			},
+		},
+		{
+			name:     "/32 pool",
+			pool:     "10.0.0.0/32",
+			capacity: 0,
+			steps: []poolStep{
+				{ue: ue1, err: ErrNoIpAvailableInPool},
+			},
+		},
+		{
+			name:     "IPv6 pool has no broadcast address",
+			pool:     "fd00::/126",
+			capacity: 3,
+			steps: []poolStep{
+				{ue: ue1, want: a("fd00::1")},
+				{ue: ue1, want: a("fd00::2")},
+				{ue: ue1, want: a("fd00::3")},
+				{ue: ue1, err: ErrNoIpAvailableInPool},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			static := make(map[jsonapi.ControlURI]netip.Addr, len(tt.static))
+			for ue, addr := range tt.static {
+				static[mustControlURI(t, ue)] = netip.MustParseAddr(addr)
+			}
+			p := NewUeIpPool(netip.MustParsePrefix(tt.pool), tt.reserved, static)
+			if got := p.Status().Capacity; got != tt.capacity {
+				t.Fatalf("got capacity %d, want %d", got, tt.capacity)
+			}
+			runPoolSteps(t, p, tt.steps)
+		})
+	}
+}
+
+func TestUeIpPoolLease(t *testing.T) {
+	ue := mustControlURI(t, "http://192.0.2.1:8080")
+	p := NewUeIpPool(netip.MustParsePrefix("10.0.0.0/29"), addrs("10.0.0.1"), nil)
+	tests := []struct {
+		addr string
+		err  error
+	}{
+		{"10.0.0.2", nil},
+		{"10.0.0.2", ErrUeIpAddrUnavailable}, // already leased
+		{"10.0.0.1", ErrUeIpAddrUnavailable}, // reserved
+		{"10.0.0.0", ErrUeIpAddrUnavailable}, // network address
+		{"10.0.1.2", ErrUeIpAddrNotInPool},
+	}
+	for _, tt := range tests {
+		if err := p.Lease(ue, netip.MustParseAddr(tt.addr)); !errors.Is(err, tt.err) {
+			t.Errorf("Lease(%s): got error %v, want %v", tt.addr, err, tt.err)
+		}
+	}
+	// leased addresses are not allocated by Next
+	if got, err := p.Next(ue); err != nil || got != netip.MustParseAddr("10.0.0.3") {
+		t.Errorf("Next: got %s, %v, want 10.0.0.3", got, err)
+	}
+}
+
+func TestUePrefixPool(t *testing.T) {
+	ue := mustControlURI(t, "http://192.0.2.1:8080")
+	tests := []struct {
+		name     string
+		pool     string
+		bits     int
+		capacity uint64
+		want     []string // allocated prefixes, in order, until the pool is exhausted
+	}{
+		{
+			name:     "/64 prefixes",
+			pool:     "fd00:0:0:100::/62",
+			bits:     64,
+			capacity: 4,
+			want:     []string{"fd00:0:0:101::/64", "fd00:0:0:102::/64", "fd00:0:0:103::/64", "fd00:0:0:100::/64"},
+		},
+		{
+			name:     "prefix length not on a byte boundary",
+			pool:     "fd00::/58",
+			bits:     60,
+			capacity: 4,
+			want:     []string{"fd00:0:0:10::/60", "fd00:0:0:20::/60", "fd00:0:0:30::/60", "fd00::/60"},
+		},
+		{
+			name:     "prefix as large as the pool",
+			pool:     "fd00::/64",
+			bits:     64,
+			capacity: 1,
+			want:     []string{"fd00::/64"},
+		},
+		{
+			name:     "carry across bytes",
+			pool:     "fd00:0:0:ff::/63",
+			bits:     64,
+			capacity: 2,
+			want:     []string{"fd00:0:0:ff::/64", "fd00:0:0:fe::/64"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewUePrefixPool(netip.MustParsePrefix(tt.pool), tt.bits)
+			if got := p.Status().Capacity; got != tt.capacity {
+				t.Fatalf("got capacity %d, want %d", got, tt.capacity)
+			}
+			for i, want := range tt.want {
+				got, err := p.NextPrefix(ue)
+				if err != nil {
+					t.Fatalf("prefix %d: %v", i, err)
+				}
+				if got != netip.MustParsePrefix(want) {
+					t.Fatalf("prefix %d: got %s, want %s", i, got, want)
+				}
+			}
+			if _, err := p.NextPrefix(ue); !errors.Is(err, ErrNoIpAvailableInPool) {
+				t.Fatalf("got error %v, want %v", err, ErrNoIpAvailableInPool)
+			}
+			// a released prefix is allocated again
+			released := netip.MustParsePrefix(tt.want[0])
+			p.Release(released.Addr())
+			if got, err := p.NextPrefix(ue); err != nil || got != released {
+				t.Fatalf("after release: got %s, %v, want %s", got, err, released)
+			}
+		})
+	}
+}
+
+func TestNextPrefixAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		bits int
+		want string // empty if invalid
+	}{
+		{"10.0.0.1", 32, "10.0.0.2"},
+		{"fd00::", 64, "fd00:0:0:1::"},
+		{"fd00:0:0:ffff::", 64, "fd00:0:1::"},
+		{"fd00::", 60, "fd00:0:0:10::"},
+		{"ffff:ffff:ffff:ffff::", 64, ""},
+	}
+	for _, tt := range tests {
+		got := nextPrefixAddr(netip.MustParseAddr(tt.addr), tt.bits)
+		if tt.want == "" {
+			if got.IsValid() {
+				t.Errorf("nextPrefixAddr(%s, %d): got %s, want invalid address", tt.addr, tt.bits, got)
+			}
+			continue
+		}
+		if got != netip.MustParseAddr(tt.want) {
+			t.Errorf("nextPrefixAddr(%s, %d): got %s, want %s", tt.addr, tt.bits, got, tt.want)
+		}
+	}
+}
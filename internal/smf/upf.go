@@ -7,13 +7,17 @@ package smf
 
 import (
 	"context"
+	"errors"
+	"maps"
 	"net/netip"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/nextmn/cp-lite/internal/common"
 	"github.com/nextmn/cp-lite/internal/config"
+	"github.com/nextmn/cp-lite/internal/metrics"
 
-	pfcp "github.com/nextmn/go-pfcp-networking/pfcp"
 	pfcpapi "github.com/nextmn/go-pfcp-networking/pfcp/api"
 	"github.com/nextmn/json-api/jsonapi"
 
@@ -24,15 +28,13 @@ type UpfsMap struct {
 	sync.Map
 }
 
-func NewUpfsMap(slices map[string]config.Slice) *UpfsMap {
+func NewUpfsMap(slices map[string]config.Slice, metrics *metrics.Metrics, onUsage usageHandler) *UpfsMap {
 	m := UpfsMap{}
-	for _, slice := range slices {
+	for dnn, slice := range slices {
 		for _, upf := range slice.Upfs {
-			if _, ok := m.Load(upf.NodeID); ok {
-				// upf used in more than a single slice
-				continue
-			}
-			m.Store(upf.NodeID, NewUpf(upf.Interfaces))
+			// upf may be used in more than a single slice
+			u, _ := m.LoadOrStore(upf.NodeID, NewUpf(upf, metrics, onUsage))
+			u.(*Upf).usage[dnn] = slice.Usage
 		}
 	}
 	return &m
@@ -40,20 +42,38 @@ func NewUpfsMap(slices map[string]config.Slice) *UpfsMap {
 
 type Upf struct {
 	common.WithContext
-	association pfcpapi.PFCPAssociationInterface
+	nodeID      netip.Addr
 	interfaces  map[netip.Addr]*UpfInterface
-	sessions    map[netip.Addr]*Pfcprules
+	chooseFteid bool // F-TEIDs are allocated by the UPF
+	metrics     *metrics.Metrics
+	usage       map[string]*config.Usage // usage reporting of each slice (DNN) using this UPF
+	onUsage     usageHandler
+
+	// protected by the lock; the lock of Pfcprules must be taken first when both are needed
+	sessions          map[netip.Addr]*Pfcprules
+	association       pfcpapi.PFCPAssociationInterface
+	health            UpfHealth
+	recoveryTimeStamp time.Time // recovery time stamp of the UPF, from its last PFCP Heartbeat Response
+	heartbeatFailures int       // consecutive failed PFCP Heartbeat Requests
+	restarts          int
+	sync.RWMutex
 }
 
-func NewUpf(interfaces []config.Interface) *Upf {
+func NewUpf(conf config.Upf, metrics *metrics.Metrics, onUsage usageHandler) *Upf {
 	upf := Upf{
-		interfaces: NewUpfInterfaceMap(interfaces),
-		sessions:   make(map[netip.Addr]*Pfcprules),
+		nodeID:      conf.NodeID,
+		interfaces:  NewUpfInterfaceMap(conf.Interfaces),
+		chooseFteid: conf.FteidAllocation == config.FteidAllocationUp,
+		sessions:    make(map[netip.Addr]*Pfcprules),
+		metrics:     metrics,
+		usage:       make(map[string]*config.Usage),
+		onUsage:     onUsage,
+		health:      UpfHealthUnknown,
 	}
 	return &upf
 }
 
-func (upf *Upf) Associate(ctx context.Context, a pfcpapi.PFCPAssociationInterface) error {
+func (upf *Upf) Init(ctx context.Context) error {
 	if err := upf.InitContext(ctx); err != nil {
 		return err
 	}
@@ -63,11 +83,42 @@ func (upf *Upf) Associate(ctx context.Context, a pfcpapi.PFCPAssociationInterfac
 			return err
 		}
 	}
-	upf.association = a
 	return nil
 }
 
+// Sets the PFCP Association; the recovery time stamp of the UPF will be learned again
+func (upf *Upf) Associate(a pfcpapi.PFCPAssociationInterface) {
+	upf.Lock()
+	defer upf.Unlock()
+	upf.association = a
+	upf.recoveryTimeStamp = time.Time{}
+}
+
+// Clears the PFCP Association after it has been lost, and marks the UPF as down until it is associated again
+func (upf *Upf) Dissociate() {
+	upf.Lock()
+	defer upf.Unlock()
+	upf.association = nil
+	upf.health = UpfHealthDown
+}
+
+func (upf *Upf) Association() pfcpapi.PFCPAssociationInterface {
+	upf.RLock()
+	defer upf.RUnlock()
+	return upf.association
+}
+
+// Returns true if the UPF is associated, and not known to be down
+func (upf *Upf) Available() bool {
+	upf.RLock()
+	defer upf.RUnlock()
+	return upf.association != nil && upf.association.IsRunning() && upf.health != UpfHealthDown
+}
+
+// Returns rules of the PFCP Session of this UE, creating them if needed
 func (upf *Upf) Rules(ueIp netip.Addr) *Pfcprules {
+	upf.Lock()
+	defer upf.Unlock()
 	rules, ok := upf.sessions[ueIp]
 	if !ok {
 		rules = NewPfcpRules()
@@ -76,6 +127,61 @@ func (upf *Upf) Rules(ueIp netip.Addr) *Pfcprules {
 	return rules
 }
 
+// Returns rules of the PFCP Session of this UE, if any
+func (upf *Upf) lookupRules(ueIp netip.Addr) (*Pfcprules, bool) {
+	upf.RLock()
+	defer upf.RUnlock()
+	rules, ok := upf.sessions[ueIp]
+	return rules, ok
+}
+
+// Forgets rules of the PFCP Session of this UE, unless they have been replaced meanwhile
+func (upf *Upf) forgetRules(ueIp netip.Addr, rules *Pfcprules) {
+	upf.Lock()
+	defer upf.Unlock()
+	if upf.sessions[ueIp] == rules {
+		delete(upf.sessions, ueIp)
+	}
+}
+
+// Returns the UE IP Address and the PFCP Session with this local SEID, if any
+func (upf *Upf) lookupSession(seid uint64) (netip.Addr, *PfcpSession, bool) {
+	for ueIp, rules := range upf.allRules() {
+		rules.Lock()
+		session := rules.session
+		rules.Unlock()
+		if session != nil && session.localSeid == seid {
+			return ueIp, session, true
+		}
+	}
+	return netip.Addr{}, nil, false
+}
+
+// Returns PFCP Sessions of this UPF, sorted by UE IP Address
+func (upf *Upf) SessionsStatus() []UpfSessionStatus {
+	r := make([]UpfSessionStatus, 0)
+	for ueIp, rules := range upf.allRules() {
+		rules.Lock()
+		r = append(r, UpfSessionStatus{
+			UeIpAddr:    ueIp,
+			Established: rules.session != nil,
+			Rules:       rules.rules(),
+		})
+		rules.Unlock()
+	}
+	slices.SortFunc(r, func(a, b UpfSessionStatus) int {
+		return a.UeIpAddr.Compare(b.UeIpAddr)
+	})
+	return r
+}
+
+// Returns rules of all PFCP Sessions
+func (upf *Upf) allRules() map[netip.Addr]*Pfcprules {
+	upf.RLock()
+	defer upf.RUnlock()
+	return maps.Clone(upf.sessions)
+}
+
 func (upf *Upf) NextListenFteid(listenInterface netip.Addr) (*jsonapi.Fteid, error) {
 	return upf.NextListenFteidContext(upf.Context(), listenInterface)
 }
@@ -106,269 +212,544 @@ func (upf *Upf) NextListenFteidContext(ctx context.Context, listenInterface neti
 	}, nil
 }
 
-func (upf *Upf) CreateUplinkIntermediate(ueIp netip.Addr, dnn string, listenInterface netip.Addr, forwardFteid *jsonapi.Fteid) (*jsonapi.Fteid, error) {
-	return upf.CreateUplinkIntermediateContext(upf.Context(), ueIp, dnn, listenInterface, forwardFteid)
+// Allocates a F-TEID on the interface, or returns nil if F-TEIDs are allocated by the UPF
+func (upf *Upf) nextListenFteid(ctx context.Context, listenInterface netip.Addr) (*jsonapi.Fteid, error) {
+	if upf.chooseFteid {
+		if _, ok := upf.interfaces[listenInterface]; !ok {
+			return nil, ErrInterfaceNotFound
+		}
+		return nil, nil
+	}
+	return upf.NextListenFteidContext(ctx, listenInterface)
+}
+
+// Returns the F-TEID matched by the PDR of these rules.
+// If the F-TEID is allocated by the UPF, it is known once the rules have been pushed.
+func (upf *Upf) ListenFteid(ueIp netip.Addr, ids RuleIds) (*jsonapi.Fteid, error) {
+	r, ok := upf.lookupRules(ueIp)
+	if !ok {
+		return nil, ErrNoPFCPRule
+	}
+	r.Lock()
+	defer r.Unlock()
+	info, ok := r.index[ids.Far]
+	if !ok || info.Ids != ids || info.Listen == nil {
+		return nil, ErrFteidNotAllocated
+	}
+	fteid := *info.Listen
+	return &fteid, nil
 }
 
-func (upf *Upf) CreateUplinkIntermediateContext(ctx context.Context, ueIp netip.Addr, dnn string, listenInterface netip.Addr, forwardFteid *jsonapi.Fteid) (*jsonapi.Fteid, error) {
+// Returns the F-TEID IE of a PDR: listenFteid, or a F-TEID to be allocated by the UPF on listenInterface if listenFteid is nil.
+// Caller must hold the lock on r.
+func (upf *Upf) newPdrFteid(r *Pfcprules, farId uint32, listenInterface netip.Addr, listenFteid *jsonapi.Fteid) (*ie.IE, error) {
+	if listenFteid == nil {
+		id, err := r.chooseId(farId)
+		if err != nil {
+			return nil, err
+		}
+		return newChooseFteid(listenInterface, id), nil
+	}
+	return newFteid(listenFteid), nil
+}
+
+// If qos is not nil (UPF of the N3 interface), uplink packets are classified by QFI.
+func (upf *Upf) CreateUplinkIntermediate(ue UeIpAddrs, dnn string, listenInterface netip.Addr, forwardFteid *jsonapi.Fteid, qos *config.Qos) (*jsonapi.Fteid, RuleIds, error) {
+	return upf.CreateUplinkIntermediateContext(upf.Context(), ue, dnn, listenInterface, forwardFteid, qos)
+}
+
+func (upf *Upf) CreateUplinkIntermediateContext(ctx context.Context, ue UeIpAddrs, dnn string, listenInterface netip.Addr, forwardFteid *jsonapi.Fteid, qos *config.Qos) (*jsonapi.Fteid, RuleIds, error) {
 	if ctx == nil {
-		return nil, ErrNilCtx
+		return nil, RuleIds{}, ErrNilCtx
 	}
 	upfCtx := upf.Context()
 	select {
 	case <-ctx.Done():
-		return nil, ctx.Err()
+		return nil, RuleIds{}, ctx.Err()
 	case <-upfCtx.Done():
-		return nil, upfCtx.Err()
+		return nil, RuleIds{}, upfCtx.Err()
 	default:
 	}
-	listenFteid, err := upf.NextListenFteidContext(ctx, listenInterface)
+	listenFteid, err := upf.nextListenFteid(ctx, listenInterface)
 	if err != nil {
-		return nil, err
+		return nil, RuleIds{}, err
 	}
-	upf.CreateUplinkIntermediateWithFteid(ueIp, dnn, listenFteid, forwardFteid)
-	return listenFteid, nil
+	ids, err := upf.createUplinkIntermediate(ue, dnn, listenInterface, listenFteid, forwardFteid, qos)
+	if err != nil {
+		upf.ReleaseFteid(listenFteid)
+		return nil, RuleIds{}, err
+	}
+	return listenFteid, ids, nil
 }
 
-func (upf *Upf) CreateUplinkIntermediateWithFteid(ueIp netip.Addr, dnn string, listenFteid *jsonapi.Fteid, forwardFteid *jsonapi.Fteid) {
-	r := upf.Rules(ueIp)
+func (upf *Upf) CreateUplinkIntermediateWithFteid(ue UeIpAddrs, dnn string, listenFteid *jsonapi.Fteid, forwardFteid *jsonapi.Fteid, qos *config.Qos) (RuleIds, error) {
+	return upf.createUplinkIntermediate(ue, dnn, listenFteid.Addr, listenFteid, forwardFteid, qos)
+}
+
+// If listenFteid is nil, the F-TEID is allocated by the UPF on listenInterface.
+// On error, no rule is added.
+func (upf *Upf) createUplinkIntermediate(ue UeIpAddrs, dnn string, listenInterface netip.Addr, listenFteid *jsonapi.Fteid, forwardFteid *jsonapi.Fteid, qos *config.Qos) (RuleIds, error) {
+	r := upf.Rules(ue.Key())
 	r.Lock()
 	defer r.Unlock()
-	r.currentpdrid += 1
-	r.currentfarid += 1
+	ids, err := r.nextIds(RuleInfo{
+		Purpose: RulePurposeUplink,
+		Listen:  listenFteid,
+		Forward: forwardFteid,
+	})
+	if err != nil {
+		return RuleIds{}, err
+	}
 
-	r.createpdrs = append(r.createpdrs, ie.NewCreatePDR(ie.NewPDRID(r.currentpdrid), ie.NewPrecedence(255),
-		ie.NewPDI(
-			ie.NewSourceInterface(ie.SrcInterfaceAccess),
-			ie.NewFTEID(FteidTypeIPv4, listenFteid.Teid, listenFteid.Addr.AsSlice(), nil, 0),
-			ie.NewNetworkInstance(dnn),
-			ie.NewUEIPAddress(UEIpAddrTypeIPv4Source, ueIp.String(), "", 0, 0),
-		),
-		ie.NewOuterHeaderRemoval(OuterHeaderRemoveGtpuUdpIpv4, 0),
-		ie.NewFARID(r.currentfarid),
-	))
-	r.createfars = append(r.createfars, ie.NewCreateFAR(ie.NewFARID(r.currentfarid),
+	fteid, err := upf.newPdrFteid(r, ids.Far, listenInterface, listenFteid)
+	if err == nil {
+		err = r.createUplinkPdrs(ids, qos, false,
+			slices.Concat([]*ie.IE{
+				ie.NewSourceInterface(ie.SrcInterfaceAccess),
+				fteid,
+				ie.NewNetworkInstance(dnn),
+			}, newUePdi(ue, false)),
+			append([]*ie.IE{newOuterHeaderRemoval(listenInterface)}, r.urr(upf.usage[dnn])...)...,
+		)
+	}
+	if err != nil {
+		r.remove(ids)
+		return RuleIds{}, err
+	}
+	r.createfars = append(r.createfars, ie.NewCreateFAR(ie.NewFARID(ids.Far),
 		ie.NewApplyAction(ApplyActionForw),
-		ie.NewForwardingParameters(
+		ie.NewForwardingParameters(slices.Concat([]*ie.IE{
 			ie.NewDestinationInterface(ie.DstInterfaceCore),
 			ie.NewNetworkInstance(dnn),
-			ie.NewOuterHeaderCreation(
-				OuterHeaderCreationGtpuUdpIpv4,
-				forwardFteid.Teid,
-				forwardFteid.Addr.String(),
-				"", 0, 0, 0,
-			),
-		),
+			newOuterHeaderCreation(forwardFteid),
+		}, newUeForwardingParameters(ue))...),
 	))
+	return ids, nil
 }
 
-func (upf *Upf) CreateUplinkAnchor(ueIp netip.Addr, dnn string, listenInterface netip.Addr) (*jsonapi.Fteid, error) {
-	return upf.CreateUplinkAnchorContext(upf.Context(), ueIp, dnn, listenInterface)
+// If qos is not nil, uplink packets are classified by QFI, and the Session-AMBR is enforced.
+func (upf *Upf) CreateUplinkAnchor(ue UeIpAddrs, dnn string, listenInterface netip.Addr, qos *config.Qos) (*jsonapi.Fteid, RuleIds, error) {
+	return upf.CreateUplinkAnchorContext(upf.Context(), ue, dnn, listenInterface, qos)
 }
-func (upf *Upf) CreateUplinkAnchorContext(ctx context.Context, ueIp netip.Addr, dnn string, listenInterface netip.Addr) (*jsonapi.Fteid, error) {
+func (upf *Upf) CreateUplinkAnchorContext(ctx context.Context, ue UeIpAddrs, dnn string, listenInterface netip.Addr, qos *config.Qos) (*jsonapi.Fteid, RuleIds, error) {
 	if ctx == nil {
-		return nil, ErrNilCtx
+		return nil, RuleIds{}, ErrNilCtx
 	}
-	listenFteid, err := upf.NextListenFteidContext(ctx, listenInterface)
+	listenFteid, err := upf.nextListenFteid(ctx, listenInterface)
 	if err != nil {
-		return nil, err
+		return nil, RuleIds{}, err
+	}
+	ids, err := upf.createUplinkAnchor(ue, dnn, listenInterface, listenFteid, qos)
+	if err != nil {
+		upf.ReleaseFteid(listenFteid)
+		return nil, RuleIds{}, err
 	}
-	upf.CreateUplinkAnchorWithFteid(ueIp, dnn, listenFteid)
-	return listenFteid, nil
+	return listenFteid, ids, nil
 }
 
-func (upf *Upf) CreateUplinkAnchorWithFteid(ueIp netip.Addr, dnn string, listenFteid *jsonapi.Fteid) {
-	r := upf.Rules(ueIp)
+func (upf *Upf) CreateUplinkAnchorWithFteid(ue UeIpAddrs, dnn string, listenFteid *jsonapi.Fteid, qos *config.Qos) (RuleIds, error) {
+	return upf.createUplinkAnchor(ue, dnn, listenFteid.Addr, listenFteid, qos)
+}
+
+// If listenFteid is nil, the F-TEID is allocated by the UPF on listenInterface.
+// On error, no rule is added.
+func (upf *Upf) createUplinkAnchor(ue UeIpAddrs, dnn string, listenInterface netip.Addr, listenFteid *jsonapi.Fteid, qos *config.Qos) (RuleIds, error) {
+	r := upf.Rules(ue.Key())
 	r.Lock()
 	defer r.Unlock()
-	r.currentpdrid += 1
-	r.currentfarid += 1
+	return upf.addUplinkAnchor(r, newUePdi(ue, false), newUeForwardingParameters(ue), dnn, listenInterface, listenFteid, qos)
+}
 
-	r.createpdrs = append(r.createpdrs, ie.NewCreatePDR(ie.NewPDRID(r.currentpdrid), ie.NewPrecedence(255),
-		ie.NewPDI(
-			ie.NewSourceInterface(ie.SrcInterfaceAccess),
-			ie.NewFTEID(FteidTypeIPv4, listenFteid.Teid, listenFteid.Addr.AsSlice(), nil, 0),
-			ie.NewNetworkInstance(dnn),
-			ie.NewUEIPAddress(UEIpAddrTypeIPv4Source, ueIp.String(), "", 0, 0),
-		),
-		ie.NewOuterHeaderRemoval(OuterHeaderRemoveGtpuUdpIpv4, 0),
-		ie.NewFARID(r.currentfarid),
-	))
-	r.createfars = append(r.createfars, ie.NewCreateFAR(ie.NewFARID(r.currentfarid),
+// Creates uplink anchor rules of a PDU Session whose UE IP Address is allocated by the UPF, and establishes the PFCP Session.
+// Rules are bound to the UE IP Address returned by the UPF in the response.
+// Other addresses of ue (IPv6 prefix) are already allocated.
+func (upf *Upf) EstablishUplinkAnchorContext(ctx context.Context, ue UeIpAddrs, dnn string, listenInterface netip.Addr, qos *config.Qos) (netip.Addr, *jsonapi.Fteid, RuleIds, error) {
+	if ctx == nil {
+		return netip.Addr{}, nil, RuleIds{}, ErrNilCtx
+	}
+	listenFteid, err := upf.nextListenFteid(ctx, listenInterface)
+	if err != nil {
+		return netip.Addr{}, nil, RuleIds{}, err
+	}
+	// the UE IP Address is unknown: rules are not in the sessions map until the PFCP Session is established
+	r := NewPfcpRules()
+	r.Lock()
+	defer r.Unlock()
+	r.ue = ue
+	r.ue.Ipv4 = netip.IPv4Unspecified()
+	ids, err := upf.addUplinkAnchor(r, []*ie.IE{newUeIpAddress(r.ue, false)}, nil, dnn, listenInterface, listenFteid, qos)
+	if err != nil {
+		upf.ReleaseFteid(listenFteid)
+		return netip.Addr{}, nil, RuleIds{}, err
+	}
+	if err := upf.createSession(r); err != nil {
+		upf.ReleaseFteid(listenFteid)
+		return netip.Addr{}, nil, RuleIds{}, err
+	}
+	info := r.index[ids.Far]
+	switch {
+	case r.ue.Ipv4.IsUnspecified():
+		return netip.Addr{}, nil, RuleIds{}, errors.Join(ErrUeIpAddrNotAllocated, upf.abortSession(r))
+	case info.Listen == nil:
+		return netip.Addr{}, nil, RuleIds{}, errors.Join(ErrFteidNotAllocated, upf.abortSession(r))
+	}
+	upf.Lock()
+	if _, ok := upf.sessions[r.ue.Ipv4]; ok {
+		upf.Unlock()
+		return netip.Addr{}, nil, RuleIds{}, errors.Join(ErrUeIpAddrUnavailable, upf.abortSession(r))
+	}
+	upf.sessions[r.ue.Ipv4] = r
+	upf.Unlock()
+	fteid := *info.Listen
+	return r.ue.Ipv4, &fteid, ids, nil
+}
+
+// Deletes a PFCP Session whose rules are not in the sessions map, and releases its F-TEIDs.
+// Caller must hold the lock on rules.
+func (upf *Upf) abortSession(rules *Pfcprules) error {
+	for _, info := range rules.index {
+		upf.ReleaseFteid(info.Listen)
+	}
+	_, err := rules.session.Delete()
+	upf.metrics.PfcpRequest(upf.nodeID.String(), "deletion", err)
+	rules.session = nil
+	return err
+}
+
+// Adds uplink anchor rules, matching uplink packets with the IEs uePdi.
+// params are added to the Forwarding Parameters of the FAR.
+// On error, no rule is added.
+// Caller must hold the lock on r.
+func (upf *Upf) addUplinkAnchor(r *Pfcprules, uePdi []*ie.IE, params []*ie.IE, dnn string, listenInterface netip.Addr, listenFteid *jsonapi.Fteid, qos *config.Qos) (RuleIds, error) {
+	ids, err := r.nextIds(RuleInfo{
+		Purpose: RulePurposeUplink,
+		Anchor:  true,
+		Listen:  listenFteid,
+	})
+	if err != nil {
+		return RuleIds{}, err
+	}
+
+	fteid, err := upf.newPdrFteid(r, ids.Far, listenInterface, listenFteid)
+	if err == nil {
+		err = r.createUplinkPdrs(ids, qos, true,
+			slices.Concat([]*ie.IE{
+				ie.NewSourceInterface(ie.SrcInterfaceAccess),
+				fteid,
+				ie.NewNetworkInstance(dnn),
+			}, uePdi),
+			append([]*ie.IE{newOuterHeaderRemoval(listenInterface)}, r.urr(upf.usage[dnn])...)...,
+		)
+	}
+	if err != nil {
+		r.remove(ids)
+		return RuleIds{}, err
+	}
+	r.createfars = append(r.createfars, ie.NewCreateFAR(ie.NewFARID(ids.Far),
 		ie.NewApplyAction(ApplyActionForw),
-		ie.NewForwardingParameters(
+		ie.NewForwardingParameters(slices.Concat([]*ie.IE{
 			ie.NewDestinationInterface(ie.DstInterfaceCore),
 			ie.NewNetworkInstance(dnn),
-		),
+		}, params)...),
 	))
+	return ids, nil
 }
 
-func (upf *Upf) UpdateDownlinkAnchor(ueIp netip.Addr, dnn string, forwardFteid *jsonapi.Fteid) uint32 {
-	r := upf.Rules(ueIp)
+// If qos is not nil, downlink packets are classified with SDF filters, marked with their QFI, and rate limited.
+// On error, no rule is added.
+func (upf *Upf) UpdateDownlinkAnchor(ue UeIpAddrs, dnn string, forwardFteid *jsonapi.Fteid, qos *config.Qos) (RuleIds, error) {
+	r := upf.Rules(ue.Key())
 	r.Lock()
 	defer r.Unlock()
-	r.currentpdrid += 1
-	r.currentfarid += 1
+	ids, err := r.nextIds(RuleInfo{
+		Purpose: RulePurposeDownlink,
+		Anchor:  true,
+		Forward: forwardFteid,
+	})
+	if err != nil {
+		return RuleIds{}, err
+	}
 
-	r.createpdrs = append(r.createpdrs, ie.NewCreatePDR(ie.NewPDRID(r.currentpdrid), ie.NewPrecedence(255),
-		ie.NewPDI(ie.NewSourceInterface(ie.SrcInterfaceCore),
+	if err := r.createDownlinkAnchorPdrs(ids, qos,
+		slices.Concat([]*ie.IE{
+			ie.NewSourceInterface(ie.SrcInterfaceCore),
 			ie.NewNetworkInstance(dnn),
-			ie.NewUEIPAddress(UEIpAddrTypeIPv4Destination, ueIp.String(), "", 0, 0),
-		),
-		ie.NewFARID(r.currentfarid),
-	),
-	)
-	r.createfars = append(r.createfars, ie.NewCreateFAR(ie.NewFARID(r.currentfarid),
+		}, newUePdi(ue, true)),
+		r.urr(upf.usage[dnn])...,
+	); err != nil {
+		r.remove(ids)
+		return RuleIds{}, err
+	}
+	r.createfars = append(r.createfars, ie.NewCreateFAR(ie.NewFARID(ids.Far),
 		ie.NewApplyAction(ApplyActionForw),
-		ie.NewForwardingParameters(
+		ie.NewForwardingParameters(slices.Concat([]*ie.IE{
 			ie.NewDestinationInterface(ie.DstInterfaceAccess),
 			ie.NewNetworkInstance(dnn),
-			ie.NewOuterHeaderCreation(
-				OuterHeaderCreationGtpuUdpIpv4,
-				forwardFteid.Teid,
-				forwardFteid.Addr.String(),
-				"", 0, 0, 0,
-			),
-		),
+			newOuterHeaderCreation(forwardFteid),
+		}, newUeForwardingParameters(ue))...),
 	))
-	return r.currentfarid
+	return ids, nil
 }
 
-func (upf *Upf) UpdateDownlinkIntermediateDirectForward(ueIp netip.Addr, dnn string, farid uint32, fteid *jsonapi.Fteid) {
+// Updates the FAR to forward to a new F-TEID (gNB, or next UPF of the downlink path).
+// If endMarker is true, the UPF sends End Marker packets on the previous tunnel.
+func (upf *Upf) UpdateDownlinkIntermediateDirectForward(ueIp netip.Addr, dnn string, farid uint32, fteid *jsonapi.Fteid, endMarker bool) {
+	r := upf.Rules(ueIp)
+	r.Lock()
+	defer r.Unlock()
+	params := []*ie.IE{
+		ie.NewDestinationInterface(ie.DstInterfaceAccess),
+		ie.NewNetworkInstance(dnn),
+		newOuterHeaderCreation(fteid),
+	}
+	if endMarker {
+		params = append(params, ie.NewPFCPSMReqFlags(PfcpsmReqFlagsSndem))
+	}
+	if info, ok := r.index[farid]; ok {
+		info.Forward = fteid
+	}
+	r.updatefars = append(r.updatefars, ie.NewUpdateFAR(ie.NewFARID(farid),
+		ie.NewApplyAction(ApplyActionForw),
+		ie.NewUpdateForwardingParameters(params...),
+	))
+}
+
+// Updates the FAR to buffer packets, until ForwardDownlink is called.
+// If notify is true, the UPF reports the arrival of downlink packets with a PFCP Session Report Request.
+func (upf *Upf) BufferDownlink(ueIp netip.Addr, farid uint32, notify bool) {
+	r := upf.Rules(ueIp)
+	r.Lock()
+	defer r.Unlock()
+	var action uint8 = ApplyActionBuff
+	if notify {
+		action |= ApplyActionNocp
+	}
+	r.updatefars = append(r.updatefars, ie.NewUpdateFAR(ie.NewFARID(farid),
+		ie.NewApplyAction(action),
+		ie.NewBARID(r.bar()),
+	))
+}
+
+// Updates the FAR to forward packets again; buffered packets are flushed
+func (upf *Upf) ForwardDownlink(ueIp netip.Addr, farid uint32) {
 	r := upf.Rules(ueIp)
 	r.Lock()
 	defer r.Unlock()
 	r.updatefars = append(r.updatefars, ie.NewUpdateFAR(ie.NewFARID(farid),
 		ie.NewApplyAction(ApplyActionForw),
-		ie.NewUpdateForwardingParameters(
-			ie.NewDestinationInterface(ie.DstInterfaceAccess),
-			ie.NewNetworkInstance(dnn),
-			ie.NewOuterHeaderCreation(
-				OuterHeaderCreationGtpuUdpIpv4,
-				fteid.Teid,
-				fteid.Addr.String(),
-				"", 0, 0, 0,
-			),
-		),
 	))
 }
 
-func (upf *Upf) UpdateDownlinkIntermediate(ueIp netip.Addr, dnn string, listenInterface netip.Addr, forwardFteid *jsonapi.Fteid) (*jsonapi.Fteid, uint32, error) {
-	return upf.UpdateDownlinkIntermediateContext(upf.Context(), ueIp, dnn, listenInterface, forwardFteid)
+func (upf *Upf) UpdateDownlinkIntermediate(ue UeIpAddrs, dnn string, listenInterface netip.Addr, forwardFteid *jsonapi.Fteid) (*jsonapi.Fteid, RuleIds, error) {
+	return upf.UpdateDownlinkIntermediateContext(upf.Context(), ue, dnn, listenInterface, forwardFteid)
 }
-func (upf *Upf) UpdateDownlinkIntermediateContext(ctx context.Context, ueIp netip.Addr, dnn string, listenInterface netip.Addr, forwardFteid *jsonapi.Fteid) (*jsonapi.Fteid, uint32, error) {
+func (upf *Upf) UpdateDownlinkIntermediateContext(ctx context.Context, ue UeIpAddrs, dnn string, listenInterface netip.Addr, forwardFteid *jsonapi.Fteid) (*jsonapi.Fteid, RuleIds, error) {
 	if ctx == nil {
-		return nil, 0, ErrNilCtx
+		return nil, RuleIds{}, ErrNilCtx
+	}
+	listenFteid, err := upf.nextListenFteid(ctx, listenInterface)
+	if err != nil {
+		return nil, RuleIds{}, err
 	}
-	listenFteid, err := upf.NextListenFteidContext(ctx, listenInterface)
+	ids, err := upf.createDownlinkIntermediate(ue, dnn, listenInterface, listenFteid, forwardFteid, RulePurposeDownlink)
 	if err != nil {
-		return nil, 0, err
+		upf.ReleaseFteid(listenFteid)
+		return nil, RuleIds{}, err
 	}
-	return listenFteid, upf.UpdateDownlinkIntermediateWithFteid(ueIp, dnn, listenFteid, forwardFteid), nil
+	return listenFteid, ids, nil
 }
 
-func (upf *Upf) UpdateDownlinkIntermediateWithFteid(ueIp netip.Addr, dnn string, listenFteid *jsonapi.Fteid, forwardFteid *jsonapi.Fteid) uint32 {
-	r := upf.Rules(ueIp)
+func (upf *Upf) UpdateDownlinkIntermediateWithFteid(ue UeIpAddrs, dnn string, listenFteid *jsonapi.Fteid, forwardFteid *jsonapi.Fteid) (RuleIds, error) {
+	return upf.createDownlinkIntermediate(ue, dnn, listenFteid.Addr, listenFteid, forwardFteid, RulePurposeDownlink)
+}
+
+// Creates temporary downlink rules forwarding packets to the target gNB during the handover
+func (upf *Upf) CreateDownlinkForwardingContext(ctx context.Context, ue UeIpAddrs, dnn string, listenInterface netip.Addr, forwardFteid *jsonapi.Fteid) (*jsonapi.Fteid, RuleIds, error) {
+	if ctx == nil {
+		return nil, RuleIds{}, ErrNilCtx
+	}
+	listenFteid, err := upf.nextListenFteid(ctx, listenInterface)
+	if err != nil {
+		return nil, RuleIds{}, err
+	}
+	ids, err := upf.createDownlinkIntermediate(ue, dnn, listenInterface, listenFteid, forwardFteid, RulePurposeDownlinkForwarding)
+	if err != nil {
+		upf.ReleaseFteid(listenFteid)
+		return nil, RuleIds{}, err
+	}
+	return listenFteid, ids, nil
+}
+
+// If listenFteid is nil, the F-TEID is allocated by the UPF on listenInterface.
+// On error, no rule is added.
+func (upf *Upf) createDownlinkIntermediate(ue UeIpAddrs, dnn string, listenInterface netip.Addr, listenFteid *jsonapi.Fteid, forwardFteid *jsonapi.Fteid, purpose RulePurpose) (RuleIds, error) {
+	r := upf.Rules(ue.Key())
 	r.Lock()
 	defer r.Unlock()
-	r.currentpdrid += 1
-	r.currentfarid += 1
+	ids, err := r.nextIds(RuleInfo{
+		Purpose: purpose,
+		Listen:  listenFteid,
+		Forward: forwardFteid,
+	})
+	if err != nil {
+		return RuleIds{}, err
+	}
+	fteid, err := upf.newPdrFteid(r, ids.Far, listenInterface, listenFteid)
+	if err != nil {
+		r.remove(ids)
+		return RuleIds{}, err
+	}
 
-	r.createpdrs = append(r.createpdrs, ie.NewCreatePDR(ie.NewPDRID(r.currentpdrid), ie.NewPrecedence(255),
-		ie.NewPDI(
+	r.createpdrs = append(r.createpdrs, newCreatePdr(ids.Pdr, defaultPrecedence, ids.Far,
+		slices.Concat([]*ie.IE{
 			ie.NewSourceInterface(ie.SrcInterfaceCore),
-			ie.NewFTEID(FteidTypeIPv4, listenFteid.Teid, listenFteid.Addr.AsSlice(), nil, 0),
+			fteid,
 			ie.NewNetworkInstance(dnn),
-			ie.NewUEIPAddress(UEIpAddrTypeIPv4Destination, ueIp.String(), "", 0, 0),
-		),
-		ie.NewOuterHeaderRemoval(OuterHeaderRemoveGtpuUdpIpv4, 0),
-		ie.NewFARID(r.currentfarid),
-	),
-	)
-	r.createfars = append(r.createfars, ie.NewCreateFAR(ie.NewFARID(r.currentfarid),
+		}, newUePdi(ue, true)),
+		append([]*ie.IE{newOuterHeaderRemoval(listenInterface)}, r.urr(upf.usage[dnn])...),
+	))
+	r.createfars = append(r.createfars, ie.NewCreateFAR(ie.NewFARID(ids.Far),
 		ie.NewApplyAction(ApplyActionForw),
-		ie.NewForwardingParameters(
+		ie.NewForwardingParameters(slices.Concat([]*ie.IE{
 			ie.NewDestinationInterface(ie.DstInterfaceAccess),
 			ie.NewNetworkInstance(dnn),
-			ie.NewOuterHeaderCreation(
-				OuterHeaderCreationGtpuUdpIpv4,
-				forwardFteid.Teid,
-				forwardFteid.Addr.String(),
-				"", 0, 0, 0,
-			),
-		),
+			newOuterHeaderCreation(forwardFteid),
+		}, newUeForwardingParameters(ue))...),
 	))
 
-	return r.currentfarid
+	return ids, nil
+}
+
+// Removes a PDR and its FAR from the PFCP Session of this UE.
+// Rules that are not in the PFCP Session are ignored.
+func (upf *Upf) RemoveRules(ueIp netip.Addr, ids RuleIds) {
+	r, ok := upf.lookupRules(ueIp)
+	if !ok {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.remove(ids)
+}
+
+// Releases a F-TEID allocated by NextListenFteid; F-TEIDs allocated by the UPF are released with their PDR
+func (upf *Upf) ReleaseFteid(fteid *jsonapi.Fteid) {
+	if fteid == nil || upf.chooseFteid {
+		return
+	}
+	if iface, ok := upf.interfaces[fteid.Addr]; ok {
+		iface.Teids.Delete(fteid.Teid)
+	}
 }
 
 func (upf *Upf) CreateSession(ue netip.Addr) error {
-	rules, ok := upf.sessions[ue]
+	rules, ok := upf.lookupRules(ue)
 	if !ok {
 		return ErrNoPFCPRule
 	}
 	rules.Lock()
 	defer rules.Unlock()
+	return upf.createSession(rules)
+}
 
-	createpdrs, err, _, _ := pfcp.NewPDRMap(rules.createpdrs)
-	if err != nil {
-		return err
-	}
-	createfars, err, _, _ := pfcp.NewFARMap(rules.createfars)
-	if err != nil {
-		return err
-	}
-	if upf.association == nil {
+// Caller must hold the lock on rules.
+func (upf *Upf) createSession(rules *Pfcprules) error {
+	association := upf.Association()
+	if association == nil {
 		return ErrUpfNotAssociated
 	}
-	rules.session, err = upf.association.CreateSession(nil, createpdrs, createfars)
+	session, created, err := EstablishPfcpSession(association, rules.pending()...)
+	upf.metrics.PfcpRequest(upf.nodeID.String(), "establishment", err)
 	if err != nil {
 		return err
 	}
-	// clear
-	rules.createpdrs = make([]*ie.IE, 0)
-	rules.createfars = make([]*ie.IE, 0)
+	rules.session = session
+	rules.commit(created)
 	return nil
 }
 
+// Pushes pending rules to the UPF.
+// If no PDR remains in the PFCP Session, the PFCP Session is deleted
+// (or simply forgotten if it has never been established).
 func (upf *Upf) UpdateSession(ue netip.Addr) error {
-	rules, ok := upf.sessions[ue]
+	rules, ok := upf.lookupRules(ue)
 	if !ok {
 		return ErrNoPFCPRule
 	}
 	rules.Lock()
 	defer rules.Unlock()
+	return upf.updateSession(ue, rules)
+}
+
+// Caller must hold the lock on rules.
+func (upf *Upf) updateSession(ue netip.Addr, rules *Pfcprules) error {
 	if rules.session == nil {
+		if rules.empty() {
+			// all rules have been removed before being pushed
+			rules.clear()
+			upf.forgetRules(ue, rules)
+			return nil
+		}
 		return ErrPDUSessionNotFound
 	}
-	createpdrs, err, _, _ := pfcp.NewPDRMap(rules.createpdrs)
-	if err != nil {
-		return err
+	if upf.Association() == nil {
+		return ErrUpfNotAssociated
 	}
-	createfars, err, _, _ := pfcp.NewFARMap(rules.createfars)
-	if err != nil {
-		return err
+	if rules.empty() {
+		reports, err := rules.session.Delete()
+		upf.metrics.PfcpRequest(upf.nodeID.String(), "deletion", err)
+		if err != nil {
+			return err
+		}
+		upf.onUsage(upf.nodeID, ue, reports)
+		rules.session = nil
+		upf.forgetRules(ue, rules)
+		return nil
 	}
-	updatepdrs, err, _, _ := pfcp.NewPDRMap(rules.updatepdrs)
-	if err != nil {
-		return err
+	if len(rules.pending()) == 0 {
+		// removed rules had not been pushed yet
+		return nil
 	}
-	updatefars, err, _, _ := pfcp.NewFARMapUpdate(rules.updatefars)
+	created, err := rules.session.Modify(rules.pending()...)
+	upf.metrics.PfcpRequest(upf.nodeID.String(), "modification", err)
 	if err != nil {
 		return err
 	}
-	if upf.association == nil {
-		return ErrUpfNotAssociated
+	rules.commit(created)
+	return nil
+}
+
+// Deletes the PFCP Session of this UE, if any
+func (upf *Upf) DeleteSession(ue netip.Addr) error {
+	rules, ok := upf.lookupRules(ue)
+	if !ok {
+		return nil
 	}
-	err = rules.session.AddUpdatePDRsFARs(createpdrs, createfars, updatepdrs, updatefars)
-	if err != nil {
-		return err
+	rules.Lock()
+	defer rules.Unlock()
+	if rules.session != nil {
+		reports, err := rules.session.Delete()
+		upf.metrics.PfcpRequest(upf.nodeID.String(), "deletion", err)
+		if err != nil {
+			return err
+		}
+		upf.onUsage(upf.nodeID, ue, reports)
+		rules.session = nil
 	}
-	// clear
-	rules.createpdrs = make([]*ie.IE, 0)
-	rules.createfars = make([]*ie.IE, 0)
-	rules.updatepdrs = make([]*ie.IE, 0)
-	rules.updatefars = make([]*ie.IE, 0)
-
+	upf.forgetRules(ue, rules)
 	return nil
 }
+
+// Pushes pending rules to the UPF, establishing the PFCP Session if it does not exist yet
+func (upf *Upf) CreateOrUpdateSession(ue netip.Addr) error {
+	rules, ok := upf.lookupRules(ue)
+	if !ok {
+		return ErrNoPFCPRule
+	}
+	rules.Lock()
+	defer rules.Unlock()
+	if rules.session != nil {
+		return upf.updateSession(ue, rules)
+	}
+	return upf.createSession(rules)
+}
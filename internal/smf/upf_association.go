@@ -0,0 +1,88 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package smf
+
+import (
+	"context"
+	"time"
+
+	pfcpapi "github.com/nextmn/go-pfcp-networking/pfcp/api"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+const (
+	DefaultAssociationInitialBackoff = 1 * time.Second
+	DefaultAssociationMaxBackoff     = 30 * time.Second
+)
+
+func (smf *Smf) newAssociation(upf *Upf) (pfcpapi.PFCPAssociationInterface, error) {
+	association, err := smf.srv.NewEstablishedPFCPAssociation(ie.NewNodeIDHeuristic(upf.nodeID.String()))
+	upf.metrics.PfcpRequest(upf.nodeID.String(), "association", err)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"upf": upf.nodeID,
+		}).Error("Could not perform PFCP association")
+		return nil, err
+	}
+	return association, nil
+}
+
+// Establishes the PFCP Association with the UPF, then starts monitoring it
+func (smf *Smf) associate(ctx context.Context, upf *Upf) error {
+	association, err := smf.newAssociation(upf)
+	if err != nil {
+		return err
+	}
+	upf.Associate(association)
+	go smf.monitorUpf(ctx, upf)
+	return nil
+}
+
+// Establishes the PFCP Association with the UPF, retrying with exponential backoff until it succeeds or ctx is done
+func (smf *Smf) associateWithRetry(ctx context.Context, upf *Upf) {
+	backoff := smf.association.InitialBackoff
+	for {
+		if err := smf.associate(ctx, upf); err == nil {
+			logrus.WithFields(logrus.Fields{
+				"upf": upf.nodeID,
+			}).Info("PFCP Association complete")
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"upf":      upf.nodeID,
+			"retry-in": backoff,
+		}).Info("PFCP Association will be retried")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, smf.association.MaxBackoff)
+	}
+}
+
+// Establishes a new PFCP Association with the UPF, then pushes again its PFCP Sessions
+func (smf *Smf) reassociate(upf *Upf) {
+	if old := upf.Association(); old != nil {
+		smf.srv.RemovePFCPAssociation(old)
+		old.Close()
+	}
+	association, err := smf.newAssociation(upf)
+	if err != nil {
+		// the old PFCP Association is closed: it must not be used anymore;
+		// establishment will be retried at next PFCP Heartbeat
+		upf.Dissociate()
+		return
+	}
+	upf.Associate(association)
+	failed := upf.resyncSessions()
+	logrus.WithFields(logrus.Fields{
+		"upf":             upf.nodeID,
+		"failed-sessions": failed,
+	}).Info("PFCP Association established again")
+}
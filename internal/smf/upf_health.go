@@ -0,0 +1,134 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package smf
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+type UpfHealth string
+
+const (
+	UpfHealthUnknown UpfHealth = "unknown" // no PFCP Heartbeat Response received yet
+	UpfHealthUp      UpfHealth = "up"
+	UpfHealthDown    UpfHealth = "down" // too many consecutive PFCP Heartbeat Requests failed
+)
+
+type UpfHealthStatus struct {
+	State             UpfHealth `json:"state"`
+	RecoveryTimeStamp time.Time `json:"recovery-time-stamp,omitzero"`
+	HeartbeatFailures int       `json:"heartbeat-failures"` // consecutive failures
+	Restarts          int       `json:"restarts"`           // number of restarts detected
+}
+
+func (upf *Upf) HealthStatus() UpfHealthStatus {
+	upf.RLock()
+	defer upf.RUnlock()
+	return UpfHealthStatus{
+		State:             upf.health,
+		RecoveryTimeStamp: upf.recoveryTimeStamp,
+		HeartbeatFailures: upf.heartbeatFailures,
+		Restarts:          upf.restarts,
+	}
+}
+
+// Sends a PFCP Heartbeat Request, and returns the recovery time stamp of the UPF
+func (upf *Upf) Heartbeat() (time.Time, error) {
+	ts, err := upf.heartbeat()
+	upf.metrics.PfcpRequest(upf.nodeID.String(), "heartbeat", err)
+	return ts, err
+}
+
+func (upf *Upf) heartbeat() (time.Time, error) {
+	association := upf.Association()
+	if association == nil {
+		return time.Time{}, ErrUpfNotAssociated
+	}
+	resp, err := association.Send(message.NewHeartbeatRequest(0, association.LocalEntity().RecoveryTimeStamp(), nil))
+	if err != nil {
+		return time.Time{}, err
+	}
+	hr, ok := resp.(*message.HeartbeatResponse)
+	if !ok || hr.RecoveryTimeStamp == nil {
+		return time.Time{}, ErrPfcpUnexpectedMessage
+	}
+	return hr.RecoveryTimeStamp.RecoveryTimeStamp()
+}
+
+// Records a failed PFCP Heartbeat Request, and returns true if the UPF is down
+func (upf *Upf) heartbeatFailed(threshold int) bool {
+	upf.Lock()
+	defer upf.Unlock()
+	upf.heartbeatFailures += 1
+	if upf.heartbeatFailures >= threshold && upf.health != UpfHealthDown {
+		upf.health = UpfHealthDown
+		logrus.WithFields(logrus.Fields{
+			"upf":      upf.nodeID,
+			"failures": upf.heartbeatFailures,
+		}).Error("UPF is down")
+	}
+	return upf.health == UpfHealthDown
+}
+
+// Records a successful PFCP Heartbeat Request,
+// and returns true if the UPF restarted since the previous one
+func (upf *Upf) heartbeatSucceeded(recoveryTimeStamp time.Time) bool {
+	upf.Lock()
+	defer upf.Unlock()
+	if upf.health != UpfHealthUp {
+		logrus.WithFields(logrus.Fields{
+			"upf": upf.nodeID,
+		}).Info("UPF is up")
+	}
+	restarted := !upf.recoveryTimeStamp.IsZero() && !upf.recoveryTimeStamp.Equal(recoveryTimeStamp)
+	if restarted {
+		upf.restarts += 1
+	}
+	upf.health = UpfHealthUp
+	upf.heartbeatFailures = 0
+	upf.recoveryTimeStamp = recoveryTimeStamp
+	return restarted
+}
+
+// Establishes again, with the rules previously installed, PFCP Sessions
+// that are not bound to the current PFCP Association (e.g. after an UPF restart).
+// Returns the number of PFCP Sessions that could not be established.
+func (upf *Upf) resyncSessions() int {
+	association := upf.Association()
+	if association == nil {
+		return 0
+	}
+	failed := 0
+	for ue, rules := range upf.allRules() {
+		if err := upf.resyncSession(rules); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"upf":   upf.nodeID,
+				"ue-ip": ue,
+			}).Error("Could not establish PFCP Session again")
+			failed += 1
+		}
+	}
+	return failed
+}
+
+func (upf *Upf) resyncSession(rules *Pfcprules) error {
+	rules.Lock()
+	defer rules.Unlock()
+	association := upf.Association()
+	if rules.session == nil || rules.session.association == association || len(rules.installedpdrs) == 0 {
+		return nil
+	}
+	session, _, err := EstablishPfcpSession(association, rules.installed()...)
+	upf.metrics.PfcpRequest(upf.nodeID.String(), "establishment", err)
+	if err != nil {
+		return err
+	}
+	rules.session = session
+	return nil
+}
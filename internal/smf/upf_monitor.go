@@ -0,0 +1,57 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package smf
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultHeartbeatInterval         = 10 * time.Second
+	DefaultHeartbeatFailureThreshold = 3
+)
+
+// Sends periodic PFCP Heartbeat Requests to the UPF until ctx is done.
+// When the UPF restarts, or when the PFCP Association is lost,
+// the PFCP Association is established again and PFCP Sessions are pushed again.
+func (smf *Smf) monitorUpf(ctx context.Context, upf *Upf) {
+	ticker := time.NewTicker(smf.heartbeat.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		recoveryTimeStamp, err := upf.Heartbeat()
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"upf": upf.nodeID,
+			}).Debug("PFCP Heartbeat Request failed")
+			if !upf.heartbeatFailed(smf.heartbeat.FailureThreshold) {
+				continue
+			}
+			// go-pfcp-networking closes the PFCP Association when its own heartbeat fails
+			if a := upf.Association(); a == nil || !a.IsRunning() {
+				smf.reassociate(upf)
+			}
+			continue
+		}
+		if upf.heartbeatSucceeded(recoveryTimeStamp) {
+			logrus.WithFields(logrus.Fields{
+				"upf":                 upf.nodeID,
+				"recovery-time-stamp": recoveryTimeStamp,
+			}).Warning("UPF restarted")
+			smf.reassociate(upf)
+			continue
+		}
+		// retry PFCP Sessions that could not be established again previously
+		upf.resyncSessions()
+	}
+}
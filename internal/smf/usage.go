@@ -0,0 +1,135 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package smf
+
+import (
+	"net/netip"
+
+	"github.com/nextmn/cp-lite/internal/cdr"
+	"github.com/nextmn/cp-lite/internal/config"
+
+	"github.com/nextmn/json-api/jsonapi"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// Called with the Usage Report IEs sent by an UPF for the PFCP Session of an UE IP Address
+type usageHandler func(nodeID netip.Addr, ueIp netip.Addr, reports []*ie.IE)
+
+// Returns a Create URR IE measuring volume and duration, with the reporting triggers of usage
+func newCreateUrr(usage *config.Usage) *ie.IE {
+	var triggers uint8
+	ies := []*ie.IE{
+		ie.NewURRID(urrId),
+		ie.NewMeasurementMethod(0, 1, 1),
+	}
+	if usage.Period > 0 {
+		triggers |= ReportingTriggersPerio
+		ies = append(ies, ie.NewMeasurementPeriod(usage.Period))
+	}
+	if usage.VolumeThreshold > 0 {
+		triggers |= ReportingTriggersVolth
+		ies = append(ies, ie.NewVolumeThreshold(VolumeThresholdTovol, usage.VolumeThreshold, 0, 0))
+	}
+	if usage.TimeThreshold > 0 {
+		triggers |= ReportingTriggersTimth
+		ies = append(ies, ie.NewTimeThreshold(usage.TimeThreshold))
+	}
+	// without triggers, usage is only reported when the PFCP Session is deleted
+	ies = append(ies, ie.NewReportingTriggers(triggers, 0))
+	return ie.NewCreateURR(ies...)
+}
+
+// Fills the record with the content of an Usage Report IE
+func parseUsageReport(report *ie.IE, record *cdr.Record) error {
+	ies, err := report.UsageReport()
+	if err != nil {
+		return err
+	}
+	for _, i := range ies {
+		switch i.Type {
+		case ie.URSEQN:
+			if record.Sequence, err = i.URSEQN(); err != nil {
+				return err
+			}
+		case ie.StartTime:
+			if record.Start, err = i.StartTime(); err != nil {
+				return err
+			}
+		case ie.EndTime:
+			if record.Stop, err = i.EndTime(); err != nil {
+				return err
+			}
+		case ie.VolumeMeasurement:
+			v, err := i.VolumeMeasurement()
+			if err != nil {
+				return err
+			}
+			record.Uplink = v.UplinkVolume
+			record.Downlink = v.DownlinkVolume
+		}
+	}
+	record.Trigger = usageReportTriggers(report)
+	return nil
+}
+
+// Returns the names of the triggers of an Usage Report IE
+func usageReportTriggers(report *ie.IE) []string {
+	triggers := make([]string, 0, 1)
+	for _, t := range []struct {
+		name string
+		has  func() bool
+	}{
+		{"periodic", report.HasPERIO},
+		{"volume-threshold", report.HasVOLTH},
+		{"time-threshold", report.HasTIMTH},
+		{"immediate", report.HasIMMER},
+		{"termination", report.HasTERMR},
+	} {
+		if t.has() {
+			triggers = append(triggers, t.name)
+		}
+	}
+	return triggers
+}
+
+// Records Usage Reports of the PFCP Session of this UE IP Address
+func (smf *Smf) recordUsage(nodeID netip.Addr, ueIp netip.Addr, reports []*ie.IE) {
+	if len(reports) == 0 {
+		return
+	}
+	ue, dnn, ok := smf.lookupPduSession(ueIp)
+	if !ok {
+		logrus.WithFields(logrus.Fields{
+			"upf":     nodeID,
+			"ue-addr": ueIp,
+		}).Warn("Usage Report for an unknown PDU Session")
+	}
+	for _, report := range reports {
+		record := cdr.Record{
+			Ue:       ue,
+			UeIpAddr: ueIp,
+			Dnn:      dnn,
+			Upf:      nodeID,
+		}
+		if err := parseUsageReport(report, &record); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"upf":     nodeID,
+				"ue-addr": ueIp,
+			}).Error("Could not parse Usage Report")
+			continue
+		}
+		if err := smf.cdrs.Add(record); err != nil {
+			logrus.WithError(err).Error("Could not write CDR")
+		}
+	}
+}
+
+// Returns the most recent CDRs. If ueCtrl is not nil, only CDRs of this UE are returned.
+func (smf *Smf) Cdrs(ueCtrl *jsonapi.ControlURI) []cdr.Record {
+	return smf.cdrs.List(ueCtrl)
+}
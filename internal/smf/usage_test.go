@@ -0,0 +1,127 @@
+// Copyright Louis Royer and the NextMN contributors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+// SPDX-License-Identifier: MIT
+
+package smf
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nextmn/cp-lite/internal/cdr"
+	"github.com/nextmn/cp-lite/internal/config"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+func TestNewCreateUrr(t *testing.T) {
+	tests := []struct {
+		name     string
+		usage    config.Usage
+		triggers uint8
+	}{
+		{name: "report on deletion only", usage: config.Usage{}},
+		{name: "periodic", usage: config.Usage{Period: time.Minute}, triggers: ReportingTriggersPerio},
+		{name: "all triggers", usage: config.Usage{Period: time.Minute, VolumeThreshold: 1000, TimeThreshold: time.Hour},
+			triggers: ReportingTriggersPerio | ReportingTriggersVolth | ReportingTriggersTimth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			urr := newCreateUrr(&tt.usage)
+			if id, err := urr.URRID(); err != nil || id != urrId {
+				t.Fatalf("got URR ID %d (%v), want %d", id, err, urrId)
+			}
+			if m, err := urr.MeasurementMethod(); err != nil || m != 0x03 {
+				t.Fatalf("got Measurement Method %#x (%v), want volume and duration", m, err)
+			}
+			triggers, err := urr.ReportingTriggers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if triggers[0] != tt.triggers {
+				t.Fatalf("got Reporting Triggers %#x, want %#x", triggers[0], tt.triggers)
+			}
+			if period, err := urr.MeasurementPeriod(); (err == nil) != (tt.usage.Period > 0) || period != tt.usage.Period {
+				t.Fatalf("got Measurement Period %s (%v), want %s", period, err, tt.usage.Period)
+			}
+			if v, err := urr.VolumeThreshold(); (err == nil) != (tt.usage.VolumeThreshold > 0) || (err == nil && v.TotalVolume != tt.usage.VolumeThreshold) {
+				t.Fatalf("got Volume Threshold %+v (%v), want %d", v, err, tt.usage.VolumeThreshold)
+			}
+			if d, err := urr.TimeThreshold(); (err == nil) != (tt.usage.TimeThreshold > 0) || d != tt.usage.TimeThreshold {
+				t.Fatalf("got Time Threshold %s (%v), want %s", d, err, tt.usage.TimeThreshold)
+			}
+		})
+	}
+}
+
+func TestParseUsageReport(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	stop := start.Add(time.Minute)
+	tests := []struct {
+		name   string
+		report *ie.IE
+		want   cdr.Record
+	}{
+		{
+			name: "periodic",
+			report: ie.NewUsageReportWithinSessionReportRequest(
+				ie.NewURRID(urrId),
+				ie.NewURSEQN(3),
+				ie.NewUsageReportTrigger(0x01, 0x00, 0x00),
+				ie.NewStartTime(start),
+				ie.NewEndTime(stop),
+				ie.NewVolumeMeasurement(0x07, 300, 100, 200, 0, 0, 0),
+			),
+			want: cdr.Record{Trigger: []string{"periodic"}, Sequence: 3, Uplink: 100, Downlink: 200, Start: start, Stop: stop},
+		},
+		{
+			name: "thresholds reached at deletion",
+			report: ie.NewUsageReportWithinSessionDeletionResponse(
+				ie.NewURRID(urrId),
+				ie.NewURSEQN(4),
+				ie.NewUsageReportTrigger(0x02|0x04, 0x08, 0x00),
+			),
+			want: cdr.Record{Trigger: []string{"volume-threshold", "time-threshold", "termination"}, Sequence: 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var record cdr.Record
+			if err := parseUsageReport(tt.report, &record); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(record.Trigger, tt.want.Trigger) || record.Sequence != tt.want.Sequence ||
+				record.Uplink != tt.want.Uplink || record.Downlink != tt.want.Downlink ||
+				!record.Start.Equal(tt.want.Start) || !record.Stop.Equal(tt.want.Stop) {
+				t.Fatalf("got record %+v, want %+v", record, tt.want)
+			}
+		})
+	}
+	if err := parseUsageReport(ie.NewURRID(urrId), &cdr.Record{}); err == nil {
+		t.Fatal("got no error for an IE that is not an Usage Report")
+	}
+}
+
+func TestRecordUsage(t *testing.T) {
+	smf, _ := newTestSmf(t, nil)
+	smf.cdrs = cdr.NewRecorder("")
+	ue := mustControlURI(t, "http://192.0.2.6:8080")
+	session := establishTestSession(t, smf, ue)
+
+	smf.recordUsage(testUpfa, session.UeIpAddr, []*ie.IE{
+		ie.NewUsageReportWithinSessionReportRequest(ie.NewURRID(urrId), ie.NewURSEQN(1), ie.NewUsageReportTrigger(0x01, 0x00, 0x00)),
+		ie.NewURRID(urrId), // not an Usage Report: skipped
+		ie.NewUsageReportWithinSessionReportRequest(ie.NewURRID(urrId), ie.NewURSEQN(2), ie.NewUsageReportTrigger(0x01, 0x00, 0x00)),
+	})
+	records := smf.Cdrs(&ue)
+	if len(records) != 2 {
+		t.Fatalf("got %d CDRs, want 2", len(records))
+	}
+	for i, record := range records {
+		if record.Ue.String() != ue.String() || record.UeIpAddr != session.UeIpAddr || record.Dnn != testDnn || record.Upf != testUpfa || record.Sequence != uint32(i+1) {
+			t.Fatalf("got CDR %+v", record)
+		}
+	}
+}
@@ -6,6 +6,7 @@ package main
 
 import (
 	"context"
+	"net/netip"
 	"os"
 	"os/signal"
 	"runtime/debug"
@@ -17,6 +18,7 @@ import (
 
 	"github.com/nextmn/cp-lite/internal/app"
 	"github.com/nextmn/cp-lite/internal/config"
+	"github.com/nextmn/cp-lite/internal/mockupf"
 
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v3"
@@ -78,6 +80,90 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:  "config",
+				Usage: "Manages the configuration",
+				Commands: []*cli.Command{
+					{
+						Name:  "validate",
+						Usage: "Checks the configuration file and reports all problems found",
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							// XXX: https://github.com/urfave/cli/issues/2244
+							if cmd.String("config") == "" {
+								logrus.Fatal("Required flag \"config\" not set")
+							}
+
+							if _, err := config.ParseConf(cmd.String("config")); err != nil {
+								errs := []error{err}
+								if joined, ok := err.(interface{ Unwrap() []error }); ok {
+									errs = joined.Unwrap()
+								}
+								for _, e := range errs {
+									logrus.WithError(e).Error("Invalid configuration")
+								}
+								os.Exit(1)
+							}
+							logrus.Info("Configuration is valid")
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "mock-upf",
+				Usage: "Runs a mock UPF that records PFCP rules and exposes them over HTTP/JSON",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "pfcp-addr",
+						Usage:    "listen for PFCP on `ADDR` (also used as Node ID)",
+						Required: true,
+					},
+					&cli.StringSliceFlag{
+						Name:  "gtpu-addr",
+						Usage: "allocate F-TEIDs requested by the Control Plane on `ADDR` (default: PFCP address)",
+					},
+					&cli.StringFlag{
+						Name:  "ue-pool",
+						Usage: "allocate UE IP Addresses requested by the Control Plane from `PREFIX`",
+					},
+					&cli.StringFlag{
+						Name:  "http-addr",
+						Usage: "serve rules over HTTP on `ADDR:PORT`",
+						Value: "127.0.0.1:8080",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					pfcpAddr, err := netip.ParseAddr(cmd.String("pfcp-addr"))
+					if err != nil {
+						logrus.WithError(err).Fatal("Invalid PFCP address, exiting…")
+					}
+					gtpuAddrs := []netip.Addr{pfcpAddr}
+					if addrs := cmd.StringSlice("gtpu-addr"); len(addrs) > 0 {
+						gtpuAddrs = make([]netip.Addr, 0, len(addrs))
+						for _, a := range addrs {
+							addr, err := netip.ParseAddr(a)
+							if err != nil {
+								logrus.WithError(err).Fatal("Invalid GTP-U address, exiting…")
+							}
+							gtpuAddrs = append(gtpuAddrs, addr)
+						}
+					}
+					var ueIpPool netip.Prefix
+					if pool := cmd.String("ue-pool"); pool != "" {
+						if ueIpPool, err = netip.ParsePrefix(pool); err != nil {
+							logrus.WithError(err).Fatal("Invalid UE IP pool, exiting…")
+						}
+					}
+					httpAddr, err := netip.ParseAddrPort(cmd.String("http-addr"))
+					if err != nil {
+						logrus.WithError(err).Fatal("Invalid HTTP address, exiting…")
+					}
+					if err := mockupf.NewMockUpf(pfcpAddr, gtpuAddrs, ueIpPool, httpAddr).Run(ctx); err != nil {
+						logrus.WithError(err).Fatal("Error while running, exiting…")
+					}
+					return nil
+				},
+			},
 			{
 				Name:  "healthcheck",
 				Usage: "Checks status of the node",